@@ -0,0 +1,62 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Configuration for this instance of oneseismic for user-controlled clients
+ *
+ * Oneseismic does not really have a good concept of logged in users, sessions
+ * etc. Rather, oneseismic gets tokens (in the Authorization header) or query
+ * parameters (shared access signatures) that are to query blob storage. Users
+ * can obtain such tokens or signatures as they see fit.
+ *
+ * The ClientConfig struct and the /config endpoint are meant for sharing
+ * oneseismic instance and company specific configurations with clients. While
+ * only auth stuff is included now, it's a natural place to add more client
+ * configuration parameters later e.g. performance hints, max/min latency.
+ */
+type ClientConfig struct {
+	AppID                  string
+	Scopes                 []string
+	DefaultStorageResource string
+}
+
+func MakeClientConfig(clientID string, storageURL string) ClientConfig {
+	return ClientConfig {
+		AppID: clientID,
+		Scopes: []string{
+			fmt.Sprintf("api://%s/One.Read", clientID),
+		},
+		DefaultStorageResource: storageURL,
+	}
+}
+
+func (c *ClientConfig) Get(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H {
+		/*
+		 * oneseismic's app-id
+		 */
+		"client_id": c.AppID,
+		/*
+		 * The scopes (permissions) that oneseismic requests in order to
+		 * function
+		 */
+		"scopes": c.Scopes,
+
+		/*
+		 * The default storage account resource URL, e.g.
+		 * https://<acc>.blob.core.windows.net. While most of the oneseismic
+		 * infrastructure doesn't mandate it, it will be overwhelmingly likely
+		 * that one oneseismic instance maps to a single storage account.
+		 * Having the "backing resource" programmatically available to users
+		 * makes for pretty programs, since it is sufficient to specify the
+		 * oneseismic instance and query the rest from there.
+		 */
+		"default-storage-resource": c.DefaultStorageResource,
+	})
+}
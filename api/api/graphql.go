@@ -8,13 +8,16 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/gin-gonic/gin"
 	graphql "github.com/graph-gophers/graphql-go"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/storage"
 	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/equinor/oneseismic/api/internal"
 )
@@ -31,10 +34,59 @@ import (
 type queryContext struct {
 	pid           string
 	urlQuery      string
-	session       *QuerySession
+	sessions      *sessionset
 	endpoint      string
 	keyring       *auth.Keyring
 	scheduler     scheduler
+	/*
+	 * The number of processes started by this request, which is used to give
+	 * every process its own pid.
+	 */
+	nprocs        int32
+}
+
+/*
+ * Make the pid for a new process. A single request can start many processes,
+ * e.g. the same slice from several cubes, and every process needs its own
+ * pid. The first process gets the pid of the request itself, so that the
+ * request log lines up with the process in the common case.
+ */
+func (q *queryContext) nextPid() string {
+	n := atomic.AddInt32(&q.nprocs, 1)
+	if n == 1 {
+		return q.pid
+	}
+	return fmt.Sprintf("%s-%d", q.pid, n - 1)
+}
+
+/*
+ * The query sessions checked out of the query engine by a single request. A
+ * session is bound to the manifest it is initialised with, so every cube in a
+ * request needs its own session. Resolvers may run concurrently, so
+ * checkouts are synchronised, and all sessions are put back into the pool
+ * when the request is done.
+ */
+type sessionset struct {
+	engine   *QueryEngine
+	lock     sync.Mutex
+	sessions []*QuerySession
+}
+
+func (s *sessionset) Get() *QuerySession {
+	session := s.engine.Get()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions = append(s.sessions, session)
+	return session
+}
+
+func (s *sessionset) PutAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, session := range s.sessions {
+		s.engine.Put(session)
+	}
+	s.sessions = nil
 }
 
 /*
@@ -67,6 +119,7 @@ type resolver struct {
 type cube struct {
 	id       graphql.ID
 	manifest json.RawMessage
+	session  *QuerySession
 }
 
 type promise struct {
@@ -90,15 +143,79 @@ func (p *promise) UnmarshalGraphQL(input interface{}) error {
 
 type opts struct {
 	Attributes *[]string `json:"attributes"`
+	Zrange     *zrange   `json:"zrange"`
+	Stride     *[]int32  `json:"stride"`
+	Format     *format   `json:"format"`
+}
+
+/*
+ * The format the workers pack the samples in, which is one of float32,
+ * float16, int16, or int8. The integer formats are scaled so that range maps
+ * onto the integers, and the scale and offset is recorded in the process
+ * header. The attributes are always float32.
+ */
+type format struct {
+	Type  string     `json:"type"`
+	Range *[]float64 `json:"range"`
+}
+
+/*
+ * The zrange restricts queries to the vertical window [from, to] (inclusive),
+ * so that only the fragments that intersect the window are fetched. The kind
+ * is either lineno (depth/time) or index.
+ */
+type zrange struct {
+	From int32  `json:"from"`
+	To   int32  `json:"to"`
+	Kind string `json:"kind"`
 }
 
 func (r *resolver) Cube(
 	ctx context.Context,
 	args struct { Id graphql.ID },
 ) (*cube, error) {
+	return openCube(ctx, args.Id)
+}
+
+/*
+ * Get many cubes in a single request, so that the same query can be issued
+ * against several surveys without a round trip per survey. The manifests are
+ * fetched concurrently, and if any cube cannot be opened the whole field
+ * fails.
+ */
+func (r *resolver) Cubes(
+	ctx context.Context,
+	args struct { Ids []graphql.ID },
+) ([]*cube, error) {
+	cubes := make([]*cube, len(args.Ids))
+	errs  := make([]error, len(args.Ids))
+
+	var wg sync.WaitGroup
+	for i, id := range args.Ids {
+		wg.Add(1)
+		go func(i int, id graphql.ID) {
+			defer wg.Done()
+			cubes[i], errs[i] = openCube(ctx, id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cubes, nil
+}
+
+/*
+ * Fetch the manifest of the cube id, and initialise a session from the
+ * request's session set with it.
+ */
+func openCube(ctx context.Context, id graphql.ID) (*cube, error) {
 	qctx := getQueryContext(ctx)
 	pid  := qctx.pid
-	urls := fmt.Sprintf("%s/%s", qctx.endpoint, args.Id)
+	urls := fmt.Sprintf("%s/%s", qctx.endpoint, id)
 	log.Printf("Getting URL %s", urls)
 	url, err := url.Parse(urls)
 	if err != nil {
@@ -106,7 +223,7 @@ func (r *resolver) Cube(
 			"pid=%s, failed to parse URL; endpoint=%s, id=%s, error=%v",
 			pid,
 			qctx.endpoint,
-			args.Id,
+			id,
 			err,
 		)
 		return nil, internal.NewInternalError()
@@ -117,7 +234,8 @@ func (r *resolver) Cube(
 		return nil, err
 	}
 
-	err = qctx.session.InitWithManifest(doc)
+	session := qctx.sessions.Get()
+	err = session.InitWithManifest(doc)
 	if err != nil {
 		// errors here probably mean the document itself is broken
 		// the URL gets recorded, but maybe the content (or digested content
@@ -132,8 +250,9 @@ func (r *resolver) Cube(
 	}
 
 	return &cube {
-		id:       args.Id,
+		id:       id,
 		manifest: doc,
+		session:  session,
 	}, nil
 }
 
@@ -147,7 +266,7 @@ func (c *cube) basicManifestQuery(
 	out interface {},
 ) error {
 	qctx := getQueryContext(ctx)
-	d, err := qctx.session.QueryManifest(path)
+	d, err := c.session.QueryManifest(path)
 	if err != nil {
 		log.Printf("pid=%s, %s failed: %v", qctx.pid, path, err)
 		return internal.NewInternalError()
@@ -218,6 +337,58 @@ func (c *cube) SampleValueMax(ctx context.Context) (*float64, error) {
 	return &out, err
 }
 
+/*
+ * The [sampleValueMin, sampleValueMax] of the cube, or nil if the cube does
+ * not record it.
+ */
+func (c *cube) sampleValueRange(ctx context.Context) (*[2]float64, error) {
+	low, err := c.SampleValueMin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	high, err := c.SampleValueMax(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if low == nil || high == nil {
+		return nil, nil
+	}
+	return &[2]float64{ *low, *high }, nil
+}
+
+/*
+ * Default the range of the integer formats in opts.format to the sample value
+ * range of the cube.
+ */
+func (c *cube) defaultFormatRange(ctx context.Context, o interface{}) error {
+	op, ok := o.(*opts)
+	if !ok || op == nil || op.Format == nil {
+		return nil
+	}
+
+	f := op.Format
+	if f.Range != nil {
+		if len(*f.Range) != 2 {
+			return internal.QueryError("format.range must be [low, high]")
+		}
+		return nil
+	}
+	if f.Type != "int8" && f.Type != "int16" {
+		return nil
+	}
+
+	r, err := c.sampleValueRange(ctx)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		msg := "format.range is required; cube has no sampleValueMin/Max"
+		return internal.QueryError(msg)
+	}
+	f.Range = &[]float64{ r[0], r[1] }
+	return nil
+}
+
 func (c *cube) FilenameOnUpload(ctx context.Context) (*string, error) {
 	var out string
 	err := c.basicManifestQuery(ctx, "/upload-filename", &out)
@@ -230,30 +401,34 @@ func (c *cube) FilenameOnUpload(ctx context.Context) (*string, error) {
 }
 
 /*
- * This is the util.GetManifest function, but tuned for graphql and with
- * gin-specifics removed. Its purpose is to make for a quick migration to a
- * working graphql interface to oneseismic. Expect this function to be removed
- * or drastically change soon.
+ * Get the manifest of the cube in the container url from the storage backend
+ * of the endpoint, and map the storage errors to graphql/oneseismic errors.
  */
 func getManifest(
 	ctx      context.Context,
 	qctx     *queryContext,
 	url      *url.URL,
 ) ([]byte, error) {
+	store, err := storage.OpenURL(qctx.endpoint)
+	if err != nil {
+		log.Printf("pid=%s, %v", qctx.pid, err)
+		return nil, internal.NewInternalError()
+	}
+
 	// This is arguably bad; the passed url gets modified in-place. It's
-	// probably ok since this is a helper function to pull the azure handling
-	// stuff out of the caller body, and it is called once, but it should be
-	// considered if this function should restore the rawQuery.
+	// probably ok since this is a helper function to pull the storage
+	// handling stuff out of the caller body, and it is called once, but it
+	// should be considered if this function should restore the rawQuery.
 	url.RawQuery = qctx.urlQuery
-	manifest, err := util.FetchManifest(ctx, url)
+	manifest, err := store.GetManifest(ctx, url)
 	if err == nil {
 		return manifest, nil
 	}
 
 	log.Printf("pid=%s, %v", qctx.pid, err)
-	switch e := err.(type) {
-	case azblob.StorageError:
-		status := e.Response().StatusCode
+	var stgErr *storage.Error
+	if errors.As(err, &stgErr) {
+		status := stgErr.Status
 		switch status {
 		case http.StatusNotFound:
 			// TODO: add guid as a part of the error message?
@@ -277,8 +452,12 @@ func (c *cube) basicQuery(
 	args interface{},
 	opts interface{},
 ) (*promise, error) {
+	if err := c.defaultFormatRange(ctx, opts); err != nil {
+		return nil, err
+	}
+
 	qctx := getQueryContext(ctx)
-	pid  := qctx.pid
+	pid  := qctx.nextPid()
 	msg  := message.Query {
 		Pid:             pid,
 		UrlQuery:        qctx.urlQuery,
@@ -289,10 +468,17 @@ func (c *cube) basicQuery(
 		Args:            args,
 		Opts:            opts,
 	}
-	query, err := qctx.session.PlanQuery(&msg)
+	query, err := c.session.PlanQuery(&msg)
 	if err != nil {
 		log.Printf("pid=%s, %v", pid, err)
-		return nil, nil
+		/*
+		 * Query errors come from bad input (out-of-range line numbers etc.)
+		 * and are reported to the user, other errors are not leaked.
+		 */
+		if _, ok := err.(*internal.QueryE); ok {
+			return nil, err
+		}
+		return nil, internal.NewInternalError()
 	}
 
 	key, err := qctx.keyring.Sign(pid)
@@ -301,17 +487,18 @@ func (c *cube) basicQuery(
 		return nil, internal.NewInternalError()
 	}
 
-	go func (s scheduler) {
-		err := s.Schedule(context.Background(), pid, query)
-		if err != nil {
-			/*
-			 * Make scheduling errors fatal to detect them for debugging.
-			 * Eventually this should log, maybe cancel the process, and
-			 * continue.
-			 */
-			log.Fatalf("pid=%s, %v", pid, err)
-		}
-	}(qctx.scheduler)
+	/*
+	 * Schedule before returning the promise, so that a failure to enqueue
+	 * (e.g. redis being unavailable) is reported as an error for this field,
+	 * rather than the user waiting for a process that never runs. The
+	 * scheduler cancels the process and removes the tasks that were enqueued
+	 * before the failure.
+	 */
+	err = qctx.scheduler.Schedule(ctx, pid, query)
+	if err != nil {
+		log.Printf("pid=%s, unable to schedule: %v", pid, err)
+		return nil, internal.InternalError("unable to schedule query")
+	}
 
 	return &promise {
 		Url: fmt.Sprintf("result/%s", pid),
@@ -320,9 +507,10 @@ func (c *cube) basicQuery(
 }
 
 type sliceargs struct {
-	Kind string `json:"kind"`
-	Dim  int32  `json:"dim"`
-	Val  int32  `json:"val"`
+	Kind   string  `json:"kind"`
+	Dim    int32   `json:"dim"`
+	Val    int32   `json:"val"`
+	Weight float32 `json:"weight,omitempty"`
 }
 
 type curtainargs struct {
@@ -375,6 +563,106 @@ func (c *cube) SliceByIndex(
 	)
 }
 
+/*
+ * Find the line (index) to slice for a value along a dimension, e.g. 2350 ms.
+ * The lines must be sorted, and the value must be in [lines[0], lines[n-1]].
+ *
+ * With nearest interpolation the weight is always zero. With linear
+ * interpolation the weight is the weight of the next line (index + 1), which
+ * the worker blends with the line at index.
+ */
+func lineOfValue(
+	lines         []int32,
+	value         float64,
+	interpolation string,
+) (int32, float32, error) {
+	if len(lines) == 0 {
+		return 0, 0, internal.QueryError("no lines in dimension")
+	}
+
+	fst := float64(lines[0])
+	lst := float64(lines[len(lines) - 1])
+	if value < fst || lst < value {
+		msg := fmt.Sprintf("value (= %v) not in [%v, %v]", value, fst, lst)
+		return 0, 0, internal.QueryError(msg)
+	}
+
+	/* The first line > value, which is the next line unless value == lst */
+	next := sort.Search(len(lines), func(i int) bool {
+		return float64(lines[i]) > value
+	})
+	if next == len(lines) {
+		return int32(next - 1), 0, nil
+	}
+
+	idx  := next - 1
+	low  := float64(lines[idx])
+	high := float64(lines[next])
+	weight := (value - low) / (high - low)
+
+	switch interpolation {
+	case "nearest":
+		if weight > 0.5 {
+			return int32(next), 0, nil
+		}
+		return int32(idx), 0, nil
+
+	case "linear":
+		return int32(idx), float32(weight), nil
+
+	default:
+		msg := fmt.Sprintf("unknown interpolation %s", interpolation)
+		return 0, 0, internal.QueryError(msg)
+	}
+}
+
+/*
+ * Slice by a value along the dimension rather than by a line number, so that
+ * users can ask for 2350 ms without looking up the nearest line themselves.
+ */
+func (c *cube) SliceByValue(
+	ctx  context.Context,
+	args struct {
+		Dim           int32
+		Value         float64
+		Interpolation string
+		Opts          *opts
+	},
+) (*promise, error) {
+	var lines []int32
+	path := fmt.Sprintf("/line-numbers/%d", args.Dim)
+	notfound := internal.QueryError(
+		fmt.Sprintf("dim (= %d) not in cube", args.Dim),
+	)
+	if args.Dim < 0 {
+		return nil, notfound
+	}
+	err := c.basicManifestQuery(ctx, path, &lines)
+	if _, ok := err.(*internal.NotFoundE); ok {
+		return nil, notfound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idx, weight, err := lineOfValue(lines, args.Value, args.Interpolation)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.basicQuery(
+		ctx,
+		"slice",
+		sliceargs {
+			Kind:   "index",
+			Dim:    args.Dim,
+			Val:    idx,
+			Weight: weight,
+		},
+		args.Opts,
+	)
+}
+
 func (c *cube) CurtainByIndex(
 	ctx    context.Context,
 	args   struct {
@@ -429,6 +717,263 @@ func (c *cube) CurtainByUTM(
 	)
 }
 
+/*
+ * The traces are full vertical traces at scattered [x, y] points, e.g. well
+ * locations. Unlike the curtain, the output is in the same order as the
+ * input, and every distinct trace is only included once.
+ */
+func (c *cube) Traces(
+	ctx    context.Context,
+	args   struct {
+		Coords [][]float64
+		Kind   string
+		Opts   *opts
+	},
+) (*promise, error) {
+	return c.basicQuery(
+		ctx,
+		"traces",
+		curtainargsUTM {
+			Kind:   args.Kind,
+			Coords: args.Coords,
+		},
+		args.Opts,
+	)
+}
+
+type fenceargs struct {
+	Polyline      [][]float64 `json:"polyline"`
+	Spacing       *float64    `json:"spacing"`
+	Interpolation string      `json:"interpolation"`
+}
+
+/*
+ * The fence is a curtain along an arbitrary UTM polyline. Unlike the
+ * curtainByUTM, which snaps every coordinate to the nearest trace, the fence
+ * is resampled at a fixed spacing (the grid spacing by default), and the
+ * traces are interpolated. The sampled UTM positions are recorded in the
+ * process header.
+ */
+func (c *cube) Fence(
+	ctx    context.Context,
+	args   struct {
+		Polyline      [][]float64
+		Spacing       *float64
+		Interpolation string
+		Opts          *opts
+	},
+) (*promise, error) {
+	return c.basicQuery(
+		ctx,
+		"fence",
+		fenceargs {
+			Polyline:      args.Polyline,
+			Spacing:       args.Spacing,
+			Interpolation: args.Interpolation,
+		},
+		args.Opts,
+	)
+}
+
+type horizonargs struct {
+	Kind   string      `json:"kind"`
+	Coords [][]float64 `json:"coords"`
+	Window int32       `json:"window"`
+}
+
+/*
+ * The horizon is a curtain-like query where every trace also has a
+ * depth/time, and the output is the window [z-window, z+window] around the
+ * surface. The surface is a list of [x, y, z] triples, where the kind
+ * decides if x/y are line numbers, indices or UTM coordinates. The z is
+ * always given in the units of the depth/time axis, except for kind index,
+ * where it is the sample index.
+ */
+func (c *cube) Horizon(
+	ctx    context.Context,
+	args   struct {
+		Surface [][]float64
+		Kind    string
+		Window  int32
+		Opts    *opts
+	},
+) (*promise, error) {
+	return c.basicQuery(
+		ctx,
+		"horizon",
+		horizonargs {
+			Kind:   args.Kind,
+			Coords: args.Surface,
+			Window: args.Window,
+		},
+		args.Opts,
+	)
+}
+
+type subvolumeargs struct {
+	Kind string  `json:"kind"`
+	From []int32 `json:"from"`
+	To   []int32 `json:"to"`
+}
+
+/*
+ * The subvolume is the box [from, to] (both inclusive) of the cube, where
+ * from and to are [x, y, z] line numbers or indices. For line numbers, the
+ * endpoints do not have to be actual lines, and the box is every line in the
+ * interval.
+ */
+func (c *cube) Subvolume(
+	ctx    context.Context,
+	args   struct {
+		From []int32
+		To   []int32
+		Kind string
+		Opts *opts
+	},
+) (*promise, error) {
+	return c.basicQuery(
+		ctx,
+		"subvolume",
+		subvolumeargs {
+			Kind: args.Kind,
+			From: args.From,
+			To:   args.To,
+		},
+		args.Opts,
+	)
+}
+
+/*
+ * The region to compute statistics over, which must be exactly one of a
+ * slice, curtain or subvolume. The regions are described the same way as the
+ * corresponding queries.
+ */
+type region struct {
+	Slice     *sliceregion
+	Curtain   *curtainregion
+	Subvolume *subvolumeregion
+}
+
+type sliceregion struct {
+	Dim  int32
+	Val  int32
+	Kind string
+}
+
+type curtainregion struct {
+	Coords [][]float64
+	Kind   string
+}
+
+type subvolumeregion struct {
+	From []int32
+	To   []int32
+	Kind string
+}
+
+type statistics struct {
+	Bins  int32      `json:"bins"`
+	Range [2]float64 `json:"range"`
+}
+
+/*
+ * The statistics are computed over the samples only, so the attributes are
+ * not forwarded from the user options, and neither is the format, as only the
+ * summary is sent. A stride makes for cheaper estimates.
+ */
+type statisticsopts struct {
+	Zrange     *zrange     `json:"zrange"`
+	Stride     *[]int32    `json:"stride"`
+	Statistics *statistics `json:"statistics"`
+}
+
+/*
+ * Every worker allocates the full histogram, so the number of bins is capped.
+ * Must match max_histogram_bins in core/include/oneseismic/messages.hpp.
+ */
+const maxHistogramBins = 65536
+
+/*
+ * Compute the summary statistics (count, min, max, mean, rms) and a histogram
+ * of the samples in a region. The workers reduce the samples to statistics,
+ * so the samples are never sent to the client, which is much cheaper than
+ * downloading the region to compute e.g. clipping values for a colour scale.
+ *
+ * The histogram has bins equally-sized bins over range, which defaults to
+ * [sampleValueMin, sampleValueMax] of the cube. Samples outside the range are
+ * counted in the first or last bin.
+ */
+func (c *cube) Statistics(
+	ctx    context.Context,
+	args   struct {
+		Region region
+		Bins   int32
+		Range  *[]float64
+		Opts   *opts
+	},
+) (*promise, error) {
+	var fun  string
+	var fargs interface{}
+	nregions := 0
+	if r := args.Region.Slice; r != nil {
+		nregions++
+		fun   = "slice"
+		fargs = sliceargs { Kind: r.Kind, Dim: r.Dim, Val: r.Val }
+	}
+	if r := args.Region.Curtain; r != nil {
+		nregions++
+		fun   = "curtain"
+		fargs = curtainargsUTM { Kind: r.Kind, Coords: r.Coords }
+	}
+	if r := args.Region.Subvolume; r != nil {
+		nregions++
+		fun   = "subvolume"
+		fargs = subvolumeargs { Kind: r.Kind, From: r.From, To: r.To }
+	}
+	if nregions != 1 {
+		msg := "region must be exactly one of slice, curtain or subvolume"
+		return nil, internal.QueryError(msg)
+	}
+
+	if args.Bins < 1 {
+		msg := fmt.Sprintf("bins (= %d) must be positive", args.Bins)
+		return nil, internal.QueryError(msg)
+	}
+	if args.Bins > maxHistogramBins {
+		msg := fmt.Sprintf("bins (= %d) must be <= %d", args.Bins, maxHistogramBins)
+		return nil, internal.QueryError(msg)
+	}
+
+	stats := statistics { Bins: args.Bins }
+	if args.Range != nil {
+		if len(*args.Range) != 2 {
+			return nil, internal.QueryError("range must be [low, high]")
+		}
+		copy(stats.Range[:], *args.Range)
+	} else {
+		r, err := c.sampleValueRange(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			msg := "range is required; cube has no sampleValueMin/Max"
+			return nil, internal.QueryError(msg)
+		}
+		stats.Range = *r
+	}
+	if !(stats.Range[0] < stats.Range[1]) {
+		msg := fmt.Sprintf("range (= %v) is empty", stats.Range)
+		return nil, internal.QueryError(msg)
+	}
+
+	opts := statisticsopts { Statistics: &stats }
+	if args.Opts != nil {
+		opts.Zrange = args.Opts.Zrange
+		opts.Stride = args.Opts.Stride
+	}
+	return c.basicQuery(ctx, fun, fargs, opts)
+}
+
 func MakeGraphQL(
 	keyring   *auth.Keyring,
 	endpoint  string,
@@ -439,6 +984,7 @@ scalar Promise
 
 type Query {
     cube(id: ID!): Cube!
+    cubes(ids: [ID!]!): [Cube!]!
 }
 
 enum Attribute {
@@ -447,8 +993,63 @@ enum Attribute {
     cdpy
 }
 
+enum Interpolation {
+    nearest
+    linear
+}
+
+enum SampleFormat {
+    float32
+    float16
+    int16
+    int8
+}
+
+enum CoordinateKind {
+    index
+    lineno
+    utm
+}
+
+input ZRange {
+    from: Int!
+    to: Int!
+    kind: CoordinateKind = lineno
+}
+
+input Format {
+    type: SampleFormat!
+    range: [Float!]
+}
+
 input Opts {
     attributes: [Attribute!]
+    zrange: ZRange
+    stride: [Int!]
+    format: Format
+}
+
+input SliceRegion {
+    dim: Int!
+    val: Int!
+    kind: CoordinateKind = lineno
+}
+
+input CurtainRegion {
+    coords: [[Float!]!]!
+    kind: CoordinateKind = lineno
+}
+
+input SubvolumeRegion {
+    from: [Int!]!
+    to: [Int!]!
+    kind: CoordinateKind = lineno
+}
+
+input Region {
+    slice: SliceRegion
+    curtain: CurtainRegion
+    subvolume: SubvolumeRegion
 }
 
 type Cube {
@@ -461,9 +1062,49 @@ type Cube {
 
     sliceByLineno(dim: Int!, lineno: Int!, opts: Opts): Promise
     sliceByIndex(dim: Int!, index: Int!, opts: Opts): Promise
+    sliceByValue(
+        dim: Int!,
+        value: Float!,
+        interpolation: Interpolation = nearest,
+        opts: Opts
+    ): Promise
     curtainByLineno(coords: [[Int!]!]!, opts: Opts): Promise
     curtainByIndex( coords: [[Int!]!]!, opts: Opts): Promise
     curtainByUTM( coords: [[Float!]!]!, opts: Opts): Promise
+
+    traces(
+        coords: [[Float!]!]!,
+        kind: CoordinateKind = lineno,
+        opts: Opts
+    ): Promise
+
+    fence(
+        polyline: [[Float!]!]!,
+        spacing: Float,
+        interpolation: Interpolation = nearest,
+        opts: Opts
+    ): Promise
+
+    horizon(
+        surface: [[Float!]!]!,
+        kind: CoordinateKind = lineno,
+        window: Int = 0,
+        opts: Opts
+    ): Promise
+
+    subvolume(
+        from: [Int!]!,
+        to: [Int!]!,
+        kind: CoordinateKind = lineno,
+        opts: Opts
+    ): Promise
+
+    statistics(
+        region: Region!,
+        bins: Int = 64,
+        range: [Float!],
+        opts: Opts
+    ): Promise
 }
 	`
 	resolver := &resolver {}
@@ -514,12 +1155,12 @@ func (g *gql) execQuery(
 	// The Query object is constructed here in order to have a single
 	// entry/exit point for the QuerySession objects, to make sure they get put
 	// back in the pool.
-	session := g.queryEngine.Get()
-	defer g.queryEngine.Put(session)
+	sessions := sessionset { engine: &g.queryEngine }
+	defer sessions.PutAll()
 	qctx := queryContext {
 		pid: ctx.GetString("pid"),
 		urlQuery:  ctx.Request.URL.RawQuery,
-		session:   session,
+		sessions:  &sessions,
 		endpoint:  g.endpoint,
 		keyring:   g.keyring,
 		scheduler: g.scheduler,
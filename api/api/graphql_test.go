@@ -2,8 +2,13 @@ package api
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/message"
 )
 
 func setupSession(t *testing.T, doc string) *QuerySession {
@@ -43,11 +48,9 @@ func TestLinenumbersReturnsExpected(t *testing.T) {
 			],
 		"line-labels": ["inline", "crossline", "time"]
 	} `
-	qctx := queryContext {
-		session: setupSession(t, doc),
-	}
+	qctx := queryContext {}
 	ctx := setQueryContext(context.Background(), &qctx)
-	c := cube {}
+	c := cube { session: setupSession(t, doc) }
 	numbers, err := c.Linenumbers(ctx)
 
 	expected := [][]int32{
@@ -84,11 +87,9 @@ func TestSampleValueMinMaxSucceeds(t *testing.T) {
 		"sample-value-max" : 5.240489959716797,
 		"line-labels": ["inline", "crossline", "time"]
 	} `
-	qctx := queryContext {
-		session: setupSession(t, doc),
-	}
+	qctx := queryContext {}
 	ctx := setQueryContext(context.Background(), &qctx)
-	c := cube {}
+	c := cube { session: setupSession(t, doc) }
 
 	sampleValueMin, err := c.SampleValueMin(ctx)
 	expected := float64(1.2100000381469727)
@@ -130,11 +131,9 @@ func TestSampleValueMinMaxSucceedsOnKeyMiss(t *testing.T) {
 			],
 		"line-labels": ["inline", "crossline", "time"]
 	} `
-	qctx := queryContext {
-		session: setupSession(t, doc),
-	}
+	qctx := queryContext {}
 	ctx := setQueryContext(context.Background(), &qctx)
-	c := cube {}
+	c := cube { session: setupSession(t, doc) }
 
 	sampleValueMin, err := c.SampleValueMin(ctx)
 	if err != nil {
@@ -172,11 +171,9 @@ func TestFilenameOnUploadSucceedsOnKeyMiss(t *testing.T) {
 			],
 		"line-labels": ["inline", "crossline", "time"]
 	}`
-	qctx := queryContext {
-		session: setupSession(t, doc),
-	}
+	qctx := queryContext {}
 	ctx := setQueryContext(context.Background(), &qctx)
-	c := cube {}
+	c := cube { session: setupSession(t, doc) }
 	fname, err := c.FilenameOnUpload(ctx)
 	if err != nil {
 		t.Errorf("expected success; got %v", err)
@@ -206,11 +203,9 @@ func TestFilenameOnUploadSucceeds(t *testing.T) {
 			],
 		"line-labels": ["inline", "crossline", "time"]
 	}`
-	qctx := queryContext {
-		session: setupSession(t, doc),
-	}
+	qctx := queryContext {}
 	ctx := setQueryContext(context.Background(), &qctx)
-	c := cube {}
+	c := cube { session: setupSession(t, doc) }
 	fname, err := c.FilenameOnUpload(ctx)
 	if err != nil {
 		t.Errorf("expected success; got %v", err)
@@ -221,3 +216,333 @@ func TestFilenameOnUploadSucceeds(t *testing.T) {
 		t.Errorf("expected fname = 'some-filename'; got %v", *fname)
 	}
 }
+
+/*
+ * Plan queries end-to-end through the C++ query engine, to make sure the args
+ * structs built by the resolvers are understood by the planner.
+ */
+func TestQueriesArePlanned(t *testing.T) {
+	manifest := `{
+		"format-version": 1,
+		"guid": "<some-id>",
+		"data": [{
+				"file-extension": "f32",
+				"filters": [],
+				"shapes": [[3, 3, 3]],
+				"prefix": "src",
+				"resolution": "source"
+			}],
+		"attributes": [],
+		"line-numbers": [
+				[9961, 9963, 9965],
+				[1961, 1962, 1963],
+				[0, 4000, 8000]
+			],
+		"line-labels": ["inline", "crossline", "time"],
+		"utm-to-lineno": [[1, 0, 9961], [0, 1, 1961]]
+	}`
+
+	testcases := []struct {
+		function string
+		args     interface{}
+		opts     interface{}
+		ntasks   int
+	}{
+		{
+			function: "horizon",
+			args:     horizonargs {
+				Kind:   "lineno",
+				Coords: [][]float64{{9961, 1962, 3900}, {9965, 1963, 0}},
+				Window: 1,
+			},
+			ntasks: 1,
+		},
+		{
+			function: "horizon",
+			args:     horizonargs {
+				Kind:   "index",
+				Coords: [][]float64{{0, 0, 2}},
+			},
+			ntasks: 1,
+		},
+		{
+			function: "traces",
+			args:     curtainargsUTM {
+				Kind:   "lineno",
+				Coords: [][]float64{{9963, 1961}, {9961, 1963}},
+			},
+			ntasks: 1,
+		},
+		{
+			function: "curtain",
+			args:     curtainargs {
+				Kind:   "index",
+				Coords: [][]int32{{0, 0}, {1, 2}},
+			},
+			opts:     &opts {
+				Zrange: &zrange { From: 4000, To: 4000, Kind: "lineno" },
+			},
+			ntasks: 1,
+		},
+		{
+			function: "slice",
+			args:     sliceargs {
+				Kind:   "index",
+				Dim:    2,
+				Val:    1,
+				Weight: 0.5,
+			},
+			ntasks: 1,
+		},
+		{
+			function: "fence",
+			args:     fenceargs {
+				Polyline:      [][]float64{{0, 0}, {4, 2}},
+				Interpolation: "linear",
+			},
+			ntasks: 1,
+		},
+		{
+			function: "subvolume",
+			args:     subvolumeargs {
+				Kind: "index",
+				From: []int32{0, 1, 0},
+				To:   []int32{2, 2, 1},
+			},
+			ntasks: 1,
+		},
+		{
+			function: "subvolume",
+			args:     subvolumeargs {
+				Kind: "index",
+				From: []int32{0, 0, 0},
+				To:   []int32{2, 2, 2},
+			},
+			opts:     &opts {
+				Stride: &[]int32{2, 1, 2},
+			},
+			ntasks: 1,
+		},
+		{
+			function: "curtain",
+			args:     curtainargs {
+				Kind:   "index",
+				Coords: [][]int32{{0, 0}, {1, 1}},
+			},
+			opts:     &opts {
+				Format: &format {
+					Type:  "int8",
+					Range: &[]float64{ -1, 1 },
+				},
+			},
+			ntasks: 1,
+		},
+		{
+			function: "slice",
+			args:     sliceargs {
+				Kind:   "lineno",
+				Dim:    0,
+				Val:    9963,
+			},
+			opts:     statisticsopts {
+				Statistics: &statistics {
+					Bins:  16,
+					Range: [2]float64{ -1, 1 },
+				},
+			},
+			ntasks: 1,
+		},
+	}
+
+	session := setupSession(t, manifest)
+	session.tasksize = 10
+	for _, testcase := range testcases {
+		query := message.Query {
+			Pid:      "pid",
+			Guid:     "<some-id>",
+			Manifest: []byte(manifest),
+			Function: testcase.function,
+			Args:     testcase.args,
+			Opts:     testcase.opts,
+		}
+		plan, err := session.PlanQuery(&query)
+		if err != nil {
+			t.Errorf("%s: expected success; got %v", testcase.function, err)
+			continue
+		}
+
+		header, err := (&message.ProcessHeader{}).Unpack(plan.header)
+		if err != nil {
+			t.Errorf("%s: unable to unpack header: %v", testcase.function, err)
+			continue
+		}
+		if header.Ntasks != testcase.ntasks {
+			msg := "%s: expected %d tasks; got %d"
+			t.Errorf(msg, testcase.function, testcase.ntasks, header.Ntasks)
+		}
+		if len(plan.plan) != header.Ntasks {
+			msg := "%s: header.Ntasks = %d, but len(plan) = %d"
+			t.Errorf(msg, testcase.function, header.Ntasks, len(plan.plan))
+		}
+	}
+}
+
+func TestLineOfValue(t *testing.T) {
+	lines := []int32{ 0, 4, 8 }
+	testcases := []struct {
+		value         float64
+		interpolation string
+		idx           int32
+		weight        float32
+	}{
+		{ value: 0, interpolation: "nearest", idx: 0, weight: 0    },
+		{ value: 5, interpolation: "nearest", idx: 1, weight: 0    },
+		{ value: 7, interpolation: "nearest", idx: 2, weight: 0    },
+		{ value: 8, interpolation: "nearest", idx: 2, weight: 0    },
+		{ value: 4, interpolation: "linear",  idx: 1, weight: 0    },
+		{ value: 5, interpolation: "linear",  idx: 1, weight: 0.25 },
+		{ value: 8, interpolation: "linear",  idx: 2, weight: 0    },
+	}
+
+	for _, tc := range testcases {
+		idx, weight, err := lineOfValue(lines, tc.value, tc.interpolation)
+		if err != nil {
+			t.Errorf("%v (%s): expected success; got %v",
+				tc.value, tc.interpolation, err)
+			continue
+		}
+		if idx != tc.idx || weight != tc.weight {
+			t.Errorf("%v (%s): expected (%d, %v); got (%d, %v)",
+				tc.value, tc.interpolation, tc.idx, tc.weight, idx, weight)
+		}
+	}
+
+	for _, value := range []float64{ -1, 8.5 } {
+		_, _, err := lineOfValue(lines, value, "nearest")
+		if err == nil {
+			t.Errorf("%v: expected error; got success", value)
+		}
+	}
+}
+
+type failingScheduler struct {
+	calls int
+}
+
+func (s *failingScheduler) Schedule(
+	ctx  context.Context,
+	pid  string,
+	plan *QueryPlan,
+) error {
+	s.calls++
+	return fmt.Errorf("dial tcp: connection refused")
+}
+
+func setupFailingQuery(t *testing.T) (context.Context, *cube, *failingScheduler) {
+	manifest := `{
+		"format-version": 1,
+		"guid": "<some-id>",
+		"data": [{
+				"file-extension": "f32",
+				"filters": [],
+				"shapes": [[3, 3, 3]],
+				"prefix": "src",
+				"resolution": "source"
+			}],
+		"attributes": [],
+		"line-numbers": [
+				[9961, 9963, 9965],
+				[1961, 1962, 1963],
+				[0, 4000, 8000]
+			],
+		"line-labels": ["inline", "crossline", "time"]
+	}`
+	keyring := auth.MakeKeyring([]byte("key"))
+	sched := &failingScheduler{}
+	qctx := queryContext {
+		pid:       "pid",
+		keyring:   &keyring,
+		scheduler: sched,
+	}
+	ctx := setQueryContext(context.Background(), &qctx)
+	session := setupSession(t, manifest)
+	session.tasksize = 10
+	c := &cube {
+		id:       "<some-id>",
+		manifest: []byte(manifest),
+		session:  session,
+	}
+	return ctx, c, sched
+}
+
+func TestSchedulingFailureIsAnError(t *testing.T) {
+	ctx, c, sched := setupFailingQuery(t)
+	args := sliceargs { Kind: "index", Dim: 0, Val: 1 }
+	promise, err := c.basicQuery(ctx, "slice", args, nil)
+	if sched.calls != 1 {
+		t.Errorf("expected Schedule() to be called once; was %d", sched.calls)
+	}
+	if promise != nil {
+		t.Errorf("expected no promise; got %v", promise)
+	}
+	if _, ok := err.(*internal.InternalE); !ok {
+		t.Errorf("expected internal error; got %T (= %v)", err, err)
+	}
+}
+
+func TestPlanningFailureIsAQueryError(t *testing.T) {
+	ctx, c, sched := setupFailingQuery(t)
+	args := sliceargs { Kind: "index", Dim: 0, Val: 10 }
+	promise, err := c.basicQuery(ctx, "slice", args, nil)
+	if sched.calls != 0 {
+		t.Errorf("expected Schedule() not to be called; was %d", sched.calls)
+	}
+	if promise != nil {
+		t.Errorf("expected no promise; got %v", promise)
+	}
+	if _, ok := err.(*internal.QueryE); !ok {
+		t.Errorf("expected query error; got %T (= %v)", err, err)
+	}
+}
+
+func TestProcessesInRequestGetDistinctPids(t *testing.T) {
+	qctx := queryContext { pid: "pid" }
+	expected := []string{ "pid", "pid-1", "pid-2" }
+	for _, pid := range expected {
+		if next := qctx.nextPid(); next != pid {
+			t.Errorf("expected %s; got %s", pid, next)
+		}
+	}
+}
+
+func TestCubesInRequestGetDistinctSessions(t *testing.T) {
+	engine := QueryEngine {
+		tasksize: 10,
+		pool: DefaultQueryEnginePool(),
+	}
+	sessions := sessionset { engine: &engine }
+	fst := sessions.Get()
+	snd := sessions.Get()
+	if fst == snd {
+		t.Errorf("expected distinct sessions; got the same twice")
+	}
+
+	sessions.PutAll()
+	if len(sessions.sessions) != 0 {
+		t.Errorf("expected all sessions put back; got %d checked out",
+			len(sessions.sessions))
+	}
+}
+
+/*
+ * The schema is checked against the resolvers when it is parsed, which
+ * otherwise only happens at startup.
+ */
+func TestSchemaMatchesResolvers(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("unable to build schema: %v", r)
+		}
+	}()
+	MakeGraphQL(nil, "", nil)
+}
@@ -1,33 +1,100 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/client/decode"
+	"github.com/equinor/oneseismic/api/internal/export"
 	"github.com/equinor/oneseismic/api/internal/message"
-	"github.com/go-redis/redis/v8"
+	"github.com/equinor/oneseismic/api/internal/queue"
 	"github.com/gin-gonic/gin"
 )
 
 type Result struct {
+	/*
+	 * The longest the status and get endpoints wait for the process with
+	 * ?wait=<duration>
+	 */
 	Timeout    time.Duration
 	StorageURL string
-	Storage    redis.Cmdable
+	Queue      queue.Queue
 	Keyring    *auth.Keyring
 }
 
+var errCancelled = errors.New("process cancelled")
+
+/*
+ * Get the failure record of the process, or nil if no task has failed.
+ */
+func getFailure(
+	ctx   context.Context,
+	q     queue.Queue,
+	pid   string,
+) (*message.Failure, error) {
+	doc, err := q.Failure(ctx, pid)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	return (&message.Failure{}).Unpack(doc)
+}
+
+/*
+ * The error posted when a task of the process has failed, and the process
+ * will never complete.
+ */
+type failedError struct {
+	failure *message.Failure
+}
+
+func (e *failedError) Error() string {
+	return fmt.Sprintf(
+		"process failed (%s) in part %s: %s",
+		e.failure.Class,
+		e.failure.Part,
+		e.failure.Message,
+	)
+}
+
+/*
+ * The name of the trailer that holds the error when a stream is terminated
+ * before all parts are sent. The trailer is always declared, but only set on
+ * failure. The value is the failure record as json.
+ */
+const errorTrailer = "Oneseismic-Error"
+
 /*
- * Silly helper to centralise the name/key of the header object. It's not
- * likely to change too much, but it beats hardcoding the key with formatting
- * all over the place.
+ * Make the error trailer for an error posted by collectResult. Only the
+ * failures from the workers and cancellation are reported as-is, other errors
+ * are internal and not leaked to the client.
  */
-func headerkey(pid string) string {
-	return fmt.Sprintf("%s/header.json", pid)
+func trailerFailure(err error) string {
+	failure := &message.Failure {
+		Class:   "internal",
+		Message: "internal error",
+	}
+
+	var failed *failedError
+	if errors.As(err, &failed) {
+		failure = failed.failure
+	} else if errors.Is(err, errCancelled) {
+		failure.Class   = "cancelled"
+		failure.Message = err.Error()
+	}
+
+	doc, err := failure.Pack()
+	if err != nil {
+		return `{"class":"internal","message":"internal error"}`
+	}
+	return string(doc)
 }
 
 func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
@@ -46,7 +113,7 @@ func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
 
 func collectResult(
 	ctx context.Context,
-	storage redis.Cmdable,
+	q queue.Queue,
 	pid string,
 	head *message.ProcessHeader,
 	tiles chan []byte,
@@ -59,40 +126,63 @@ func collectResult(
 
 	tiles <- head.RawHeader
 
-	streamCursor := "0"
+	/*
+	 * With at-least-once task consumption, a part can be written more than
+	 * once, e.g. when a slow task is reclaimed by another worker. The parts
+	 * are identical, so only the first one is sent.
+	 */
+	seen := make(map[string]bool, head.Ntasks)
+	cursor := ""
 	count := 0
 	for count < head.Ntasks {
-		xreadArgs := redis.XReadArgs{
-			Streams: []string{pid, streamCursor},
-			Block:   0,
-		}
-		reply, err := storage.XRead(ctx, &xreadArgs).Result()
-
+		/*
+		 * Block for a short while only, so that the stream is not waiting
+		 * forever for the parts of a process that has been cancelled.
+		 */
+		parts, next, err := q.ReadParts(ctx, pid, cursor, time.Second)
 		if err != nil {
 			failure <- err
 			return
 		}
 
-		for _, message := range reply[0].Messages {
-			for _, tile := range message.Values {
-				chunk, ok := tile.(string)
-				if !ok {
-					msg := fmt.Sprintf("tile.type = %T; expected []byte]", tile)
-					failure <- errors.New(msg)
-					return
-				}
-
-				tiles <- []byte(chunk)
-				count++
+		if len(parts) == 0 {
+			stop, err := q.Cancelled(ctx, pid)
+			if err != nil {
+				failure <- err
+				return
+			}
+			if stop {
+				failure <- errCancelled
+				return
+			}
+
+			failed, err := getFailure(ctx, q, pid)
+			if err != nil {
+				failure <- err
+				return
+			}
+			if failed != nil {
+				failure <- &failedError { failure: failed }
+				return
+			}
+			continue
+		}
+
+		for _, part := range parts {
+			if seen[part.Name] {
+				continue
 			}
-			streamCursor = message.ID
+			seen[part.Name] = true
+			tiles <- part.Data
+			count++
 		}
+		cursor = next
 	}
 }
 
 func (r *Result) Stream(ctx *gin.Context) {
 	pid := ctx.Param("pid")
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	body, err := r.Queue.GetHeader(ctx, pid)
 	if err != nil {
 		log.Printf("Unable to get process header: %v", err)
 		ctx.AbortWithStatus(http.StatusNotFound)
@@ -108,12 +198,13 @@ func (r *Result) Stream(ctx *gin.Context) {
 
 	tiles := make(chan []byte)
 	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
+	go collectResult(ctx, r.Queue, pid, head, tiles, failure)
 
 	w := ctx.Writer
 	header := w.Header()
 	header.Set("Transfer-Encoding", "chunked")
 	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Trailer", errorTrailer)
 	w.WriteHeader(http.StatusOK)
 
 	for {
@@ -127,14 +218,153 @@ func (r *Result) Stream(ctx *gin.Context) {
 
 		case err := <-failure:
 			log.Printf("pid=%s, %s", pid, err)
+			header.Set(errorTrailer, trailerFailure(err))
 			return
 		}
 	}
 }
 
+/*
+ * Get the time to wait for the process to complete from the wait query
+ * parameter, e.g. ?wait=10s (or ?wait=10, in seconds). The wait is capped by
+ * the Timeout, so that requests do not hold on to connections for long.
+ * Without ?wait, the handlers do not wait at all.
+ */
+func (r *Result) waitDuration(ctx *gin.Context) (time.Duration, error) {
+	param, ok := ctx.GetQuery("wait")
+	if !ok {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(param)
+	if err != nil {
+		seconds, serr := strconv.ParseFloat(param, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("bad wait '%s': %w", param, err)
+		}
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("bad wait '%s': must be >= 0", param)
+	}
+	if r.Timeout > 0 && wait > r.Timeout {
+		wait = r.Timeout
+	}
+	return wait, nil
+}
+
+/*
+ * Wait until all parts of the process are written, the process is cancelled
+ * or failed, or the deadline is reached, without reading the parts. The
+ * caller must check what happened.
+ */
+func (r *Result) waitForProcess(
+	ctx      context.Context,
+	pid      string,
+	ntasks   int,
+	deadline time.Time,
+) error {
+	count, err := r.Queue.CountParts(ctx, pid)
+	if err != nil {
+		return err
+	}
+
+	for count < int64(ntasks) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		if err := r.Queue.WaitParts(ctx, pid, count, remaining); err != nil {
+			return err
+		}
+
+		/*
+		 * No new parts means the wait expired, or the process was
+		 * cancelled or failed, and will never complete.
+		 */
+		n, err := r.Queue.CountParts(ctx, pid)
+		if err != nil {
+			return err
+		}
+		if n == count {
+			return nil
+		}
+		count = n
+	}
+	return nil
+}
+
+/*
+ * Get the output format requested with the format query parameter, e.g.
+ * ?format=npy, or the Accept header. Returns nil for the native (msgpack)
+ * format, which is the default, and what the bundled decoders read.
+ *
+ * Clients that accept anything get the native format, and so do clients that
+ * only accept formats not offered, for compatibility with clients that send
+ * an arbitrary Accept.
+ */
+func outputFormat(ctx *gin.Context) (*export.Format, error) {
+	if name, ok := ctx.GetQuery("format"); ok {
+		if name == "msgpack" {
+			return nil, nil
+		}
+		format, ok := export.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown format %s", name)
+		}
+		return &format, nil
+	}
+
+	offered := []string { "application/octet-stream" }
+	for _, format := range export.Formats {
+		offered = append(offered, format.ContentType)
+	}
+	format, ok := export.Lookup(ctx.NegotiateFormat(offered...))
+	if !ok {
+		return nil, nil
+	}
+	return &format, nil
+}
+
+/*
+ * Convert the assembled (native) response to the output format.
+ */
+func convert(doc []byte, format *export.Format, w io.Writer) error {
+	result, err := decode.Decode(doc)
+	if err != nil {
+		return fmt.Errorf("unable to decode result: %w", err)
+	}
+	ds, err := export.FromResult(result)
+	if err != nil {
+		return err
+	}
+	return format.Write(w, ds)
+}
+
+/*
+ * Get the complete result, as the native msgpack message by default, or as
+ * one of the export formats (npy, arrow, netcdf).
+ */
 func (r *Result) Get(ctx *gin.Context) {
 	pid := ctx.Param("pid")
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	format, err := outputFormat(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	wait, err := r.waitDuration(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+	deadline := time.Now().Add(wait)
+
+	body, err := r.Queue.WaitHeader(ctx, pid, wait)
 	if err != nil {
 		log.Printf("Unable to get process header: %v", err)
 		ctx.AbortWithStatus(http.StatusNotFound)
@@ -148,16 +378,53 @@ func (r *Result) Get(ctx *gin.Context) {
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	err = r.waitForProcess(ctx, pid, head.Ntasks, deadline)
+	if err != nil {
+		log.Printf("pid=%s, %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	/*
+	 * Count the distinct parts written, rather than the length of the
+	 * stream, as a part can be written more than once.
+	 */
+	count, err := r.Queue.CountParts(ctx, pid)
+	if err != nil {
+		log.Printf("pid=%s, %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
 	if count < int64(head.Ntasks) {
+		stop, err := r.Queue.Cancelled(ctx, pid)
+		if err != nil {
+			log.Printf("pid=%s, %v", pid, err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if stop {
+			ctx.AbortWithStatus(http.StatusGone)
+			return
+		}
+
+		failed, err := getFailure(ctx, r.Queue, pid)
+		if err != nil {
+			log.Printf("pid=%s, %v", pid, err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if failed != nil {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, failed)
+			return
+		}
 		ctx.AbortWithStatus(http.StatusAccepted)
 		return
 	}
 
 	tiles := make(chan []byte, 1000)
 	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
+	go collectResult(ctx, r.Queue, pid, head, tiles, failure)
 
 	result := make([]byte, 0)
 
@@ -172,7 +439,22 @@ func (r *Result) Get(ctx *gin.Context) {
 	default:
 	}
 
-	ctx.Data(http.StatusOK, "application/octet-stream", result)
+	if format == nil {
+		ctx.Data(http.StatusOK, "application/octet-stream", result)
+		return
+	}
+
+	var output bytes.Buffer
+	if err := convert(result, format, &output); err != nil {
+		log.Printf("pid=%s, %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Header(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%s.%s", pid, format.Extension),
+	)
+	ctx.Data(http.StatusOK, format.ContentType, output.Bytes())
 }
 
 func (r *Result) Status(ctx *gin.Context) {
@@ -191,9 +473,22 @@ func (r *Result) Status(ctx *gin.Context) {
 	 * the status is pending.
 	 *
 	 * [1] the header-write step not completed, to be precise
+	 *
+	 * With ?wait, the status is not returned until the process is done
+	 * (finished, failed, or cancelled), or the wait expires, so that clients
+	 * can long-poll rather than request the status in a loop.
 	 */
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
-	if err == redis.Nil {
+	wait, err := r.waitDuration(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+	deadline := time.Now().Add(wait)
+
+	body, err := r.Queue.WaitHeader(ctx, pid, wait)
+	if errors.Is(err, queue.ErrNotFound) {
 		/* request sucessful, but key does not exist */
 		ctx.JSON(http.StatusAccepted, gin.H {
 			"location": fmt.Sprintf("result/%s/status", pid),
@@ -214,7 +509,14 @@ func (r *Result) Status(ctx *gin.Context) {
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	err = r.waitForProcess(ctx, pid, proc.Ntasks, deadline)
+	if err != nil {
+		log.Printf("%s %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	count, err := r.Queue.CountParts(ctx, pid)
 	if err != nil {
 		log.Printf("%s %v", pid, err)
 		ctx.AbortWithStatus(http.StatusInternalServerError)
@@ -224,8 +526,38 @@ func (r *Result) Status(ctx *gin.Context) {
 	done := count == int64(proc.Ntasks)
 	completed := fmt.Sprintf("%d/%d", count, proc.Ntasks)
 
-	// TODO: add (and detect) failed status
-	if done {
+	stop, err := r.Queue.Cancelled(ctx, pid)
+	if err != nil {
+		log.Printf("%s %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	failed, err := getFailure(ctx, r.Queue, pid)
+	if err != nil {
+		log.Printf("%s %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	/*
+	 * A failed or cancelled process will never be done, and the status is
+	 * final, so it is reported with 200 OK to stop clients from polling.
+	 */
+	if stop && !done {
+		ctx.JSON(http.StatusOK, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status": "cancelled",
+			"progress": completed,
+		})
+	} else if failed != nil && !done {
+		ctx.JSON(http.StatusOK, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status": "failed",
+			"progress": completed,
+			"reason": failed,
+		})
+	} else if done {
 		ctx.JSON(http.StatusOK, gin.H {
 			"location": fmt.Sprintf("result/%s", pid),
 			"status": "finished",
@@ -239,3 +571,34 @@ func (r *Result) Status(ctx *gin.Context) {
 		})
 	}
 }
+
+/*
+ * Cancel a process. The process is marked as cancelled, so that workers drop
+ * its tasks, and the running tasks are signalled to stop downloading
+ * fragments. Finally, the tasks still in the job queue are removed.
+ *
+ * The result of a cancelled process is never completed, and cancelling a
+ * process that is already completed is harmless.
+ */
+func (r *Result) Cancel(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	err := r.Queue.Cancel(ctx, pid)
+	if err != nil {
+		log.Printf("pid=%s, %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	n, err := r.Queue.Remove(ctx, pid)
+	if err != nil {
+		log.Printf("pid=%s, %v", pid, err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("pid=%s, cancelled; %d queued tasks removed", pid, n)
+
+	ctx.JSON(http.StatusOK, gin.H {
+		"location": fmt.Sprintf("result/%s/status", pid),
+		"status": "cancelled",
+	})
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+func TestTrailerHasTheWorkerFailure(t *testing.T) {
+	failed := &failedError {
+		failure: &message.Failure {
+			Class:    "download",
+			Part:     "0/2",
+			Fragment: "src/0-0-0.f32",
+			Message:  "Internal error",
+		},
+	}
+	trailer := trailerFailure(failed)
+	expected := `{"class":"download","part":"0/2",` +
+		`"fragment":"src/0-0-0.f32","message":"Internal error"}`
+	assert.JSONEq(t, expected, trailer)
+}
+
+func TestTrailerHasCancellation(t *testing.T) {
+	trailer := trailerFailure(errCancelled)
+	expected := `{"class":"cancelled","part":"","message":"process cancelled"}`
+	assert.JSONEq(t, expected, trailer)
+}
+
+func TestTrailerDoesNotLeakInternalErrors(t *testing.T) {
+	trailer := trailerFailure(fmt.Errorf("dial tcp 10.0.0.1:6379: refused"))
+	expected := `{"class":"internal","part":"","message":"internal error"}`
+	assert.JSONEq(t, expected, trailer)
+}
+
+func TestCollectResultSkipsDuplicatedParts(t *testing.T) {
+	ctx := context.Background()
+	q := queue.NewMemory(queue.DefaultOptions())
+	q.PutPart(ctx, "pid", queue.Part { Name: "0/2", Data: []byte("a") })
+	q.PutPart(ctx, "pid", queue.Part { Name: "0/2", Data: []byte("a") })
+	q.PutPart(ctx, "pid", queue.Part { Name: "1/2", Data: []byte("b") })
+	head := &message.ProcessHeader {
+		Ntasks:    2,
+		RawHeader: []byte("head"),
+	}
+
+	tiles := make(chan []byte, 10)
+	failure := make(chan error, 1)
+	collectResult(ctx, q, "pid", head, tiles, failure)
+
+	result := make([]string, 0)
+	for tile := range tiles {
+		result = append(result, string(tile))
+	}
+	assert.Empty(t, failure)
+	assert.Equal(t, []string{ "head", "a", "b" }, result)
+}
+
+func negotiate(t *testing.T, target, accept string) (string, error) {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	if accept != "" {
+		ctx.Request.Header.Set("Accept", accept)
+	}
+	format, err := outputFormat(ctx)
+	if format == nil {
+		return "msgpack", err
+	}
+	return format.Name, err
+}
+
+func TestOutputFormatFromQueryOrAccept(t *testing.T) {
+	cases := []struct {
+		target   string
+		accept   string
+		expected string
+	}{
+		{ "/result/pid",                "",                          "msgpack" },
+		{ "/result/pid",                "*/*",                       "msgpack" },
+		{ "/result/pid",                "text/html",                 "msgpack" },
+		{ "/result/pid",                "application/x-npy",         "npy" },
+		{ "/result/pid",                "application/x-netcdf, */*", "netcdf" },
+		{ "/result/pid?format=arrow",   "application/x-npy",         "arrow" },
+		{ "/result/pid?format=msgpack", "application/x-npy",         "msgpack" },
+	}
+
+	for _, c := range cases {
+		format, err := negotiate(t, c.target, c.accept)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, format, "%s (Accept: %s)", c.target, c.accept)
+	}
+}
+
+func TestUnknownOutputFormatIsAnError(t *testing.T) {
+	_, err := negotiate(t, "/result/pid?format=segy", "")
+	assert.Error(t, err)
+}
+
+func TestWaitDurationIsCapped(t *testing.T) {
+	r := &Result { Timeout: 15 * time.Second }
+	tests := []struct {
+		target   string
+		expected time.Duration
+	}{
+		{ "/result/pid/status",         0                      },
+		{ "/result/pid/status?wait=2s", 2 * time.Second        },
+		{ "/result/pid/status?wait=.5", 500 * time.Millisecond },
+		{ "/result/pid/status?wait=1m", 15 * time.Second       },
+	}
+
+	for _, test := range tests {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, test.target, nil)
+		wait, err := r.waitDuration(ctx)
+		assert.NoError(t, err, test.target)
+		assert.Equal(t, test.expected, wait, test.target)
+	}
+
+	for _, target := range []string { "/?wait=-1s", "/?wait=soon" } {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		_, err := r.waitDuration(ctx)
+		assert.Error(t, err, target)
+	}
+}
+
+func TestStatusWaitsForProcess(t *testing.T) {
+	q := queue.NewMemory(queue.DefaultOptions())
+	r := &Result { Timeout: 5 * time.Second, Queue: q }
+
+	head, err := (&message.ProcessHeader { Ntasks: 2 }).Pack()
+	assert.NoError(t, err)
+	/* the envelope, which Unpack skips */
+	head = append([]byte { 0x92 }, head...)
+
+	bg := context.Background()
+	assert.NoError(t, q.PutHeader(bg, "pid", head))
+	q.PutPart(bg, "pid", queue.Part { Name: "0/2" })
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.PutPart(bg, "pid", queue.Part { Name: "1/2" })
+	}()
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/?wait=5s", nil)
+	ctx.Params = gin.Params { { Key: "pid", Value: "pid" } }
+
+	start := time.Now()
+	r.Status(ctx)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"finished"`)
+}
+
+func TestStatusWaitsForHeader(t *testing.T) {
+	q := queue.NewMemory(queue.DefaultOptions())
+	r := &Result { Timeout: 5 * time.Second, Queue: q }
+
+	head, err := (&message.ProcessHeader { Ntasks: 1 }).Pack()
+	assert.NoError(t, err)
+	head = append([]byte { 0x92 }, head...)
+
+	/*
+	 * Write a part before the header, so that the wait does not end on
+	 * parts being written
+	 */
+	bg := context.Background()
+	q.PutPart(bg, "pid", queue.Part { Name: "0/1" })
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.PutHeader(bg, "pid", head)
+	}()
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/?wait=5s", nil)
+	ctx.Params = gin.Params { { Key: "pid", Value: "pid" } }
+
+	start := time.Now()
+	r.Status(ctx)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"finished"`)
+}
+
+func TestStatusWaitStopsOnCancel(t *testing.T) {
+	q := queue.NewMemory(queue.DefaultOptions())
+	r := &Result { Timeout: 5 * time.Second, Queue: q }
+
+	head, err := (&message.ProcessHeader { Ntasks: 2 }).Pack()
+	assert.NoError(t, err)
+	head = append([]byte { 0x92 }, head...)
+
+	bg := context.Background()
+	assert.NoError(t, q.PutHeader(bg, "pid", head))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Cancel(bg, "pid")
+	}()
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/?wait=5s", nil)
+	ctx.Params = gin.Params { { Key: "pid", Value: "pid" } }
+
+	start := time.Now()
+	r.Status(ctx)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"cancelled"`)
+}
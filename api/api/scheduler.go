@@ -13,18 +13,16 @@ package api
 import(
 	"context"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
 )
 
-type redisScheduler struct {
-	queue redis.Cmdable
-	/*
-	 * Time-to-live for the response, i.e. after this duration results will be
-	 * cleaned up
-	 */
-	ttl   time.Duration
+type queueScheduler struct {
+	queue queue.Queue
 }
 
 /*
@@ -37,43 +35,54 @@ type scheduler interface {
 	Schedule(context.Context, string, *QueryPlan) error
 }
 
+/*
+ * Make a scheduler on redis, with the default job queue and time-to-live.
+ */
 func NewScheduler(storage redis.Cmdable) scheduler {
-	return &redisScheduler {
-		queue: storage,
-		ttl:   10 * time.Minute,
-	}
+	return NewQueueScheduler(queue.NewRedis(storage, queue.DefaultOptions()))
 }
 
-func (rs *redisScheduler) Schedule(
+func NewQueueScheduler(q queue.Queue) scheduler {
+	return &queueScheduler { queue: q }
+}
+
+func (qs *queueScheduler) Schedule(
 	ctx  context.Context,
 	pid  string,
 	plan *QueryPlan,
 ) error {
-	err := rs.queue.Set(
-		ctx,
-		fmt.Sprintf("%s/header.json", pid),
-		plan.header,
-		rs.ttl,
-	).Err()
+	err := qs.queue.PutHeader(ctx, pid, plan.header)
 	if err != nil {
 		return err
 	}
-	values := []interface{} {
-		"pid",  pid,
-		"part", nil,
-		"task", nil,
-	}
-	args := &redis.XAddArgs{Stream: "jobs", Values: values}
 	ntasks := len(plan.plan)
-	for i, task := range plan.plan {
+	for i, body := range plan.plan {
 		part := fmt.Sprintf("%d/%d", i, ntasks)
-		values[3] = part
-		values[5] = task
-		err := rs.queue.XAdd(ctx, args).Err()
+		task := queue.Task { Pid: pid, Part: part, Body: body }
+		err := qs.queue.Enqueue(ctx, task)
 		if err != nil {
+			qs.abandon(pid)
 			msg := "pid=%s, part=%v, unable to schedule: %w"
 			return fmt.Errorf(msg, pid, part, err)
 		}
 	}
 	return nil
 }
+
+/*
+ * Cancel the process and remove the tasks that were enqueued before
+ * scheduling failed, so that workers do not compute a result no one can
+ * fetch. Scheduling may have failed because the request context is done, so
+ * the clean-up gets its own context.
+ */
+func (qs *queueScheduler) abandon(pid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	if err := qs.queue.Cancel(ctx, pid); err != nil {
+		log.Printf("pid=%s, unable to cancel: %v", pid, err)
+	}
+	if _, err := qs.queue.Remove(ctx, pid); err != nil {
+		log.Printf("pid=%s, unable to remove tasks: %v", pid, err)
+	}
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
 )
 
 type redisNoSET struct {
@@ -66,11 +68,35 @@ func (r *redisNoXADD) Set(
 	return redis.NewStatusResult("OK", nil)
 }
 
-func (r *redisNoXADD) XAdd(
+/*
+ * Tasks are enqueued with a script, in which the XADD fails
+ */
+func (r *redisNoXADD) EvalSha(
 	ctx  context.Context,
-	args *redis.XAddArgs,
-) *redis.StringCmd {
-	return redis.NewStringResult("xadd-fails", fmt.Errorf("XADD failure"))
+	sha1 string,
+	keys []string,
+	args ...interface{},
+) *redis.Cmd {
+	return redis.NewCmdResult(nil, fmt.Errorf("XADD failure"))
+}
+
+/*
+ * A failed schedule is cleaned up by cancelling the process (SET, PUBLISH)
+ * and removing its tasks (SMEMBERS), which must not fail the test
+ */
+func (r *redisNoXADD) Publish(
+	ctx     context.Context,
+	channel string,
+	message interface{},
+) *redis.IntCmd {
+	return redis.NewIntResult(0, nil)
+}
+
+func (r *redisNoXADD) SMembers(
+	ctx context.Context,
+	key string,
+) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(nil, nil)
 }
 
 func TestScheduleFailsOnXADDError(t *testing.T) {
@@ -89,3 +115,35 @@ func TestErrorOnDisconnectedClient(t *testing.T) {
 	err := s.Schedule(context.Background(), "<pid>", qp)
 	assert.Error(t, err, "Scheduling on disconnected redis did not fail")
 }
+
+/*
+ * The queue that fails to enqueue after n tasks
+ */
+type queueFailsAfter struct {
+	queue.Queue
+	n int
+}
+
+func (q *queueFailsAfter) Enqueue(ctx context.Context, task queue.Task) error {
+	if q.n == 0 {
+		return fmt.Errorf("enqueue failure")
+	}
+	q.n--
+	return q.Queue.Enqueue(ctx, task)
+}
+
+func TestFailedScheduleCancelsProcess(t *testing.T) {
+	ctx := context.Background()
+	mem := queue.NewMemory(queue.DefaultOptions())
+	s   := NewQueueScheduler(&queueFailsAfter { Queue: mem, n: 2 })
+	qp  := &QueryPlan{plan: make([][]byte, 3)}
+	err := s.Schedule(ctx, "pid", qp)
+	assert.Error(t, err)
+
+	stop, err := mem.Cancelled(ctx, "pid")
+	assert.NoError(t, err)
+	assert.True(t, stop)
+	jobs, err := mem.Dequeue(ctx, "c", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ * The client for oneseismic, which does the query-and-fetch dance:
+ *
+ *     1. POST the graphql query to /graphql, which returns a promise
+ *        { url, key } for every data query
+ *     2. poll <url>/status with the key as bearer token until the process is
+ *        done (or failed)
+ *     3. GET <url>/stream, and decode the response
+ *
+ * e.g.
+ *
+ *     c := client.New("https://oneseismic.example.com")
+ *     c.Token = token
+ *     proc, err := c.Cube(guid).SliceByLineno(ctx, 0, 1234, nil)
+ *     ...
+ *     result, err := proc.Result(ctx)
+ *     ...
+ *     data := result.Arrays["data"]
+ *
+ * The graphql queries are authorized either with a token for the storage
+ * account (Token), or with a shared access signature (Sas), which is passed
+ * on to the storage account as-is. The result endpoints only use the key in
+ * the promise.
+ */
+type Client struct {
+	/*
+	 * The root URL of the oneseismic instance, without /graphql
+	 */
+	Endpoint     string
+	Token        string
+	Sas          string
+	HTTPClient   *http.Client
+	/*
+	 * The time between status requests when waiting for a process
+	 */
+	PollInterval time.Duration
+}
+
+func New(endpoint string) *Client {
+	return &Client {
+		Endpoint:     strings.TrimSuffix(endpoint, "/"),
+		HTTPClient:   http.DefaultClient,
+		PollInterval: 500 * time.Millisecond,
+	}
+}
+
+/*
+ * The client configuration of the oneseismic instance, i.e. the response of
+ * /config.
+ */
+type Config struct {
+	ClientID               string   `json:"client_id"`
+	Scopes                 []string `json:"scopes"`
+	DefaultStorageResource string   `json:"default-storage-resource"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+/*
+ * Make the URL for path, which is relative to the endpoint, e.g. graphql or
+ * result/<pid>/status.
+ */
+func (c *Client) url(path string) string {
+	return fmt.Sprintf(
+		"%s/%s",
+		strings.TrimSuffix(c.Endpoint, "/"),
+		strings.TrimPrefix(path, "/"),
+	)
+}
+
+/*
+ * Do the request, and map the error statuses to errors. The body of the
+ * response must be closed by the caller, but only if the error is nil.
+ */
+func (c *Client) do(req *http.Request, ok ...int) (*http.Response, error) {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range ok {
+		if res.StatusCode == status {
+			return res, nil
+		}
+	}
+
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, errorFromStatus(res.StatusCode, body)
+}
+
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("config"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	config := &Config{}
+	if err := json.NewDecoder(res.Body).Decode(config); err != nil {
+		return nil, fmt.Errorf("bad /config response: %w", err)
+	}
+	return config, nil
+}
+
+type graphqlError struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []graphqlError  `json:"errors"`
+}
+
+/*
+ * Run a graphql query, and unmarshal the data of the response into out.
+ *
+ * The query fails if any of the fields fails, and the error is the error of
+ * the first field, typed by its code.
+ */
+func (c *Client) Query(
+	ctx       context.Context,
+	query     string,
+	variables map[string]interface{},
+	out       interface{},
+) error {
+	body, err := json.Marshal(map[string]interface{} {
+		"query":     query,
+		"variables": variables,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(c.url("graphql"))
+	if err != nil {
+		return err
+	}
+	endpoint.RawQuery = strings.TrimPrefix(c.Sas, "?")
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		"POST",
+		endpoint.String(),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer " + c.Token)
+	}
+
+	res, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	response := graphqlResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("bad graphql response: %w", err)
+	}
+	if len(response.Errors) > 0 {
+		return errorFromGraphQL(response.Errors[0])
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Data, out)
+}
@@ -0,0 +1,271 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * A 1x2x3 inline slice, as written by the query service and the workers
+ */
+func sliceResponse(t *testing.T) []byte {
+	samples := make([]byte, 4 * 6)
+	for i := 0; i < 6; i++ {
+		bits := math.Float32bits(float32(i))
+		binary.LittleEndian.PutUint32(samples[4*i:], bits)
+	}
+
+	head := map[string]interface{} {
+		"pid":        "pid",
+		"function":   1,
+		"nbundles":   1,
+		"ndims":      3,
+		"index":      []int { 1, 2, 3, 10, 1, 2, 0, 4, 8 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 3, 1, 2, 3 },
+	}
+	tile   := []interface{} { 1, 6, 0, 6, 6, samples }
+	bundle := []interface{} { "data", []interface{} { tile } }
+	doc, err := msgpack.Marshal([]interface{} { head, []interface{} { bundle } })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return doc
+}
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+/*
+ * Serve graphql queries with response (and record the request), and the
+ * result endpoints for the process "pid" with the status handler.
+ */
+func fakeServer(
+	t        *testing.T,
+	response string,
+	request  *graphqlRequest,
+	status   http.HandlerFunc,
+	stream   http.HandlerFunc,
+) *Client {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		if request != nil {
+			json.NewDecoder(r.Body).Decode(request)
+		}
+		w.Write([]byte(response))
+	})
+	authorized := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer key" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		}
+	}
+	if status != nil {
+		mux.HandleFunc("/result/pid/status", authorized(status))
+	}
+	if stream != nil {
+		mux.HandleFunc("/result/pid/stream", authorized(stream))
+	}
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := New(server.URL)
+	c.PollInterval = time.Millisecond
+	return c
+}
+
+const slicePromise = `{
+	"data": {
+		"cube": {
+			"sliceByLineno": { "url": "result/pid", "key": "key" }
+		}
+	}
+}`
+
+func TestConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/config", r.URL.Path)
+			w.Write([]byte(`{
+				"client_id": "id",
+				"scopes": [ "api://id/One.Read" ],
+				"default-storage-resource": "https://acc.blob.core.windows.net"
+			}`))
+		},
+	))
+	defer server.Close()
+
+	config, err := New(server.URL + "/").Config(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "id", config.ClientID)
+	assert.Equal(t, []string { "api://id/One.Read" }, config.Scopes)
+	expected := "https://acc.blob.core.windows.net"
+	assert.Equal(t, expected, config.DefaultStorageResource)
+}
+
+func TestSliceByLinenoQuery(t *testing.T) {
+	request := graphqlRequest{}
+	c := fakeServer(t, slicePromise, &request, nil, nil)
+
+	opts := &Opts { Attributes: []string { "cdpx" } }
+	proc, err := c.Cube("guid").SliceByLineno(context.Background(), 0, 10, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, "pid", proc.Pid())
+	assert.Equal(t, Promise { URL: "result/pid", Key: "key" }, proc.Promise())
+
+	assert.Contains(t, request.Query, "$lineno: Int!")
+	assert.Contains(t, request.Query,
+		"sliceByLineno(dim: $dim, lineno: $lineno, opts: $opts)",
+	)
+	assert.Equal(t, "guid", request.Variables["id"])
+	assert.Equal(t, float64(10), request.Variables["lineno"])
+	attributes := request.Variables["opts"].(map[string]interface{})["attributes"]
+	assert.Equal(t, []interface{} { "cdpx" }, attributes)
+}
+
+func TestGraphQLErrorsAreTyped(t *testing.T) {
+	response := func(extensions string) string {
+		return `{
+			"errors": [ { "message": "msg"` + extensions + ` } ],
+			"data": null
+		}`
+	}
+	var query    *QueryError
+	var denied   *PermissionDeniedError
+	var internal *InternalError
+
+	tests := []struct {
+		extensions string
+		target     interface{}
+	}{
+		{ `, "extensions": { "code": "query" }`,             &query    },
+		{ `, "extensions": { "code": "permission-denied" }`, &denied   },
+		{ `, "extensions": { "code": "internal" }`,          &internal },
+		/* schema errors have no code */
+		{ ``,                                                &query    },
+	}
+
+	for _, test := range tests {
+		c := fakeServer(t, response(test.extensions), nil, nil, nil)
+		_, err := c.Cube("guid").SliceByIndex(context.Background(), 0, 0, nil)
+		assert.True(t, errors.As(err, test.target), "%T", err)
+		assert.Equal(t, "msg", err.Error())
+	}
+}
+
+func TestBadKeyIsPermissionDenied(t *testing.T) {
+	status := func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unauthorized request to status")
+	}
+	c := fakeServer(t, slicePromise, nil, status, nil)
+	proc := c.Process(&Promise { URL: "result/pid", Key: "bad" })
+
+	_, err := proc.Status(context.Background())
+	var denied *PermissionDeniedError
+	assert.True(t, errors.As(err, &denied), "%T", err)
+}
+
+func TestResultWaitsForProcess(t *testing.T) {
+	polls := 0
+	status := func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		assert.Equal(t, "15s", r.URL.Query().Get("wait"))
+		if polls < 3 {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{ "status": "working", "progress": "0/1" }`))
+			return
+		}
+		w.Write([]byte(`{ "status": "finished", "progress": "1/1" }`))
+	}
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 3, polls)
+		w.Write(sliceResponse(t))
+	}
+	c := fakeServer(t, slicePromise, nil, status, stream)
+
+	ctx := context.Background()
+	proc, err := c.Cube("guid").SliceByLineno(ctx, 0, 10, nil)
+	assert.NoError(t, err)
+
+	result, err := proc.Result(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int { 1, 2, 3 }, result.Arrays["data"].Shape)
+	expected := []float32 { 0, 1, 2, 3, 4, 5 }
+	assert.Equal(t, expected, result.Arrays["data"].Data)
+}
+
+func TestFailedProcessIsAnError(t *testing.T) {
+	status := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"status": "failed",
+			"progress": "1/3",
+			"reason": {
+				"class": "download",
+				"part": "2/3",
+				"message": "403 Forbidden"
+			}
+		}`))
+	}
+	c := fakeServer(t, slicePromise, nil, status, nil)
+	proc := c.Process(&Promise { URL: "result/pid", Key: "key" })
+
+	_, err := proc.Result(context.Background())
+	var failed *FailedError
+	assert.True(t, errors.As(err, &failed), "%T", err)
+	assert.Equal(t, "download", failed.Class)
+	assert.Equal(t, "2/3", failed.Part)
+}
+
+func TestStreamReportsTrailerFailure(t *testing.T) {
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Oneseismic-Error")
+		doc := sliceResponse(t)
+		w.Write(doc[:len(doc) - 8])
+		w.Header().Set(
+			"Oneseismic-Error",
+			`{"class":"cancelled","part":"","message":"process cancelled"}`,
+		)
+	}
+	c := fakeServer(t, slicePromise, nil, nil, stream)
+	proc := c.Process(&Promise { URL: "result/pid", Key: "key" })
+
+	s, err := proc.Stream(context.Background())
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Decode()
+	assert.True(t, errors.Is(err, ErrCancelled), "%v", err)
+}
+
+func TestSasIsPassedToGraphQL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "sv=2020&sig=abc", r.URL.RawQuery)
+			assert.Empty(t, r.Header.Get("Authorization"))
+			w.Write([]byte(slicePromise))
+		},
+	))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.Sas = "?sv=2020&sig=abc"
+	_, err := c.Cube("guid").SliceByLineno(context.Background(), 0, 10, nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+/*
+ * The options shared by all data queries, i.e. the graphql Opts input. The
+ * zero value is the default.
+ */
+type Opts struct {
+	/*
+	 * Extra attributes, e.g. cdpx, cdpy
+	 */
+	Attributes []string `json:"attributes,omitempty"`
+	ZRange     *ZRange  `json:"zrange,omitempty"`
+	Stride     []int    `json:"stride,omitempty"`
+	Format     *Format  `json:"format,omitempty"`
+}
+
+type ZRange struct {
+	From int    `json:"from"`
+	To   int    `json:"to"`
+	/*
+	 * lineno (default), index
+	 */
+	Kind string `json:"kind,omitempty"`
+}
+
+type Format struct {
+	/*
+	 * float32, float16, int16, int8
+	 */
+	Type  string    `json:"type"`
+	Range []float64 `json:"range,omitempty"`
+}
+
+type Cube struct {
+	client *Client
+	id     string
+}
+
+func (c *Client) Cube(id string) *Cube {
+	return &Cube { client: c, id: id }
+}
+
+func (c *Cube) ID() string {
+	return c.id
+}
+
+func (c *Cube) Linenumbers(ctx context.Context) ([][]int, error) {
+	query := `
+	query($id: ID!) {
+		cube(id: $id) {
+			linenumbers
+		}
+	}`
+	var out struct {
+		Cube struct {
+			Linenumbers [][]int `json:"linenumbers"`
+		} `json:"cube"`
+	}
+	variables := map[string]interface{} { "id": c.id }
+	err := c.client.Query(ctx, query, variables, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out.Cube.Linenumbers, nil
+}
+
+type argument struct {
+	name  string
+	kind  string
+	value interface{}
+}
+
+/*
+ * Make and run the query for a single data field of the cube, e.g.
+ *
+ *     query($id: ID!, $dim: Int!, $lineno: Int!, $opts: Opts) {
+ *         cube(id: $id) {
+ *             sliceByLineno(dim: $dim, lineno: $lineno, opts: $opts)
+ *         }
+ *     }
+ *
+ * and make the process from the promise. The promise is a scalar, i.e. an
+ * object { url, key } without subfields.
+ */
+func (c *Cube) promise(
+	ctx   context.Context,
+	field string,
+	opts  *Opts,
+	args  ...argument,
+) (*Process, error) {
+	args = append(args, argument { "opts", "Opts", opts })
+
+	params    := []string { "$id: ID!" }
+	fieldargs := make([]string, 0, len(args))
+	variables := map[string]interface{} { "id": c.id }
+	for _, arg := range args {
+		params    = append(params,    fmt.Sprintf("$%s: %s", arg.name, arg.kind))
+		fieldargs = append(fieldargs, fmt.Sprintf("%s: $%s", arg.name, arg.name))
+		variables[arg.name] = arg.value
+	}
+
+	query := fmt.Sprintf(`
+	query(%s) {
+		cube(id: $id) {
+			%s(%s)
+		}
+	}`,
+		strings.Join(params, ", "),
+		field,
+		strings.Join(fieldargs, ", "),
+	)
+
+	var out struct {
+		Cube map[string]*Promise `json:"cube"`
+	}
+	if err := c.client.Query(ctx, query, variables, &out); err != nil {
+		return nil, err
+	}
+
+	promise := out.Cube[field]
+	if promise == nil || promise.URL == "" {
+		return nil, &InternalError {
+			Message: fmt.Sprintf("%s: no promise in response", field),
+		}
+	}
+	return c.client.Process(promise), nil
+}
+
+func (c *Cube) SliceByLineno(
+	ctx    context.Context,
+	dim    int,
+	lineno int,
+	opts   *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "sliceByLineno", opts,
+		argument { "dim",    "Int!", dim    },
+		argument { "lineno", "Int!", lineno },
+	)
+}
+
+func (c *Cube) SliceByIndex(
+	ctx   context.Context,
+	dim   int,
+	index int,
+	opts  *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "sliceByIndex", opts,
+		argument { "dim",   "Int!", dim   },
+		argument { "index", "Int!", index },
+	)
+}
+
+/*
+ * The curtain through the (inline, crossline) pairs
+ */
+func (c *Cube) CurtainByLineno(
+	ctx    context.Context,
+	coords [][2]int,
+	opts   *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "curtainByLineno", opts,
+		argument { "coords", "[[Int!]!]!", coords },
+	)
+}
+
+func (c *Cube) CurtainByIndex(
+	ctx    context.Context,
+	coords [][2]int,
+	opts   *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "curtainByIndex", opts,
+		argument { "coords", "[[Int!]!]!", coords },
+	)
+}
+
+/*
+ * The curtain through the (x, y) pairs, which are snapped to the nearest
+ * trace
+ */
+func (c *Cube) CurtainByUTM(
+	ctx    context.Context,
+	coords [][2]float64,
+	opts   *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "curtainByUTM", opts,
+		argument { "coords", "[[Float!]!]!", coords },
+	)
+}
+
+/*
+ * The subvolume [from, to] (inclusive) in line numbers
+ */
+func (c *Cube) Subvolume(
+	ctx  context.Context,
+	from []int,
+	to   []int,
+	opts *Opts,
+) (*Process, error) {
+	return c.promise(ctx, "subvolume", opts,
+		argument { "from", "[Int!]!", from },
+		argument { "to",   "[Int!]!", to   },
+	)
+}
+
+/*
+ * The promise as returned by the graphql data queries. Queries with more than
+ * one field can be run with Query, and the promises made into processes:
+ *
+ *     var out struct {
+ *         Cube struct {
+ *             A client.Promise `json:"a"`
+ *             B client.Promise `json:"b"`
+ *         } `json:"cube"`
+ *     }
+ *     err := c.Query(ctx, query, variables, &out)
+ *     a := c.Process(&out.Cube.A)
+ */
+type Promise struct {
+	URL string `json:"url"`
+	Key string `json:"key"`
+}
@@ -0,0 +1,684 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * The decoder for the response message, i.e. the header written by the query
+ * service followed by the parts written by the workers. This is the go
+ * implementation of core/src/decoder.cpp, and the two must be kept in sync.
+ *
+ * The message is a msgpack array(2) of the header and the array of bundles:
+ *
+ *     [header, [bundle, bundle, ...]]
+ *
+ * where every part is a (msgpack-complete) sequence of bundles. The samples
+ * are always decoded into float32, regardless of the sample format on the
+ * wire.
+ */
+
+type Function int
+
+/*
+ * Corresponds to one::functionid in oneseismic/messages.hpp
+ */
+const (
+	Slice      Function = 1
+	Curtain    Function = 2
+	Horizon    Function = 3
+	Subvolume  Function = 4
+	Traces     Function = 5
+	Fence      Function = 6
+	Statistics Function = 7
+)
+
+func (f Function) String() string {
+	switch f {
+	case Slice:      return "slice"
+	case Curtain:    return "curtain"
+	case Horizon:    return "horizon"
+	case Subvolume:  return "subvolume"
+	case Traces:     return "traces"
+	case Fence:      return "fence"
+	case Statistics: return "statistics"
+	default:         return fmt.Sprintf("function(%d)", int(f))
+	}
+}
+
+/*
+ * Corresponds to one::process_header in oneseismic/messages.hpp. The index and
+ * shapes are flattened on the wire, use Axes() and SplitShapes() to split them.
+ */
+type Header struct {
+	Pid         string    `msgpack:"pid"`
+	Function    Function  `msgpack:"function"`
+	Nbundles    int       `msgpack:"nbundles"`
+	Ndims       int       `msgpack:"ndims"`
+	Index       []int     `msgpack:"index"`
+	Labels      []string  `msgpack:"labels"`
+	Attributes  []string  `msgpack:"attributes"`
+	Shapes      []int     `msgpack:"shapes"`
+	Coordinates []float64 `msgpack:"coordinates"`
+	/*
+	 * The sample format of the data, see oneseismic/sampleformat.hpp. Empty
+	 * means float32.
+	 */
+	Format      string    `msgpack:"format"`
+	Scale       float64   `msgpack:"scale"`
+	Offset      float64   `msgpack:"offset"`
+}
+
+/*
+ * The index (line numbers) of every axis. The index is laid out as the ndims
+ * lengths, followed by the concatenated lists, e.g. [2, 3, 1, 2, 1, 2, 3]
+ * means [[1, 2], [1, 2, 3]].
+ */
+func (h *Header) Axes() ([][]int, error) {
+	if h.Ndims < 0 || len(h.Index) < h.Ndims {
+		msg := "bad index; len(index) = %d, ndims = %d"
+		return nil, fmt.Errorf(msg, len(h.Index), h.Ndims)
+	}
+
+	index := h.Index[h.Ndims:]
+	axes  := make([][]int, 0, h.Ndims)
+	for _, n := range h.Index[:h.Ndims] {
+		if n < 0 || len(index) < n {
+			return nil, fmt.Errorf("bad index; axis of length %d", n)
+		}
+		axes  = append(axes, index[:n])
+		index = index[n:]
+	}
+	return axes, nil
+}
+
+/*
+ * The shape of every attribute, in the order of Attributes. The shapes are
+ * laid out as [n, dims...] per attribute, e.g. [2, 3, 4, 1, 3] means
+ * [[3, 4], [3]].
+ */
+func (h *Header) SplitShapes() ([][]int, error) {
+	shapes := h.Shapes
+	out := make([][]int, 0, len(h.Attributes))
+	for len(shapes) > 0 {
+		n := shapes[0]
+		shapes = shapes[1:]
+		if n < 0 || len(shapes) < n {
+			return nil, fmt.Errorf("bad shapes; shape of %d dimensions", n)
+		}
+		out = append(out, shapes[:n])
+		shapes = shapes[n:]
+	}
+
+	if len(out) != len(h.Attributes) {
+		msg := "bad shapes; %d shapes for %d attributes"
+		return nil, fmt.Errorf(msg, len(out), len(h.Attributes))
+	}
+	return out, nil
+}
+
+/*
+ * A decoded attribute, in C (row-major) order.
+ */
+type Array struct {
+	Shape []int
+	Data  []float32
+}
+
+/*
+ * The value at index, e.g. a.At(i, j, k) for a 3D array. Panics if the index
+ * is out of bounds, like indexing a slice.
+ */
+func (a *Array) At(index ...int) float32 {
+	if len(index) != len(a.Shape) {
+		msg := "index of %d dimensions for array of shape %v"
+		panic(fmt.Sprintf(msg, len(index), a.Shape))
+	}
+
+	offset := 0
+	for i, n := range a.Shape {
+		if index[i] < 0 || index[i] >= n {
+			panic(fmt.Sprintf("index %v out of bounds %v", index, a.Shape))
+		}
+		offset = offset * n + index[i]
+	}
+	return a.Data[offset]
+}
+
+/*
+ * The decoded response. The arrays are keyed by the attribute name, and the
+ * samples are always in the "data" attribute.
+ */
+type Result struct {
+	Header *Header
+	Arrays map[string]*Array
+}
+
+/*
+ * The incremental decoder, which reads the response from a stream, e.g. the
+ * body of /result/:pid/stream, and decodes the bundles as they arrive:
+ *
+ *     dec := decode.NewDecoder(body)
+ *     head, err := dec.Header()
+ *     ...
+ *     for {
+ *         err := dec.Next()
+ *         if err == io.EOF {
+ *             break
+ *         }
+ *         ...
+ *     }
+ *     result := dec.Result()
+ *
+ * The arrays of the result are allocated when the header is read, and filled
+ * in bundle by bundle, so the result can be inspected (and e.g. drawn) before
+ * the response is complete.
+ */
+type Decoder struct {
+	dec       *msgpack.Decoder
+	result    *Result
+	summary   statistics
+	/*
+	 * The number of bundles decoded, and the total number of bundles
+	 * (from the envelope)
+	 */
+	nbundles  int
+	total     int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder { dec: msgpack.NewDecoder(r) }
+}
+
+/*
+ * Read the header, and allocate the result. Reading the header is a no-op if
+ * it is already read.
+ */
+func (d *Decoder) Header() (*Header, error) {
+	if d.result != nil {
+		return d.result.Header, nil
+	}
+
+	envelope, err := d.dec.DecodeArrayLen()
+	if err != nil {
+		return nil, fmt.Errorf("bad envelope: %w", err)
+	}
+	if envelope != 2 {
+		msg := "bad envelope; expected array(2), was %d"
+		return nil, fmt.Errorf(msg, envelope)
+	}
+
+	head := &Header{}
+	if err := d.dec.Decode(head); err != nil {
+		return nil, fmt.Errorf("bad header: %w", err)
+	}
+
+	result, err := allocate(head)
+	if err != nil {
+		return nil, err
+	}
+
+	nbundles, err := d.dec.DecodeArrayLen()
+	if err != nil {
+		return nil, fmt.Errorf("bad bundles: %w", err)
+	}
+	if nbundles != head.Nbundles {
+		msg := "nbundles inconsistent; header.nbundles = %d, " +
+			"envelope.nbundles = %d"
+		return nil, fmt.Errorf(msg, head.Nbundles, nbundles)
+	}
+
+	d.result = result
+	d.total  = nbundles
+	return head, nil
+}
+
+/*
+ * Decode the next bundle into the result, reading the header first if
+ * necessary. Returns io.EOF when all bundles are decoded, and
+ * io.ErrUnexpectedEOF (wrapped) if the stream ends before that, e.g. when the
+ * process failed.
+ */
+func (d *Decoder) Next() error {
+	if _, err := d.Header(); err != nil {
+		return err
+	}
+	if d.nbundles == d.total {
+		return io.EOF
+	}
+
+	if err := extract(d.dec, d.result, &d.summary); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("bundle %d: %w", d.nbundles, err)
+	}
+	d.nbundles++
+	return nil
+}
+
+/*
+ * The number of bundles decoded so far, and the total
+ */
+func (d *Decoder) Progress() (int, int) {
+	return d.nbundles, d.total
+}
+
+/*
+ * The result, which is nil until the header is read, and complete when Next
+ * returns io.EOF.
+ */
+func (d *Decoder) Result() *Result {
+	return d.result
+}
+
+/*
+ * Decode all the remaining bundles.
+ */
+func (d *Decoder) Decode() (*Result, error) {
+	for {
+		err := d.Next()
+		if err == io.EOF {
+			return d.result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/*
+ * Decode a complete response.
+ */
+func Decode(doc []byte) (*Result, error) {
+	return NewDecoder(bytes.NewReader(doc)).Decode()
+}
+
+func allocate(head *Header) (*Result, error) {
+	switch head.Function {
+	case Slice, Curtain, Horizon, Subvolume, Traces, Fence, Statistics:
+	default:
+		return nil, fmt.Errorf("invalid function; was %d", int(head.Function))
+	}
+
+	if _, err := sampleSize(head.Format); err != nil {
+		return nil, err
+	}
+
+	shapes, err := head.SplitShapes()
+	if err != nil {
+		return nil, err
+	}
+
+	arrays := make(map[string]*Array, len(shapes))
+	for i, shape := range shapes {
+		size := 1
+		for _, n := range shape {
+			if n < 0 {
+				return nil, fmt.Errorf("bad shape %v", shape)
+			}
+			size *= n
+		}
+		arrays[head.Attributes[i]] = &Array {
+			Shape: shape,
+			Data:  make([]float32, size),
+		}
+	}
+	return &Result { Header: head, Arrays: arrays }, nil
+}
+
+func extract(dec *msgpack.Decoder, result *Result, summary *statistics) error {
+	switch result.Header.Function {
+	case Slice, Subvolume:
+		/*
+		 * The subvolume is packed as slice tiles, with one tile per x-line
+		 * of every fragment.
+		 */
+		return slice(dec, result)
+
+	case Curtain, Horizon, Traces, Fence:
+		return curtain(dec, result)
+
+	default:
+		return summary.merge(dec, result)
+	}
+}
+
+/*
+ * Get the output array of the attribute, or nil if the attribute is not in
+ * the header and should be skipped.
+ */
+func (r *Result) output(attribute string) *Array {
+	return r.Arrays[attribute]
+}
+
+/*
+ * The sample format only applies to the data, the attributes are always
+ * float32.
+ */
+func (r *Result) formatof(attribute string) (string, float64, float64) {
+	if attribute != "data" {
+		return "", 1, 0
+	}
+	return r.Header.Format, r.Header.Scale, r.Header.Offset
+}
+
+func slice(dec *msgpack.Decoder, result *Result) error {
+	if err := expectTuple(dec, 2); err != nil {
+		return err
+	}
+	attribute, err := dec.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	out := result.output(attribute)
+	if out == nil {
+		return dec.Skip()
+	}
+	format, scale, offset := result.formatof(attribute)
+	elemsize, _ := sampleSize(format)
+
+	ntiles, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	for t := 0; t < ntiles; t++ {
+		if err := expectTuple(dec, 6); err != nil {
+			return err
+		}
+		var slots [5]int
+		for k := range slots {
+			if slots[k], err = dec.DecodeInt(); err != nil {
+				return err
+			}
+		}
+		src, err := dec.DecodeBytes()
+		if err != nil {
+			return err
+		}
+
+		iterations   := slots[0]
+		chunkSize    := slots[1]
+		initialSkip  := slots[2]
+		superstride  := slots[3]
+		substride    := slots[4]
+		for i := 0; i < iterations; i++ {
+			s := elemsize * i * substride
+			d := i * superstride + initialSkip
+			if !inbounds(s, elemsize * chunkSize, len(src)) ||
+			   !inbounds(d, chunkSize, len(out.Data)) {
+				return fmt.Errorf("tile %d out of bounds", t)
+			}
+			decodeSamples(
+				src[s:s + elemsize * chunkSize],
+				format,
+				scale,
+				offset,
+				out.Data[d:d + chunkSize],
+			)
+		}
+	}
+	return nil
+}
+
+func curtain(dec *msgpack.Decoder, result *Result) error {
+	if err := expectTuple(dec, 6); err != nil {
+		return err
+	}
+	attribute, err := dec.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	size, err := dec.DecodeInt()
+	if err != nil {
+		return err
+	}
+	zlen, err := dec.DecodeInt()
+	if err != nil {
+		return err
+	}
+	var major, minor []int
+	if err := dec.Decode(&major); err != nil {
+		return err
+	}
+	if err := dec.Decode(&minor); err != nil {
+		return err
+	}
+	src, err := dec.DecodeBytes()
+	if err != nil {
+		return err
+	}
+
+	out := result.output(attribute)
+	if out == nil {
+		return nil
+	}
+	if len(major) < 2 * size || len(minor) < 2 * size {
+		msg := "bad curtain bundle; size = %d, len(major) = %d, len(minor) = %d"
+		return fmt.Errorf(msg, size, len(major), len(minor))
+	}
+
+	format, scale, offset := result.formatof(attribute)
+	elemsize, _ := sampleSize(format)
+	for n := 0; n < size; n++ {
+		ifst := major[n*2 + 0]
+		ilst := major[n*2 + 1]
+		zfst := minor[n*2 + 0]
+		zlst := minor[n*2 + 1]
+
+		chunksize := elemsize * (zlst - zfst)
+		for i := ifst; i < ilst; i++ {
+			s := chunksize * (i - ifst)
+			d := i * zlen + zfst
+			if !inbounds(s, chunksize, len(src)) ||
+			   !inbounds(d, zlst - zfst, len(out.Data)) {
+				return fmt.Errorf("trace %d out of bounds", i)
+			}
+			decodeSamples(
+				src[s:s + chunksize],
+				format,
+				scale,
+				offset,
+				out.Data[d:d + zlst - zfst],
+			)
+		}
+		if ilst > ifst {
+			src = src[chunksize * (ilst - ifst):]
+		}
+	}
+	return nil
+}
+
+/*
+ * Every bundle holds the statistics of a single task, which are merged into
+ * the summary. The output is re-written for every bundle, so that it is
+ * complete when the last bundle is processed. The output is laid out as:
+ *
+ *   [count, min, max, mean, rms, lo, hi, histogram...]
+ *
+ * where [lo, hi] is the range of the histogram. When no samples are counted,
+ * min, max, mean, and rms are NaN.
+ *
+ * The output is float32 like every other result, so count and the histogram
+ * are exact only up to 2^24 (16777216). Larger counts are rounded to the
+ * nearest float, i.e. they have a relative error of at most 2^-24.
+ */
+type statistics struct {
+	count     int64
+	min       float32
+	max       float32
+	sum       float64
+	sumsq     float64
+	lo        float64
+	hi        float64
+	histogram []int64
+}
+
+func (s *statistics) merge(dec *msgpack.Decoder, result *Result) error {
+	if err := expectTuple(dec, 9); err != nil {
+		return err
+	}
+	attribute, err := dec.DecodeString()
+	if err != nil {
+		return err
+	}
+
+	count, err := dec.DecodeInt64()
+	if err != nil {
+		return err
+	}
+	var slots [6]float64
+	for k := range slots {
+		if slots[k], err = dec.DecodeFloat64(); err != nil {
+			return err
+		}
+	}
+	var histogram []int64
+	if err := dec.Decode(&histogram); err != nil {
+		return err
+	}
+
+	out := result.output(attribute)
+	if out == nil {
+		return nil
+	}
+
+	if s.histogram == nil {
+		s.histogram = make([]int64, len(histogram))
+	}
+	if len(s.histogram) != len(histogram) {
+		msg := "inconsistent number of bins; expected %d, was %d"
+		return fmt.Errorf(msg, len(s.histogram), len(histogram))
+	}
+	if len(out.Data) < 7 + len(histogram) {
+		msg := "statistics output too small; len = %d, bins = %d"
+		return fmt.Errorf(msg, len(out.Data), len(histogram))
+	}
+
+	min, max := float32(slots[0]), float32(slots[1])
+	if count > 0 {
+		if s.count == 0 {
+			s.min = min
+			s.max = max
+		} else {
+			s.min = float32(math.Min(float64(s.min), float64(min)))
+			s.max = float32(math.Max(float64(s.max), float64(max)))
+		}
+	}
+
+	s.count += count
+	s.sum   += slots[2]
+	s.sumsq += slots[3]
+	s.lo     = slots[4]
+	s.hi     = slots[5]
+	for i, n := range histogram {
+		s.histogram[i] += n
+	}
+
+	nan := float32(math.NaN())
+	n := float64(s.count)
+	stats := []float32 { float32(s.count), nan, nan, nan, nan }
+	if s.count > 0 {
+		stats[1] = s.min
+		stats[2] = s.max
+		stats[3] = float32(s.sum / n)
+		stats[4] = float32(math.Sqrt(s.sumsq / n))
+	}
+	stats = append(stats, float32(s.lo), float32(s.hi))
+	for _, n := range s.histogram {
+		stats = append(stats, float32(n))
+	}
+	copy(out.Data, stats)
+	return nil
+}
+
+func expectTuple(dec *msgpack.Decoder, n int) error {
+	size, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if size != n {
+		return fmt.Errorf("expected %d slots, was %d", n, size)
+	}
+	return nil
+}
+
+func inbounds(start, n, size int) bool {
+	return start >= 0 && n >= 0 && start + n <= size
+}
+
+func sampleSize(format string) (int, error) {
+	switch format {
+	case "", "float32": return 4, nil
+	case "float16":     return 2, nil
+	case "int16":       return 2, nil
+	case "int8":        return 1, nil
+	default:
+		msg := "expected format float32, float16, int16, or int8, got %s"
+		return 0, fmt.Errorf(msg, format)
+	}
+}
+
+/*
+ * Decode the little-endian samples in src into dst, the inverse of
+ * one::encode. The integer formats are scaled as offset + scale * x.
+ */
+func decodeSamples(
+	src    []byte,
+	format string,
+	scale  float64,
+	offset float64,
+	dst    []float32,
+) {
+	le := binary.LittleEndian
+	switch format {
+	case "float16":
+		for i := range dst {
+			dst[i] = fromhalf(le.Uint16(src[2*i:]))
+		}
+	case "int16":
+		for i := range dst {
+			x := float64(int16(le.Uint16(src[2*i:])))
+			dst[i] = float32(offset + scale * x)
+		}
+	case "int8":
+		for i := range dst {
+			dst[i] = float32(offset + scale * float64(int8(src[i])))
+		}
+	default:
+		for i := range dst {
+			dst[i] = math.Float32frombits(le.Uint32(src[4*i:]))
+		}
+	}
+}
+
+func fromhalf(h uint16) float32 {
+	sign := uint32(h & 0x8000) << 16
+	exp  := uint32(h >> 10) & 0x1F
+	mant := uint32(h & 0x3FF)
+
+	if exp == 0 {
+		f := float32(math.Ldexp(float64(mant), -24))
+		if sign != 0 {
+			return -f
+		}
+		return f
+	}
+
+	var x uint32
+	if exp == 0x1F {
+		x = sign | 0x7F800000 | (mant << 13)
+	} else {
+		x = sign | ((exp + 127 - 15) << 23) | (mant << 13)
+	}
+	return math.Float32frombits(x)
+}
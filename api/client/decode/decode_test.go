@@ -0,0 +1,249 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func float32s(xs ...float32) []byte {
+	out := make([]byte, 4 * len(xs))
+	for i, x := range xs {
+		binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(x))
+	}
+	return out
+}
+
+func pack(t *testing.T, head map[string]interface{}, bundles ...interface{}) []byte {
+	head["nbundles"] = len(bundles)
+	doc, err := msgpack.Marshal([]interface{} { head, bundles })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return doc
+}
+
+func TestAxesSplitsIndex(t *testing.T) {
+	head := Header {
+		Ndims: 2,
+		Index: []int { 2, 3, 1, 2, 1, 2, 3 },
+	}
+	axes, err := head.Axes()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]int { { 1, 2 }, { 1, 2, 3 } }, axes)
+
+	head.Index = []int { 2, 3, 1, 2, 1 }
+	_, err = head.Axes()
+	assert.Error(t, err)
+}
+
+func TestDecodeSlice(t *testing.T) {
+	head := map[string]interface{} {
+		"pid":        "pid",
+		"function":   int(Slice),
+		"ndims":      3,
+		"index":      []int { 1, 2, 3, 10, 1, 2, 0, 4, 8 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 3, 1, 2, 3 },
+	}
+	/*
+	 * The two rows of the slice are written as one tile, with a padding
+	 * sample between them in the source.
+	 */
+	tile := []interface{} {
+		2, 3, 0, 3, 4,
+		float32s(0, 1, 2, -1, 3, 4, 5, -1),
+	}
+	bundle := []interface{} { "data", []interface{} { tile } }
+
+	result, err := Decode(pack(t, head, bundle))
+	assert.NoError(t, err)
+	assert.Equal(t, Slice, result.Header.Function)
+	assert.Equal(t, []int { 1, 2, 3 }, result.Arrays["data"].Shape)
+	expected := []float32 { 0, 1, 2, 3, 4, 5 }
+	assert.Equal(t, expected, result.Arrays["data"].Data)
+}
+
+func TestDecodeScaledSamples(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Slice),
+		"ndims":      3,
+		"index":      []int { 1, 1, 3, 10, 1, 0, 4, 8 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 3, 1, 1, 3 },
+		"format":     "int8",
+		"scale":      0.5,
+		"offset":     1.0,
+	}
+	tile := []interface{} { 1, 3, 0, 3, 3, []byte { 0, 2, 0xFE } }
+	bundle := []interface{} { "data", []interface{} { tile } }
+
+	result, err := Decode(pack(t, head, bundle))
+	assert.NoError(t, err)
+	assert.Equal(t, []float32 { 1, 2, 0 }, result.Arrays["data"].Data)
+}
+
+func TestDecodeCurtain(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Curtain),
+		"ndims":      3,
+		"index":      []int { 2, 2, 4, 1, 2, 5, 5, 0, 4, 8, 12 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 2, 2, 4 },
+	}
+	/*
+	 * Samples [1, 3) of both traces
+	 */
+	bundle := []interface{} {
+		"data", 1, 4, []int { 0, 2 }, []int { 1, 3 },
+		float32s(1, 2, 3, 4),
+	}
+
+	result, err := Decode(pack(t, head, bundle))
+	assert.NoError(t, err)
+	expected := []float32 { 0, 1, 2, 0, 0, 3, 4, 0 }
+	assert.Equal(t, expected, result.Arrays["data"].Data)
+}
+
+func TestDecodeMergesStatistics(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Statistics),
+		"attributes": []string { "data" },
+		"shapes":     []int { 1, 9 },
+	}
+	first  := []interface{} { "data", 2, 1.0, 3.0, 4.0, 10.0, 0.0, 4.0, []int { 1, 1 } }
+	second := []interface{} { "data", 2, 2.0, 4.0, 6.0, 20.0, 0.0, 4.0, []int { 0, 2 } }
+
+	result, err := Decode(pack(t, head, first, second))
+	assert.NoError(t, err)
+	expected := []float32 { 4, 1, 4, 2.5, float32(math.Sqrt(30.0 / 4)), 0, 4, 1, 3 }
+	assert.Equal(t, expected, result.Arrays["data"].Data)
+}
+
+/*
+ * Count and histogram are written as float32, and are only exact up to 2^24
+ */
+func TestDecodeRoundsLargeStatisticsCounts(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Statistics),
+		"attributes": []string { "data" },
+		"shapes":     []int { 1, 8 },
+	}
+	exact   := []interface{} { "data", 1 << 24, 0.0, 1.0, 0.0, 0.0, 0.0, 1.0, []int { 1 << 24 } }
+	rounded := []interface{} { "data", 1, 0.0, 1.0, 0.0, 0.0, 0.0, 1.0, []int { 1 } }
+
+	result, err := Decode(pack(t, head, exact))
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1 << 24), result.Arrays["data"].Data[0])
+	assert.Equal(t, float32(1 << 24), result.Arrays["data"].Data[7])
+
+	result, err = Decode(pack(t, head, exact, rounded))
+	assert.NoError(t, err)
+	assert.Equal(t, float32(1 << 24), result.Arrays["data"].Data[0])
+	assert.Equal(t, float32(1 << 24), result.Arrays["data"].Data[7])
+}
+
+func TestDecodeFailsOnInconsistentNbundles(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Statistics),
+		"attributes": []string { "data" },
+		"shapes":     []int { 1, 8 },
+		"nbundles":   1,
+	}
+	doc, _ := msgpack.Marshal([]interface{} { head, []interface{}{} })
+
+	_, err := Decode(doc)
+	assert.Error(t, err)
+}
+
+func TestDecodeFailsOnOutOfBoundsTile(t *testing.T) {
+	head := map[string]interface{} {
+		"function":   int(Slice),
+		"ndims":      3,
+		"index":      []int { 1, 1, 2, 10, 1, 0, 4 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 3, 1, 1, 2 },
+	}
+	tile := []interface{} { 1, 3, 0, 3, 3, float32s(0, 1, 2) }
+	bundle := []interface{} { "data", []interface{} { tile } }
+
+	_, err := Decode(pack(t, head, bundle))
+	assert.Error(t, err)
+}
+
+func TestArrayAtIsRowMajor(t *testing.T) {
+	a := Array {
+		Shape: []int { 2, 3 },
+		Data:  []float32 { 0, 1, 2, 3, 4, 5 },
+	}
+	assert.Equal(t, float32(1), a.At(0, 1))
+	assert.Equal(t, float32(5), a.At(1, 2))
+	assert.Panics(t, func() { a.At(0, 3) })
+}
+
+func twoTraces(t *testing.T) ([]byte, []byte) {
+	head := map[string]interface{} {
+		"function":   int(Traces),
+		"ndims":      3,
+		"index":      []int { 2, 2, 2, 1, 2, 5, 5, 0, 4 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 2, 2, 2 },
+	}
+	first  := []interface{} {
+		"data", 1, 2, []int { 0, 1 }, []int { 0, 2 }, float32s(1, 2),
+	}
+	second := []interface{} {
+		"data", 1, 2, []int { 1, 2 }, []int { 0, 2 }, float32s(3, 4),
+	}
+
+	doc := pack(t, head, first, second)
+	last, _ := msgpack.Marshal(second)
+	return doc[:len(doc) - len(last)], last
+}
+
+func TestDecoderIsIncremental(t *testing.T) {
+	prefix, last := twoTraces(t)
+	r, w := io.Pipe()
+	go w.Write(prefix)
+
+	dec := NewDecoder(r)
+	head, err := dec.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, Traces, head.Function)
+
+	assert.NoError(t, dec.Next())
+	expected := []float32 { 1, 2, 0, 0 }
+	assert.Equal(t, expected, dec.Result().Arrays["data"].Data)
+	done, total := dec.Progress()
+	assert.Equal(t, 1, done)
+	assert.Equal(t, 2, total)
+
+	go func() {
+		w.Write(last)
+		w.Close()
+	}()
+	assert.NoError(t, dec.Next())
+	assert.Equal(t, io.EOF, dec.Next())
+	expected = []float32 { 1, 2, 3, 4 }
+	assert.Equal(t, expected, dec.Result().Arrays["data"].Data)
+}
+
+func TestDecoderDetectsTruncatedStream(t *testing.T) {
+	prefix, _ := twoTraces(t)
+	dec := NewDecoder(bytes.NewReader(prefix))
+	assert.NoError(t, dec.Next())
+
+	err := dec.Next()
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "err = %v", err)
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+ * The errors reported by oneseismic, which mirror the errors of the server
+ * (internal.QueryE, internal.PermissionDeniedE etc.). Use errors.As to tell
+ * them apart:
+ *
+ *     var denied *client.PermissionDeniedError
+ *     if errors.As(err, &denied) {
+ *         // refresh token and try again
+ *     }
+ */
+
+/*
+ * The query is bad, e.g. out-of-range line numbers, a cube that does not
+ * exist, or a query that does not match the schema.
+ */
+type QueryError struct {
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+/*
+ * The token or shared access signature does not give access to the cube, or
+ * the key does not give access to the result.
+ */
+type PermissionDeniedError struct {
+	Message string
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return e.Message
+}
+
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Message
+}
+
+/*
+ * Something went wrong in oneseismic. The message is deliberately vague, and
+ * the details are in the server logs.
+ */
+type InternalError struct {
+	Message string
+}
+
+func (e *InternalError) Error() string {
+	return e.Message
+}
+
+/*
+ * A task of the process failed, and the process will never complete. This is
+ * the failure record from /status or the stream trailer.
+ */
+type FailedError struct {
+	Class    string `json:"class"`
+	Part     string `json:"part"`
+	Fragment string `json:"fragment,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf(
+		"process failed (%s) in part %s: %s",
+		e.Class,
+		e.Part,
+		e.Message,
+	)
+}
+
+var ErrCancelled = errors.New("process cancelled")
+
+/*
+ * Errors without a code are from the graphql engine itself, i.e. the query
+ * does not match the schema.
+ */
+func errorFromGraphQL(e graphqlError) error {
+	code, _ := e.Extensions["code"].(string)
+	switch code {
+	case "permission-denied":
+		return &PermissionDeniedError { Message: e.Message }
+	case "internal":
+		return &InternalError { Message: e.Message }
+	case "not-found":
+		return &NotFoundError { Message: e.Message }
+	default:
+		return &QueryError { Message: e.Message }
+	}
+}
+
+func errorFromStatus(status int, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &PermissionDeniedError { Message: msg }
+	case http.StatusBadRequest:
+		return &QueryError { Message: msg }
+	case http.StatusNotFound:
+		return &NotFoundError { Message: msg }
+	case http.StatusGone:
+		return ErrCancelled
+	default:
+		return &InternalError {
+			Message: fmt.Sprintf("%d %s", status, msg),
+		}
+	}
+}
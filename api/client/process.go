@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/equinor/oneseismic/api/client/decode"
+)
+
+/*
+ * A (possibly running) process, made from the promise returned by the graphql
+ * query. All requests for the process are authorized with the key in the
+ * promise, so processes can be handed to other programs without the token or
+ * signature used for the query.
+ */
+type Process struct {
+	client  *Client
+	promise Promise
+}
+
+func (c *Client) Process(promise *Promise) *Process {
+	return &Process { client: c, promise: *promise }
+}
+
+/*
+ * The process id, i.e. the last element of the promise url
+ */
+func (p *Process) Pid() string {
+	url := strings.TrimSuffix(p.promise.URL, "/")
+	return url[strings.LastIndex(url, "/") + 1:]
+}
+
+func (p *Process) Promise() Promise {
+	return p.promise
+}
+
+func (p *Process) request(
+	ctx    context.Context,
+	method string,
+	path   string,
+) (*http.Request, error) {
+	url := p.client.url(p.promise.URL + path)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer " + p.promise.Key)
+	return req, nil
+}
+
+/*
+ * The response of /result/:pid/status
+ */
+type Status struct {
+	/*
+	 * pending, working, finished, failed, cancelled
+	 */
+	Status   string       `json:"status"`
+	Location string       `json:"location"`
+	/*
+	 * The number of completed tasks of the process, as "done/total"
+	 */
+	Progress string       `json:"progress"`
+	Reason   *FailedError `json:"reason,omitempty"`
+}
+
+/*
+ * The status is final, and polling again will not change it
+ */
+func (s *Status) Done() bool {
+	switch s.Status {
+	case "finished", "failed", "cancelled":
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+ * The error of a failed or cancelled process, or nil
+ */
+func (s *Status) Err() error {
+	switch s.Status {
+	case "failed":
+		if s.Reason == nil {
+			return &FailedError { Class: "unknown" }
+		}
+		return s.Reason
+	case "cancelled":
+		return ErrCancelled
+	default:
+		return nil
+	}
+}
+
+func (p *Process) Status(ctx context.Context) (*Status, error) {
+	return p.status(ctx, 0)
+}
+
+/*
+ * The longest Wait asks the server to hold the status request. The server caps
+ * it to its own timeout, and servers without long-polling ignore it.
+ */
+const longPoll = 15 * time.Second
+
+/*
+ * Get the status, and ask the server to wait (up to wait) for the process to
+ * complete before responding.
+ */
+func (p *Process) status(ctx context.Context, wait time.Duration) (*Status, error) {
+	path := "/status"
+	if wait > 0 {
+		path += "?wait=" + wait.String()
+	}
+	req, err := p.request(ctx, "GET", path)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.do(req, http.StatusOK, http.StatusAccepted)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	status := &Status{}
+	if err := json.NewDecoder(res.Body).Decode(status); err != nil {
+		return nil, fmt.Errorf("bad status response: %w", err)
+	}
+	return status, nil
+}
+
+/*
+ * Poll the status until the process is done, or the context is cancelled.
+ * The server holds every poll until the process completes or the long-poll
+ * expires, and the poll interval is only the pause between polls. Returns the
+ * error of the process if it failed or was cancelled.
+ */
+func (p *Process) Wait(ctx context.Context) (*Status, error) {
+	interval := p.client.PollInterval
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+
+	for {
+		status, err := p.status(ctx, longPoll)
+		if err != nil {
+			return nil, err
+		}
+		if status.Done() {
+			return status, status.Err()
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+/*
+ * The result stream, which is decoded as it arrives. The decoder methods
+ * report the failure of the process (from the stream trailer) rather than an
+ * unexpected EOF when the process fails while streaming.
+ */
+type Stream struct {
+	*decode.Decoder
+	res *http.Response
+}
+
+/*
+ * Stream the result. The stream can be started before the process is done,
+ * and the bundles are read as they are completed by the workers. The stream
+ * must be closed.
+ */
+func (p *Process) Stream(ctx context.Context) (*Stream, error) {
+	req, err := p.request(ctx, "GET", "/stream")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream {
+		Decoder: decode.NewDecoder(res.Body),
+		res:     res,
+	}, nil
+}
+
+/*
+ * Replace the error of a stream that ended early with the failure in the
+ * trailer, if any. The trailer is only available when the body is read to
+ * the end, which it is if the decoder got an unexpected EOF.
+ */
+func (s *Stream) failure(err error) error {
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	trailer := s.res.Trailer.Get("Oneseismic-Error")
+	if trailer == "" {
+		return err
+	}
+
+	failure := &FailedError{}
+	if json.Unmarshal([]byte(trailer), failure) != nil {
+		return err
+	}
+	if failure.Class == "cancelled" {
+		return ErrCancelled
+	}
+	return failure
+}
+
+func (s *Stream) Header() (*decode.Header, error) {
+	head, err := s.Decoder.Header()
+	return head, s.failure(err)
+}
+
+func (s *Stream) Next() error {
+	return s.failure(s.Decoder.Next())
+}
+
+func (s *Stream) Decode() (*decode.Result, error) {
+	result, err := s.Decoder.Decode()
+	return result, s.failure(err)
+}
+
+func (s *Stream) Close() error {
+	return s.res.Body.Close()
+}
+
+/*
+ * Wait for the process to complete, then fetch and decode the result.
+ */
+func (p *Process) Result(ctx context.Context) (*decode.Result, error) {
+	if _, err := p.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	stream, err := p.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return stream.Decode()
+}
+
+/*
+ * Cancel the process, which is useful when the result is no longer needed.
+ */
+func (p *Process) Cancel(ctx context.Context) error {
+	req, err := p.request(ctx, "DELETE", "")
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
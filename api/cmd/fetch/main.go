@@ -2,15 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
-	"net/url"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/equinor/oneseismic/api/internal/queue"
+	blobstore "github.com/equinor/oneseismic/api/internal/storage"
 	"github.com/equinor/oneseismic/api/internal/util"
+	"github.com/equinor/oneseismic/api/internal/worker"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
 )
 
@@ -18,11 +21,16 @@ type opts struct {
 	redisURL          string
 	redisPassword     string
 	secureConnections bool
+	natsURL           string
 	group             string
 	stream            string
 	consumerid        string
 	jobs              int
 	retries           int
+	ack               bool
+	reclaimIdle       time.Duration
+	drainTimeout      time.Duration
+	storageURL        string
 }
 
 func parseopts() opts {
@@ -30,6 +38,8 @@ func parseopts() opts {
 	opts := opts{
 		redisURL:      os.Getenv("REDIS_URL"),
 		redisPassword: os.Getenv("REDIS_PASSWORD"),
+		storageURL:    os.Getenv("STORAGE_URL"),
+		natsURL:       os.Getenv("NATS_URL"),
 		group:         "fetch",
 		stream:        "jobs",
 	}
@@ -47,11 +57,29 @@ func parseopts() opts {
 		"Redis password. Empty by default",
 		"string",
 	)
+	getopt.FlagLong(
+		&opts.storageURL,
+		"storage-url",
+		0,
+		"Only serve tasks for this storage, e.g. file:///data/oneseismic. " +
+			"By default, tasks are served for any storage endpoint. " +
+			"Should be set for storage that does not check the user's " +
+			"access itself, i.e. anything but azure",
+		"string",
+	)
 	secureConnections := getopt.BoolLong(
 		"secureConnections",
 		0,
 		"Connect to Redis securely",
 	)
+	getopt.FlagLong(
+		&opts.natsURL,
+		"nats-url",
+		0,
+		"NATS URL, e.g. nats://host:4222. " +
+			"When set, NATS JetStream is used instead of redis",
+		"string",
+	)
 	getopt.FlagLong(
 		&opts.group,
 		"group",
@@ -91,9 +119,38 @@ func parseopts() opts {
 		"retries",
 		'r',
 		0,
-		"Max attempted retries when fetching from blobstore. Defaults to 0",
+		"Max attempted retries per fragment when fetching from blobstore. " +
+			"Only transient errors, like timeouts, 429 and 5xx, are " +
+			"retried, with exponential backoff. Defaults to 0",
 		"int",
 	)
+	ack := getopt.BoolLong(
+		"ack",
+		0,
+		"Consume tasks at-least-once. Tasks are acknowledged when the " +
+			"result is written, and tasks abandoned by other workers " +
+			"are reclaimed and run again. " +
+			"By default tasks are consumed at-most-once.",
+	)
+	reclaimIdle := getopt.DurationLong(
+		"reclaim-idle",
+		0,
+		time.Minute,
+		"With --ack, reclaim tasks that have been pending for this long. " +
+			"Should be well above the time it takes to run a task. " +
+			"Defaults to 1m",
+		"duration",
+	)
+	drainTimeout := getopt.DurationLong(
+		"drain-timeout",
+		0,
+		25 * time.Second,
+		"On SIGTERM, wait this long for the running tasks to complete " +
+			"before exiting. Should be less than the grace period of " +
+			"the orchestrator (30s by default in kubernetes). " +
+			"Defaults to 25s",
+		"duration",
+	)
 	getopt.Parse()
 
 	if *help {
@@ -107,106 +164,54 @@ func parseopts() opts {
 	opts.jobs = *jobs
 	opts.retries = *retries
 	opts.secureConnections = *secureConnections
-
-	return opts
-}
-
-func run(
-	storage redis.Cmdable,
-	fetch   *fetch,
-	retries int,
-	process map[string]interface{},
-) {
-	/*
-	 * Curiously, the XReadGroup/XStream values end up being map[string]string
-	 * effectively. This is detail of the go library where it uses ReadLine()
-	 * internally - redis uses byte strings as strings anyway.
-	 *
-	 * The type assertion is not checked and will panic. This is a good thing
-	 * as it should only happen when the redis library is updated to no longer
-	 * return strings, and crash oneseismic properly. This should catch such a
-	 * change early.
-	 */
-	pid  := process["pid" ].(string)
-	part := process["part"].(string)
-	body := process["task"].(string)
-	msg  := [][]byte{ []byte(pid), []byte(part), []byte(body) }
-	proc, err := exec(msg)
-	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
-		return
+	opts.ack = *ack
+	opts.reclaimIdle = *reclaimIdle
+	if opts.reclaimIdle <= 0 {
+		log.Fatalf("--reclaim-idle (= %v) must be positive", opts.reclaimIdle)
 	}
-	/*
-	 * Build the container-URL early, in case it should be broken,
-	 * so that no goroutines are scheduled before any sanity
-	 * checking of input.
-	 */
-	container, err := proc.container()
-	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
-		return
-	}
-
-	fragments := proc.fragments()
-	blobs := make([]*url.URL, len(fragments))
-	for i, id := range fragments {
-		blob, err := proc.blob(container, id)
-		if err != nil {
-			log.Printf("%s dropping bad process %v", proc.logpid(), err)
-			return
+	opts.drainTimeout = *drainTimeout
+	if opts.storageURL != "" {
+		if _, err := blobstore.OpenURL(opts.storageURL); err != nil {
+			log.Fatalf("Bad --storage-url: %v", err)
 		}
-		blobs[i] = blob
 	}
 
-	fq := fetch.mkqueue()
-	go proc.gather(storage, len(fragments), fq)
-	fetch.enqueue(proc.ctx, fq, blobs)
+	return opts
 }
 
 func main() {
 	opts := parseopts()
 
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
-	}
+	qopts := queue.DefaultOptions()
+	qopts.Stream      = opts.stream
+	qopts.Group       = opts.group
+	qopts.AtLeastOnce = opts.ack
+	qopts.ReclaimIdle = opts.reclaimIdle
 
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	q, err := queue.Open(queue.Connection {
+		RedisURL:          opts.redisURL,
+		RedisPassword:     opts.redisPassword,
+		SecureConnections: opts.secureConnections,
+		NatsURL:           opts.natsURL,
+	}, qopts)
+	if err != nil {
+		log.Fatalf("Unable to open queue: %v", err)
 	}
-	storage := redis.NewClient(redisOptions)
-	// TODO: err?
-	defer storage.Close()
 
 	ctx := context.Background()
 	/*
-	 * Always try to create the group and stream on start-up. The stream may
-	 * have already been created, but that is a soft error to be discarded. In
-	 * fact, the stream and group *probably* exists already because nodes
-	 * connect in parallel.
-	 *
-	 * The XGroupCreate command is really just a try-create and fits well here,
-	 * it offloads all the concurrency issues to redis. Consequently, this
-	 * program can immediately go into the work loop assuming that the stream
-	 * and group exists, without having to do any chatter or sync.
+	 * Always try to join the group on start-up, which creates the job queue
+	 * if needed. This program can then immediately go into the work loop,
+	 * without having to do any chatter or sync with the other workers.
 	 */
-	err := storage.XGroupCreateMkStream(ctx, opts.stream, opts.group, "0").Err()
+	err = q.Join(ctx, opts.consumerid)
 	if err != nil {
-		 // Check if the response is a redis error (= BUSYGROUP), which just
-		 // means the group already exists and nothing happens, or if it is a
-		 // network error or something
-		_, busygroup := err.(interface{RedisError()});
-		if !busygroup {
-			log.Fatalf(
-				"Unable to create group %s for stream %s: %v",
-				opts.group,
-				opts.stream,
-				err,
-			)
-		}
+		log.Fatalf(
+			"Unable to create group %s for stream %s: %v",
+			opts.group,
+			opts.stream,
+			err,
+		)
 	}
 	log.Printf(
 		"consumer %s in group %s connecting to stream %s",
@@ -215,73 +220,38 @@ func main() {
 		opts.stream,
 	)
 
-	// TODO: destroy consumers on shutdown
-	// All reads can re-use the same group-args
-	// NoAck is turned on - we can afford to fail requests and lose messages
-	// should a node crash.
-	args := redis.XReadGroupArgs {
-		Group:    opts.group,
-		Consumer: opts.consumerid,
-		Streams:  []string { opts.stream, ">", },
-		Count:    1,
-		NoAck:    true,
-	}
-
-	fetch := newFetch(opts.jobs)
-	fetch.startWorkers()
-
-	for {
-		msgs, err := storage.XReadGroup(ctx, &args).Result()
-		if err != nil {
-			log.Fatalf("Unable to read from redis: %v", err)
-		}
+	/*
+	 * Stop reading new tasks on SIGTERM, which is how kubernetes stops pods
+	 * on rolling deploys and scale-downs, or SIGINT, and drain the running
+	 * tasks before exiting.
+	 */
+	shutdown, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
 
-		go func() {
-			/*
-			 * Send a request-for-delete once the message has been read, in
-			 * order to stop the infinite growth of the job queue.
-			 *
-			 * This is the simplest solution that is correct [1] - the node
-			 * that gets a job also deletes it, which emulates a
-			 * fire-and-forget job queue. Unfortunately it also means more
-			 * traffic back to the central job queue node. In redis6.2 the
-			 * XTRIM MINID strategy is introduced, which opens up some
-			 * interesting strategies for cleaning up the job queue. This is
-			 * work for later though.
-			 *
-			 * [1] except in some crashing scenarios
-			 */
-			ids := make([]string, 0, 3)
-			for _, xmsg := range msgs {
-				for _, msg := range xmsg.Messages {
-					ids = append(ids, msg.ID)
-				}
-			}
-			err := storage.XDel(ctx, opts.stream, ids...).Err()
-			if err != nil {
-				log.Fatalf("Unable to XDEL: %v", err)
-			}
-		}()
+	/*
+	 * Restore the default signal handling on the first signal, so that a
+	 * second signal kills the worker immediately, rather than waiting for
+	 * the running tasks to drain.
+	 */
+	go func() {
+		<-shutdown.Done()
+		stop()
+	}()
 
-		/*
-		 * The redis interface is designed for asking for a set of messages per
-		 * XReadGroup command, but we really only ask for one [1]. The redis-go
-		 * API is is aware of this which means the message structure must be
-		 * unpacked with nested loops. As a consequence, the read-count can
-		 * be increased with little code change, but it also means more nested
-		 * loops.
-		 *
-		 * For ease of understanding, the loops can be ignored.
-		 *
-		 * [1] Instead opting for multiple fragments to download per message.
-		 *     This is a design decision from before redis streams, but it
-		 *     works well with redis streams too.
-		 */
-		for _, xmsg := range msgs {
-			for _, message := range xmsg.Messages {
-				// TODO: graceful shutdown and/or cancellation
-				run(storage, fetch, opts.retries, message.Values)
-			}
-		}
+	err = worker.Run(shutdown, q, worker.Config {
+		Consumer:     opts.consumerid,
+		Jobs:         opts.jobs,
+		Retries:      opts.retries,
+		AtLeastOnce:  opts.ack,
+		ReclaimIdle:  opts.reclaimIdle,
+		DrainTimeout: opts.drainTimeout,
+		StorageURL:   opts.storageURL,
+	})
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 }
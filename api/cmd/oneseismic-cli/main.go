@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/equinor/oneseismic/api/client"
+	"github.com/equinor/oneseismic/api/client/decode"
+	"github.com/equinor/oneseismic/api/internal/export"
+	"github.com/pborman/getopt/v2"
+)
+
+/*
+ * Command-line client for ad-hoc queries against a deployed oneseismic, e.g.
+ * to reproduce user-reported problems without writing python:
+ *
+ *     oneseismic-cli slice --cube <guid> --dim 0 --lineno 1234 -o out.npy
+ *     oneseismic-cli curtain --cube <guid> -o out.sgy --utm 451200,6781100 ...
+ *     oneseismic-cli status --key <key> result/<pid>
+ *
+ * The queries follow the same protocol as every other client: the graphql
+ * query returns a promise, the status is polled with the key in the promise
+ * until the process is done, and then the result is streamed and decoded.
+ *
+ * The options must come before the arguments (e.g. the curtain coordinates).
+ */
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command {
+	{ "slice",    "fetch a slice and write it to a file",          slice    },
+	{ "curtain",  "fetch a curtain and write it to a file",        curtain  },
+	{ "manifest", "print the line numbers and metadata of a cube", manifest },
+	{ "status",   "print the status of a process",                 status   },
+	{ "search",   "search the catalogue for cubes",                search   },
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: oneseismic-cli <command> [options]\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "    %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nSee oneseismic-cli <command> --help\n")
+}
+
+/*
+ * The options shared by all commands, for finding and authenticating with
+ * the oneseismic instance.
+ */
+type opts struct {
+	endpoint string
+	token    string
+	sas      string
+	verbose  bool
+}
+
+func commonopts(set *getopt.Set) *opts {
+	opts := &opts {
+		endpoint: os.Getenv("ONESEISMIC_ENDPOINT"),
+		token:    os.Getenv("ONESEISMIC_TOKEN"),
+		sas:      os.Getenv("ONESEISMIC_SAS"),
+	}
+
+	set.FlagLong(
+		&opts.endpoint,
+		"endpoint",
+		'e',
+		"oneseismic URL, e.g. https://oneseismic.example.com. " +
+			"Defaults to $ONESEISMIC_ENDPOINT",
+		"url",
+	)
+	set.FlagLong(
+		&opts.token,
+		"token",
+		0,
+		"Bearer token for the storage account. Defaults to $ONESEISMIC_TOKEN",
+		"string",
+	)
+	set.FlagLong(
+		&opts.sas,
+		"sas",
+		0,
+		"Shared access signature (query string) for the storage account. " +
+			"Defaults to $ONESEISMIC_SAS",
+		"string",
+	)
+	set.FlagLong(&opts.verbose, "verbose", 'v', "Log the progress to stderr")
+	return opts
+}
+
+/*
+ * Parse the command line, and exit on --help
+ */
+func parse(set *getopt.Set, args []string, parameters string) {
+	help := set.BoolLong("help", 0, "print this help text")
+	set.SetParameters(parameters)
+	set.SetProgram(fmt.Sprintf("oneseismic-cli %s", args[0]))
+	set.Parse(args)
+	if *help {
+		set.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+}
+
+func (o *opts) client() (*client.Client, error) {
+	if o.endpoint == "" {
+		return nil, fmt.Errorf("no endpoint; use --endpoint or $ONESEISMIC_ENDPOINT")
+	}
+	c := client.New(o.endpoint)
+	c.Token = o.token
+	c.Sas   = o.sas
+	return c, nil
+}
+
+func (o *opts) logf(format string, args ...interface{}) {
+	if o.verbose {
+		log.Printf(format, args...)
+	}
+}
+
+/*
+ * The options of the data commands (slice, curtain)
+ */
+type queryopts struct {
+	cube       string
+	output     string
+	format     string
+	attributes string
+	samples    string
+}
+
+func dataopts(set *getopt.Set) *queryopts {
+	opts := &queryopts {}
+	set.FlagLong(&opts.cube, "cube", 'c', "Cube ID (guid)", "guid")
+	set.FlagLong(
+		&opts.output,
+		"output",
+		'o',
+		"Output file. The format is chosen by the extension: " +
+			".npy, .csv, .sgy/.segy",
+		"file",
+	)
+	set.FlagLong(
+		&opts.format,
+		"output-format",
+		0,
+		"Output format (npy, csv, segy), for when --output has some " +
+			"other extension, or is - (stdout)",
+		"format",
+	)
+	set.FlagLong(
+		&opts.attributes,
+		"attributes",
+		'a',
+		"Comma-separated list of extra attributes, e.g. cdpx,cdpy",
+		"list",
+	)
+	set.FlagLong(
+		&opts.samples,
+		"sample-format",
+		0,
+		"Sample format on the wire (float32, float16, int16, int8)",
+		"format",
+	)
+	return opts
+}
+
+func (q *queryopts) check() error {
+	if q.cube == "" {
+		return fmt.Errorf("no cube; use --cube")
+	}
+	if q.output == "" {
+		return fmt.Errorf("no output; use --output")
+	}
+	_, err := q.writer()
+	return err
+}
+
+func (q *queryopts) opts() *client.Opts {
+	opts := &client.Opts {}
+	if q.attributes != "" {
+		opts.Attributes = strings.Split(q.attributes, ",")
+	}
+	if q.samples != "" {
+		opts.Format = &client.Format { Type: q.samples }
+	}
+	return opts
+}
+
+type writer func(w io.Writer, result *decode.Result) error
+
+func datasetWriter(write func(io.Writer, *export.Dataset) error) writer {
+	return func(w io.Writer, result *decode.Result) error {
+		ds, err := export.FromResult(result)
+		if err != nil {
+			return err
+		}
+		return write(w, ds)
+	}
+}
+
+func (q *queryopts) writer() (writer, error) {
+	format := q.format
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(q.output), ".")
+	}
+
+	switch strings.ToLower(format) {
+	case "npy":
+		return datasetWriter(export.WriteNpy), nil
+	case "csv":
+		return datasetWriter(export.WriteCSV), nil
+	case "sgy", "segy":
+		return writeSegy, nil
+	default:
+		msg := "unknown output format '%s'; use --output-format"
+		return nil, fmt.Errorf(msg, format)
+	}
+}
+
+/*
+ * Wait for the process, fetch the result, and write it to the output. If
+ * interrupted, the process is cancelled so that the workers do not keep
+ * fetching fragments for nobody.
+ */
+func (q *queryopts) fetch(
+	ctx  context.Context,
+	o    *opts,
+	proc *client.Process,
+) error {
+	o.logf("pid=%s", proc.Pid())
+	defer func() {
+		if ctx.Err() != nil {
+			o.logf("pid=%s interrupted, cancelling", proc.Pid())
+			timeout, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+			defer cancel()
+			proc.Cancel(timeout)
+		}
+	}()
+
+	status, err := proc.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	o.logf("pid=%s %s (%s)", proc.Pid(), status.Status, status.Progress)
+
+	stream, err := proc.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	result, err := stream.Decode()
+	if err != nil {
+		return err
+	}
+
+	write, err := q.writer()
+	if err != nil {
+		return err
+	}
+
+	if q.output == "-" {
+		return write(os.Stdout, result)
+	}
+	f, err := os.Create(q.output)
+	if err != nil {
+		return err
+	}
+	if err := write(f, result); err != nil {
+		f.Close()
+		return err
+	}
+	o.logf("wrote %s", q.output)
+	return f.Close()
+}
+
+func slice(args []string) error {
+	set  := getopt.New()
+	o    := commonopts(set)
+	q    := dataopts(set)
+	dim  := 0
+	line := 0
+	set.FlagLong(&dim, "dim", 'd', "Dimension to slice through (0, 1, 2)", "int")
+	set.FlagLong(
+		&line,
+		"lineno",
+		'l',
+		"Line number of the slice, or the index with --index",
+		"int",
+	)
+	byIndex := set.BoolLong(
+		"index",
+		0,
+		"Slice by index instead of line number",
+	)
+	parse(set, args, "")
+
+	if err := q.check(); err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cube := c.Cube(q.cube)
+	var proc *client.Process
+	if *byIndex {
+		proc, err = cube.SliceByIndex(ctx, dim, line, q.opts())
+	} else {
+		proc, err = cube.SliceByLineno(ctx, dim, line, q.opts())
+	}
+	if err != nil {
+		return err
+	}
+	return q.fetch(ctx, o, proc)
+}
+
+/*
+ * Parse the x,y pairs of the curtain
+ */
+func pairs(args []string) ([][2]float64, error) {
+	coords := make([][2]float64, 0, len(args))
+	for _, arg := range args {
+		xy := strings.Split(arg, ",")
+		if len(xy) != 2 {
+			return nil, fmt.Errorf("expected pair x,y, got '%s'", arg)
+		}
+		x, err := strconv.ParseFloat(xy[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad coordinate '%s': %w", arg, err)
+		}
+		y, err := strconv.ParseFloat(xy[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad coordinate '%s': %w", arg, err)
+		}
+		coords = append(coords, [2]float64 { x, y })
+	}
+	if len(coords) == 0 {
+		return nil, fmt.Errorf("no coordinates")
+	}
+	return coords, nil
+}
+
+func integral(coords [][2]float64) ([][2]int, error) {
+	out := make([][2]int, len(coords))
+	for i, xy := range coords {
+		for k := range xy {
+			if xy[k] != float64(int(xy[k])) {
+				return nil, fmt.Errorf("coordinate %v is not integral", xy)
+			}
+			out[i][k] = int(xy[k])
+		}
+	}
+	return out, nil
+}
+
+func curtain(args []string) error {
+	set := getopt.New()
+	o   := commonopts(set)
+	q   := dataopts(set)
+	byIndex := set.BoolLong(
+		"index",
+		0,
+		"The coordinates are (inline, crossline) indices",
+	)
+	byUTM := set.BoolLong(
+		"utm",
+		0,
+		"The coordinates are UTM (x, y), snapped to the nearest trace",
+	)
+	parse(set, args, "inline,crossline...")
+
+	if err := q.check(); err != nil {
+		return err
+	}
+	if *byIndex && *byUTM {
+		return fmt.Errorf("--index and --utm are mutually exclusive")
+	}
+	coords, err := pairs(set.Args())
+	if err != nil {
+		return err
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cube := c.Cube(q.cube)
+	var proc *client.Process
+	if *byUTM {
+		proc, err = cube.CurtainByUTM(ctx, coords, q.opts())
+	} else {
+		lines, lineserr := integral(coords)
+		if lineserr != nil {
+			return lineserr
+		}
+		if *byIndex {
+			proc, err = cube.CurtainByIndex(ctx, lines, q.opts())
+		} else {
+			proc, err = cube.CurtainByLineno(ctx, lines, q.opts())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return q.fetch(ctx, o, proc)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func manifest(args []string) error {
+	set := getopt.New()
+	o   := commonopts(set)
+	id  := ""
+	set.FlagLong(&id, "cube", 'c', "Cube ID (guid)", "guid")
+	parse(set, args, "")
+
+	if id == "" {
+		return fmt.Errorf("no cube; use --cube")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	query := `
+	query($id: ID!) {
+		cube(id: $id) {
+			id
+			filenameOnUpload
+			linenumbers
+			sampleValueMin
+			sampleValueMax
+		}
+	}`
+	var out struct {
+		Cube json.RawMessage `json:"cube"`
+	}
+	variables := map[string]interface{} { "id": id }
+	if err := c.Query(context.Background(), query, variables, &out); err != nil {
+		return err
+	}
+	return printJSON(out.Cube)
+}
+
+func status(args []string) error {
+	set := getopt.New()
+	o   := commonopts(set)
+	key := os.Getenv("ONESEISMIC_KEY")
+	set.FlagLong(
+		&key,
+		"key",
+		'k',
+		"The key of the promise. Defaults to $ONESEISMIC_KEY",
+		"string",
+	)
+	wait := set.BoolLong("wait", 'w', "Wait for the process to complete")
+	parse(set, args, "pid|url")
+
+	if set.NArgs() != 1 {
+		return fmt.Errorf("expected one pid or promise url, got %d", set.NArgs())
+	}
+	if key == "" {
+		return fmt.Errorf("no key; use --key or $ONESEISMIC_KEY")
+	}
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * Accept the bare pid, and the url as it is in the promise
+	 */
+	url := set.Arg(0)
+	if !strings.Contains(url, "/") {
+		url = fmt.Sprintf("result/%s", url)
+	}
+	proc := c.Process(&client.Promise { URL: url, Key: key })
+
+	var st *client.Status
+	if *wait {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		/*
+		 * A failed process is not an error here - the status (and the
+		 * reason) is what was asked for.
+		 */
+		st, err = proc.Wait(ctx)
+		if st != nil && st.Done() {
+			err = nil
+		}
+	} else {
+		st, err = proc.Status(context.Background())
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(st)
+}
+
+func search(args []string) error {
+	set := getopt.New()
+	o   := commonopts(set)
+	catalogue := os.Getenv("ONESEISMIC_CATALOGUE")
+	filename  := ""
+	point     := ""
+	first     := 100
+	set.FlagLong(
+		&catalogue,
+		"catalogue",
+		0,
+		"Catalogue URL. Defaults to $ONESEISMIC_CATALOGUE",
+		"url",
+	)
+	set.FlagLong(
+		&filename,
+		"filename",
+		'f',
+		"Only cubes uploaded from this (SEG-Y) file name",
+		"string",
+	)
+	set.FlagLong(
+		&point,
+		"point",
+		0,
+		"Only cubes that contain the point x,y",
+		"x,y",
+	)
+	set.FlagLong(&first, "first", 'n', "Return at most n cubes", "int")
+	parse(set, args, "")
+
+	if catalogue == "" {
+		return fmt.Errorf("no catalogue; use --catalogue or $ONESEISMIC_CATALOGUE")
+	}
+	o.endpoint = catalogue
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	variables := map[string]interface{} { "first": first }
+	if filename != "" {
+		variables["where"] = map[string]interface{} {
+			"eq": map[string]interface{} { "uploadFilename": filename },
+		}
+	}
+	if point != "" {
+		xy, err := pairs([]string { point })
+		if err != nil {
+			return err
+		}
+		variables["intersects"] = map[string]interface{} {
+			"point": map[string]interface{} { "x": xy[0][0], "y": xy[0][1] },
+		}
+	}
+
+	query := `
+	query($where: Filter, $intersects: Geometry, $first: Int) {
+		manifests(where: $where, intersects: $intersects, first: $first) {
+			guid
+			uploadFilename
+		}
+	}`
+	var out struct {
+		Manifests []struct {
+			Guid           string `json:"guid"`
+			UploadFilename string `json:"uploadFilename"`
+		} `json:"manifests"`
+	}
+	if err := c.Query(context.Background(), query, variables, &out); err != nil {
+		return err
+	}
+
+	for _, m := range out.Manifests {
+		fmt.Printf("%s\t%s\n", m.Guid, m.UploadFilename)
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("oneseismic-cli: ")
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	if name == "help" || name == "--help" || name == "-h" {
+		usage()
+		os.Exit(0)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(os.Args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", name)
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * Serve a 1x2x3 inline slice (inline 10, crosslines 1, 2, time 0, 4, 8) for
+ * the process "pid", like the query and result services do.
+ */
+func sliceServer(t *testing.T) *httptest.Server {
+	samples := make([]byte, 4 * 6)
+	for i := 0; i < 6; i++ {
+		bits := math.Float32bits(float32(i))
+		binary.LittleEndian.PutUint32(samples[4*i:], bits)
+	}
+	head := map[string]interface{} {
+		"pid":        "pid",
+		"function":   1,
+		"nbundles":   1,
+		"ndims":      3,
+		"index":      []int { 1, 2, 3, 10, 1, 2, 0, 4, 8 },
+		"labels":     []string { "inline", "crossline", "time" },
+		"attributes": []string { "data" },
+		"shapes":     []int { 3, 1, 2, 3 },
+	}
+	tile   := []interface{} { 1, 6, 0, 6, 6, samples }
+	bundle := []interface{} { "data", []interface{} { tile } }
+	doc, err := msgpack.Marshal([]interface{} { head, []interface{} { bundle } })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{
+			"data": {
+				"cube": {
+					"sliceByLineno": { "url": "result/pid", "key": "key" }
+				}
+			}
+		}`))
+	})
+	mux.HandleFunc("/result/pid/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{ "status": "finished", "progress": "1/1" }`))
+	})
+	mux.HandleFunc("/result/pid/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(doc)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSliceWritesSegy(t *testing.T) {
+	server := sliceServer(t)
+	output := filepath.Join(t.TempDir(), "out.sgy")
+
+	err := slice([]string {
+		"slice",
+		"-e", server.URL,
+		"-c", "guid",
+		"-d", "0",
+		"-l", "10",
+		"-o", output,
+	})
+	assert.NoError(t, err)
+
+	doc, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	f := readSegy(t, doc, 3)
+	assert.Len(t, f.traces, 2)
+	assert.Equal(t, int16(4), i16(f.binary, 3217 - 3200))
+	assert.Equal(t, int32(10), i32(f.traces[1], 189))
+	assert.Equal(t, int32(2),  i32(f.traces[1], 193))
+	assert.Equal(t, []float32 { 3, 4, 5 }, samples(f.traces[1]))
+}
+
+func TestWriterFromExtension(t *testing.T) {
+	for _, output := range []string { "a.npy", "a.csv", "a.sgy", "a.SEGY" } {
+		q := &queryopts { cube: "guid", output: output }
+		assert.NoError(t, q.check(), output)
+	}
+
+	q := &queryopts { cube: "guid", output: "a.txt" }
+	assert.Error(t, q.check())
+	q.format = "csv"
+	assert.NoError(t, q.check())
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/equinor/oneseismic/api/client/decode"
+)
+
+/*
+ * Write slices, curtains, and subvolumes as SEG-Y revision 2 [1], with IEEE
+ * float samples, for the tools that only read SEG-Y. Every (vertical) trace of
+ * the result is a trace in the file, with the inline and crossline in the
+ * standard positions (189, 193), and cdpx/cdpy (181, 185) if they were
+ * queried. Time slices are written as one-sample traces.
+ *
+ * The line numbers of the vertical axis are assumed to be in microseconds
+ * (time) or millimetres (depth), like the sample interval of the source SEG-Y
+ * file.
+ *
+ * [1] https://seg.org/Portals/0/SEG/News%20and%20Resources/Technical%20Standards/seg_y_rev2_0-mar2017.pdf
+ */
+
+const (
+	segyTextHeaderSize   = 3200
+	segyBinaryHeaderSize = 400
+	segyTraceHeaderSize  = 240
+	segyIEEEFloat        = 5
+)
+
+/*
+ * The traces of the result, i.e. the line numbers and index into the
+ * attributes (cdpx, ...) of every trace, and the vertical axis.
+ */
+type traces struct {
+	inlines    []int
+	crosslines []int
+	samples    []int
+}
+
+func segyTraces(result *decode.Result) (*traces, error) {
+	head := result.Header
+	axes, err := head.Axes()
+	if err != nil {
+		return nil, err
+	}
+	if len(axes) != 3 {
+		return nil, fmt.Errorf("segy: ndims = %d; want 3", len(axes))
+	}
+
+	t := &traces { samples: axes[2] }
+	switch head.Function {
+	case decode.Slice, decode.Subvolume:
+		for _, il := range axes[0] {
+			for _, xl := range axes[1] {
+				t.inlines    = append(t.inlines,    il)
+				t.crosslines = append(t.crosslines, xl)
+			}
+		}
+	case decode.Curtain, decode.Traces, decode.Fence:
+		t.inlines    = axes[0]
+		t.crosslines = axes[1]
+	default:
+		return nil, fmt.Errorf("segy: %s is not supported", head.Function)
+	}
+
+	if len(t.inlines) != len(t.crosslines) {
+		msg := "segy: %d inlines, %d crosslines"
+		return nil, fmt.Errorf(msg, len(t.inlines), len(t.crosslines))
+	}
+	data := result.Arrays["data"]
+	if data == nil || len(data.Data) != len(t.inlines) * len(t.samples) {
+		return nil, fmt.Errorf("segy: data does not match the line numbers")
+	}
+	if len(t.samples) > math.MaxInt16 {
+		return nil, fmt.Errorf("segy: %d samples per trace", len(t.samples))
+	}
+	return t, nil
+}
+
+/*
+ * The sample interval, which must be regular
+ */
+func (t *traces) interval() (int, error) {
+	if len(t.samples) < 2 {
+		return 0, nil
+	}
+	dt := t.samples[1] - t.samples[0]
+	for i := 1; i < len(t.samples); i++ {
+		if t.samples[i] - t.samples[i - 1] != dt {
+			return 0, fmt.Errorf("segy: irregular sampling %v", t.samples)
+		}
+	}
+	if dt <= 0 || dt > math.MaxInt16 {
+		return 0, fmt.Errorf("segy: sample interval %d out of range", dt)
+	}
+	return dt, nil
+}
+
+func textHeader(result *decode.Result) []byte {
+	lines := []string {
+		fmt.Sprintf("oneseismic %s, pid %s", result.Header.Function, result.Header.Pid),
+		"SEG-Y REV2.0 ASCII, IEEE float samples",
+		"inline 189-192, crossline 193-196, cdpx 181-184, cdpy 185-188",
+		"END TEXTUAL HEADER",
+	}
+
+	header := make([]byte, 0, segyTextHeaderSize)
+	for i := 0; i < 40; i++ {
+		line := ""
+		if i < len(lines) {
+			line = lines[i]
+		}
+		line = fmt.Sprintf("C%2d %s", i + 1, line)
+		if len(line) > 80 {
+			line = line[:80]
+		}
+		header = append(header, line + strings.Repeat(" ", 80 - len(line))...)
+	}
+	return header
+}
+
+/*
+ * Get the attribute value (e.g. cdpx) of the trace, as a coordinate scaled by
+ * 100, so that centimetres are preserved.
+ */
+func coordinate(result *decode.Result, attribute string, trace int) int32 {
+	array := result.Arrays[attribute]
+	if array == nil || trace >= len(array.Data) {
+		return 0
+	}
+	return int32(math.Round(float64(array.Data[trace]) * 100))
+}
+
+func writeSegy(w io.Writer, result *decode.Result) error {
+	t, err := segyTraces(result)
+	if err != nil {
+		return err
+	}
+	dt, err := t.interval()
+	if err != nil {
+		return err
+	}
+	nsamples := len(t.samples)
+
+	be  := binary.BigEndian
+	out := bufio.NewWriter(w)
+	out.Write(textHeader(result))
+
+	/*
+	 * The header offsets are 1-based, relative to the start of the binary
+	 * and trace headers.
+	 */
+	binheader := make([]byte, segyBinaryHeaderSize)
+	be.PutUint16(binheader[3217 - 3201:], uint16(dt))
+	be.PutUint16(binheader[3221 - 3201:], uint16(nsamples))
+	be.PutUint16(binheader[3225 - 3201:], segyIEEEFloat)
+	/* revision 2.0, fixed-length traces, no extended textual headers */
+	binheader[3501 - 3201] = 2
+	binheader[3502 - 3201] = 0
+	be.PutUint16(binheader[3503 - 3201:], 1)
+	be.PutUint16(binheader[3505 - 3201:], 0)
+	out.Write(binheader)
+
+	/* the coordinates are scaled by 1/100 */
+	scalar := int16(-100)
+	data := result.Arrays["data"].Data
+	header := make([]byte, segyTraceHeaderSize)
+	samples := make([]byte, 4 * nsamples)
+	for trace := range t.inlines {
+		for i := range header {
+			header[i] = 0
+		}
+		be.PutUint32(header[1 - 1:],   uint32(trace + 1))
+		be.PutUint32(header[5 - 1:],   uint32(trace + 1))
+		be.PutUint16(header[71 - 1:],  uint16(scalar))
+		be.PutUint16(header[109 - 1:], uint16(int16(t.samples[0] / 1000)))
+		be.PutUint16(header[115 - 1:], uint16(nsamples))
+		be.PutUint16(header[117 - 1:], uint16(dt))
+		be.PutUint32(header[181 - 1:], uint32(coordinate(result, "cdpx", trace)))
+		be.PutUint32(header[185 - 1:], uint32(coordinate(result, "cdpy", trace)))
+		be.PutUint32(header[189 - 1:], uint32(int32(t.inlines[trace])))
+		be.PutUint32(header[193 - 1:], uint32(int32(t.crosslines[trace])))
+
+		trc := data[trace * nsamples : (trace + 1) * nsamples]
+		for i, x := range trc {
+			be.PutUint32(samples[4*i:], math.Float32bits(x))
+		}
+
+		out.Write(header)
+		if _, err := out.Write(samples); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/client/decode"
+)
+
+/*
+ * A 1x3x2 inline slice, with the cdpx/cdpy of every trace
+ */
+func sliceResult() *decode.Result {
+	return &decode.Result {
+		Header: &decode.Header {
+			Pid:        "pid",
+			Function:   decode.Slice,
+			Ndims:      3,
+			Index:      []int { 1, 3, 2, 9961, 1961, 1962, 1963, 4000, 8000 },
+			Attributes: []string { "data", "cdpx", "cdpy" },
+		},
+		Arrays: map[string]*decode.Array {
+			"data": {
+				Shape: []int { 1, 3, 2 },
+				Data:  []float32 { 0, 1, 2, 3, 4, 5 },
+			},
+			"cdpx": {
+				Shape: []int { 1, 3 },
+				Data:  []float32 { 10.5, 20.25, 30 },
+			},
+			"cdpy": {
+				Shape: []int { 1, 3 },
+				Data:  []float32 { 100, 200, 300.75 },
+			},
+		},
+	}
+}
+
+/*
+ * Read the SEG-Y written by writeSegy, with the (1-based) byte positions of
+ * the standard, so that the test does not share the offset arithmetic of the
+ * writer.
+ */
+type segyFile struct {
+	text   string
+	binary []byte
+	traces [][]byte
+}
+
+func readSegy(t *testing.T, doc []byte, nsamples int) segyFile {
+	tracesize := 240 + 4 * nsamples
+	if len(doc) < 3600 || (len(doc) - 3600) % tracesize != 0 {
+		t.Fatalf("bad file size %d for %d samples", len(doc), nsamples)
+	}
+	f := segyFile {
+		text:   string(doc[:3200]),
+		binary: doc[3200:3600],
+	}
+	for pos := 3600; pos < len(doc); pos += tracesize {
+		f.traces = append(f.traces, doc[pos : pos + tracesize])
+	}
+	return f
+}
+
+func i16(b []byte, pos int) int16 {
+	return int16(binary.BigEndian.Uint16(b[pos - 1:]))
+}
+
+func i32(b []byte, pos int) int32 {
+	return int32(binary.BigEndian.Uint32(b[pos - 1:]))
+}
+
+func samples(trace []byte) []float32 {
+	xs := make([]float32, 0)
+	for pos := 241; pos <= len(trace); pos += 4 {
+		xs = append(xs, math.Float32frombits(uint32(i32(trace, pos))))
+	}
+	return xs
+}
+
+func TestSegyHeaders(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, writeSegy(&out, sliceResult()))
+	f := readSegy(t, out.Bytes(), 2)
+
+	/* 40 lines of 80 characters, in ASCII */
+	assert.True(t, strings.HasPrefix(f.text, "C 1 oneseismic"), f.text[:80])
+	assert.Equal(t, "C40 ", f.text[39 * 80 : 39 * 80 + 4])
+	assert.NotContains(t, f.text, "\n")
+
+	/* interval, samples per trace, IEEE float, revision 2.0, fixed length */
+	bin := f.binary
+	assert.Equal(t, int16(4000), i16(bin, 3217 - 3200))
+	assert.Equal(t, int16(2),    i16(bin, 3221 - 3200))
+	assert.Equal(t, int16(5),    i16(bin, 3225 - 3200))
+	assert.Equal(t, byte(2),     bin[3501 - 3201])
+	assert.Equal(t, byte(0),     bin[3502 - 3201])
+	assert.Equal(t, int16(1),    i16(bin, 3503 - 3200))
+	assert.Equal(t, int16(0),    i16(bin, 3505 - 3200))
+}
+
+func TestSegyTraces(t *testing.T) {
+	var out bytes.Buffer
+	result := sliceResult()
+	assert.NoError(t, writeSegy(&out, result))
+	f := readSegy(t, out.Bytes(), 2)
+	assert.Len(t, f.traces, 3)
+
+	crosslines := []int32   { 1961, 1962, 1963 }
+	cdpx       := []int32   { 1050, 2025, 3000 }
+	cdpy       := []int32   { 10000, 20000, 30075 }
+	for i, trace := range f.traces {
+		assert.Equal(t, int32(i + 1),    i32(trace, 1))
+		assert.Equal(t, int16(-100),     i16(trace, 71))
+		assert.Equal(t, int16(4),        i16(trace, 109))
+		assert.Equal(t, int16(2),        i16(trace, 115))
+		assert.Equal(t, int16(4000),     i16(trace, 117))
+		assert.Equal(t, cdpx[i],         i32(trace, 181))
+		assert.Equal(t, cdpy[i],         i32(trace, 185))
+		assert.Equal(t, int32(9961),     i32(trace, 189))
+		assert.Equal(t, crosslines[i],   i32(trace, 193))
+
+		expected := result.Arrays["data"].Data[2 * i : 2 * i + 2]
+		assert.Equal(t, expected, samples(trace))
+	}
+}
+
+func TestSegyCurtain(t *testing.T) {
+	result := &decode.Result {
+		Header: &decode.Header {
+			Function:   decode.Curtain,
+			Ndims:      3,
+			Index:      []int { 2, 2, 3, 9961, 9963, 1961, 1963, 0, 4, 8 },
+			Attributes: []string { "data" },
+		},
+		Arrays: map[string]*decode.Array {
+			"data": {
+				Shape: []int { 2, 3 },
+				Data:  []float32 { 0, 1, 2, 3, 4, 5 },
+			},
+		},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, writeSegy(&out, result))
+	f := readSegy(t, out.Bytes(), 3)
+	assert.Len(t, f.traces, 2)
+	assert.Equal(t, int32(9963), i32(f.traces[1], 189))
+	assert.Equal(t, int32(1963), i32(f.traces[1], 193))
+	/* no cdpx/cdpy queried */
+	assert.Equal(t, int32(0),    i32(f.traces[1], 181))
+	assert.Equal(t, []float32 { 3, 4, 5 }, samples(f.traces[1]))
+}
+
+func TestSegyRejectsIrregularSampling(t *testing.T) {
+	result := sliceResult()
+	result.Header.Index = []int { 1, 1, 3, 9961, 1961, 0, 4, 12 }
+	result.Arrays["data"].Data = []float32 { 0, 1, 2 }
+
+	var out bytes.Buffer
+	assert.Error(t, writeSegy(&out, result))
+}
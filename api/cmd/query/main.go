@@ -1,16 +1,16 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
+	"log"
 	"os"
 
 	"github.com/equinor/oneseismic/api/api"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/storage"
 	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
 )
 
@@ -20,8 +20,12 @@ type opts struct {
 	redisURL          string
 	redisPassword     string
 	secureConnections bool
+	natsURL           string
 	signkey           string
 	port              string
+	authserver        string
+	audience          string
+	noAuth            bool
 }
 
 func parseopts() opts {
@@ -31,7 +35,10 @@ func parseopts() opts {
 		storageURL:    os.Getenv("STORAGE_URL"),
 		redisURL:      os.Getenv("REDIS_URL"),
 		redisPassword: os.Getenv("REDIS_PASSWORD"),
+		natsURL:       os.Getenv("NATS_URL"),
 		signkey:       os.Getenv("SIGN_KEY"),
+		authserver:    os.Getenv("AUTHSERVER"),
+		audience:      os.Getenv("AUDIENCE"),
 	}
 
 	getopt.FlagLong(
@@ -45,7 +52,9 @@ func parseopts() opts {
 		&opts.storageURL,
 		"storage-url",
 		0,
-		"Storage URL, e.g. https://<account>.blob.core.windows.net",
+		"Storage URL, e.g. https://<account>.blob.core.windows.net. " +
+			"The scheme selects the storage backend: https (azure), " +
+			"file, s3, or s3+https (S3-compatible)",
 		"string",
 	)
 	getopt.FlagLong(
@@ -67,6 +76,14 @@ func parseopts() opts {
 		0,
 		"Connect to Redis securely",
 	)
+	getopt.FlagLong(
+		&opts.natsURL,
+		"nats-url",
+		0,
+		"NATS URL, e.g. nats://host:4222. " +
+			"When set, NATS JetStream is used instead of redis",
+		"string",
+	)
 	getopt.FlagLong(
 		&opts.signkey,
 		"sign-key",
@@ -82,6 +99,30 @@ func parseopts() opts {
 		"Port to start server on. Defaults to 8080",
 	)
 
+	getopt.FlagLong(
+		&opts.authserver,
+		"authserver",
+		0,
+		"OpenID Connect discovery server. If set, requests must carry a " +
+			"valid access token. Required for storage that does not " +
+			"check the user's access itself, i.e. anything but azure",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.audience,
+		"audience",
+		0,
+		"Application (client) ID, the expected audience of access tokens",
+		"string",
+	)
+	noAuth := getopt.BoolLong(
+		"no-auth",
+		0,
+		"Allow storage that does not check the user's access without " +
+			"--authserver, i.e. anyone who can reach the service can read " +
+			"every cube. Only use for single-user, local deployments",
+	)
+
 	getopt.Parse()
 	if *help {
 		getopt.Usage()
@@ -89,84 +130,47 @@ func parseopts() opts {
 	}
 
 	opts.secureConnections = *secureConnections
+	opts.noAuth = *noAuth
 	return opts
 }
 
-/*
- * Configuration for this instance of oneseismic for user-controlled clients
- *
- * Oneseismic does not really have a good concept of logged in users, sessions
- * etc. Rather, oneseismic gets tokens (in the Authorization header) or query
- * parameters (shared access signatures) that are to query blob storage. Users
- * can obtain such tokens or signatures as they see fit.
- *
- * The clientconfig struct and the /config endpoint are meant for sharing
- * oneseismic instance and company specific configurations with clients. While
- * only auth stuff is included now, it's a natural place to add more client
- * configuration parameters later e.g. performance hints, max/min latency.
- */
-type clientconfig struct {
-	appid      string
-	scopes     []string
-	defaultStorageResource string
-}
-
-func (c *clientconfig) Get(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, gin.H {
-		/*
-		 * oneseismic's app-id
-		 */
-		"client_id": c.appid,
-		/*
-		 * The scopes (permissions) that oneseismic requests in order to
-		 * function
-		 */
-		"scopes": c.scopes,
-
-		/*
-		 * The default storage account resource URL, e.g.
-		 * https://<acc>.blob.core.windows.net. While most of the oneseismic
-		 * infrastructure doesn't mandate it, it will be overwhelmingly likely
-		 * that one oneseismic instance maps to a single storage account.
-		 * Having the "backing resource" programmatically available to users
-		 * makes for pretty programs, since it is sufficient to specify the
-		 * oneseismic instance and query the rest from there.
-		 */
-		"default-storage-resource": c.defaultStorageResource,
-	})
-}
-
 func main() {
 	opts := parseopts()
 
-	keyring := auth.MakeKeyring([]byte(opts.signkey))
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
+	hasAuthserver := opts.authserver != ""
+	err := storage.CheckServiceAccess(opts.storageURL, hasAuthserver, opts.noAuth)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	keyring := auth.MakeKeyring([]byte(opts.signkey))
+	q, err := queue.Open(queue.Connection {
+		RedisURL:          opts.redisURL,
+		RedisPassword:     opts.redisPassword,
+		SecureConnections: opts.secureConnections,
+		NatsURL:           opts.natsURL,
+	}, queue.DefaultOptions())
+	if err != nil {
+		log.Fatalf("Unable to open queue: %v", err)
 	}
-	cmdable := redis.NewClient(redisOptions)
 
-	scheduler := api.NewScheduler(cmdable)
+	scheduler := api.NewQueueScheduler(q)
+
 	gql := api.MakeGraphQL(&keyring, opts.storageURL, scheduler)
 
-	cfg := clientconfig {
-		appid: opts.clientID,
-		scopes: []string{
-			fmt.Sprintf("api://%s/One.Read", opts.clientID),
-		},
-		defaultStorageResource: opts.storageURL,
-	}
+	cfg := api.MakeClientConfig(opts.clientID, opts.storageURL)
 
 	app := gin.Default()
 	
 	graphql := app.Group("/graphql")
+	if opts.authserver != "" {
+		provider := auth.GetJwksProvider(opts.authserver)
+		graphql.Use(auth.JWTvalidation(
+			opts.authserver,
+			opts.audience,
+			provider.KeyFunc,
+		))
+	}
 	graphql.Use(util.GeneratePID)
 	graphql.GET( "", gql.Get)
 	graphql.POST("", gql.Post)
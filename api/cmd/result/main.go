@@ -1,17 +1,17 @@
 package main
 
 import (
-	"crypto/tls"
+	"log"
 	"os"
 	"time"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
 
 	"github.com/equinor/oneseismic/api/api"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/queue"
 	"github.com/equinor/oneseismic/api/internal/util"
 )
 
@@ -19,6 +19,7 @@ type opts struct {
 	redisURL          string
 	redisPassword     string
 	secureConnections bool
+	natsURL           string
 	signkey           string
 	port              string
 }
@@ -28,6 +29,7 @@ func parseopts() opts {
 	opts := opts{
 		redisURL:      os.Getenv("REDIS_URL"),
 		redisPassword: os.Getenv("REDIS_PASSWORD"),
+		natsURL:       os.Getenv("NATS_URL"),
 		signkey:       os.Getenv("SIGN_KEY"),
 	}
 
@@ -59,6 +61,14 @@ func parseopts() opts {
 		0,
 		"Connect to Redis securely",
 	)
+	getopt.FlagLong(
+		&opts.natsURL,
+		"nats-url",
+		0,
+		"NATS URL, e.g. nats://host:4222. " +
+			"When set, NATS JetStream is used instead of redis",
+		"string",
+	)
 
 	opts.port = "8080"
 	getopt.FlagLong(
@@ -83,21 +93,19 @@ func main() {
 
 	keyring := auth.MakeKeyring([]byte(opts.signkey))
 
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
-	}
-
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	q, err := queue.Open(queue.Connection {
+		RedisURL:          opts.redisURL,
+		RedisPassword:     opts.redisPassword,
+		SecureConnections: opts.secureConnections,
+		NatsURL:           opts.natsURL,
+	}, queue.DefaultOptions())
+	if err != nil {
+		log.Fatalf("Unable to open queue: %v", err)
 	}
 
 	result := api.Result{
 		Timeout: time.Second * 15,
-		Storage: redis.NewClient(redisOptions),
+		Queue:   q,
 		Keyring: &keyring,
 	}
 
@@ -108,5 +116,6 @@ func main() {
 	results.GET("/:pid", result.Get)
 	results.GET("/:pid/stream", result.Stream)
 	results.GET("/:pid/status", result.Status)
+	results.DELETE("/:pid", result.Cancel)
 	app.Run(fmt.Sprintf(":%s", opts.port))
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/equinor/oneseismic/api/api"
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/storage"
+	"github.com/equinor/oneseismic/api/internal/util"
+	"github.com/equinor/oneseismic/api/internal/worker"
+	"github.com/gin-gonic/gin"
+	"github.com/pborman/getopt/v2"
+)
+
+/*
+ * The all-in-one oneseismic server, which runs the query (/graphql, /config),
+ * the result (/result) and a pool of fetch workers in one process, on one
+ * port. This is meant for development and small installations, where running
+ * the services separately behind a reverse proxy is a lot of moving parts for
+ * little gain.
+ *
+ * Without --redis-url or --nats-url the job queue and results are kept in
+ * memory, and nothing but the storage is needed. With redis or NATS, more
+ * workers (cmd/fetch) can be added to the same queue.
+ */
+type opts struct {
+	clientID          string
+	storageURL        string
+	redisURL          string
+	redisPassword     string
+	secureConnections bool
+	natsURL           string
+	signkey           string
+	port              string
+	authserver        string
+	audience          string
+	noAuth            bool
+	jobs              int
+	retries           int
+	drainTimeout      time.Duration
+}
+
+func parseopts() opts {
+	help := getopt.BoolLong("help", 0, "print this help text")
+	opts := opts{
+		clientID:      os.Getenv("CLIENT_ID"),
+		storageURL:    os.Getenv("STORAGE_URL"),
+		redisURL:      os.Getenv("REDIS_URL"),
+		redisPassword: os.Getenv("REDIS_PASSWORD"),
+		natsURL:       os.Getenv("NATS_URL"),
+		signkey:       os.Getenv("SIGN_KEY"),
+		authserver:    os.Getenv("AUTHSERVER"),
+		audience:      os.Getenv("AUDIENCE"),
+	}
+
+	getopt.FlagLong(
+		&opts.clientID,
+		"client-id",
+		0,
+		"Client ID for on-behalf tokens",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.storageURL,
+		"storage-url",
+		0,
+		"Storage URL, e.g. https://<account>.blob.core.windows.net. " +
+			"The scheme selects the storage backend: https (azure), " +
+			"file, s3, or s3+https (S3-compatible)",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.redisURL,
+		"redis-url",
+		0,
+		"Redis URL (host:port). " +
+			"By default, the job queue and results are kept in memory",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.redisPassword,
+		"redis-password",
+		0,
+		"Redis password. Empty by default",
+		"string",
+	)
+	secureConnections := getopt.BoolLong(
+		"secureConnections",
+		0,
+		"Connect to Redis securely",
+	)
+	getopt.FlagLong(
+		&opts.natsURL,
+		"nats-url",
+		0,
+		"NATS URL, e.g. nats://host:4222. " +
+			"When set, NATS JetStream is used instead of redis",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.signkey,
+		"sign-key",
+		0,
+		"Signing key used for response authorization tokens. " +
+			"By default a random key is generated on start-up",
+		"string",
+	)
+	opts.port = "8080"
+	getopt.FlagLong(
+		&opts.port,
+		"port",
+		0,
+		"Port to start server on. Defaults to 8080",
+	)
+	getopt.FlagLong(
+		&opts.authserver,
+		"authserver",
+		0,
+		"OpenID Connect discovery server. If set, requests must carry a " +
+			"valid access token. Required for storage that does not " +
+			"check the user's access itself, i.e. anything but azure",
+		"string",
+	)
+	getopt.FlagLong(
+		&opts.audience,
+		"audience",
+		0,
+		"Application (client) ID, the expected audience of access tokens",
+		"string",
+	)
+	noAuth := getopt.BoolLong(
+		"no-auth",
+		0,
+		"Allow storage that does not check the user's access without " +
+			"--authserver, i.e. anyone who can reach the service can read " +
+			"every cube. Only use for single-user, local deployments",
+	)
+	jobs := getopt.IntLong(
+		"jobs",
+		'j',
+		30,
+		"Allow N concurrent connections at once. Defaults to 30",
+		"int",
+	)
+	retries := getopt.IntLong(
+		"retries",
+		'r',
+		0,
+		"Max attempted retries per fragment when fetching from blobstore. " +
+			"Only transient errors, like timeouts, 429 and 5xx, are " +
+			"retried, with exponential backoff. Defaults to 0",
+		"int",
+	)
+	drainTimeout := getopt.DurationLong(
+		"drain-timeout",
+		0,
+		25 * time.Second,
+		"On SIGTERM, wait this long for the running tasks to complete " +
+			"before exiting. Defaults to 25s",
+		"duration",
+	)
+
+	getopt.Parse()
+	if *help {
+		getopt.Usage()
+		os.Exit(0)
+	}
+
+	opts.secureConnections = *secureConnections
+	opts.noAuth = *noAuth
+	opts.jobs = *jobs
+	opts.retries = *retries
+	opts.drainTimeout = *drainTimeout
+	return opts
+}
+
+/*
+ * Open the queue shared by the query, result and the workers.
+ */
+func openQueue(opts opts) queue.Queue {
+	qopts := queue.DefaultOptions()
+	if opts.natsURL == "" && opts.redisURL == "" {
+		log.Printf("no --redis-url or --nats-url; using in-memory queue")
+		return queue.NewMemory(qopts)
+	}
+
+	q, err := queue.Open(queue.Connection {
+		RedisURL:          opts.redisURL,
+		RedisPassword:     opts.redisPassword,
+		SecureConnections: opts.secureConnections,
+		NatsURL:           opts.natsURL,
+	}, qopts)
+	if err != nil {
+		log.Fatalf("Unable to open queue: %v", err)
+	}
+	return q
+}
+
+func main() {
+	opts := parseopts()
+
+	hasAuthserver := opts.authserver != ""
+	err := storage.CheckServiceAccess(opts.storageURL, hasAuthserver, opts.noAuth)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	/*
+	 * The query and result services share the keyring in this process, so
+	 * the key only needs to be stable if other result services should
+	 * accept the tokens.
+	 */
+	signkey := []byte(opts.signkey)
+	if len(signkey) == 0 {
+		signkey = make([]byte, 32)
+		if _, err := rand.Read(signkey); err != nil {
+			log.Fatalf("Unable to generate sign key: %v", err)
+		}
+	}
+	keyring := auth.MakeKeyring(signkey)
+
+	q := openQueue(opts)
+	consumer := fmt.Sprintf("consumer:%s", util.MakePID())
+	if err := q.Join(context.Background(), consumer); err != nil {
+		log.Fatalf("Unable to join the job queue: %v", err)
+	}
+
+	scheduler := api.NewQueueScheduler(q)
+	gql := api.MakeGraphQL(&keyring, opts.storageURL, scheduler)
+	cfg := api.MakeClientConfig(opts.clientID, opts.storageURL)
+	result := api.Result{
+		Timeout: time.Second * 15,
+		Queue:   q,
+		Keyring: &keyring,
+	}
+
+	app := gin.Default()
+
+	graphql := app.Group("/graphql")
+	if opts.authserver != "" {
+		provider := auth.GetJwksProvider(opts.authserver)
+		graphql.Use(auth.JWTvalidation(
+			opts.authserver,
+			opts.audience,
+			provider.KeyFunc,
+		))
+	}
+	graphql.Use(util.GeneratePID)
+	graphql.GET( "", gql.Get)
+	graphql.POST("", gql.Post)
+
+	results := app.Group("/result")
+	results.Use(auth.ResultAuth(&keyring))
+	results.Use(util.Compression())
+	results.GET("/:pid", result.Get)
+	results.GET("/:pid/stream", result.Stream)
+	results.GET("/:pid/status", result.Status)
+	results.DELETE("/:pid", result.Cancel)
+
+	app.GET("/config", cfg.Get)
+
+	shutdown, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
+
+	/*
+	 * The workers stop reading tasks on shutdown, and drain the running
+	 * ones, so that the processes already scheduled complete.
+	 */
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		err := worker.Run(shutdown, q, worker.Config {
+			Consumer:     consumer,
+			Jobs:         opts.jobs,
+			Retries:      opts.retries,
+			DrainTimeout: opts.drainTimeout,
+			StorageURL:   opts.storageURL,
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}()
+
+	server := &http.Server {
+		Addr:    fmt.Sprintf(":%s", opts.port),
+		Handler: app,
+	}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("%v", err)
+		}
+	}()
+
+	<-shutdown.Done()
+	/*
+	 * Restore the default signal handling, so that a second signal kills the
+	 * server immediately.
+	 */
+	stop()
+	<-drained
+
+	/*
+	 * The results of the drained tasks are still being streamed to clients,
+	 * which are given a little more time to finish.
+	 */
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Unable to shut down server: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/equinor/oneseismic/api
 go 1.16
 
 require (
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v0.21.1
 	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v0.3.0
 	github.com/auth0/go-jwt-middleware/v2 v2.0.0
 	github.com/dgraph-io/ristretto v0.1.0
@@ -12,8 +13,10 @@ require (
 	github.com/google/uuid v1.2.0
 	github.com/graph-gophers/graphql-go v1.3.0
 	github.com/jackc/pgx/v4 v4.15.0
+	github.com/nats-io/nats-server/v2 v2.9.0
+	github.com/nats-io/nats.go v1.17.0
 	github.com/pborman/getopt/v2 v2.1.0
-	github.com/stretchr/testify v1.7.0
+	github.com/stretchr/testify v1.7.1
 	github.com/vmihailenco/msgpack/v5 v5.2.3
 	go.uber.org/zap v1.13.0
 )
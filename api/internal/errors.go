@@ -4,6 +4,14 @@ import (
 	"net/http"
 )
 
+/*
+ * The errors that are reported to users. In graphql responses, the kind of
+ * error is the code in the error extensions, so that clients can tell e.g. a
+ * bad query from missing permissions without parsing the message:
+ *
+ *     { "message": "Forbidden", "extensions": { "code": "permission-denied" } }
+ */
+
 type InternalE struct {
 	msg string
 }
@@ -20,6 +28,10 @@ func (ie *InternalE) Error() string {
 	return ie.msg
 }
 
+func (ie *InternalE) Extensions() map[string]interface{} {
+	return map[string]interface{} { "code": "internal" }
+}
+
 type PermissionDeniedE struct {
 	msg string
 }
@@ -36,6 +48,10 @@ func (pd *PermissionDeniedE) Error() string {
 	return pd.msg
 }
 
+func (pd *PermissionDeniedE) Extensions() map[string]interface{} {
+	return map[string]interface{} { "code": "permission-denied" }
+}
+
 type QueryE struct {
 	msg string
 }
@@ -48,6 +64,10 @@ func (qe *QueryE) Error() string {
 	return qe.msg
 }
 
+func (qe *QueryE) Extensions() map[string]interface{} {
+	return map[string]interface{} { "code": "query" }
+}
+
 type NotFoundE struct {
 }
 
@@ -58,3 +78,7 @@ func NewNotFoundError() *NotFoundE {
 func (nf *NotFoundE) Error() string {
 	return "Not found"
 }
+
+func (nf *NotFoundE) Extensions() map[string]interface{} {
+	return map[string]interface{} { "code": "not-found" }
+}
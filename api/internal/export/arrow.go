@@ -0,0 +1,457 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+ * The Apache Arrow IPC streaming format [1], as a "long" table with one row
+ * per sample. Every dimension and coordinate is a column, broadcast to the
+ * samples, followed by the data column, so e.g. an inline slice is the
+ * columns
+ *
+ *     crossline, time, cdpx, cdpy, data
+ *
+ * This is the tidy layout that arrow::read_ipc_stream (R), pyarrow and pandas
+ * work best with. The function and the dataset attributes (e.g. the inline of
+ * an inline slice) are the schema metadata.
+ *
+ * There is no arrow library in the go dependencies, so the messages are
+ * written with a minimal flatbuffer builder, which only supports what the
+ * Schema and RecordBatch messages need.
+ *
+ * [1] https://arrow.apache.org/docs/format/Columnar.html#ipc-streaming-format
+ */
+
+/*
+ * The maximum number of rows in a record batch. The table is split into
+ * multiple batches, so that the full table is never materialized in memory
+ * at once.
+ */
+const arrowBatchSize = 1 << 16
+
+const (
+	/* MetadataVersion.V5 */
+	arrowVersion = 4
+
+	/* MessageHeader */
+	arrowSchema      = 1
+	arrowRecordBatch = 3
+
+	/* Type */
+	arrowInt           = 2
+	arrowFloatingPoint = 3
+
+	/* Precision */
+	arrowSingle = 1
+	arrowDouble = 2
+)
+
+/*
+ * A flatbuffer builder. Flatbuffers are built back to front, so that objects
+ * are always written before the (forward) offsets that refer to them. The
+ * buffer is kept reversed, and objects are referred to by their distance from
+ * the end of the buffer.
+ */
+type fbuilder struct {
+	rev []byte
+}
+
+func (b *fbuilder) size() int {
+	return len(b.rev)
+}
+
+func (b *fbuilder) prepend(p []byte) {
+	for i := len(p) - 1; i >= 0; i-- {
+		b.rev = append(b.rev, p[i])
+	}
+}
+
+/*
+ * Pad so that the buffer is n-aligned after prepending additional bytes.
+ */
+func (b *fbuilder) align(n, additional int) {
+	for (len(b.rev) + additional) % n != 0 {
+		b.rev = append(b.rev, 0)
+	}
+}
+
+func (b *fbuilder) uint8(x uint8) {
+	b.rev = append(b.rev, x)
+}
+
+func (b *fbuilder) uint16(x uint16) {
+	b.align(2, 2)
+	var p [2]byte
+	binary.LittleEndian.PutUint16(p[:], x)
+	b.prepend(p[:])
+}
+
+func (b *fbuilder) uint32(x uint32) {
+	b.align(4, 4)
+	var p [4]byte
+	binary.LittleEndian.PutUint32(p[:], x)
+	b.prepend(p[:])
+}
+
+func (b *fbuilder) uint64(x uint64) {
+	b.align(8, 8)
+	var p [8]byte
+	binary.LittleEndian.PutUint64(p[:], x)
+	b.prepend(p[:])
+}
+
+/*
+ * Prepend an offset to the object at (distance-from-end) target. The offset
+ * is relative to where it is stored.
+ */
+func (b *fbuilder) offset(target int) {
+	b.align(4, 4)
+	b.uint32(uint32(b.size() + 4 - target))
+}
+
+func (b *fbuilder) string(s string) int {
+	b.align(4, len(s) + 1)
+	b.uint8(0)
+	b.prepend([]byte(s))
+	b.uint32(uint32(len(s)))
+	return b.size()
+}
+
+func (b *fbuilder) offsets(targets []int) int {
+	b.align(4, 4 * len(targets))
+	for i := len(targets) - 1; i >= 0; i-- {
+		b.offset(targets[i])
+	}
+	b.uint32(uint32(len(targets)))
+	return b.size()
+}
+
+/*
+ * A vector of structs of two longs, i.e. FieldNode and Buffer.
+ */
+func (b *fbuilder) pairs(xs [][2]int64) int {
+	b.align(8, 16 * len(xs))
+	for i := len(xs) - 1; i >= 0; i-- {
+		b.uint64(uint64(xs[i][1]))
+		b.uint64(uint64(xs[i][0]))
+	}
+	b.uint32(uint32(len(xs)))
+	return b.size()
+}
+
+/*
+ * A table field. The write function prepends the value, and is responsible
+ * for its alignment.
+ */
+type fbfield struct {
+	id    int
+	write func()
+}
+
+func (b *fbuilder) table(fields ...fbfield) int {
+	start := b.size()
+	nfields := 0
+	for _, f := range fields {
+		if f.id + 1 > nfields {
+			nfields = f.id + 1
+		}
+	}
+
+	positions := make([]int, nfields)
+	for i := len(fields) - 1; i >= 0; i-- {
+		fields[i].write()
+		positions[fields[i].id] = b.size()
+	}
+
+	/*
+	 * The table starts with the offset to its vtable, which is written
+	 * immediately before the table. The vtable is the sequence of uint16:
+	 *
+	 *     vtable size, table size, field offsets...
+	 */
+	vtsize := 4 + 2 * nfields
+	b.align(4, 4)
+	b.uint32(uint32(vtsize))
+	table := b.size()
+
+	for i := nfields - 1; i >= 0; i-- {
+		if positions[i] == 0 {
+			b.uint16(0)
+		} else {
+			b.uint16(uint16(table - positions[i]))
+		}
+	}
+	b.uint16(uint16(table - start))
+	b.uint16(uint16(vtsize))
+	return table
+}
+
+func (b *fbuilder) finish(root int) []byte {
+	b.align(8, 4)
+	b.offset(root)
+	out := make([]byte, len(b.rev))
+	for i, x := range b.rev {
+		out[len(out) - 1 - i] = x
+	}
+	return out
+}
+
+func (b *fbuilder) int16field(id int, x int16) fbfield {
+	return fbfield { id: id, write: func() { b.uint16(uint16(x)) } }
+}
+
+func (b *fbuilder) int32field(id int, x int32) fbfield {
+	return fbfield { id: id, write: func() { b.uint32(uint32(x)) } }
+}
+
+func (b *fbuilder) int64field(id int, x int64) fbfield {
+	return fbfield { id: id, write: func() { b.uint64(uint64(x)) } }
+}
+
+func (b *fbuilder) uint8field(id int, x uint8) fbfield {
+	return fbfield { id: id, write: func() { b.uint8(x) } }
+}
+
+func (b *fbuilder) offsetfield(id int, target int) fbfield {
+	return fbfield { id: id, write: func() { b.offset(target) } }
+}
+
+/*
+ * The arrow type (union tag and table) of the column
+ */
+func (b *fbuilder) arrowType(data interface{}) (uint8, int) {
+	switch data.(type) {
+	case []float32:
+		return arrowFloatingPoint, b.table(b.int16field(0, arrowSingle))
+	case []float64:
+		return arrowFloatingPoint, b.table(b.int16field(0, arrowDouble))
+	default:
+		return arrowInt, b.table(
+			b.int32field(0, 32),
+			/* is_signed */
+			b.uint8field(1, 1),
+		)
+	}
+}
+
+func (b *fbuilder) keyvalues(kvs [][2]string) int {
+	tables := make([]int, 0, len(kvs))
+	for _, kv := range kvs {
+		key   := b.string(kv[0])
+		value := b.string(kv[1])
+		tables = append(tables, b.table(
+			b.offsetfield(0, key),
+			b.offsetfield(1, value),
+		))
+	}
+	return b.offsets(tables)
+}
+
+func (b *fbuilder) message(kind uint8, header int, bodylen int64) []byte {
+	return b.finish(b.table(
+		b.int16field(0, arrowVersion),
+		b.uint8field(1, kind),
+		b.offsetfield(2, header),
+		b.int64field(3, bodylen),
+	))
+}
+
+func arrowSchemaMessage(ds *Dataset, columns []Variable) []byte {
+	b := &fbuilder{}
+	fields := make([]int, 0, len(columns))
+	for _, column := range columns {
+		name := b.string(column.Name)
+		kind, datatype := b.arrowType(column.Data)
+		/*
+		 * Readers require the children, even for primitive types.
+		 */
+		children := b.offsets(nil)
+		fields = append(fields, b.table(
+			b.offsetfield(0, name),
+			/* nullable = false */
+			b.uint8field(1, 0),
+			b.uint8field(2, kind),
+			b.offsetfield(3, datatype),
+			b.offsetfield(5, children),
+		))
+	}
+	fieldvec := b.offsets(fields)
+
+	metadata := [][2]string { { "function", ds.Function } }
+	for _, attr := range ds.Attributes {
+		value := strconv.FormatFloat(attr.Value, 'g', -1, 64)
+		metadata = append(metadata, [2]string { attr.Name, value })
+	}
+	kvs := b.keyvalues(metadata)
+
+	schema := b.table(
+		/* endianness = little */
+		b.int16field(0, 0),
+		b.offsetfield(1, fieldvec),
+		b.offsetfield(2, kvs),
+	)
+	return b.message(arrowSchema, schema, 0)
+}
+
+func arrowRecordBatchMessage(
+	nrows   int,
+	buffers [][2]int64,
+	bodylen int64,
+) []byte {
+	b := &fbuilder{}
+	nodes := make([][2]int64, len(buffers) / 2)
+	for i := range nodes {
+		/* length, null count */
+		nodes[i] = [2]int64 { int64(nrows), 0 }
+	}
+	nodevec   := b.pairs(nodes)
+	buffervec := b.pairs(buffers)
+	batch := b.table(
+		b.int64field(0, int64(nrows)),
+		b.offsetfield(1, nodevec),
+		b.offsetfield(2, buffervec),
+	)
+	return b.message(arrowRecordBatch, batch, bodylen)
+}
+
+/*
+ * Write the encapsulated message, i.e. the continuation marker, the metadata
+ * length, the metadata and the body. The metadata from the builder is always
+ * 8-byte aligned.
+ */
+func writeArrowMessage(w io.Writer, metadata []byte, body []byte) error {
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(metadata); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+/*
+ * The index function of the variable for the rows of the long table, i.e. all
+ * the combinations of the dataset dimensions in C order. Variables that do not
+ * span all dimensions are repeated.
+ */
+func (ds *Dataset) rowindex(v *Variable) func(row int) int {
+	/*
+	 * The stride of every dataset dimension in the rows, and in the
+	 * variable (zero for the dimensions the variable does not span).
+	 */
+	ndims := len(ds.Dimensions)
+	rowstrides := make([]int, ndims)
+	varstrides := make([]int, ndims)
+	rowstride, varstride := 1, 1
+	for i := ndims - 1; i >= 0; i-- {
+		dim := ds.Dimensions[i]
+		rowstrides[i] = rowstride
+		rowstride *= dim.Size
+		for _, name := range v.Dims {
+			if name == dim.Name {
+				varstrides[i] = varstride
+				varstride *= dim.Size
+			}
+		}
+	}
+
+	return func(row int) int {
+		i := 0
+		for d, dim := range ds.Dimensions {
+			i += ((row / rowstrides[d]) % dim.Size) * varstrides[d]
+		}
+		return i
+	}
+}
+
+/*
+ * Gather the values of the variable for the rows [fst, lst) of the table,
+ * as little-endian bytes.
+ */
+func (ds *Dataset) gather(v *Variable, fst, lst int) []byte {
+	index := ds.rowindex(v)
+
+	le := binary.LittleEndian
+	switch xs := v.Data.(type) {
+	case []float32:
+		out := make([]byte, 4 * (lst - fst))
+		for row := fst; row < lst; row++ {
+			le.PutUint32(out[4*(row - fst):], math.Float32bits(xs[index(row)]))
+		}
+		return out
+	case []float64:
+		out := make([]byte, 8 * (lst - fst))
+		for row := fst; row < lst; row++ {
+			le.PutUint64(out[8*(row - fst):], math.Float64bits(xs[index(row)]))
+		}
+		return out
+	case []int32:
+		out := make([]byte, 4 * (lst - fst))
+		for row := fst; row < lst; row++ {
+			le.PutUint32(out[4*(row - fst):], uint32(xs[index(row)]))
+		}
+		return out
+	default:
+		panic(fmt.Sprintf("arrow: unsupported column type %T", v.Data))
+	}
+}
+
+func WriteArrow(w io.Writer, ds *Dataset) error {
+	columns := append(append([]Variable{}, ds.Coords...), ds.Data)
+	nrows := 1
+	for _, dim := range ds.Dimensions {
+		nrows *= dim.Size
+	}
+
+	out := bufio.NewWriter(w)
+	if err := writeArrowMessage(out, arrowSchemaMessage(ds, columns), nil); err != nil {
+		return err
+	}
+
+	for fst := 0; fst < nrows; fst += arrowBatchSize {
+		lst := fst + arrowBatchSize
+		if lst > nrows {
+			lst = nrows
+		}
+
+		/*
+		 * Every column has two buffers, the validity bitmap, which is
+		 * empty as there are no nulls, and the values. The buffers are
+		 * padded to 8 bytes.
+		 */
+		body := make([]byte, 0)
+		buffers := make([][2]int64, 0, 2 * len(columns))
+		for i := range columns {
+			values := ds.gather(&columns[i], fst, lst)
+			buffers = append(buffers,
+				[2]int64 { int64(len(body)), 0 },
+				[2]int64 { int64(len(body)), int64(len(values)) },
+			)
+			body = append(body, values...)
+			for len(body) % 8 != 0 {
+				body = append(body, 0)
+			}
+		}
+
+		metadata := arrowRecordBatchMessage(lst - fst, buffers, int64(len(body)))
+		if err := writeArrowMessage(out, metadata, body); err != nil {
+			return err
+		}
+	}
+
+	/* end-of-stream, i.e. the continuation marker and zero length */
+	if err := writeArrowMessage(out, nil, nil); err != nil {
+		return err
+	}
+	return out.Flush()
+}
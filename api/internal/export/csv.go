@@ -0,0 +1,86 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+/*
+ * Comma-separated values, as a long table like the arrow format: one row per
+ * sample, with a column for every coordinate and the data. The dataset
+ * attributes, e.g. the inline of an inline slice, are columns with the same
+ * value in every row, so that tables from different queries can be
+ * concatenated.
+ *
+ * This is meant for small results and for tools that read nothing else
+ * (spreadsheets, awk), as every sample is written as text.
+ */
+func WriteCSV(w io.Writer, ds *Dataset) error {
+	variables := append(append([]Variable{}, ds.Coords...), ds.Data)
+	names := make([]string, 0, len(variables) + len(ds.Attributes))
+	for _, v := range variables[:len(variables) - 1] {
+		names = append(names, v.Name)
+	}
+	for _, attr := range ds.Attributes {
+		names = append(names, attr.Name)
+	}
+	names = append(names, ds.Data.Name)
+
+	attributes := make([]string, len(ds.Attributes))
+	for i, attr := range ds.Attributes {
+		attributes[i] = strconv.FormatFloat(attr.Value, 'g', -1, 64)
+	}
+
+	indices := make([]func(int) int, len(variables))
+	for i := range variables {
+		indices[i] = ds.rowindex(&variables[i])
+	}
+
+	nrows := 1
+	for _, dim := range ds.Dimensions {
+		nrows *= dim.Size
+	}
+
+	buffered := bufio.NewWriter(w)
+	out := csv.NewWriter(buffered)
+	if err := out.Write(names); err != nil {
+		return err
+	}
+
+	record := make([]string, len(names))
+	for row := 0; row < nrows; row++ {
+		for i, v := range variables {
+			/* the data is the last column, after the attributes */
+			col := i
+			if i == len(variables) - 1 {
+				col = len(names) - 1
+			}
+			record[col] = format(v.Data, indices[i](row))
+		}
+		copy(record[len(variables) - 1:], attributes)
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func format(data interface{}, i int) string {
+	switch xs := data.(type) {
+	case []float32:
+		return strconv.FormatFloat(float64(xs[i]), 'g', -1, 32)
+	case []float64:
+		return strconv.FormatFloat(xs[i], 'g', -1, 64)
+	case []int32:
+		return strconv.FormatInt(int64(xs[i]), 10)
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,446 @@
+package export
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/equinor/oneseismic/api/client/decode"
+)
+
+/*
+ * Export decoded results to general purpose, self-describing formats, so that
+ * clients without the oneseismic decoder (R, go, plain numpy, ...) can read
+ * them.
+ *
+ * The result is first described as a dataset, modelled after the xarray built
+ * by the python client (python/oneseismic/decoding/xarray.py), with a few
+ * changes to make the names valid identifiers in all formats:
+ *
+ *  - the trace axis of curtain, traces, fence, and horizon is "trace", not
+ *    "x, y"
+ *  - the fence UTM positions are "utm_x" and "utm_y"
+ *  - the histogram range of the statistics is the "lo" and "hi" attributes
+ *
+ * The samples are always the "data" variable.
+ */
+
+type Dimension struct {
+	Name string
+	Size int
+}
+
+type Variable struct {
+	Name string
+	/*
+	 * The dimensions of the variable, which are always a subset of the
+	 * dataset dimensions, in the same order.
+	 */
+	Dims []string
+	/*
+	 * []float32, []float64 or []int32, in C (row-major) order
+	 */
+	Data interface{}
+}
+
+type Attribute struct {
+	Name  string
+	Value float64
+}
+
+type Dataset struct {
+	Function   string
+	Dimensions []Dimension
+	Data       Variable
+	/*
+	 * The coordinates, i.e. the line numbers of the dimensions, and the
+	 * other attributes (e.g. cdpx, cdpy) of the result.
+	 */
+	Coords     []Variable
+	Attributes []Attribute
+}
+
+/*
+ * An output format. Write must only be called with datasets made by
+ * FromResult.
+ */
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	Write       func(w io.Writer, ds *Dataset) error
+}
+
+var Formats = []Format {
+	{
+		Name:        "npy",
+		ContentType: "application/x-npy",
+		Extension:   "npy",
+		Write:       WriteNpy,
+	},
+	{
+		Name:        "arrow",
+		ContentType: "application/vnd.apache.arrow.stream",
+		Extension:   "arrows",
+		Write:       WriteArrow,
+	},
+	{
+		Name:        "netcdf",
+		ContentType: "application/x-netcdf",
+		Extension:   "nc",
+		Write:       WriteNetCDF,
+	},
+}
+
+/*
+ * Look up the format by name, e.g. "npy", or content type, e.g.
+ * "application/x-npy".
+ */
+func Lookup(key string) (Format, bool) {
+	for _, format := range Formats {
+		if key == format.Name || key == format.ContentType {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+func (ds *Dataset) size(dim string) (int, bool) {
+	for _, d := range ds.Dimensions {
+		if d.Name == dim {
+			return d.Size, true
+		}
+	}
+	return 0, false
+}
+
+func (ds *Dataset) addDimension(name string, size int) {
+	ds.Dimensions = append(ds.Dimensions, Dimension { Name: name, Size: size })
+}
+
+func (ds *Dataset) addAttribute(name string, value float64) {
+	ds.Attributes = append(ds.Attributes, Attribute {
+		Name:  name,
+		Value: value,
+	})
+}
+
+func (ds *Dataset) addCoord(name string, dims []string, data interface{}) {
+	ds.Coords = append(ds.Coords, Variable {
+		Name: name,
+		Dims: dims,
+		Data: data,
+	})
+}
+
+func int32s(xs []int) []int32 {
+	out := make([]int32, len(xs))
+	for i, x := range xs {
+		out[i] = int32(x)
+	}
+	return out
+}
+
+func length(data interface{}) int {
+	switch xs := data.(type) {
+	case []float32: return len(xs)
+	case []float64: return len(xs)
+	case []int32:   return len(xs)
+	default:        return -1
+	}
+}
+
+/*
+ * The number of elements of a variable, from its dimensions.
+ */
+func (ds *Dataset) elements(v *Variable) int {
+	n := 1
+	for _, dim := range v.Dims {
+		size, _ := ds.size(dim)
+		n *= size
+	}
+	return n
+}
+
+/*
+ * Check that all variables are consistent with the dimensions, so that the
+ * writers can trust the dataset.
+ */
+func (ds *Dataset) validate() error {
+	names := make(map[string]bool)
+	variables := append([]Variable { ds.Data }, ds.Coords...)
+	for _, v := range variables {
+		if names[v.Name] {
+			return fmt.Errorf("variable %s defined more than once", v.Name)
+		}
+		names[v.Name] = true
+
+		last := -1
+		for _, dim := range v.Dims {
+			i := -1
+			for k, d := range ds.Dimensions {
+				if d.Name == dim {
+					i = k
+				}
+			}
+			if i <= last {
+				msg := "variable %s: dimension %s not in dataset, or out of order"
+				return fmt.Errorf(msg, v.Name, dim)
+			}
+			last = i
+		}
+
+		if n := length(v.Data); n != ds.elements(&v) {
+			msg := "variable %s: len = %d, want %d (dims = %v)"
+			return fmt.Errorf(msg, v.Name, n, ds.elements(&v), v.Dims)
+		}
+	}
+	return nil
+}
+
+/*
+ * The attributes of the result, other than the data
+ */
+func attributes(result *decode.Result) []string {
+	attrs := make([]string, 0, len(result.Header.Attributes))
+	for _, attr := range result.Header.Attributes {
+		if attr != "data" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+/*
+ * Remove all 1-length dimensions from the shape
+ */
+func squeeze(shape []int) []int {
+	out := make([]int, 0, len(shape))
+	for _, n := range shape {
+		if n != 1 {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+/*
+ * Describe a decoded result as a dataset.
+ */
+func FromResult(result *decode.Result) (*Dataset, error) {
+	head := result.Header
+	data, ok := result.Arrays["data"]
+	if !ok {
+		return nil, fmt.Errorf("result has no data attribute")
+	}
+
+	ds := &Dataset {
+		Function: head.Function.String(),
+		Data:     Variable { Name: "data", Data: data.Data },
+	}
+
+	var err error
+	switch head.Function {
+	case decode.Slice:
+		err = fromSlice(ds, result)
+	case decode.Curtain, decode.Traces, decode.Fence:
+		err = fromCurtain(ds, result)
+	case decode.Horizon:
+		err = fromHorizon(ds, result)
+	case decode.Subvolume:
+		err = fromSubvolume(ds, result)
+	case decode.Statistics:
+		err = fromStatistics(ds, result)
+	default:
+		err = fmt.Errorf("unknown function %s", head.Function)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ds.validate(); err != nil {
+		return nil, fmt.Errorf("bad %s result: %w", ds.Function, err)
+	}
+	return ds, nil
+}
+
+/*
+ * The axes and labels of the result, which must be the same number as the
+ * dimensions of the data.
+ */
+func axes(result *decode.Result) ([][]int, []string, error) {
+	head := result.Header
+	axes, err := head.Axes()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(head.Labels) != len(axes) {
+		msg := "len(labels) = %d, ndims = %d"
+		return nil, nil, fmt.Errorf(msg, len(head.Labels), len(axes))
+	}
+	if len(axes) != 3 {
+		return nil, nil, fmt.Errorf("ndims = %d; want 3", len(axes))
+	}
+	return axes, head.Labels, nil
+}
+
+/*
+ * For slices, the dimension sliced through is 1, and is recorded as an
+ * attribute rather than a dimension, e.g. inline = 1204. The other attributes
+ * (cdpx, cdpy, ...) span the plane of the slice, less the z-axis.
+ */
+func fromSlice(ds *Dataset, result *decode.Result) error {
+	axes, labels, err := axes(result)
+	if err != nil {
+		return err
+	}
+
+	shape := result.Arrays["data"].Shape
+	if len(shape) != len(axes) {
+		return fmt.Errorf("data shape %v; want %d dimensions", shape, len(axes))
+	}
+
+	dims := make([]string, 0, len(shape))
+	for i, n := range shape {
+		if n == 1 && len(axes[i]) == 1 {
+			ds.addAttribute(labels[i], float64(axes[i][0]))
+			continue
+		}
+		dims = append(dims, labels[i])
+		ds.addDimension(labels[i], n)
+		ds.addCoord(labels[i], labels[i:i+1], int32s(axes[i]))
+	}
+	ds.Data.Dims = dims
+
+	for _, attr := range attributes(result) {
+		array := result.Arrays[attr]
+		ndims := len(squeeze(array.Shape))
+		if ndims > len(dims) {
+			return fmt.Errorf("attribute %s has shape %v", attr, array.Shape)
+		}
+		ds.addCoord(attr, dims[:ndims], array.Data)
+	}
+	return nil
+}
+
+/*
+ * Curtains, traces, and fences are a list of (vertical) traces, where every
+ * trace has its own pair of line numbers. Fence traces are interpolated
+ * between the grid traces, so the line numbers are only the nearest lines,
+ * and the actual positions are the UTM coordinates.
+ */
+func fromCurtain(ds *Dataset, result *decode.Result) error {
+	axes, labels, err := axes(result)
+	if err != nil {
+		return err
+	}
+
+	ntraces := len(axes[0])
+	ds.addDimension("trace", ntraces)
+	ds.addDimension(labels[2], len(axes[2]))
+	ds.Data.Dims = []string { "trace", labels[2] }
+
+	ds.addCoord(labels[0], []string { "trace" }, int32s(axes[0]))
+	ds.addCoord(labels[1], []string { "trace" }, int32s(axes[1]))
+	ds.addCoord(labels[2], labels[2:], int32s(axes[2]))
+
+	if result.Header.Function == decode.Fence {
+		coordinates := result.Header.Coordinates
+		if len(coordinates) != 2 * ntraces {
+			msg := "len(coordinates) = %d; want %d"
+			return fmt.Errorf(msg, len(coordinates), 2 * ntraces)
+		}
+		x := make([]float64, ntraces)
+		y := make([]float64, ntraces)
+		for i := range x {
+			x[i] = coordinates[2*i + 0]
+			y[i] = coordinates[2*i + 1]
+		}
+		ds.addCoord("utm_x", []string { "trace" }, x)
+		ds.addCoord("utm_y", []string { "trace" }, y)
+	}
+
+	for _, attr := range attributes(result) {
+		ds.addCoord(attr, []string { "trace" }, result.Arrays[attr].Data)
+	}
+	return nil
+}
+
+/*
+ * The z-axis of the horizon is the offset from the horizon itself, since the
+ * depth/time of the horizon varies from trace to trace.
+ */
+func fromHorizon(ds *Dataset, result *decode.Result) error {
+	axes, labels, err := axes(result)
+	if err != nil {
+		return err
+	}
+
+	ds.addDimension("trace", len(axes[0]))
+	ds.addDimension("offset", len(axes[2]))
+	ds.Data.Dims = []string { "trace", "offset" }
+
+	ds.addCoord(labels[0], []string { "trace" }, int32s(axes[0]))
+	ds.addCoord(labels[1], []string { "trace" }, int32s(axes[1]))
+	ds.addCoord("offset", []string { "offset" }, int32s(axes[2]))
+
+	for _, attr := range attributes(result) {
+		ds.addCoord(attr, []string { "trace" }, result.Arrays[attr].Data)
+	}
+	return nil
+}
+
+/*
+ * The attributes of a subvolume are one-per-trace, and only span the x/y
+ * plane.
+ */
+func fromSubvolume(ds *Dataset, result *decode.Result) error {
+	axes, labels, err := axes(result)
+	if err != nil {
+		return err
+	}
+
+	for i, axis := range axes {
+		ds.addDimension(labels[i], len(axis))
+		ds.addCoord(labels[i], labels[i:i+1], int32s(axis))
+	}
+	ds.Data.Dims = labels
+
+	for _, attr := range attributes(result) {
+		ds.addCoord(attr, labels[:2], result.Arrays[attr].Data)
+	}
+	return nil
+}
+
+/*
+ * The statistics are [count, min, max, mean, rms, lo, hi, histogram...]. The
+ * histogram is the data, labelled with the bin centres, and the rest are
+ * attributes.
+ */
+func fromStatistics(ds *Dataset, result *decode.Result) error {
+	data := result.Arrays["data"].Data
+	if len(data) < 7 {
+		return fmt.Errorf("statistics of length %d; want >= 7", len(data))
+	}
+
+	names := []string { "count", "min", "max", "mean", "rms", "lo", "hi" }
+	for i, name := range names {
+		ds.addAttribute(name, float64(data[i]))
+	}
+
+	histogram := data[7:]
+	lo, hi := float64(data[5]), float64(data[6])
+	width := (hi - lo) / float64(len(histogram))
+	centres := make([]float64, len(histogram))
+	for i := range centres {
+		centres[i] = lo + width * (float64(i) + 0.5)
+	}
+
+	ds.addDimension("value", len(histogram))
+	ds.addCoord("value", []string { "value" }, centres)
+	ds.Data = Variable {
+		Name: "data",
+		Dims: []string { "value" },
+		Data: histogram,
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/client/decode"
+)
+
+/*
+ * An inline slice of a 3x2 (crossline x time) cube, with the cdpx attribute
+ */
+func inlineSlice() *decode.Result {
+	return &decode.Result {
+		Header: &decode.Header {
+			Function:   decode.Slice,
+			Ndims:      3,
+			Index:      []int { 1, 3, 2, 10, 1, 2, 3, 0, 4 },
+			Labels:     []string { "inline", "crossline", "time" },
+			Attributes: []string { "data", "cdpx" },
+		},
+		Arrays: map[string]*decode.Array {
+			"data": {
+				Shape: []int { 1, 3, 2 },
+				Data:  []float32 { 0, 1, 2, 3, 4, 5 },
+			},
+			"cdpx": {
+				Shape: []int { 1, 3, 1 },
+				Data:  []float32 { 100, 200, 300 },
+			},
+		},
+	}
+}
+
+func TestSliceIsSqueezed(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	expected := []Dimension {
+		{ Name: "crossline", Size: 3 },
+		{ Name: "time",      Size: 2 },
+	}
+	assert.Equal(t, expected, ds.Dimensions)
+	assert.Equal(t, []string { "crossline", "time" }, ds.Data.Dims)
+	assert.Equal(t, []Attribute { { Name: "inline", Value: 10 } }, ds.Attributes)
+
+	cdpx := ds.Coords[len(ds.Coords) - 1]
+	assert.Equal(t, "cdpx", cdpx.Name)
+	assert.Equal(t, []string { "crossline" }, cdpx.Dims)
+}
+
+func TestCurtainTracesHaveLineNumbers(t *testing.T) {
+	result := &decode.Result {
+		Header: &decode.Header {
+			Function:   decode.Fence,
+			Ndims:      3,
+			Index:      []int { 2, 2, 1, 10, 11, 1, 2, 0 },
+			Labels:     []string { "inline", "crossline", "time" },
+			Attributes: []string { "data" },
+			Coordinates: []float64 { 1.5, 2.5, 3.5, 4.5 },
+		},
+		Arrays: map[string]*decode.Array {
+			"data": { Shape: []int { 2, 1 }, Data: []float32 { 0, 1 } },
+		},
+	}
+
+	ds, err := FromResult(result)
+	assert.NoError(t, err)
+	assert.Equal(t, []string { "trace", "time" }, ds.Data.Dims)
+
+	names := make([]string, 0)
+	for _, coord := range ds.Coords {
+		names = append(names, coord.Name)
+	}
+	expected := []string { "inline", "crossline", "time", "utm_x", "utm_y" }
+	assert.Equal(t, expected, names)
+	assert.Equal(t, []float64 { 2.5, 4.5 }, ds.Coords[4].Data)
+}
+
+func TestStatisticsHistogramIsTheData(t *testing.T) {
+	result := &decode.Result {
+		Header: &decode.Header {
+			Function:   decode.Statistics,
+			Attributes: []string { "data" },
+		},
+		Arrays: map[string]*decode.Array {
+			"data": {
+				Shape: []int { 9 },
+				Data:  []float32 { 4, -1, 3, 1, 2, -2, 2, 1, 3 },
+			},
+		},
+	}
+
+	ds, err := FromResult(result)
+	assert.NoError(t, err)
+	assert.Equal(t, []float32 { 1, 3 }, ds.Data.Data)
+	assert.Equal(t, []float64 { -1, 1 }, ds.Coords[0].Data)
+	assert.Equal(t, Attribute { Name: "count", Value: 4 }, ds.Attributes[0])
+}
+
+func TestInconsistentResultIsAnError(t *testing.T) {
+	result := inlineSlice()
+	result.Arrays["cdpx"].Data = []float32 { 100, 200 }
+	_, err := FromResult(result)
+	assert.Error(t, err)
+}
+
+func TestNpyHeader(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteNpy(&out, ds))
+	doc := out.Bytes()
+
+	assert.Equal(t, []byte("\x93NUMPY\x01\x00"), doc[:8])
+	headerlen := int(binary.LittleEndian.Uint16(doc[8:10]))
+	assert.Equal(t, 0, (10 + headerlen) % 64)
+
+	header := string(doc[10:10 + headerlen])
+	assert.Contains(t, header, "'descr': '<f4'")
+	assert.Contains(t, header, "'shape': (3, 2,)")
+	assert.Equal(t, byte('\n'), header[len(header) - 1])
+	assert.Equal(t, 10 + headerlen + 4 * 6, len(doc))
+}
+
+func TestNetCDFHeader(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteNetCDF(&out, ds))
+	doc := out.Bytes()
+
+	be := binary.BigEndian
+	assert.Equal(t, []byte("CDF\x02"), doc[:4])
+	/* numrecs, the dimension tag and the number of dimensions */
+	assert.Equal(t, uint32(0), be.Uint32(doc[4:]))
+	assert.Equal(t, uint32(ncDimension), be.Uint32(doc[8:]))
+	assert.Equal(t, uint32(2), be.Uint32(doc[12:]))
+	/* the first dimension is crossline (padded to 12), of size 3 */
+	assert.Equal(t, uint32(9), be.Uint32(doc[16:]))
+	assert.Equal(t, "crossline", string(doc[20:29]))
+	assert.Equal(t, uint32(3), be.Uint32(doc[32:]))
+
+	/*
+	 * The data is the last variable, so the file ends with the samples
+	 */
+	samples := doc[len(doc) - 4 * 6:]
+	assert.Equal(t, uint32(0x40A00000), be.Uint32(samples[20:]))
+}
+
+func TestArrowBroadcastsCoordinates(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	crossline := ds.gather(&ds.Coords[0], 0, 6)
+	time      := ds.gather(&ds.Coords[1], 0, 6)
+	cdpx      := ds.gather(&ds.Coords[2], 0, 6)
+
+	le := binary.LittleEndian
+	for row, expected := range []uint32 { 1, 1, 2, 2, 3, 3 } {
+		assert.Equal(t, expected, le.Uint32(crossline[4*row:]))
+	}
+	for row, expected := range []uint32 { 0, 4, 0, 4, 0, 4 } {
+		assert.Equal(t, expected, le.Uint32(time[4*row:]))
+	}
+	/* 100, 100, 200, ... as float32 */
+	assert.Equal(t, cdpx[0:4], cdpx[4:8])
+	assert.NotEqual(t, cdpx[4:8], cdpx[8:12])
+}
+
+func TestArrowStreamIsTerminated(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteArrow(&out, ds))
+	doc := out.Bytes()
+
+	/*
+	 * The schema, one record batch, and the end-of-stream marker, all
+	 * 8-byte aligned
+	 */
+	le := binary.LittleEndian
+	messages := 0
+	for len(doc) > 0 {
+		assert.Equal(t, uint32(0xFFFFFFFF), le.Uint32(doc))
+		size := int(le.Uint32(doc[4:]))
+		assert.Equal(t, 0, size % 8)
+		if size == 0 {
+			doc = doc[8:]
+			break
+		}
+
+		metadata := doc[8:8 + size]
+		root := le.Uint32(metadata)
+		table := metadata[root:]
+		vtable := metadata[int(root) - int(int32(le.Uint32(table))):]
+		/* the body length is field 3 of the message */
+		bodylen := int(le.Uint64(table[le.Uint16(vtable[4 + 2*3:]):]))
+		assert.Equal(t, 0, bodylen % 8)
+
+		doc = doc[8 + size + bodylen:]
+		messages++
+	}
+	assert.Equal(t, 2, messages)
+	assert.Empty(t, doc)
+}
+
+func TestCSVIsLongTable(t *testing.T) {
+	ds, err := FromResult(inlineSlice())
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteCSV(&out, ds))
+
+	expected := "crossline,time,cdpx,inline,data\n" +
+		"1,0,100,10,0\n" +
+		"1,4,100,10,1\n" +
+		"2,0,200,10,2\n" +
+		"2,4,200,10,3\n" +
+		"3,0,300,10,4\n" +
+		"3,4,300,10,5\n"
+	assert.Equal(t, expected, out.String())
+}
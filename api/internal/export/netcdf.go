@@ -0,0 +1,196 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+/*
+ * The netCDF classic format, with 64-bit offsets (CDF-2) [1], which is read by
+ * every netCDF library, including xarray, R (ncdf4, RNetCDF, stars) and
+ * matlab.
+ *
+ * The dimensions with a coordinate (the line numbers) get a coordinate
+ * variable, i.e. a variable of the same name, and the other coordinates, like
+ * cdpx, cdpy and the line numbers of curtain traces, are listed in the
+ * coordinates attribute of the data variable, as per the CF conventions. The
+ * dataset attributes, e.g. the inline of an inline slice, are global
+ * attributes.
+ *
+ * [1] https://docs.unidata.ucar.edu/netcdf-c/current/file_format_specifications.html
+ */
+
+const (
+	ncDimension = 0x0A
+	ncVariable  = 0x0B
+	ncAttribute = 0x0C
+
+	ncChar   = 2
+	ncInt    = 4
+	ncFloat  = 5
+	ncDouble = 6
+)
+
+type ncwriter struct {
+	bytes.Buffer
+}
+
+func (w *ncwriter) int32(x int32) {
+	binary.Write(w, binary.BigEndian, x)
+}
+
+func (w *ncwriter) int64(x int64) {
+	binary.Write(w, binary.BigEndian, x)
+}
+
+func (w *ncwriter) pad() {
+	for w.Len() % 4 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+func (w *ncwriter) name(s string) {
+	w.int32(int32(len(s)))
+	w.WriteString(s)
+	w.pad()
+}
+
+/*
+ * An empty list is written as ABSENT, i.e. two zeros, rather than a tag with
+ * zero elements.
+ */
+func (w *ncwriter) list(tag int32, n int) {
+	if n == 0 {
+		tag = 0
+	}
+	w.int32(tag)
+	w.int32(int32(n))
+}
+
+func (w *ncwriter) charAttribute(name, value string) {
+	w.name(name)
+	w.int32(ncChar)
+	w.int32(int32(len(value)))
+	w.WriteString(value)
+	w.pad()
+}
+
+func (w *ncwriter) doubleAttribute(name string, value float64) {
+	w.name(name)
+	w.int32(ncDouble)
+	w.int32(1)
+	w.int64(int64(math.Float64bits(value)))
+}
+
+func nctype(data interface{}) (int32, int) {
+	switch data.(type) {
+	case []float32: return ncFloat, 4
+	case []float64: return ncDouble, 8
+	default:        return ncInt, 4
+	}
+}
+
+/*
+ * Write the header, with the variable data starting at offset begin.
+ */
+func (ds *Dataset) ncheader(w *ncwriter, variables []Variable, begin int64) {
+	w.WriteString("CDF\x02")
+	/* numrecs - there is no record (unlimited) dimension */
+	w.int32(0)
+
+	dimids := make(map[string]int32)
+	w.list(ncDimension, len(ds.Dimensions))
+	for i, dim := range ds.Dimensions {
+		dimids[dim.Name] = int32(i)
+		w.name(dim.Name)
+		w.int32(int32(dim.Size))
+	}
+
+	w.list(ncAttribute, len(ds.Attributes) + 1)
+	w.charAttribute("function", ds.Function)
+	for _, attr := range ds.Attributes {
+		w.doubleAttribute(attr.Name, attr.Value)
+	}
+
+	auxiliary := make([]string, 0)
+	for _, v := range ds.Coords {
+		if _, ok := dimids[v.Name]; !ok {
+			auxiliary = append(auxiliary, v.Name)
+		}
+	}
+
+	w.list(ncVariable, len(variables))
+	for _, v := range variables {
+		w.name(v.Name)
+		w.int32(int32(len(v.Dims)))
+		for _, dim := range v.Dims {
+			w.int32(dimids[dim])
+		}
+
+		if v.Name == ds.Data.Name && len(auxiliary) > 0 {
+			w.list(ncAttribute, 1)
+			w.charAttribute("coordinates", strings.Join(auxiliary, " "))
+		} else {
+			w.list(ncAttribute, 0)
+		}
+
+		kind, elemsize := nctype(v.Data)
+		w.int32(kind)
+		/*
+		 * The size is only informational, and is allowed to overflow for
+		 * the last variable, which is always the data.
+		 */
+		vsize := int64(ds.elements(&v) * elemsize)
+		if vsize > math.MaxInt32 {
+			w.int32(-1)
+		} else {
+			w.int32(int32(vsize))
+		}
+		w.int64(begin)
+		begin += vsize
+	}
+}
+
+func WriteNetCDF(w io.Writer, ds *Dataset) error {
+	for _, dim := range ds.Dimensions {
+		/*
+		 * A zero-length dimension is the record (unlimited) dimension in
+		 * netcdf, which would change the layout.
+		 */
+		if dim.Size == 0 {
+			return fmt.Errorf("netcdf: dimension %s is empty", dim.Name)
+		}
+	}
+
+	/*
+	 * The data is written last, so that only the data can be larger than
+	 * 4GB, which is the limit for the other variables.
+	 */
+	variables := append(append([]Variable{}, ds.Coords...), ds.Data)
+
+	/*
+	 * The size of the header does not depend on the offsets, so write it
+	 * once to find where the data starts.
+	 */
+	header := &ncwriter{}
+	ds.ncheader(header, variables, 0)
+	begin := int64(header.Len())
+	header.Reset()
+	ds.ncheader(header, variables, begin)
+
+	out := bufio.NewWriter(w)
+	if _, err := out.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, v := range variables {
+		if err := binary.Write(out, binary.BigEndian, v.Data); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,65 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+/*
+ * The numpy .npy format, version 1.0 [1]. Only the data is written, with the
+ * dimensions of the dataset (so slices are 2D), as little-endian float32. The
+ * coordinates are lost, use the netcdf or arrow formats to keep them.
+ *
+ * [1] https://numpy.org/doc/stable/reference/generated/numpy.lib.format.html
+ */
+func WriteNpy(w io.Writer, ds *Dataset) error {
+	data, ok := ds.Data.Data.([]float32)
+	if !ok {
+		return fmt.Errorf("npy: data is %T; want []float32", ds.Data.Data)
+	}
+
+	shape := make([]string, 0, len(ds.Data.Dims))
+	for _, dim := range ds.Data.Dims {
+		size, _ := ds.size(dim)
+		shape = append(shape, fmt.Sprintf("%d,", size))
+	}
+	/*
+	 * Tuples of more than one element do not need the trailing comma, but
+	 * it is still valid python.
+	 */
+	header := fmt.Sprintf(
+		"{'descr': '<f4', 'fortran_order': False, 'shape': (%s), }",
+		strings.Join(shape, " "),
+	)
+
+	/*
+	 * The header is padded with spaces and terminated by a newline, so that
+	 * the data is 64-byte aligned. The preamble is the magic string (6), the
+	 * version (2), and the header length (2).
+	 */
+	const preamble = 10
+	padding := 64 - (preamble + len(header) + 1) % 64
+	if padding == 64 {
+		padding = 0
+	}
+	header += strings.Repeat(" ", padding) + "\n"
+
+	out := bufio.NewWriter(w)
+	out.WriteString("\x93NUMPY")
+	out.Write([]byte { 1, 0 })
+	binary.Write(out, binary.LittleEndian, uint16(len(header)))
+	out.WriteString(header)
+
+	var sample [4]byte
+	for _, x := range data {
+		binary.LittleEndian.PutUint32(sample[:], math.Float32bits(x))
+		if _, err := out.Write(sample[:]); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -108,3 +109,54 @@ func (m *ProcessHeader) Unpack(doc []byte) (*ProcessHeader, error) {
 	// that follows immediately after
 	return m, msgpack.Unmarshal(doc[1:], m)
 }
+
+/*
+ * A process is cancelled by setting the cancelled key and publishing the pid
+ * on the cancel channel. The key makes workers drop tasks of the process that
+ * have not started yet, and the channel makes workers stop the tasks that are
+ * already running.
+ */
+const CancelChannel = "cancel"
+
+func CancelledKey(pid string) string {
+	return fmt.Sprintf("%s/cancelled", pid)
+}
+
+/*
+ * The failure record written by the workers when a task fails, so that the
+ * status and stream endpoints can report why a process failed, rather than
+ * have clients wait for parts that never come. Only the first failure of a
+ * process is recorded.
+ *
+ * The class is one of:
+ *  - task:     the task could not be parsed or set up
+ *  - download: a fragment could not be fetched from storage
+ */
+type Failure struct {
+	Class    string `json:"class"`
+	Part     string `json:"part"`
+	Fragment string `json:"fragment,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (m *Failure) Pack() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (m *Failure) Unpack(doc []byte) (*Failure, error) {
+	return m, json.Unmarshal(doc, m)
+}
+
+func FailedKey(pid string) string {
+	return fmt.Sprintf("%s/failed", pid)
+}
+
+/*
+ * The set of parts of a process that have been written to the result stream.
+ * A part can be written more than once when a slow task is reclaimed by
+ * another worker, so the size of this set, not the length of the stream, is
+ * the number of completed parts.
+ */
+func PartsKey(pid string) string {
+	return fmt.Sprintf("%s/parts", pid)
+}
@@ -0,0 +1,427 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * The in-process queue, for running the query, fetch and result services in
+ * the same binary, without redis. Nothing is persisted, and everything is
+ * lost when the process exits.
+ *
+ * All state is behind a single lock. Blocking reads wait on the changed
+ * channel, which is closed (and replaced) on every write, so that all waiters
+ * wake up and check again.
+ */
+type memory struct {
+	lock    sync.Mutex
+	opts    Options
+	changed chan struct{}
+	seq     uint64
+	/*
+	 * The tasks not yet read, in order, and the tasks read but not yet
+	 * acknowledged (at-least-once only), by job id.
+	 */
+	jobs    []Job
+	pending map[string]*pendingJob
+	procs   map[string]*memproc
+	/*
+	 * The channels returned by Cancellations
+	 */
+	cancellations map[chan string]struct{}
+}
+
+type pendingJob struct {
+	job      Job
+	consumer string
+	since    time.Time
+}
+
+type memproc struct {
+	header    []byte
+	parts     []Part
+	names     map[string]bool
+	cancelled bool
+	failure   []byte
+	expires   time.Time
+}
+
+func NewMemory(opts Options) Queue {
+	return &memory {
+		opts:          opts,
+		changed:       make(chan struct{}),
+		pending:       make(map[string]*pendingJob),
+		procs:         make(map[string]*memproc),
+		cancellations: make(map[chan string]struct{}),
+	}
+}
+
+/*
+ * Wake up the blocked readers. Must be called with the lock held.
+ */
+func (m *memory) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+/*
+ * Get the process, creating it if it does not exist, and extend its life.
+ * Expired processes are removed on the way. Must be called with the lock
+ * held.
+ */
+func (m *memory) proc(pid string) *memproc {
+	now := time.Now()
+	for key, proc := range m.procs {
+		if now.After(proc.expires) {
+			delete(m.procs, key)
+		}
+	}
+
+	proc, ok := m.procs[pid]
+	if !ok {
+		proc = &memproc { names: make(map[string]bool) }
+		m.procs[pid] = proc
+	}
+	proc.expires = now.Add(m.opts.TTL)
+	return proc
+}
+
+/*
+ * Get the process if it exists and has not expired. Must be called with the
+ * lock held.
+ */
+func (m *memory) lookup(pid string) *memproc {
+	proc, ok := m.procs[pid]
+	if !ok || time.Now().After(proc.expires) {
+		return nil
+	}
+	return proc
+}
+
+/*
+ * Wait until the queue changes, the timeout expires or the context is done,
+ * and return false if it was not a change.
+ */
+func wait(ctx context.Context, changed chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (m *memory) PutHeader(
+	ctx    context.Context,
+	pid    string,
+	header []byte,
+) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.proc(pid).header = header
+	m.notify()
+	return nil
+}
+
+func (m *memory) GetHeader(ctx context.Context, pid string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.lookup(pid)
+	if proc == nil || proc.header == nil {
+		return nil, ErrNotFound
+	}
+	return proc.header, nil
+}
+
+func (m *memory) WaitHeader(
+	ctx   context.Context,
+	pid   string,
+	block time.Duration,
+) ([]byte, error) {
+	deadline := time.Now().Add(block)
+	for {
+		m.lock.Lock()
+		var header []byte
+		if proc := m.lookup(pid); proc != nil {
+			header = proc.header
+		}
+		changed := m.changed
+		m.lock.Unlock()
+
+		if header != nil {
+			return header, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !wait(ctx, changed, remaining) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, ErrNotFound
+		}
+	}
+}
+
+func (m *memory) Enqueue(ctx context.Context, task Task) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.seq++
+	m.jobs = append(m.jobs, Job { ID: strconv.FormatUint(m.seq, 10), Task: task })
+	m.notify()
+	return nil
+}
+
+func (m *memory) Join(ctx context.Context, consumer string) error {
+	return nil
+}
+
+func (m *memory) Dequeue(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Job, error) {
+	deadline := time.Now().Add(block)
+	for {
+		m.lock.Lock()
+		if len(m.jobs) > 0 {
+			job := m.jobs[0]
+			m.jobs = m.jobs[1:]
+			if m.opts.AtLeastOnce {
+				m.pending[job.ID] = &pendingJob {
+					job:      job,
+					consumer: consumer,
+					since:    time.Now(),
+				}
+			}
+			m.lock.Unlock()
+			return []Job { job }, nil
+		}
+		changed := m.changed
+		m.lock.Unlock()
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !wait(ctx, changed, remaining) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *memory) Ack(ctx context.Context, job Job) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.pending, job.ID)
+	return nil
+}
+
+func (m *memory) Reclaim(ctx context.Context, consumer string) ([]Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	jobs := make([]Job, 0)
+	for _, pending := range m.pending {
+		if now.Sub(pending.since) < m.opts.ReclaimIdle {
+			continue
+		}
+		pending.consumer = consumer
+		pending.since    = now
+		jobs = append(jobs, pending.job)
+	}
+	return jobs, nil
+}
+
+func (m *memory) Remove(ctx context.Context, pid string) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if job.Pid != pid {
+			jobs = append(jobs, job)
+		}
+	}
+	removed := len(m.jobs) - len(jobs)
+	m.jobs = jobs
+	return int64(removed), nil
+}
+
+func (m *memory) Leave(ctx context.Context, consumer string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	n := 0
+	for _, pending := range m.pending {
+		if pending.consumer == consumer {
+			n++
+		}
+	}
+	if n > 0 {
+		msg := "consumer %s has %d pending tasks; not removed"
+		return fmt.Errorf(msg, consumer, n)
+	}
+	return nil
+}
+
+func (m *memory) PutPart(ctx context.Context, pid string, part Part) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.proc(pid)
+	proc.parts = append(proc.parts, part)
+	proc.names[part.Name] = true
+	m.notify()
+	return nil
+}
+
+/*
+ * The cursor is the number of parts already read.
+ */
+func (m *memory) ReadParts(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+	block  time.Duration,
+) ([]Part, string, error) {
+	start := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 {
+			return nil, cursor, fmt.Errorf("bad cursor %s", cursor)
+		}
+		start = n
+	}
+
+	deadline := time.Now().Add(block)
+	for {
+		m.lock.Lock()
+		var parts []Part
+		if proc := m.lookup(pid); proc != nil && start < len(proc.parts) {
+			parts = append(parts, proc.parts[start:]...)
+		}
+		changed := m.changed
+		m.lock.Unlock()
+
+		if len(parts) > 0 {
+			return parts, strconv.Itoa(start + len(parts)), nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !wait(ctx, changed, remaining) {
+			return nil, cursor, ctx.Err()
+		}
+	}
+}
+
+func (m *memory) CountParts(ctx context.Context, pid string) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.lookup(pid)
+	if proc == nil {
+		return 0, nil
+	}
+	return int64(len(proc.names)), nil
+}
+
+/*
+ * Check the process every time the queue changes (a part written, a process
+ * cancelled or failed), rather than sleep, so the wait ends as soon as the
+ * process moves.
+ */
+func (m *memory) WaitParts(
+	ctx   context.Context,
+	pid   string,
+	count int64,
+	block time.Duration,
+) error {
+	deadline := time.Now().Add(block)
+	for {
+		m.lock.Lock()
+		proc := m.lookup(pid)
+		done := proc != nil && (
+			int64(len(proc.names)) > count ||
+			proc.cancelled ||
+			proc.failure != nil)
+		changed := m.changed
+		m.lock.Unlock()
+
+		if done {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !wait(ctx, changed, remaining) {
+			return ctx.Err()
+		}
+	}
+}
+
+/*
+ * The pid is sent without blocking, so a slow listener can miss the
+ * announcement. The cancelled flag is still set, which makes workers drop the
+ * tasks that are not yet started, and the running tasks just run to
+ * completion.
+ */
+func (m *memory) Cancel(ctx context.Context, pid string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.proc(pid).cancelled = true
+	for c := range m.cancellations {
+		select {
+		case c <- pid:
+		default:
+		}
+	}
+	m.notify()
+	return nil
+}
+
+func (m *memory) Cancelled(ctx context.Context, pid string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.lookup(pid)
+	return proc != nil && proc.cancelled, nil
+}
+
+func (m *memory) Cancellations(ctx context.Context) (<-chan string, error) {
+	pids := make(chan string, 64)
+	m.lock.Lock()
+	m.cancellations[pids] = struct{}{}
+	m.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.cancellations, pids)
+		close(pids)
+	}()
+	return pids, nil
+}
+
+func (m *memory) Fail(ctx context.Context, pid string, failure []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.proc(pid)
+	if proc.failure == nil {
+		proc.failure = failure
+		m.notify()
+	}
+	return nil
+}
+
+func (m *memory) Failure(ctx context.Context, pid string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	proc := m.lookup(pid)
+	if proc == nil {
+		return nil, nil
+	}
+	return proc.failure, nil
+}
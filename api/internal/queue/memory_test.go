@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDequeueInOrder(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2" })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2" })
+
+	first, err := q.Dequeue(ctx, "c", 0)
+	assert.NoError(t, err)
+	second, err := q.Dequeue(ctx, "c", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "0/2", first[0].Part)
+	assert.Equal(t, "1/2", second[0].Part)
+
+	empty, err := q.Dequeue(ctx, "c", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+}
+
+func TestMemoryDequeueWakesOnEnqueue(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Enqueue(ctx, Task { Pid: "a", Part: "0/1" })
+	}()
+
+	jobs, err := q.Dequeue(ctx, "c", 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+func TestMemoryReclaimAbandonedJobs(t *testing.T) {
+	ctx := context.Background()
+	opts := DefaultOptions()
+	opts.AtLeastOnce = true
+	opts.ReclaimIdle = time.Millisecond
+	q := NewMemory(opts)
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2" })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2" })
+
+	done, _ := q.Dequeue(ctx, "c1", 0)
+	abandoned, _ := q.Dequeue(ctx, "c1", 0)
+	assert.NoError(t, q.Ack(ctx, done[0]))
+	assert.Error(t, q.Leave(ctx, "c1"))
+
+	time.Sleep(5 * time.Millisecond)
+	jobs, err := q.Reclaim(ctx, "c2")
+	assert.NoError(t, err)
+	assert.Equal(t, abandoned, jobs)
+	assert.NoError(t, q.Leave(ctx, "c1"))
+	assert.Error(t, q.Leave(ctx, "c2"))
+}
+
+func TestMemoryRemoveOnlyTasksOfThePid(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2" })
+	q.Enqueue(ctx, Task { Pid: "b", Part: "0/1" })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2" })
+
+	n, err := q.Remove(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	jobs, _ := q.Dequeue(ctx, "c", 0)
+	assert.Equal(t, "b", jobs[0].Pid)
+}
+
+func TestMemoryReadPartsFromCursor(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	q.PutPart(ctx, "a", Part { Name: "0/2", Data: []byte("x") })
+
+	parts, cursor, err := q.ReadParts(ctx, "a", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "0/2", Data: []byte("x") } }, parts)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutPart(ctx, "a", Part { Name: "1/2", Data: []byte("y") })
+	}()
+	parts, _, err = q.ReadParts(ctx, "a", cursor, 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "1/2", Data: []byte("y") } }, parts)
+}
+
+func TestMemoryCountDistinctParts(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+	q.PutPart(ctx, "a", Part { Name: "1/2" })
+
+	n, err := q.CountParts(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestMemoryWaitHeaderWakesOnPutHeader(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+
+	_, err := q.WaitHeader(ctx, "a", 10 * time.Millisecond)
+	assert.Equal(t, ErrNotFound, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutHeader(ctx, "a", []byte("header"))
+	}()
+	start := time.Now()
+	header, err := q.WaitHeader(ctx, "a", 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+}
+
+func TestMemoryWaitPartsWakesOnNewPart(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+
+	/* the part already written does not count */
+	start := time.Now()
+	assert.NoError(t, q.WaitParts(ctx, "a", 1, 20 * time.Millisecond))
+	assert.True(t, time.Since(start) >= 20 * time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutPart(ctx, "a", Part { Name: "1/2" })
+	}()
+	assert.NoError(t, q.WaitParts(ctx, "a", 1, 5 * time.Second))
+	n, _ := q.CountParts(ctx, "a")
+	assert.Equal(t, int64(2), n)
+}
+
+func TestMemoryWaitPartsWakesOnCancel(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Cancel(ctx, "a")
+	}()
+
+	start := time.Now()
+	assert.NoError(t, q.WaitParts(ctx, "a", 0, 5 * time.Second))
+	assert.True(t, time.Since(start) < 5 * time.Second)
+	stop, _ := q.Cancelled(ctx, "a")
+	assert.True(t, stop)
+}
+
+func TestMemoryKeepsFirstFailure(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemory(DefaultOptions())
+
+	failure, err := q.Failure(ctx, "a")
+	assert.NoError(t, err)
+	assert.Nil(t, failure)
+
+	q.Fail(ctx, "a", []byte("first"))
+	q.Fail(ctx, "a", []byte("second"))
+	failure, err = q.Failure(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), failure)
+}
+
+func TestMemoryCancelIsAnnounced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := NewMemory(DefaultOptions())
+	pids, err := q.Cancellations(ctx)
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.Cancel(ctx, "a"))
+	assert.Equal(t, "a", <-pids)
+	stop, err := q.Cancelled(ctx, "a")
+	assert.NoError(t, err)
+	assert.True(t, stop)
+
+	cancel()
+	_, ok := <-pids
+	assert.False(t, ok)
+}
+
+func TestMemoryProcessesExpire(t *testing.T) {
+	ctx := context.Background()
+	opts := DefaultOptions()
+	opts.TTL = time.Millisecond
+	q := NewMemory(opts)
+	q.PutHeader(ctx, "a", []byte("header"))
+
+	header, err := q.GetHeader(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+
+	time.Sleep(5 * time.Millisecond)
+	_, err = q.GetHeader(ctx, "a")
+	assert.Equal(t, ErrNotFound, err)
+}
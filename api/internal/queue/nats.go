@@ -0,0 +1,733 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+ * The queue on NATS JetStream, for deployments where redis is not available.
+ * Everything is kept in three streams, where the pid and part are encoded in
+ * the subject:
+ *
+ *     <Stream>              oneseismic.jobs.<pid>.<part>    the job queue
+ *     oneseismic-parts      oneseismic.parts.<pid>.<part>   the parts
+ *     oneseismic-processes  oneseismic.header.<pid>         the header
+ *                           oneseismic.cancelled.<pid>      cancel marker
+ *                           oneseismic.failed.<pid>         the first failure
+ *
+ * The job queue has work-queue retention, and is read by the workers through
+ * a durable pull consumer named after the group, so that each task is
+ * delivered to one worker. Tasks are removed from the stream when they are
+ * acknowledged, and tasks that are not acknowledged within ReclaimIdle are
+ * redelivered by the server, so Reclaim has nothing to do. In at-most-once
+ * mode, tasks are acknowledged as soon as they are read.
+ *
+ * All streams have the TTL as max age. The workers listen for cancellations
+ * on the cancelled subjects directly.
+ *
+ * Reading single messages by subject (last_by_subj, next_by_subj), purging by
+ * subject, and listing the subjects of a stream (subjects_filter) is not in
+ * the client library, and is done with requests to the JetStream API. This
+ * requires nats-server 2.9 or newer.
+ */
+type natsQueue struct {
+	conn *nats.Conn
+	js   nats.JetStreamContext
+	opts Options
+
+	lock sync.Mutex
+	subs map[string]*nats.Subscription
+	/*
+	 * The jobs read but not yet acknowledged, by job id
+	 */
+	inflight map[string]*nats.Msg
+}
+
+const (
+	natsPartsStream = "oneseismic-parts"
+	natsProcsStream = "oneseismic-processes"
+)
+
+func natsJobSubject(pid, part string) string {
+	return fmt.Sprintf("oneseismic.jobs.%s.%s", pid, part)
+}
+
+func natsPartSubject(pid, part string) string {
+	return fmt.Sprintf("oneseismic.parts.%s.%s", pid, part)
+}
+
+func natsProcSubject(kind, pid string) string {
+	return fmt.Sprintf("oneseismic.%s.%s", kind, pid)
+}
+
+/*
+ * Split the pid and part from a jobs or parts subject.
+ */
+func natsSplitSubject(subject string) (string, string, error) {
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != 4 {
+		return "", "", fmt.Errorf("bad subject %s", subject)
+	}
+	return tokens[2], tokens[3], nil
+}
+
+/*
+ * The pid and part are subject tokens, and must not contain the separator or
+ * wildcards, which would otherwise address other processes.
+ */
+func natsCheckToken(token string) error {
+	if token == "" || strings.ContainsAny(token, ".*> \t\r\n") {
+		return fmt.Errorf("%q is not a valid subject token", token)
+	}
+	return nil
+}
+
+func NewNATS(conn *nats.Conn, opts Options) (Queue, error) {
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	streams := []*nats.StreamConfig {
+		{
+			Name:      opts.Stream,
+			Subjects:  []string { "oneseismic.jobs.>" },
+			Retention: nats.WorkQueuePolicy,
+			MaxAge:    opts.TTL,
+		},
+		{
+			Name:      natsPartsStream,
+			Subjects:  []string { "oneseismic.parts.>" },
+			Retention: nats.LimitsPolicy,
+			MaxAge:    opts.TTL,
+		},
+		{
+			Name:      natsProcsStream,
+			Subjects:  []string {
+				"oneseismic.header.*",
+				"oneseismic.cancelled.*",
+				"oneseismic.failed.*",
+			},
+			Retention: nats.LimitsPolicy,
+			MaxAge:    opts.TTL,
+		},
+	}
+	/*
+	 * Create the streams if they do not exist. Like with redis, the services
+	 * start in parallel and all try to create them, which is harmless.
+	 */
+	for _, cfg := range streams {
+		if _, err := js.StreamInfo(cfg.Name); err == nil {
+			continue
+		}
+		if _, err := js.AddStream(cfg); err != nil {
+			return nil, fmt.Errorf("unable to create stream %s: %w", cfg.Name, err)
+		}
+	}
+
+	return &natsQueue {
+		conn:     conn,
+		js:       js,
+		opts:     opts,
+		subs:     make(map[string]*nats.Subscription),
+		inflight: make(map[string]*nats.Msg),
+	}, nil
+}
+
+type natsAPIError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+func (e *natsAPIError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Description)
+}
+
+type natsStoredMsg struct {
+	Subject  string `json:"subject"`
+	Sequence uint64 `json:"seq"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+type natsMsgGetRequest struct {
+	Seq        uint64 `json:"seq,omitempty"`
+	LastBySubj string `json:"last_by_subj,omitempty"`
+	NextBySubj string `json:"next_by_subj,omitempty"`
+}
+
+type natsMsgGetResponse struct {
+	Error   *natsAPIError  `json:"error,omitempty"`
+	Message *natsStoredMsg `json:"message,omitempty"`
+}
+
+type natsStreamInfoRequest struct {
+	SubjectsFilter string `json:"subjects_filter"`
+	Offset         int    `json:"offset,omitempty"`
+}
+
+/*
+ * The subjects of the stream matching the filter, with the number of messages
+ * for each. Servers with paging (2.10+) return at most limit subjects at a
+ * time, starting at offset, out of the total.
+ */
+type natsStreamInfoResponse struct {
+	Error  *natsAPIError `json:"error,omitempty"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+	State  struct {
+		Subjects map[string]uint64 `json:"subjects"`
+	} `json:"state"`
+}
+
+type natsPurgeRequest struct {
+	Filter string `json:"filter"`
+}
+
+type natsPurgeResponse struct {
+	Error  *natsAPIError `json:"error,omitempty"`
+	Purged int64         `json:"purged"`
+}
+
+/*
+ * Get a message from the stream, or nil if there is no such message.
+ */
+func (q *natsQueue) getMsg(
+	ctx    context.Context,
+	stream string,
+	req    natsMsgGetRequest,
+) (*natsStoredMsg, error) {
+	doc, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	subject := fmt.Sprintf("$JS.API.STREAM.MSG.GET.%s", stream)
+	reply, err := q.conn.RequestWithContext(ctx, subject, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp natsMsgGetResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		if resp.Error.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, resp.Error
+	}
+	return resp.Message, nil
+}
+
+func (q *natsQueue) lastMsg(
+	ctx     context.Context,
+	subject string,
+) (*natsStoredMsg, error) {
+	req := natsMsgGetRequest { LastBySubj: subject }
+	return q.getMsg(ctx, natsProcsStream, req)
+}
+
+func (q *natsQueue) PutHeader(
+	ctx    context.Context,
+	pid    string,
+	header []byte,
+) error {
+	if err := natsCheckToken(pid); err != nil {
+		return err
+	}
+	subject := natsProcSubject("header", pid)
+	_, err := q.js.Publish(subject, header, nats.Context(ctx))
+	return err
+}
+
+func (q *natsQueue) GetHeader(ctx context.Context, pid string) ([]byte, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return nil, err
+	}
+	msg, err := q.lastMsg(ctx, natsProcSubject("header", pid))
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrNotFound
+	}
+	return msg.Data, nil
+}
+
+/*
+ * Like WaitParts, the subscription is made before checking, so that the
+ * header is not missed if it is written in between.
+ */
+func (q *natsQueue) WaitHeader(
+	ctx   context.Context,
+	pid   string,
+	block time.Duration,
+) ([]byte, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return nil, err
+	}
+
+	changed := make(chan *nats.Msg, 1)
+	subject := natsProcSubject("header", pid)
+	sub, err := q.conn.ChanSubscribe(subject, changed)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	header, err := q.GetHeader(ctx, pid)
+	if err != ErrNotFound {
+		return header, err
+	}
+
+	timer := time.NewTimer(block)
+	defer timer.Stop()
+	select {
+	case msg := <-changed:
+		return msg.Data, nil
+	case <-timer.C:
+		return nil, ErrNotFound
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *natsQueue) Enqueue(ctx context.Context, task Task) error {
+	if err := natsCheckToken(task.Pid); err != nil {
+		return err
+	}
+	if err := natsCheckToken(task.Part); err != nil {
+		return err
+	}
+	subject := natsJobSubject(task.Pid, task.Part)
+	_, err := q.js.Publish(subject, task.Body, nats.Context(ctx))
+	return err
+}
+
+func (q *natsQueue) Join(ctx context.Context, consumer string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if _, ok := q.subs[consumer]; ok {
+		return nil
+	}
+
+	/*
+	 * The consumer is created up front, rather than by PullSubscribe, so
+	 * that the ack wait can be set. Adding a consumer that already exists
+	 * with the same config is a no-op.
+	 */
+	subject := "oneseismic.jobs.>"
+	_, err := q.js.AddConsumer(q.opts.Stream, &nats.ConsumerConfig {
+		Durable:       q.opts.Group,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       q.opts.ReclaimIdle,
+		FilterSubject: subject,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create consumer %s: %w", q.opts.Group, err)
+	}
+
+	sub, err := q.js.PullSubscribe(
+		subject,
+		q.opts.Group,
+		nats.BindStream(q.opts.Stream),
+	)
+	if err != nil {
+		return err
+	}
+	q.subs[consumer] = sub
+	return nil
+}
+
+func (q *natsQueue) Dequeue(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Job, error) {
+	q.lock.Lock()
+	sub, ok := q.subs[consumer]
+	q.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("consumer %s has not joined", consumer)
+	}
+
+	msgs, err := sub.Fetch(1, nats.MaxWait(block))
+	if err == nats.ErrTimeout {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, len(msgs))
+	for _, msg := range msgs {
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		pid, part, err := natsSplitSubject(msg.Subject)
+		if err != nil {
+			msg.Term()
+			return nil, err
+		}
+
+		id := strconv.FormatUint(meta.Sequence.Stream, 10)
+		if q.opts.AtLeastOnce {
+			q.lock.Lock()
+			q.inflight[id] = msg
+			q.lock.Unlock()
+		} else if err := msg.AckSync(); err != nil {
+			return nil, fmt.Errorf("unable to ack %s: %w", id, err)
+		}
+
+		jobs = append(jobs, Job {
+			ID:   id,
+			Task: Task { Pid: pid, Part: part, Body: msg.Data },
+		})
+	}
+	return jobs, nil
+}
+
+func (q *natsQueue) Ack(ctx context.Context, job Job) error {
+	if !q.opts.AtLeastOnce {
+		return nil
+	}
+	q.lock.Lock()
+	msg, ok := q.inflight[job.ID]
+	delete(q.inflight, job.ID)
+	q.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("job %s is not in flight", job.ID)
+	}
+	return msg.AckSync()
+}
+
+func (q *natsQueue) Reclaim(ctx context.Context, consumer string) ([]Job, error) {
+	return nil, nil
+}
+
+func (q *natsQueue) Remove(ctx context.Context, pid string) (int64, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return 0, err
+	}
+	doc, err := json.Marshal(natsPurgeRequest {
+		Filter: natsJobSubject(pid, "*"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	subject := fmt.Sprintf("$JS.API.STREAM.PURGE.%s", q.opts.Stream)
+	reply, err := q.conn.RequestWithContext(ctx, subject, doc)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp natsPurgeResponse
+	if err := json.Unmarshal(reply.Data, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		return 0, resp.Error
+	}
+	return resp.Purged, nil
+}
+
+/*
+ * The consumer is shared by the group, and is kept. Jobs that are read but
+ * not acknowledged are redelivered to other workers after ReclaimIdle.
+ */
+func (q *natsQueue) Leave(ctx context.Context, consumer string) error {
+	q.lock.Lock()
+	sub, ok := q.subs[consumer]
+	delete(q.subs, consumer)
+	q.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return sub.Unsubscribe()
+}
+
+func (q *natsQueue) PutPart(ctx context.Context, pid string, part Part) error {
+	if err := natsCheckToken(pid); err != nil {
+		return err
+	}
+	if err := natsCheckToken(part.Name); err != nil {
+		return err
+	}
+	subject := natsPartSubject(pid, part.Name)
+	_, err := q.js.Publish(subject, part.Data, nats.Context(ctx))
+	return err
+}
+
+/*
+ * Read the parts after the cursor, which is the stream sequence of the last
+ * part read.
+ */
+func (q *natsQueue) nextParts(
+	ctx    context.Context,
+	pid    string,
+	cursor uint64,
+) ([]Part, uint64, error) {
+	filter := natsPartSubject(pid, "*")
+	parts := make([]Part, 0)
+	for {
+		msg, err := q.getMsg(ctx, natsPartsStream, natsMsgGetRequest {
+			Seq:        cursor + 1,
+			NextBySubj: filter,
+		})
+		if err != nil {
+			return nil, cursor, err
+		}
+		if msg == nil {
+			return parts, cursor, nil
+		}
+
+		_, name, err := natsSplitSubject(msg.Subject)
+		if err != nil {
+			return nil, cursor, err
+		}
+		parts = append(parts, Part { Name: name, Data: msg.Data })
+		cursor = msg.Sequence
+	}
+}
+
+func (q *natsQueue) ReadParts(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+	block  time.Duration,
+) ([]Part, string, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return nil, cursor, err
+	}
+	var seq uint64
+	if cursor != "" {
+		n, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, cursor, fmt.Errorf("bad cursor %s", cursor)
+		}
+		seq = n
+	}
+
+	/*
+	 * Parts published to the stream are also delivered to plain
+	 * subscribers, which is used to wake up when a new part is written. The
+	 * subscription is made before reading, so that no part is missed.
+	 */
+	sub, err := q.conn.SubscribeSync(natsPartSubject(pid, "*"))
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer sub.Unsubscribe()
+
+	deadline := time.Now().Add(block)
+	for {
+		parts, next, err := q.nextParts(ctx, pid, seq)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if len(parts) > 0 {
+			return parts, strconv.FormatUint(next, 10), nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 || ctx.Err() != nil {
+			return nil, cursor, ctx.Err()
+		}
+		_, err = sub.NextMsg(remaining)
+		if err == nats.ErrTimeout {
+			return nil, cursor, nil
+		}
+		if err != nil {
+			return nil, cursor, err
+		}
+	}
+}
+
+/*
+ * Every part has its own subject, so the distinct parts are the subjects of
+ * the process in the parts stream, which the server counts without sending
+ * the parts.
+ */
+func (q *natsQueue) CountParts(ctx context.Context, pid string) (int64, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return 0, err
+	}
+
+	subject := fmt.Sprintf("$JS.API.STREAM.INFO.%s", natsPartsStream)
+	count := 0
+	for {
+		doc, err := json.Marshal(natsStreamInfoRequest {
+			SubjectsFilter: natsPartSubject(pid, "*"),
+			Offset:         count,
+		})
+		if err != nil {
+			return 0, err
+		}
+		reply, err := q.conn.RequestWithContext(ctx, subject, doc)
+		if err != nil {
+			return 0, err
+		}
+
+		var resp natsStreamInfoResponse
+		if err := json.Unmarshal(reply.Data, &resp); err != nil {
+			return 0, err
+		}
+		if resp.Error != nil {
+			return 0, resp.Error
+		}
+
+		n := len(resp.State.Subjects)
+		count += n
+		if n == 0 || count >= resp.Total {
+			return int64(count), nil
+		}
+	}
+}
+
+/*
+ * Like ReadParts, the subscriptions are made before checking, so that no
+ * change is missed. The cancel and failure messages are published to the
+ * proc subjects, and wake up the wait too.
+ */
+func (q *natsQueue) WaitParts(
+	ctx   context.Context,
+	pid   string,
+	count int64,
+	block time.Duration,
+) error {
+	if err := natsCheckToken(pid); err != nil {
+		return err
+	}
+
+	changed := make(chan *nats.Msg, 64)
+	subjects := []string {
+		natsPartSubject(pid, "*"),
+		natsProcSubject("cancelled", pid),
+		natsProcSubject("failed", pid),
+	}
+	for _, subject := range subjects {
+		sub, err := q.conn.ChanSubscribe(subject, changed)
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+
+	timer := time.NewTimer(block)
+	defer timer.Stop()
+	for {
+		n, err := q.CountParts(ctx, pid)
+		if err != nil {
+			return err
+		}
+		stop, err := q.Cancelled(ctx, pid)
+		if err != nil {
+			return err
+		}
+		failure, err := q.Failure(ctx, pid)
+		if err != nil {
+			return err
+		}
+		if n > count || stop || failure != nil {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (q *natsQueue) Cancel(ctx context.Context, pid string) error {
+	if err := natsCheckToken(pid); err != nil {
+		return err
+	}
+	subject := natsProcSubject("cancelled", pid)
+	_, err := q.js.Publish(subject, nil, nats.Context(ctx))
+	return err
+}
+
+func (q *natsQueue) Cancelled(ctx context.Context, pid string) (bool, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return false, err
+	}
+	msg, err := q.lastMsg(ctx, natsProcSubject("cancelled", pid))
+	return msg != nil, err
+}
+
+func (q *natsQueue) Cancellations(ctx context.Context) (<-chan string, error) {
+	msgs := make(chan *nats.Msg, 64)
+	sub, err := q.conn.ChanSubscribe(natsProcSubject("cancelled", "*"), msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make(chan string)
+	go func() {
+		defer close(pids)
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case msg := <-msgs:
+				pid := strings.TrimPrefix(
+					msg.Subject,
+					natsProcSubject("cancelled", ""),
+				)
+				select {
+				case pids <- pid:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return pids, nil
+}
+
+/*
+ * The failure is only published if there is no failure for the process
+ * already, which the server checks atomically with the expected last
+ * subject sequence.
+ */
+func (q *natsQueue) Fail(ctx context.Context, pid string, failure []byte) error {
+	if err := natsCheckToken(pid); err != nil {
+		return err
+	}
+	msg := nats.NewMsg(natsProcSubject("failed", pid))
+	msg.Header.Set("Nats-Expected-Last-Subject-Sequence", "0")
+	msg.Data = failure
+	_, err := q.js.PublishMsg(msg, nats.Context(ctx))
+	if err != nil && strings.Contains(err.Error(), "wrong last sequence") {
+		return nil
+	}
+	return err
+}
+
+func (q *natsQueue) Failure(ctx context.Context, pid string) ([]byte, error) {
+	if err := natsCheckToken(pid); err != nil {
+		return nil, err
+	}
+	msg, err := q.lastMsg(ctx, natsProcSubject("failed", pid))
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
@@ -0,0 +1,266 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNatsSubjectRoundtrip(t *testing.T) {
+	pid, part, err := natsSplitSubject(natsJobSubject("pid", "1/3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pid", pid)
+	assert.Equal(t, "1/3", part)
+
+	_, _, err = natsSplitSubject("oneseismic.header.pid")
+	assert.Error(t, err)
+}
+
+func TestNatsRejectsWildcardTokens(t *testing.T) {
+	for _, token := range []string { "", "a.b", "*", ">", "a b" } {
+		assert.Error(t, natsCheckToken(token), "token = %q", token)
+	}
+	assert.NoError(t, natsCheckToken("0/2"))
+}
+
+/*
+ * Run an embedded nats-server with JetStream for the test, and open a queue on
+ * it. Every test gets its own server, so the streams start out empty.
+ */
+func natsQueueForTest(t *testing.T, opts Options) Queue {
+	s, err := server.NewServer(&server.Options {
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("unable to start nats-server: %v", err)
+	}
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats-server not ready")
+	}
+
+	q, err := Open(Connection { NatsURL: s.ClientURL() }, opts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return q
+}
+
+func TestNatsHeaderRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+
+	_, err := q.GetHeader(ctx, "a")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, q.PutHeader(ctx, "a", []byte("header")))
+	header, err := q.GetHeader(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+}
+
+func TestNatsWaitHeaderWakesOnPutHeader(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+
+	_, err := q.WaitHeader(ctx, "a", 10 * time.Millisecond)
+	assert.Equal(t, ErrNotFound, err)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutHeader(ctx, "a", []byte("header"))
+	}()
+	start := time.Now()
+	header, err := q.WaitHeader(ctx, "a", 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+	assert.True(t, time.Since(start) < 5 * time.Second)
+}
+
+func TestNatsDequeueAndAck(t *testing.T) {
+	ctx := context.Background()
+	opts := DefaultOptions()
+	opts.AtLeastOnce = true
+	q := natsQueueForTest(t, opts)
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2", Body: []byte("x") })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2", Body: []byte("y") })
+	assert.NoError(t, q.Join(ctx, "c"))
+
+	first, err := q.Dequeue(ctx, "c", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, first, 1)
+	expected := Task { Pid: "a", Part: "0/2", Body: []byte("x") }
+	assert.Equal(t, expected, first[0].Task)
+	assert.NoError(t, q.Ack(ctx, first[0]))
+	assert.Error(t, q.Ack(ctx, first[0]))
+
+	second, err := q.Dequeue(ctx, "c", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, second, 1)
+	assert.Equal(t, "1/2", second[0].Part)
+	assert.NoError(t, q.Ack(ctx, second[0]))
+
+	empty, err := q.Dequeue(ctx, "c", 10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+	assert.NoError(t, q.Leave(ctx, "c"))
+}
+
+func TestNatsRedeliversUnackedJobs(t *testing.T) {
+	ctx := context.Background()
+	opts := DefaultOptions()
+	opts.AtLeastOnce = true
+	opts.ReclaimIdle = 100 * time.Millisecond
+	q := natsQueueForTest(t, opts)
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/1" })
+	assert.NoError(t, q.Join(ctx, "c1"))
+	assert.NoError(t, q.Join(ctx, "c2"))
+
+	abandoned, err := q.Dequeue(ctx, "c1", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, abandoned, 1)
+
+	jobs, err := q.Dequeue(ctx, "c2", 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, abandoned[0].Task, jobs[0].Task)
+	assert.NoError(t, q.Ack(ctx, jobs[0]))
+}
+
+func TestNatsRemoveOnlyTasksOfThePid(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2" })
+	q.Enqueue(ctx, Task { Pid: "b", Part: "0/1" })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2" })
+
+	n, err := q.Remove(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	assert.NoError(t, q.Join(ctx, "c"))
+	jobs, err := q.Dequeue(ctx, "c", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "b", jobs[0].Pid)
+
+	empty, err := q.Dequeue(ctx, "c", 10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+}
+
+func TestNatsReadPartsFromCursor(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+	q.PutPart(ctx, "a", Part { Name: "0/2", Data: []byte("x") })
+	q.PutPart(ctx, "b", Part { Name: "0/1", Data: []byte("z") })
+
+	parts, cursor, err := q.ReadParts(ctx, "a", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "0/2", Data: []byte("x") } }, parts)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutPart(ctx, "a", Part { Name: "1/2", Data: []byte("y") })
+	}()
+	parts, _, err = q.ReadParts(ctx, "a", cursor, 5 * time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "1/2", Data: []byte("y") } }, parts)
+}
+
+func TestNatsCountDistinctParts(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+
+	n, err := q.CountParts(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+	q.PutPart(ctx, "a", Part { Name: "1/2" })
+	q.PutPart(ctx, "b", Part { Name: "0/1" })
+
+	n, err = q.CountParts(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestNatsWaitPartsWakesOnNewPart(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+	q.PutPart(ctx, "a", Part { Name: "0/2" })
+
+	/* the part already written does not count */
+	start := time.Now()
+	assert.NoError(t, q.WaitParts(ctx, "a", 1, 20 * time.Millisecond))
+	assert.True(t, time.Since(start) >= 20 * time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.PutPart(ctx, "a", Part { Name: "1/2" })
+	}()
+	assert.NoError(t, q.WaitParts(ctx, "a", 1, 5 * time.Second))
+	n, _ := q.CountParts(ctx, "a")
+	assert.Equal(t, int64(2), n)
+}
+
+func TestNatsWaitPartsWakesOnCancel(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Cancel(ctx, "a")
+	}()
+
+	start := time.Now()
+	assert.NoError(t, q.WaitParts(ctx, "a", 0, 5 * time.Second))
+	assert.True(t, time.Since(start) < 5 * time.Second)
+	stop, _ := q.Cancelled(ctx, "a")
+	assert.True(t, stop)
+}
+
+func TestNatsKeepsFirstFailure(t *testing.T) {
+	ctx := context.Background()
+	q := natsQueueForTest(t, DefaultOptions())
+
+	failure, err := q.Failure(ctx, "a")
+	assert.NoError(t, err)
+	assert.Nil(t, failure)
+
+	assert.NoError(t, q.Fail(ctx, "a", []byte("first")))
+	assert.NoError(t, q.Fail(ctx, "a", []byte("second")))
+	failure, err = q.Failure(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), failure)
+}
+
+func TestNatsCancelIsAnnounced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := natsQueueForTest(t, DefaultOptions())
+	pids, err := q.Cancellations(ctx)
+	assert.NoError(t, err)
+
+	stop, err := q.Cancelled(ctx, "a")
+	assert.NoError(t, err)
+	assert.False(t, stop)
+
+	assert.NoError(t, q.Cancel(ctx, "a"))
+	assert.Equal(t, "a", <-pids)
+	stop, err = q.Cancelled(ctx, "a")
+	assert.NoError(t, err)
+	assert.True(t, stop)
+
+	cancel()
+	_, ok := <-pids
+	assert.False(t, ok)
+}
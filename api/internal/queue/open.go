@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nats-io/nats.go"
+)
+
+/*
+ * Where the queue is, as given by the options the services share:
+ * --redis-url, --redis-password, --secure-connections and --nats-url.
+ */
+type Connection struct {
+	RedisURL          string
+	RedisPassword     string
+	SecureConnections bool
+	NatsURL           string
+}
+
+/*
+ * Open the queue on NATS JetStream if the NATS URL is set, and on redis
+ * otherwise. The connection is kept open for the lifetime of the program.
+ */
+func Open(c Connection, opts Options) (Queue, error) {
+	if c.NatsURL != "" {
+		conn, err := nats.Connect(c.NatsURL)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to %s: %w", c.NatsURL, err)
+		}
+		return NewNATS(conn, opts)
+	}
+
+	redisOptions := &redis.Options{
+		Addr:     c.RedisURL,
+		Password: c.RedisPassword,
+		DB:       0,
+	}
+
+	if c.SecureConnections {
+		redisOptions.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return NewRedis(redis.NewClient(redisOptions), opts), nil
+}
@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/*
+ * This package abstracts the message broker that ties the services together.
+ * A process is scheduled by the query service as a header and a set of tasks,
+ * the tasks are run by the fetch workers which write the parts of the result,
+ * and the result service collects the parts and streams them to the client:
+ *
+ *     query  -> PutHeader, Enqueue
+ *     fetch  -> Dequeue, PutPart, Ack (or Fail)
+ *     result -> WaitHeader, ReadParts, CountParts, WaitParts, Cancel
+ *
+ * There are three implementations: redis streams, which is what the services
+ * are deployed with, NATS JetStream for deployments where redis is not
+ * available, and an in-process queue, which lets all the services run in the
+ * same binary.
+ *
+ * Everything written for a process expires after the TTL of the queue, so
+ * that abandoned processes do not pile up.
+ */
+
+/*
+ * ErrNotFound is returned by GetHeader when the process does not exist, or
+ * has expired.
+ */
+var ErrNotFound = errors.New("not found")
+
+/*
+ * A task, i.e. a part of a process, as scheduled by the query service. The
+ * part is on the form i/n, and the body is the task document.
+ */
+type Task struct {
+	Pid  string
+	Part string
+	Body []byte
+}
+
+/*
+ * A task read from the job queue. The ID identifies this delivery of the
+ * task, and is what is acknowledged.
+ *
+ * A job can have a nil body, when the task was removed (e.g. by cancel) after
+ * it was delivered but before it was acknowledged, and such jobs should just
+ * be acknowledged.
+ */
+type Job struct {
+	ID string
+	Task
+}
+
+/*
+ * A part of the result, where the name is the part of the task that made it.
+ */
+type Part struct {
+	Name string
+	Data []byte
+}
+
+type Options struct {
+	/*
+	 * The name of the job queue. Must be the same for the producer and the
+	 * workers.
+	 */
+	Stream string
+	/*
+	 * The consumer group of the workers. All workers should be in the same
+	 * group for fair distribution of work.
+	 */
+	Group string
+	/*
+	 * Consume tasks at-least-once. Tasks must then be acknowledged when they
+	 * are done, and tasks that are not acknowledged within ReclaimIdle are
+	 * delivered again. Otherwise, tasks are removed as soon as they are read.
+	 */
+	AtLeastOnce bool
+	ReclaimIdle time.Duration
+	/*
+	 * Time-to-live for the process, i.e. after this duration the header,
+	 * results and state of the process are cleaned up.
+	 */
+	TTL time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options {
+		Stream:      "jobs",
+		Group:       "fetch",
+		ReclaimIdle: time.Minute,
+		TTL:         10 * time.Minute,
+	}
+}
+
+type Queue interface {
+	/*
+	 * The process header is written before the tasks are scheduled, and read
+	 * by the result service to know how many parts to wait for.
+	 */
+	PutHeader(ctx context.Context, pid string, header []byte) error
+	GetHeader(ctx context.Context, pid string) ([]byte, error)
+
+	/*
+	 * Like GetHeader, but wait at most block for the header to be written.
+	 * Returns ErrNotFound if it is not written before block expires.
+	 */
+	WaitHeader(
+		ctx   context.Context,
+		pid   string,
+		block time.Duration,
+	) ([]byte, error)
+
+	/*
+	 * Add a task to the job queue.
+	 */
+	Enqueue(ctx context.Context, task Task) error
+
+	/*
+	 * Join the consumer group, which creates the job queue if needed. Must
+	 * be called by a worker before it dequeues any tasks.
+	 */
+	Join(ctx context.Context, consumer string) error
+
+	/*
+	 * Read the next task, waiting at most block for one to be available.
+	 * Returns no jobs (and no error) if the wait times out.
+	 */
+	Dequeue(
+		ctx      context.Context,
+		consumer string,
+		block    time.Duration,
+	) ([]Job, error)
+
+	/*
+	 * Mark the job as done. This is a no-op for at-most-once queues.
+	 */
+	Ack(ctx context.Context, job Job) error
+
+	/*
+	 * Claim the jobs that have been pending for longer than ReclaimIdle,
+	 * e.g. because the worker running them died. A queue that redelivers
+	 * abandoned jobs by itself returns nothing.
+	 */
+	Reclaim(ctx context.Context, consumer string) ([]Job, error)
+
+	/*
+	 * Remove the queued tasks of a process, and return how many were
+	 * removed.
+	 */
+	Remove(ctx context.Context, pid string) (int64, error)
+
+	/*
+	 * Leave the consumer group. In at-least-once mode, a consumer with
+	 * pending jobs is not removed, so that the jobs can be reclaimed, and an
+	 * error is returned.
+	 */
+	Leave(ctx context.Context, consumer string) error
+
+	/*
+	 * Write a part of the result. A part can be written more than once, e.g.
+	 * when a slow task is reclaimed by another worker.
+	 */
+	PutPart(ctx context.Context, pid string, part Part) error
+
+	/*
+	 * Read the parts written after the cursor, waiting at most block for new
+	 * parts. The empty cursor is the start of the result. Returns the parts
+	 * and the cursor to continue reading from.
+	 */
+	ReadParts(
+		ctx    context.Context,
+		pid    string,
+		cursor string,
+		block  time.Duration,
+	) ([]Part, string, error)
+
+	/*
+	 * The number of distinct parts written.
+	 */
+	CountParts(ctx context.Context, pid string) (int64, error)
+
+	/*
+	 * Wait until more than count distinct parts are written, the process is
+	 * cancelled or failed, or block expires, whichever comes first. This is
+	 * for waiting on the process without reading the parts, and the state
+	 * must be checked again after, as the wait can end early.
+	 */
+	WaitParts(
+		ctx   context.Context,
+		pid   string,
+		count int64,
+		block time.Duration,
+	) error
+
+	/*
+	 * Mark the process as cancelled, and announce it to the workers.
+	 */
+	Cancel(ctx context.Context, pid string) error
+	Cancelled(ctx context.Context, pid string) (bool, error)
+
+	/*
+	 * The pids of processes as they are cancelled. The channel is closed
+	 * when the context is done.
+	 */
+	Cancellations(ctx context.Context) (<-chan string, error)
+
+	/*
+	 * Record the failure of a process. Only the first failure is kept, as it
+	 * is usually the cause of the others. Failure returns nil if no failure
+	 * is recorded.
+	 */
+	Fail(ctx context.Context, pid string, failure []byte) error
+	Failure(ctx context.Context, pid string) ([]byte, error)
+}
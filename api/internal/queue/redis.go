@@ -0,0 +1,652 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * The queue on redis. The tasks are added to a stream (the job queue), which
+ * the workers read in a consumer group. The parts of a process are written to
+ * a stream named after the pid, and the rest is plain keys:
+ *
+ *     jobs                 the job queue, fields pid, part and task
+ *     <pid>/tasks          the ids of the tasks of the process in the queue
+ *     <pid>                the parts, with the part name as field
+ *     <pid>/header.json    the process header
+ *     <pid>/parts          the set of parts written
+ *     <pid>/cancelled      set when the process is cancelled
+ *     <pid>/failed         the first failure
+ *
+ * Cancelled pids are published on the cancel channel.
+ *
+ * In at-most-once mode the tasks are read with NoAck and deleted right away,
+ * which emulates a fire-and-forget job queue. In at-least-once mode the tasks
+ * are kept in the pending entries list (PEL) of the consumer group until they
+ * are acknowledged, and tasks that have been pending for too long are claimed
+ * by other workers with XAUTOCLAIM.
+ */
+type redisQueue struct {
+	client redis.Cmdable
+	opts   Options
+}
+
+func NewRedis(client redis.Cmdable, opts Options) Queue {
+	return &redisQueue { client: client, opts: opts }
+}
+
+/*
+ * Silly helper to centralise the name/key of the header object. It's not
+ * likely to change too much, but it beats hardcoding the key with formatting
+ * all over the place.
+ */
+func headerkey(pid string) string {
+	return fmt.Sprintf("%s/header.json", pid)
+}
+
+/*
+ * The set of the (stream) ids of the tasks of the process, so that the tasks
+ * can be removed from the queue without scanning it.
+ */
+func taskskey(pid string) string {
+	return fmt.Sprintf("%s/tasks", pid)
+}
+
+func (r *redisQueue) PutHeader(
+	ctx    context.Context,
+	pid    string,
+	header []byte,
+) error {
+	return r.client.Set(ctx, headerkey(pid), header, r.opts.TTL).Err()
+}
+
+func (r *redisQueue) GetHeader(ctx context.Context, pid string) ([]byte, error) {
+	header, err := r.client.Get(ctx, headerkey(pid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return header, err
+}
+
+/*
+ * Redis has no blocking GET, and keyspace notifications are not enabled by
+ * default, so the header is polled. The query service writes the header
+ * before it hands out the pid, so the header is almost always there on the
+ * first read, and polling is rare.
+ */
+func (r *redisQueue) WaitHeader(
+	ctx   context.Context,
+	pid   string,
+	block time.Duration,
+) ([]byte, error) {
+	const interval = 50 * time.Millisecond
+	deadline := time.Now().Add(block)
+	for {
+		header, err := r.GetHeader(ctx, pid)
+		if err != ErrNotFound {
+			return header, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrNotFound
+		}
+		if remaining > interval {
+			remaining = interval
+		}
+		select {
+		case <-time.After(remaining):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+ * Add the task to the job queue and its id to the tasks of the process. The
+ * id is assigned by XADD and needed by SADD, so the commands cannot be
+ * pipelined, but running them as a script makes Enqueue a single round trip,
+ * and the task is never in the queue without being recorded in <pid>/tasks.
+ *
+ *     KEYS = [stream, <pid>/tasks]
+ *     ARGV = [pid, part, task, ttl (ms)]
+ */
+var enqueueScript = redis.NewScript(`
+local id = redis.call('XADD', KEYS[1], '*',
+    'pid',  ARGV[1],
+    'part', ARGV[2],
+    'task', ARGV[3]
+)
+redis.call('SADD', KEYS[2], id)
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return id
+`)
+
+func (r *redisQueue) Enqueue(ctx context.Context, task Task) error {
+	keys := []string { r.opts.Stream, taskskey(task.Pid) }
+	err := enqueueScript.Run(
+		ctx,
+		r.client,
+		keys,
+		task.Pid,
+		task.Part,
+		task.Body,
+		r.opts.TTL.Milliseconds(),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("unable to enqueue %s %s: %w", task.Pid, task.Part, err)
+	}
+	return nil
+}
+
+func (r *redisQueue) Join(ctx context.Context, consumer string) error {
+	/*
+	 * Always try to create the group and stream. The stream may have already
+	 * been created, but that is a soft error to be discarded. In fact, the
+	 * stream and group *probably* exists already because nodes connect in
+	 * parallel.
+	 *
+	 * The XGroupCreate command is really just a try-create and fits well
+	 * here, it offloads all the concurrency issues to redis.
+	 */
+	err := r.client.XGroupCreateMkStream(
+		ctx,
+		r.opts.Stream,
+		r.opts.Group,
+		"0",
+	).Err()
+	if err != nil {
+		// Check if the response is a redis error (= BUSYGROUP), which just
+		// means the group already exists and nothing happens, or if it is a
+		// network error or something
+		_, busygroup := err.(interface{RedisError()});
+		if !busygroup {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Curiously, the XReadGroup/XStream values end up being map[string]string
+ * effectively. This is detail of the go library where it uses ReadLine()
+ * internally - redis uses byte strings as strings anyway.
+ */
+func redisJob(msg redis.XMessage) (Job, error) {
+	job := Job { ID: msg.ID }
+	if msg.Values == nil {
+		return job, nil
+	}
+
+	pid,  ok1 := msg.Values["pid" ].(string)
+	part, ok2 := msg.Values["part"].(string)
+	body, ok3 := msg.Values["task"].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return job, fmt.Errorf("job %s: bad fields %v", msg.ID, msg.Values)
+	}
+	job.Task = Task { Pid: pid, Part: part, Body: []byte(body) }
+	return job, nil
+}
+
+func (r *redisQueue) Dequeue(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Job, error) {
+	/*
+	 * Only one task is read at a time, as tasks download multiple fragments.
+	 * This is a design decision from before redis streams, but it works well
+	 * with redis streams too.
+	 */
+	args := redis.XReadGroupArgs {
+		Group:    r.opts.Group,
+		Consumer: consumer,
+		Streams:  []string { r.opts.Stream, ">", },
+		Count:    1,
+		Block:    block,
+		NoAck:    !r.opts.AtLeastOnce,
+	}
+	streams, err := r.client.XReadGroup(ctx, &args).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job, 0, 1)
+	ids  := make([]string, 0, 1)
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			job, err := redisJob(msg)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, job)
+			ids  = append(ids, msg.ID)
+		}
+	}
+
+	if !r.opts.AtLeastOnce && len(ids) > 0 {
+		/*
+		 * Delete the message once it has been read, in order to stop the
+		 * infinite growth of the job queue.
+		 *
+		 * This is the simplest solution that is correct [1] - the node that
+		 * gets a job also deletes it. Unfortunately it also means more
+		 * traffic back to the central job queue node. In redis6.2 the XTRIM
+		 * MINID strategy is introduced, which opens up some interesting
+		 * strategies for cleaning up the job queue. This is work for later
+		 * though.
+		 *
+		 * [1] except in some crashing scenarios
+		 */
+		err := r.client.XDel(ctx, r.opts.Stream, ids...).Err()
+		if err != nil {
+			return jobs, fmt.Errorf("unable to XDEL: %w", err)
+		}
+	}
+	return jobs, nil
+}
+
+func (r *redisQueue) Ack(ctx context.Context, job Job) error {
+	if !r.opts.AtLeastOnce {
+		return nil
+	}
+	err := r.client.XAck(ctx, r.opts.Stream, r.opts.Group, job.ID).Err()
+	if err != nil {
+		return fmt.Errorf("unable to XACK %s: %w", job.ID, err)
+	}
+	err = r.client.XDel(ctx, r.opts.Stream, job.ID).Err()
+	if err != nil {
+		return fmt.Errorf("unable to XDEL %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+/*
+ * The go-redis version used has no XAutoClaim, so the command is issued
+ * through Do(), which the redis.Client implements, but redis.Cmdable does not
+ * include.
+ */
+type claimer interface {
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
+}
+
+/*
+ * Parse the XAUTOCLAIM reply, which is an array of the cursor (the start for
+ * the next call) and the claimed messages. Redis >= 7 adds a third element
+ * with the IDs of deleted messages, which are ignored. Messages that are
+ * deleted but still pending are returned (by redis 6.2) with nil fields, and
+ * are returned as messages with nil Values, so that the caller can
+ * acknowledge them.
+ */
+func parseAutoclaim(reply interface{}) ([]redis.XMessage, string, error) {
+	xs, ok := reply.([]interface{})
+	if !ok || len(xs) < 2 {
+		return nil, "", fmt.Errorf("XAUTOCLAIM: unexpected reply %v", reply)
+	}
+
+	next, ok := xs[0].(string)
+	if !ok {
+		return nil, "", fmt.Errorf("XAUTOCLAIM: bad cursor %v", xs[0])
+	}
+
+	entries, ok := xs[1].([]interface{})
+	if !ok {
+		return nil, "", fmt.Errorf("XAUTOCLAIM: bad entries %v", xs[1])
+	}
+
+	msgs := make([]redis.XMessage, 0, len(entries))
+	for _, entry := range entries {
+		kv, ok := entry.([]interface{})
+		if !ok || len(kv) != 2 {
+			return nil, "", fmt.Errorf("XAUTOCLAIM: bad entry %v", entry)
+		}
+		id, ok := kv[0].(string)
+		if !ok {
+			return nil, "", fmt.Errorf("XAUTOCLAIM: bad id %v", kv[0])
+		}
+		if kv[1] == nil {
+			msgs = append(msgs, redis.XMessage { ID: id })
+			continue
+		}
+
+		fields, ok := kv[1].([]interface{})
+		if !ok || len(fields) % 2 != 0 {
+			return nil, "", fmt.Errorf("XAUTOCLAIM: bad fields %v", kv[1])
+		}
+		values := make(map[string]interface{}, len(fields) / 2)
+		for i := 0; i < len(fields); i += 2 {
+			key, ok := fields[i].(string)
+			if !ok {
+				return nil, "", fmt.Errorf("XAUTOCLAIM: bad key %v", fields[i])
+			}
+			values[key] = fields[i + 1]
+		}
+		msgs = append(msgs, redis.XMessage { ID: id, Values: values })
+	}
+	return msgs, next, nil
+}
+
+/*
+ * Claim the messages that have been pending for at least idle, starting at
+ * start. Returns the claimed messages and the start for the next call, which
+ * is 0-0 when the whole PEL has been scanned.
+ */
+func xautoclaim(
+	ctx      context.Context,
+	c        claimer,
+	stream   string,
+	group    string,
+	consumer string,
+	idle     time.Duration,
+	start    string,
+	count    int64,
+) ([]redis.XMessage, string, error) {
+	reply, err := c.Do(
+		ctx,
+		"XAUTOCLAIM",
+		stream,
+		group,
+		consumer,
+		idle.Milliseconds(),
+		start,
+		"COUNT",
+		count,
+	).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	return parseAutoclaim(reply)
+}
+
+func (r *redisQueue) Reclaim(ctx context.Context, consumer string) ([]Job, error) {
+	c, ok := r.client.(claimer)
+	if !ok {
+		return nil, fmt.Errorf("redis client %T does not support Do", r.client)
+	}
+
+	jobs  := make([]Job, 0)
+	start := "0-0"
+	for {
+		msgs, next, err := xautoclaim(
+			ctx,
+			c,
+			r.opts.Stream,
+			r.opts.Group,
+			consumer,
+			r.opts.ReclaimIdle,
+			start,
+			10,
+		)
+		if err != nil {
+			return jobs, err
+		}
+
+		for _, msg := range msgs {
+			job, err := redisJob(msg)
+			if err != nil {
+				return jobs, err
+			}
+			jobs = append(jobs, job)
+		}
+
+		if next == "0-0" {
+			return jobs, nil
+		}
+		start = next
+	}
+}
+
+/*
+ * The ids of all the tasks of the process are deleted, and XDEL only counts
+ * the tasks that are still in the queue, i.e. not yet picked up (or acked) by
+ * the workers.
+ */
+func (r *redisQueue) Remove(ctx context.Context, pid string) (int64, error) {
+	tasks := taskskey(pid)
+	ids, err := r.client.SMembers(ctx, tasks).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	n, err := r.client.XDel(ctx, r.opts.Stream, ids...).Result()
+	if err != nil {
+		return 0, err
+	}
+	return n, r.client.Del(ctx, tasks).Err()
+}
+
+/*
+ * Remove the consumer from the group, so that it is not left for cmd/gc to
+ * find. Deleting a consumer also drops its pending tasks, so in at-least-once
+ * mode the consumer is kept if it has any.
+ */
+func (r *redisQueue) Leave(ctx context.Context, consumer string) error {
+	if r.opts.AtLeastOnce {
+		pending, err := r.client.XPending(
+			ctx,
+			r.opts.Stream,
+			r.opts.Group,
+		).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("unable to get pending tasks: %w", err)
+		}
+		if pending != nil && pending.Consumers[consumer] > 0 {
+			return fmt.Errorf(
+				"consumer %s has %d pending tasks; not removed",
+				consumer,
+				pending.Consumers[consumer],
+			)
+		}
+	}
+
+	return r.client.XGroupDelConsumer(
+		ctx,
+		r.opts.Stream,
+		r.opts.Group,
+		consumer,
+	).Err()
+}
+
+/*
+ * The part is recorded as completed only after it is written, so that a
+ * worker dying in between at worst writes the part twice.
+ */
+func (r *redisQueue) PutPart(ctx context.Context, pid string, part Part) error {
+	args := redis.XAddArgs{
+		Stream: pid,
+		Values: map[string]interface{}{part.Name: part.Data},
+	}
+	err := r.client.XAdd(ctx, &args).Err()
+	if err != nil {
+		return err
+	}
+	r.client.Expire(ctx, pid, r.opts.TTL)
+
+	parts := message.PartsKey(pid)
+	err = r.client.SAdd(ctx, parts, part.Name).Err()
+	if err != nil {
+		return err
+	}
+	r.client.Expire(ctx, parts, r.opts.TTL)
+	return nil
+}
+
+func (r *redisQueue) ReadParts(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+	block  time.Duration,
+) ([]Part, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	args := redis.XReadArgs{
+		Streams: []string{pid, cursor},
+		Block:   block,
+	}
+	reply, err := r.client.XRead(ctx, &args).Result()
+	if err == redis.Nil {
+		return nil, cursor, nil
+	}
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	parts := make([]Part, 0)
+	for _, msg := range reply[0].Messages {
+		for name, data := range msg.Values {
+			chunk, ok := data.(string)
+			if !ok {
+				msg := "part.type = %T; expected []byte"
+				return nil, cursor, fmt.Errorf(msg, data)
+			}
+			parts = append(parts, Part { Name: name, Data: []byte(chunk) })
+		}
+		cursor = msg.ID
+	}
+	return parts, cursor, nil
+}
+
+func (r *redisQueue) CountParts(ctx context.Context, pid string) (int64, error) {
+	return r.client.SCard(ctx, message.PartsKey(pid)).Result()
+}
+
+/*
+ * Wait on the result stream with XREAD BLOCK, one entry at a time, from the
+ * end of the stream ($). Cancelling and failing do not write to the stream,
+ * and the first read can miss a part written just before it, so the reads
+ * are capped at a second, and the state is checked in between.
+ */
+func (r *redisQueue) WaitParts(
+	ctx   context.Context,
+	pid   string,
+	count int64,
+	block time.Duration,
+) error {
+	deadline := time.Now().Add(block)
+	cursor := "$"
+	for {
+		n, err := r.CountParts(ctx, pid)
+		if err != nil {
+			return err
+		}
+		stop, err := r.Cancelled(ctx, pid)
+		if err != nil {
+			return err
+		}
+		failure, err := r.Failure(ctx, pid)
+		if err != nil {
+			return err
+		}
+		if n > count || stop || failure != nil {
+			return nil
+		}
+
+		/*
+		 * A zero block is forever in XREAD, so anything below the
+		 * resolution of BLOCK (milliseconds) is expired.
+		 */
+		remaining := time.Until(deadline)
+		if remaining < time.Millisecond {
+			return nil
+		}
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+
+		args := redis.XReadArgs {
+			Streams: []string { pid, cursor },
+			Count:   1,
+			Block:   remaining,
+		}
+		reply, err := r.client.XRead(ctx, &args).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if len(reply) > 0 && len(reply[0].Messages) > 0 {
+			cursor = reply[0].Messages[0].ID
+		}
+	}
+}
+
+/*
+ * The key must outlive any task of the process in the queue, and the tasks
+ * are not kept around longer than the results are.
+ */
+func (r *redisQueue) Cancel(ctx context.Context, pid string) error {
+	key := message.CancelledKey(pid)
+	err := r.client.Set(ctx, key, "", r.opts.TTL).Err()
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, message.CancelChannel, pid).Err()
+}
+
+func (r *redisQueue) Cancelled(ctx context.Context, pid string) (bool, error) {
+	n, err := r.client.Exists(ctx, message.CancelledKey(pid)).Result()
+	return n > 0, err
+}
+
+/*
+ * Like Do(), Subscribe is implemented by redis.Client, but not included in
+ * redis.Cmdable.
+ */
+type subscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+func (r *redisQueue) Cancellations(ctx context.Context) (<-chan string, error) {
+	s, ok := r.client.(subscriber)
+	if !ok {
+		msg := "redis client %T does not support Subscribe"
+		return nil, fmt.Errorf(msg, r.client)
+	}
+
+	sub := s.Subscribe(ctx, message.CancelChannel)
+	pids := make(chan string)
+	go func() {
+		defer close(pids)
+		defer sub.Close()
+		msgs := sub.Channel()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case pids <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return pids, nil
+}
+
+func (r *redisQueue) Fail(ctx context.Context, pid string, failure []byte) error {
+	key := message.FailedKey(pid)
+	return r.client.SetNX(ctx, key, failure, r.opts.TTL).Err()
+}
+
+func (r *redisQueue) Failure(ctx context.Context, pid string) ([]byte, error) {
+	doc, err := r.client.Get(ctx, message.FailedKey(pid)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return doc, err
+}
@@ -0,0 +1,223 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+type redisJobs struct {
+	redis.Cmdable
+	jobs    []redis.XMessage
+	deleted []string
+	sets    map[string][]string
+	ttls    []int64
+}
+
+func (r *redisJobs) XAdd(
+	ctx  context.Context,
+	args *redis.XAddArgs,
+) *redis.StringCmd {
+	id := fmt.Sprintf("%d-0", len(r.jobs) + 1)
+	r.jobs = append(r.jobs, redis.XMessage { ID: id })
+	return redis.NewStringResult(id, nil)
+}
+
+/*
+ * Emulate the enqueue script, which is the only script run by the queue
+ */
+func (r *redisJobs) EvalSha(
+	ctx  context.Context,
+	sha  string,
+	keys []string,
+	args ...interface{},
+) *redis.Cmd {
+	id := r.XAdd(ctx, &redis.XAddArgs { Stream: keys[0] }).Val()
+	r.SAdd(ctx, keys[1], id)
+	r.ttls = append(r.ttls, args[3].(int64))
+	return redis.NewCmdResult(id, nil)
+}
+
+func (r *redisJobs) XDel(
+	ctx    context.Context,
+	stream string,
+	ids    ...string,
+) *redis.IntCmd {
+	r.deleted = append(r.deleted, ids...)
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func (r *redisJobs) SAdd(
+	ctx     context.Context,
+	key     string,
+	members ...interface{},
+) *redis.IntCmd {
+	if r.sets == nil {
+		r.sets = make(map[string][]string)
+	}
+	for _, member := range members {
+		r.sets[key] = append(r.sets[key], member.(string))
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func (r *redisJobs) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	return redis.NewStringSliceResult(r.sets[key], nil)
+}
+
+func (r *redisJobs) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	for _, key := range keys {
+		delete(r.sets, key)
+	}
+	return redis.NewIntResult(int64(len(keys)), nil)
+}
+
+func (r *redisJobs) Expire(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+) *redis.BoolCmd {
+	return redis.NewBoolResult(true, nil)
+}
+
+func (r *redisJobs) XReadGroup(
+	ctx  context.Context,
+	args *redis.XReadGroupArgs,
+) *redis.XStreamSliceCmd {
+	streams := []redis.XStream {
+		{ Stream: args.Streams[0], Messages: r.jobs },
+	}
+	return redis.NewXStreamSliceCmdResult(streams, nil)
+}
+
+func TestRemoveRemovesOnlyTasksOfThePid(t *testing.T) {
+	ctx := context.Background()
+	storage := &redisJobs {}
+	q := NewRedis(storage, DefaultOptions())
+	q.Enqueue(ctx, Task { Pid: "a", Part: "0/2" })
+	q.Enqueue(ctx, Task { Pid: "b", Part: "0/1" })
+	q.Enqueue(ctx, Task { Pid: "a", Part: "1/2" })
+
+	n, err := q.Remove(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, []string{ "1-0", "3-0" }, storage.deleted)
+	assert.Empty(t, storage.sets[taskskey("a")])
+	assert.Equal(t, []string{ "2-0" }, storage.sets[taskskey("b")])
+}
+
+func TestEnqueueExpiresTheTasksOfThePid(t *testing.T) {
+	storage := &redisJobs {}
+	opts := DefaultOptions()
+	opts.TTL = 2 * time.Second
+	q := NewRedis(storage, opts)
+	err := q.Enqueue(context.Background(), Task { Pid: "a", Part: "0/1" })
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ "1-0" }, storage.sets[taskskey("a")])
+	assert.Equal(t, []int64{ 2000 }, storage.ttls)
+}
+
+func TestRemoveWithNoQueuedTasks(t *testing.T) {
+	storage := &redisJobs {}
+	q := NewRedis(storage, DefaultOptions())
+	n, err := q.Remove(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Empty(t, storage.deleted)
+}
+
+func TestRedisDequeueDeletesAtMostOnceTasks(t *testing.T) {
+	storage := &redisJobs {
+		jobs: []redis.XMessage {
+			{
+				ID: "1-0",
+				Values: map[string]interface{} {
+					"pid":  "a",
+					"part": "0/1",
+					"task": "body",
+				},
+			},
+		},
+	}
+
+	q := NewRedis(storage, DefaultOptions())
+	jobs, err := q.Dequeue(context.Background(), "c", 0)
+	assert.NoError(t, err)
+	expected := []Job {
+		{
+			ID:   "1-0",
+			Task: Task { Pid: "a", Part: "0/1", Body: []byte("body") },
+		},
+	}
+	assert.Equal(t, expected, jobs)
+	assert.Equal(t, []string{ "1-0" }, storage.deleted)
+}
+
+func TestRedisDequeueKeepsAtLeastOnceTasks(t *testing.T) {
+	storage := &redisJobs {
+		jobs: []redis.XMessage {
+			{
+				ID: "1-0",
+				Values: map[string]interface{} {
+					"pid":  "a",
+					"part": "0/1",
+					"task": "body",
+				},
+			},
+		},
+	}
+
+	opts := DefaultOptions()
+	opts.AtLeastOnce = true
+	q := NewRedis(storage, opts)
+	jobs, err := q.Dequeue(context.Background(), "c", 0)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Empty(t, storage.deleted)
+}
+
+func TestParseAutoclaim(t *testing.T) {
+	reply := []interface{} {
+		"5-0",
+		[]interface{} {
+			[]interface{} {
+				"1-0",
+				[]interface{} { "pid", "a", "part", "0/2" },
+			},
+			[]interface{} { "2-0", nil },
+		},
+		[]interface{} {},
+	}
+
+	msgs, next, err := parseAutoclaim(reply)
+	assert.NoError(t, err)
+	assert.Equal(t, "5-0", next)
+	expected := []redis.XMessage {
+		{
+			ID: "1-0",
+			Values: map[string]interface{} { "pid": "a", "part": "0/2" },
+		},
+		{ ID: "2-0" },
+	}
+	assert.Equal(t, expected, msgs)
+}
+
+func TestParseAutoclaimBadReply(t *testing.T) {
+	replies := []interface{} {
+		"OK",
+		[]interface{} { "0-0" },
+		[]interface{} { "0-0", []interface{} { "1-0" } },
+		[]interface{} {
+			"0-0",
+			[]interface{} { []interface{} { "1-0", []interface{} { "pid" } } },
+		},
+	}
+	for _, reply := range replies {
+		_, _, err := parseAutoclaim(reply)
+		assert.Error(t, err, "reply = %v", reply)
+	}
+}
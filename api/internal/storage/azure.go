@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+/*
+ * Azure blob storage, where the endpoint is the storage account and the cube
+ * guid the container. Credentials are passed as a SAS in the URL query.
+ */
+type azure struct {}
+
+/*
+ * Automate unwrapping of azblob.StorageError
+ *
+ * azblob methods such as azblob.BlobClient.Download will wrap any error in
+ * azblob.InternalError before returning to the caller. This is rather annoying
+ * if we want to switch on error type, or in the case of azblob.StorageError, the
+ * StorageErrorCode.
+ *
+ * This function undoes the work of azblob by attempting to unpack the wrapped
+ * StorageError, and maps it to a storage.Error. If the underlying error is not
+ * a azblob.StorageError, this is a no-op and the original error is returned.
+ */
+func unpackAzStorageError(err error) error {
+	var stgErr *azblob.StorageError
+	if !errors.As(err, &stgErr) {
+		return err
+	}
+
+	response := stgErr.Response()
+	if response == nil {
+		return *stgErr
+	}
+	if response.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+	return &Error { Status: response.StatusCode, Err: *stgErr }
+}
+
+func downloadBlob(
+	ctx    context.Context,
+	blob   azblob.BlobClient,
+	dlopts *azblob.DownloadBlobOptions,
+) (*Fragment, error) {
+	dl, err := blob.Download(ctx, dlopts)
+	if err != nil {
+		return nil, unpackAzStorageError(err)
+	}
+	body := dl.Body(&azblob.RetryReaderOptions{})
+	defer body.Close()
+	chunk, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Fragment { Chunk: chunk, ETag: dl.ETag }, nil
+}
+
+/*
+ * Get the manifest for the cube from the blob store.
+ *
+ * It's important that this is a blocking read, since this is the first
+ * authorization mechanism in oneseismic. If the user (through the
+ * on-behalf-token) does not have permissions to read the manifest, it
+ * shouldn't be able to read the cube either. If so, no more processing should
+ * be done, and the request discarded.
+ */
+func (*azure) GetManifest(
+	ctx       context.Context,
+	container *url.URL,
+) ([]byte, error) {
+	blob, err := azblob.NewBlobClientWithNoCredential(
+		join(container, "manifest.json").String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := downloadBlob(ctx, blob, &azblob.DownloadBlobOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Chunk, nil
+}
+
+func (*azure) GetFragment(
+	ctx  context.Context,
+	blob *url.URL,
+	etag *string,
+) (*Fragment, error) {
+	/*
+	 * Fragment downloads are retried by the caller, which knows which errors
+	 * are worth retrying, so the retry policy of the SDK is disabled to not
+	 * multiply the attempts.
+	 */
+	client, err := azblob.NewBlobClientWithNoCredential(
+		blob.String(),
+		&azblob.ClientOptions{
+			Retry: policy.RetryOptions { MaxRetries: -1 },
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &azblob.DownloadBlobOptions{
+		BlobAccessConditions: &azblob.BlobAccessConditions{
+			ModifiedAccessConditions : &azblob.ModifiedAccessConditions{
+				IfNoneMatch: etag,
+			},
+		},
+	}
+	return downloadBlob(ctx, client, options)
+}
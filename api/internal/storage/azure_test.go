@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelledDownloadErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blob, err := azblob.NewBlobClientWithNoCredential("https://example.com", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = downloadBlob(ctx, blob, &azblob.DownloadBlobOptions{})
+	if err == nil {
+		t.Errorf("expected downloadBlob() to fail; err was nil")
+	}
+
+	msg := "context canceled"
+	assert.Containsf(t, err.Error(), msg, "want err =~ '%s'; was %v", msg, err)
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * A local directory, e.g. a NAS mount, or a directory of test cubes. The
+ * files are read directly, and the etag is made from the modification time
+ * and size, which is what most web servers do for static files.
+ *
+ * Only files under the root directory can be read, so that a cube id like
+ * ../../etc cannot be used to read arbitrary files.
+ */
+type filesystem struct {
+	root string
+}
+
+func newFilesystem(endpoint *url.URL) (*filesystem, error) {
+	if endpoint.Host != "" && endpoint.Host != "localhost" {
+		msg := "file url must be file:///path, got host %s"
+		return nil, fmt.Errorf(msg, endpoint.Host)
+	}
+	if endpoint.Path == "" {
+		return nil, fmt.Errorf("file url %s has no path", endpoint)
+	}
+	return &filesystem { root: filepath.Clean(endpoint.Path) }, nil
+}
+
+/*
+ * Map the URL to a path under the root directory.
+ */
+func (fs *filesystem) path(u *url.URL) (string, error) {
+	path := filepath.Clean(u.Path)
+	rel, err := filepath.Rel(fs.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", &Error {
+			Status: http.StatusNotFound,
+			Err:    fmt.Errorf("%s is outside %s", path, fs.root),
+		}
+	}
+	return path, nil
+}
+
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return &Error { Status: http.StatusNotFound, Err: err }
+	case errors.Is(err, os.ErrPermission):
+		return &Error { Status: http.StatusForbidden, Err: err }
+	default:
+		return err
+	}
+}
+
+func (fs *filesystem) GetManifest(
+	ctx       context.Context,
+	container *url.URL,
+) ([]byte, error) {
+	path, err := fs.path(join(container, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return manifest, nil
+}
+
+func (fs *filesystem) GetFragment(
+	ctx  context.Context,
+	blob *url.URL,
+	etag *string,
+) (*Fragment, error) {
+	path, err := fs.path(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, statusError(err)
+	}
+	tag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	if etag != nil && *etag == tag {
+		return nil, ErrNotModified
+	}
+
+	chunk, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &Fragment { Chunk: chunk, ETag: &tag }, nil
+}
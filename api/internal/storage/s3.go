@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * S3, and S3-compatible stores like minio and most NAS appliances. The
+ * endpoint is either
+ *
+ *     s3://<bucket>               AWS, region from AWS_REGION
+ *     s3+https://<host>/<bucket>  any S3-compatible store
+ *
+ * and objects are addressed path-style, i.e. <host>/<bucket>/<guid>/..., which
+ * works with every S3-compatible store. Requests are signed (signature v4)
+ * with the credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and,
+ * optionally, AWS_SESSION_TOKEN. Without credentials the requests are
+ * anonymous, which works for public buckets.
+ *
+ * The protocol is implemented directly on top of net/http, as only signed
+ * GETs are needed, which does not warrant pulling in the AWS SDK.
+ */
+type s3 struct {
+	region      string
+	credentials *s3credentials
+	client      *http.Client
+}
+
+type s3credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3(endpoint *url.URL) (*s3, error) {
+	if endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 url %s has no bucket/host", endpoint)
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	store := &s3 { region: region, client: http.DefaultClient }
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		store.credentials = &s3credentials {
+			accessKey:    accessKey,
+			secretKey:    secretKey,
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	return store, nil
+}
+
+/*
+ * Map the s3:// URL to the https URL of the object.
+ */
+func (s *s3) objectURL(u *url.URL) *url.URL {
+	obj := *u
+	switch u.Scheme {
+	case "s3":
+		obj.Scheme = "https"
+		obj.Host   = fmt.Sprintf("s3.%s.amazonaws.com", s.region)
+		obj.Path   = fmt.Sprintf("/%s%s", u.Host, u.Path)
+	default:
+		obj.Scheme = strings.TrimPrefix(u.Scheme, "s3+")
+	}
+	obj.RawPath = ""
+	/*
+	 * The URL query is meant for azure (SAS), the S3 credentials are
+	 * configured on the server.
+	 */
+	obj.RawQuery = ""
+	return &obj
+}
+
+func (s *s3) get(
+	ctx  context.Context,
+	u    *url.URL,
+	etag *string,
+) (*Fragment, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		s.objectURL(u).String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if etag != nil {
+		req.Header.Set("If-None-Match", *etag)
+	}
+	if s.credentials != nil {
+		sign(req, s.credentials, s.region, time.Now())
+	}
+
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		chunk, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		fragment := &Fragment { Chunk: chunk }
+		if tag := response.Header.Get("ETag"); tag != "" {
+			fragment.ETag = &tag
+		}
+		return fragment, nil
+
+	case http.StatusNotModified:
+		return nil, ErrNotModified
+
+	default:
+		body, _ := ioutil.ReadAll(response.Body)
+		return nil, &Error {
+			Status: response.StatusCode,
+			Err:    fmt.Errorf("GET %s: %s", u.Path, body),
+		}
+	}
+}
+
+func (s *s3) GetManifest(
+	ctx       context.Context,
+	container *url.URL,
+) ([]byte, error) {
+	manifest, err := s.get(ctx, join(container, "manifest.json"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Chunk, nil
+}
+
+func (s *s3) GetFragment(
+	ctx  context.Context,
+	blob *url.URL,
+	etag *string,
+) (*Fragment, error) {
+	return s.get(ctx, blob, etag)
+}
+
+/*
+ * URI-encode as specified for signature v4, which differs from the
+ * url.PathEscape and url.QueryEscape in which characters are escaped.
+ */
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			b.WriteByte(c)
+		case c == '-' || c == '_' || c == '.' || c == '~':
+			b.WriteByte(c)
+		case c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacsha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+/*
+ * Sign the (body-less) request with AWS signature version 4 [1], by setting
+ * the x-amz-* and Authorization headers. All the headers set on the request
+ * when it is signed are signed.
+ *
+ * [1] https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+ */
+func sign(
+	req    *http.Request,
+	creds  *s3credentials,
+	region string,
+	now    time.Time,
+) {
+	/* sha256 of the empty body */
+	const payload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzdate := now.UTC().Format("20060102T150405Z")
+	date    := now.UTC().Format("20060102")
+
+	req.Header.Set("x-amz-content-sha256", payload)
+	req.Header.Set("x-amz-date", amzdate)
+	if creds.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.sessionToken)
+	}
+
+	headers := map[string]string { "host": req.URL.Host }
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(values[0])
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(
+				params,
+				awsEscape(key, false) + "=" + awsEscape(value, false),
+			)
+		}
+	}
+	sort.Strings(params)
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string {
+		req.Method,
+		awsEscape(path, true),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	scope  := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	stringToSign := strings.Join([]string {
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacsha256([]byte("AWS4" + creds.secretKey), date)
+	key  = hmacsha256(key, region)
+	key  = hmacsha256(key, "s3")
+	key  = hmacsha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacsha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
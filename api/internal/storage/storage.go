@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ * This package abstracts the blob store that cubes are read from. Cubes are
+ * stored the same way in all backends, as laid out by the uploader:
+ *
+ *     <endpoint>/<guid>/manifest.json
+ *     <endpoint>/<guid>/src/64-64-64/0-0-0.f32
+ *     ...
+ *
+ * Everything is addressed by URL, as both the query service and the workers
+ * already pass URLs around, and because the URL query carries the
+ * credentials (e.g. a SAS) for the backends that support it. The backend is
+ * selected by the scheme of the endpoint:
+ *
+ *     https://<account>.blob.core.windows.net   azure blob
+ *     http://127.0.0.1:10000/devstoreaccount1   azure blob (azurite)
+ *     file:///data/oneseismic                   local directory
+ *     s3://<bucket>                             AWS S3
+ *     s3+https://<host>/<bucket>                S3-compatible store
+ */
+
+/*
+ * ErrNotModified is returned by GetFragment when the fragment matches the
+ * etag, and the cached copy can be used.
+ */
+var ErrNotModified = errors.New("not modified")
+
+/*
+ * The backends map their errors to HTTP statuses, so that the callers can
+ * handle (and retry) errors the same way regardless of backend. Errors
+ * that do not come from the store, like network errors, are returned as-is.
+ */
+type Error struct {
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %v", e.Status, http.StatusText(e.Status), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+/*
+ * A downloaded fragment. The etag identifies the version of the fragment,
+ * and is nil if the backend does not support etags.
+ */
+type Fragment struct {
+	Chunk []byte
+	ETag  *string
+}
+
+type Storage interface {
+	/*
+	 * Get the manifest of the cube in the container, i.e. <endpoint>/<guid>
+	 */
+	GetManifest(ctx context.Context, container *url.URL) ([]byte, error)
+
+	/*
+	 * Get a fragment. If etag is non-nil and the fragment is unchanged,
+	 * ErrNotModified is returned.
+	 */
+	GetFragment(
+		ctx  context.Context,
+		blob *url.URL,
+		etag *string,
+	) (*Fragment, error)
+}
+
+/*
+ * Open the storage of the endpoint, e.g. https://acc.blob.core.windows.net.
+ * This is cheap, and the storage can be opened on every request.
+ */
+func Open(endpoint *url.URL) (Storage, error) {
+	switch endpoint.Scheme {
+	case "https", "http":
+		return &azure{}, nil
+
+	case "file":
+		return newFilesystem(endpoint)
+
+	case "s3", "s3+https", "s3+http":
+		return newS3(endpoint)
+
+	default:
+		return nil, fmt.Errorf("unsupported storage url scheme %s", endpoint)
+	}
+}
+
+/*
+ * Automation for the common case of parsing the endpoint string from the
+ * command line or the task.
+ */
+func OpenURL(endpoint string) (Storage, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return Open(u)
+}
+
+/*
+ * Azure checks the credentials of the user, which are passed in the URL query,
+ * on every request, so the user can only read the cubes they have access to.
+ * The other backends read with the credentials of the server, if any, and
+ * services using them must authenticate the user themselves.
+ */
+func AuthorizesUser(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" || u.Scheme == "http"
+}
+
+/*
+ * Check the --storage-url of a service that serves cubes to users. With
+ * azure, the user's SAS or token is forwarded to storage, which decides what
+ * the user can read. Other storage is read with the service's own credentials
+ * (or, for file, none at all), so the service must check the user's token
+ * itself, i.e. have an auth server, unless authentication is explicitly
+ * disabled with noAuth.
+ */
+func CheckServiceAccess(storageURL string, hasAuthserver, noAuth bool) error {
+	if _, err := OpenURL(storageURL); err != nil {
+		return fmt.Errorf("bad --storage-url: %w", err)
+	}
+	if AuthorizesUser(storageURL) || hasAuthserver {
+		return nil
+	}
+	if !noAuth {
+		return fmt.Errorf(
+			"--storage-url %s does not check the user's access; " +
+			"set --authserver and --audience, or --no-auth",
+			storageURL,
+		)
+	}
+	log.Printf(
+		"WARNING: no authentication; anyone can read the cubes in %s",
+		storageURL,
+	)
+	return nil
+}
+
+/*
+ * Compare endpoints, ignoring trailing slashes.
+ */
+func SameEndpoint(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+func join(container *url.URL, name string) *url.URL {
+	u := *container
+	u.Path = fmt.Sprintf("%s/%s", strings.TrimSuffix(u.Path, "/"), name)
+	u.RawPath = ""
+	return &u
+}
@@ -2,9 +2,7 @@ package util
 
 import (
 	"compress/gzip"
-	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -12,7 +10,6 @@ import (
 	"time"
 
 	"github.com/equinor/oneseismic/api/internal"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -153,59 +150,6 @@ func GraphQLQueryFromGet(query url.Values) (*GraphQLQuery, error) {
 	return &params, nil
 }
 
-/*
- * Automate unwrapping of azblob.StorageError
- *
- * azblob methods such as azblob.BlobClient.Download will wrap any error in
- * azblob.InternalError before returning to the caller. This is rather annoying
- * if we want to switch on error type, or in the case of azblob.StorageError, the
- * StorageErrorCode.
- *
- * This function undoes the work of azblob by attempting to unpack the wrapped
- * StorageError. If the underlying error is not a azblob.StorageError, this is
- * a no-op and the original error is returned.
- */
-func UnpackAzStorageError(err error) error {
-	var stgErr *azblob.StorageError
-	if errors.As(err, &stgErr) {
-		return *stgErr
-	}
-
-	return err
-}
-
-/*
- * Get the manifest for the cube from the blob store.
- *
- * It's important that this is a blocking read, since this is the first
- * authorization mechanism in oneseismic. If the user (through the
- * on-behalf-token) does not have permissions to read the manifest, it
- * shouldn't be able to read the cube either. If so, no more processing should
- * be done, and the request discarded.
- */
-func FetchManifest(
-	ctx          context.Context,
-	containerURL *url.URL,
-) ([]byte, error) {
-	container, err := azblob.NewContainerClientWithNoCredential(
-		containerURL.String(),
-		nil,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	blob    := container.NewBlobClient("manifest.json")
-	dl, err := blob.Download(ctx, &azblob.DownloadBlobOptions{})
-	if err != nil {
-		return nil, UnpackAzStorageError(err)
-	}
-
-	body := dl.Body(&azblob.RetryReaderOptions{})
-	defer body.Close()
-	return ioutil.ReadAll(body)
-}
-
 /*
  * Custom logger for the /query family of endpoints, that logs the id of the
  * process to be generated by the request (pid).
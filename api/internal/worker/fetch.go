@@ -1,4 +1,4 @@
-package main
+package worker
 
 // #cgo LDFLAGS: -loneseismic -lfmt
 // #include <stdlib.h>
@@ -8,16 +8,17 @@ import "unsafe"
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/equinor/oneseismic/api/internal"
 	"github.com/equinor/oneseismic/api/internal/message"
-
-	"github.com/go-redis/redis/v8"
+	"github.com/equinor/oneseismic/api/internal/queue"
 )
 
 /*
@@ -52,7 +53,7 @@ type process struct {
 	cancel context.CancelFunc
 	/*
 	 * A pointer to the corresponding C++ object. The go part of this program
-	 * handles sessions and I/O (tokens, requests, http requests and redis
+	 * handles sessions and I/O (tokens, requests, http requests and queue
 	 * writes), whereas parsing bytes, understanding geometry, and constructing
 	 * results are done in C++.
 	 *
@@ -67,6 +68,93 @@ type process struct {
 	cpp *C.struct_proc
 }
 
+/*
+ * The processes running on this worker, grouped by pid, so that all the tasks
+ * of a process can be stopped when the process is cancelled. Cancelling a
+ * process only cancels its context, which stops its downloads and makes
+ * gather() return, which in turn cleans up the process.
+ */
+type running struct {
+	lock  sync.Mutex
+	procs map[string]map[*process]struct{}
+	wg    sync.WaitGroup
+}
+
+func newRunning() *running {
+	return &running {
+		procs: make(map[string]map[*process]struct{}),
+	}
+}
+
+func (r *running) add(p *process) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	procs, ok := r.procs[p.pid]
+	if !ok {
+		procs = make(map[*process]struct{})
+		r.procs[p.pid] = procs
+	}
+	if _, ok := procs[p]; !ok {
+		r.wg.Add(1)
+	}
+	procs[p] = struct{}{}
+}
+
+func (r *running) remove(p *process) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	procs := r.procs[p.pid]
+	if _, ok := procs[p]; ok {
+		r.wg.Done()
+	}
+	delete(procs, p)
+	if len(procs) == 0 {
+		delete(r.procs, p.pid)
+	}
+}
+
+/*
+ * Wait for the running tasks to complete, for at most timeout, and return
+ * the tasks that are still running. No tasks must be added while draining.
+ */
+func (r *running) drain(timeout time.Duration) []*process {
+	drained := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	remaining := make([]*process, 0)
+	for _, procs := range r.procs {
+		for p := range procs {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
+
+/*
+ * Cancel all the running tasks of the process pid, and return the number of
+ * tasks cancelled.
+ */
+func (r *running) cancel(pid string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	procs := r.procs[pid]
+	for p := range procs {
+		p.cancel()
+	}
+	return len(procs)
+}
+
 /*
  * Automation - return the pid=, proc= log line prefix to make log formatting
  * less noisy.
@@ -253,6 +341,57 @@ func (p *process) blob(container *url.URL, blob string) (*url.URL, error) {
 	return bloburl, nil
 }
 
+/*
+ * The result could not be written to storage. This is not a failure of the
+ * task itself, and the task can be retried.
+ */
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+/*
+ * Record the failure of a task, so that it can be reported to the client.
+ * Only the first failure of a process is kept, as it is usually the cause of
+ * the others.
+ */
+func fail(
+	q     queue.Queue,
+	pid   string,
+	part  string,
+	class string,
+	err   error,
+) {
+	failure := message.Failure {
+		Class:   class,
+		Part:    part,
+		Message: err.Error(),
+	}
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		failure.Fragment = fe.fragment
+		failure.Message  = fe.err.Error()
+	}
+
+	doc, err := failure.Pack()
+	if err != nil {
+		log.Printf("pid=%s, part=%s unable to pack failure: %v", pid, part, err)
+		return
+	}
+
+	err = q.Fail(context.Background(), pid, doc)
+	if err != nil {
+		log.Printf("pid=%s, part=%s unable to record failure: %v", pid, part, err)
+	}
+}
+
 /*
  * Gather the result and write the result to storage. This must *be called
  * exactly once* since it also clears the process handle.
@@ -263,31 +402,46 @@ func (p *process) blob(container *url.URL, blob string) (*url.URL, error) {
  * doesn't have to without introducing deadlocks if the channels are
  * sufficiently buffered.
  *
+ * The first download error is returned, so that the caller can record the
+ * failure. A cancelled process is not a failure, and gives no error. If the
+ * result cannot be written, a *writeError is returned.
+ *
  * This function finalizes the process.
  */
 func (p *process) gather(
-	storage    redis.Cmdable,
+	q          queue.Queue,
 	nfragments int,
-	queue      fetchQueue,
-) {
+	fq         fetchQueue,
+) error {
 	defer p.cleanup()
 	for i := 0; i < nfragments; i++ {
 		select {
-		case f := <-queue.fragments:
+		case <-p.ctx.Done():
+			log.Printf("%s cancelled", p.logpid())
+			return nil
+		case f := <-fq.fragments:
 			err := p.add(f)
 			if err != nil {
 				log.Fatalf("%s add failed: %v", p.logpid(), err)
 			}
-		case e := <-queue.errors:
+		case e := <-fq.errors:
+			/*
+			 * Downloads of a cancelled process fail with context.Canceled,
+			 * and the error may be read before ctx.Done() is noticed
+			 */
+			if p.ctx.Err() != nil {
+				log.Printf("%s cancelled", p.logpid())
+				return nil
+			}
 			log.Printf("%s download failed: %v", p.logpid(), e)
 			for {
 				// Grab the remaining available errors to log them, but don't
 				// wait around for any new ones to come in
 				select {
-				case e := <-queue.errors:
+				case e := <-fq.errors:
 					log.Printf("%s download failed: %v", p.logpid(), e)
 				default:
-					return
+					return e
 				}
 			}
 		}
@@ -295,14 +449,12 @@ func (p *process) gather(
 
 	packed := p.pack()
 	log.Printf("%s ready", p.logpid())
-	args := redis.XAddArgs{
-		Stream: p.pid,
-		Values: map[string]interface{}{p.part: packed},
-	}
-	err := storage.XAdd(p.ctx, &args).Err()
+	part := queue.Part { Name: p.part, Data: packed }
+	err := q.PutPart(p.ctx, p.pid, part)
 	if err != nil {
 		log.Printf("%s write to storage failed: %v", p.logpid(), err)
+		return &writeError { err: err }
 	}
-	storage.Expire(p.ctx, p.pid, 10 * time.Minute)
 	log.Printf("%s written to storage", p.logpid())
+	return nil
 }
@@ -0,0 +1,444 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testurl() *url.URL {
+	addr, _ := url.Parse("https://example.com")
+	return addr
+}
+
+func TestCancelledDownloadPostsOnErrorChannel(t *testing.T) {
+	/* 
+	 * Cancel the context immediately, to emulating a failure from the process
+	 * controller. This tests that the messages flow onto the right channel in
+	 * the presence of cancelled sibling fetches, not the actual fetch being
+	 * processed by this thread.
+	 */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetch := newFetch(1, 0)
+	blobs := []*url.URL{testurl()}
+	store, err := storage.Open(testurl())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fq := fetch.mkqueue()
+	fetch.enqueue(ctx, fq, store, blobs)
+	close(fetch.requests)
+	fetch.run()
+
+	select {
+	case <-fq.errors:
+	case <-fq.fragments:
+		t.Errorf("Pending message on fragments; should be message on error")
+	}
+}
+
+func TestMessageOnErrorCancelsGather(t *testing.T) {
+	o := fetchQueue {
+		fragments: make(chan fragment, 1),
+		errors:    make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// directly construct the process by populating fields manually. This is to
+	// avoid having to shuffle bytes about and init the C++ object, which
+	// should not be used at all for this test. This is vulnerable to changes
+	// in the struct layout, but such changes should probably be detected
+	// compile time anyway, and this test is then easily updated.
+	proc := process {
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	o.errors <- fmt.Errorf("Test error")
+	// Pretend that there are 2 fragments to be fetched. None will be sent, but
+	// it increases the confidence that the worker loop is aborted immediately
+	// rather than waiting for more data.
+	proc.gather(nil, 2, o)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Errorf("Expected context to be cancelled, but it is not")
+	}
+}
+
+func TestCancelledProcessStopsGather(t *testing.T) {
+	o := fetchQueue {
+		fragments: make(chan fragment, 1),
+		errors:    make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := &process {
+		pid:    "pid",
+		ctx:    ctx,
+		cancel: cancel,
+		cpp:    nil,
+	}
+
+	active := newRunning()
+	active.add(proc)
+	n := active.cancel("pid")
+	assert.Equal(t, 1, n)
+
+	// No fragments are sent, so gather only returns if it is cancelled
+	proc.gather(nil, 2, o)
+}
+
+func TestCancelOnlyCancelsTasksOfThePid(t *testing.T) {
+	mkproc := func(pid string) *process {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &process { pid: pid, ctx: ctx, cancel: cancel }
+	}
+	a1 := mkproc("a")
+	a2 := mkproc("a")
+	b  := mkproc("b")
+
+	active := newRunning()
+	active.add(a1)
+	active.add(a2)
+	active.add(b)
+	active.remove(a2)
+
+	assert.Equal(t, 1, active.cancel("a"))
+	assert.Equal(t, 0, active.cancel("c"))
+	assert.Error(t, a1.ctx.Err())
+	assert.NoError(t, a2.ctx.Err())
+	assert.NoError(t, b.ctx.Err())
+}
+
+func TestDrainWaitsForRunningTasks(t *testing.T) {
+	proc := &process { pid: "a" }
+	active := newRunning()
+	active.add(proc)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		active.remove(proc)
+	}()
+
+	remaining := active.drain(time.Minute)
+	assert.Empty(t, remaining)
+}
+
+func TestDrainReturnsTasksStillRunning(t *testing.T) {
+	a := &process { pid: "a" }
+	b := &process { pid: "b" }
+	active := newRunning()
+	active.add(a)
+	active.add(b)
+	active.remove(a)
+
+	remaining := active.drain(time.Millisecond)
+	assert.Equal(t, []*process{ b }, remaining)
+}
+
+func TestDrainWithNoRunningTasks(t *testing.T) {
+	assert.Empty(t, newRunning().drain(time.Minute))
+}
+
+func TestGatherReturnsTheFirstError(t *testing.T) {
+	o := fetchQueue {
+		fragments: make(chan fragment, 2),
+		errors:    make(chan error, 2),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := process {
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	first := &fetchError { fragment: "src/0-0-0.f32", err: fmt.Errorf("1") }
+	o.errors <- first
+	o.errors <- fmt.Errorf("2")
+	err := proc.gather(nil, 2, o)
+	assert.Equal(t, first, err)
+}
+
+func TestCancelledDownloadIsNotAFailure(t *testing.T) {
+	o := fetchQueue {
+		fragments: make(chan fragment, 1),
+		errors:    make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := process {
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	cancel()
+	o.errors <- &fetchError { fragment: "src/0-0-0.f32", err: context.Canceled }
+	err := proc.gather(nil, 2, o)
+	assert.NoError(t, err)
+}
+
+func TestFailureRecordsTheFragment(t *testing.T) {
+	q := queue.NewMemory(queue.DefaultOptions())
+	err := &fetchError {
+		fragment: "src/64-64-64/0-0-1.f32",
+		err:      fmt.Errorf("Internal error"),
+	}
+	fail(q, "pid", "1/3", "download", err)
+
+	doc, e := q.Failure(context.Background(), "pid")
+	assert.NoError(t, e)
+	failure, e := (&message.Failure{}).Unpack(doc)
+	assert.NoError(t, e)
+	assert.Equal(t, message.Failure {
+		Class:    "download",
+		Part:     "1/3",
+		Fragment: "src/64-64-64/0-0-1.f32",
+		Message:  "Internal error",
+	}, *failure)
+}
+
+/*
+ * Compare the cost of sending the (regular) payload with a smaller structure.
+ * Sending blob objects as pointers is much faster, but might possibly
+ * pessimize garbage collection or other parts of the program, so it must be
+ * optimized with much care.
+ *
+ * So far it seems that the cost of sending by-value is so small that *any* gc
+ * hit or other indirection will eat up the gain and more.
+ *
+ * BenchmarkSendTask-4             15701625                75.2 ns/op
+ * BenchmarkSendSmallStruct-4      20805266                55.6 ns/op
+ */
+func BenchmarkSendTask(b *testing.B) {
+	type payload = request
+	p := payload {}
+	c := make(chan payload, 100)
+	for n := 0; n < b.N; n++ {
+		c <- p
+		<-c
+	}
+}
+
+func BenchmarkSendSmallStruct(b *testing.B) {
+	type payload struct {
+		i int
+		b []byte
+		e chan error
+	}
+	p := payload {}
+	c := make(chan payload, 100)
+	for n := 0; n < b.N; n++ {
+		c <- p
+		<-c
+	}
+}
+
+type timeout struct {}
+func (timeout) Error() string   { return "timeout" }
+func (timeout) Timeout() bool   { return true }
+func (timeout) Temporary() bool { return true }
+
+func TestRetryableStatus(t *testing.T) {
+	assert.True(t,  retryableStatus(http.StatusTooManyRequests))
+	assert.True(t,  retryableStatus(http.StatusInternalServerError))
+	assert.True(t,  retryableStatus(http.StatusServiceUnavailable))
+	assert.False(t, retryableStatus(http.StatusForbidden))
+	assert.False(t, retryableStatus(http.StatusNotFound))
+}
+
+func TestRetryableErrors(t *testing.T) {
+	assert.True(t,  retryable(fmt.Errorf("read: %w", timeout{})))
+	assert.True(t,  retryable(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	assert.True(t,  retryable(io.ErrUnexpectedEOF))
+	assert.False(t, retryable(errors.New("permanent")))
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	p := retryPolicy { base: time.Millisecond, max: 10 * time.Millisecond }
+	for retry := 0; retry < 100; retry++ {
+		wait := p.backoff(retry)
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.Less(t, wait, p.max)
+	}
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	p := retryPolicy { retries: 3, base: time.Microsecond, max: time.Microsecond }
+	calls := 0
+	err := p.do(context.Background(), "blob", func() error {
+		calls++
+		if calls < 3 {
+			return timeout{}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetriesAreExhausted(t *testing.T) {
+	p := retryPolicy { retries: 2, base: time.Microsecond, max: time.Microsecond }
+	calls := 0
+	err := p.do(context.Background(), "blob", func() error {
+		calls++
+		return timeout{}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestPermanentErrorsAreNotRetried(t *testing.T) {
+	p := retryPolicy { retries: 3, base: time.Microsecond, max: time.Microsecond }
+	calls := 0
+	err := p.do(context.Background(), "blob", func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCancelledContextIsNotRetried(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := retryPolicy { retries: 3, base: time.Microsecond, max: time.Microsecond }
+	calls := 0
+	err := p.do(ctx, "blob", func() error {
+		calls++
+		return timeout{}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestFetchblobUsesCachedFragmentWhenNotModified(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "0-0-0.f32")
+	if err := ioutil.WriteFile(path, []byte("fragment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.OpenURL("file://" + root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, _ := url.Parse("file://" + path)
+	cold, err := fetchblob(context.Background(), store, blob, &nocache{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fragment"), cold)
+
+	fragment, _ := store.GetFragment(context.Background(), blob, nil)
+	cache := &staticcache {
+		entry: cacheEntry { chunk: []byte("cached"), etag: fragment.ETag },
+	}
+	hot, err := fetchblob(context.Background(), store, blob, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cached"), hot)
+}
+
+type staticcache struct {
+	entry cacheEntry
+}
+func (c *staticcache) set(key string, val cacheEntry) {}
+func (c *staticcache) get(key string) (cacheEntry, bool) {
+	return c.entry, true
+}
+
+/*
+ * A store without etags, like an S3 endpoint that does not send the ETag
+ * header. The etags passed to GetFragment are recorded.
+ */
+type noetagstore struct {
+	etags []*string
+}
+func (s *noetagstore) GetManifest(
+	ctx       context.Context,
+	container *url.URL,
+) ([]byte, error) {
+	return nil, errors.New("no manifest")
+}
+func (s *noetagstore) GetFragment(
+	ctx  context.Context,
+	blob *url.URL,
+	etag *string,
+) (*storage.Fragment, error) {
+	s.etags = append(s.etags, etag)
+	return &storage.Fragment { Chunk: []byte("fragment") }, nil
+}
+
+type recordingcache struct {
+	sync.Mutex
+	entries map[string]cacheEntry
+}
+func (c *recordingcache) set(key string, val cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = val
+}
+func (c *recordingcache) get(key string) (cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	val, hit := c.entries[key]
+	return val, hit
+}
+
+func TestFetchblobDoesNotCacheFragmentsWithoutETag(t *testing.T) {
+	store := &noetagstore {}
+	cache := &recordingcache { entries: make(map[string]cacheEntry) }
+	blob, _ := url.Parse("s3://bucket/guid/0-0-0.f32")
+
+	for i := 0; i < 2; i++ {
+		chunk, err := fetchblob(context.Background(), store, blob, cache)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("fragment"), chunk)
+	}
+	/* cache.set is called asynchronously, so give it a moment */
+	time.Sleep(10 * time.Millisecond)
+	_, hit := cache.get(blob.Path)
+	assert.False(t, hit)
+	assert.Equal(t, []*string { nil, nil }, store.etags)
+}
+
+func TestFetchblobTreatsCachedFragmentWithoutETagAsMiss(t *testing.T) {
+	store := &noetagstore {}
+	cache := &staticcache {
+		entry: cacheEntry { chunk: []byte("cached"), etag: nil },
+	}
+	blob, _ := url.Parse("s3://bucket/guid/0-0-0.f32")
+
+	chunk, err := fetchblob(context.Background(), store, blob, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fragment"), chunk)
+}
+
+func TestOpenerOnlyServesConfiguredStorage(t *testing.T) {
+	open := makeOpener("file:///data/oneseismic/")
+	_, err := open("file:///data/oneseismic")
+	assert.NoError(t, err)
+	_, err = open("file:///etc")
+	assert.Error(t, err)
+
+	_, err = makeOpener("")("file:///etc")
+	assert.NoError(t, err)
+}
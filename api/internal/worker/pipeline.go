@@ -0,0 +1,435 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/storage"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+/*
+ * This module implements a worker pool for blob fetches, with caching. The
+ * intended use is for the main function to spawn a worker group that pulls
+ * URLs and serves downloaded, possibly cached, blobs. The worker pool are
+ * stupid pipes and have no context or reference to the task that provided the
+ * URLs.
+ */
+
+/*
+ * Silly & minimal interface to a cache of fragments - this hides a lot of
+ * features, but should make some testing and benchmarking easier by providing
+ * a way to tune or disable the cache.
+ *
+ * It achieves two things:
+ * 1. ease-of-testing through custom cache implementations
+ * 2. automates the casting, forcing the cache to only store the cacheentry
+ *    type, which is way less annoying than dealing with interface{}
+ */
+type fragmentcache interface {
+	set(string, cacheEntry)
+	get(string) (cacheEntry, bool)
+}
+
+type cacheEntry struct {
+	chunk []byte
+	etag  *string
+}
+
+type ristrettocache struct {
+	ristretto.Cache
+}
+func (c *ristrettocache) set(key string, val cacheEntry) {
+	c.Set(key, val, 0)
+}
+func (c *ristrettocache) get(key string) (val cacheEntry, hit bool) {
+	v, hit := c.Get(key)
+	if hit {
+		val = v.(cacheEntry)
+	}
+	return
+}
+
+/*
+ * The nocache isn't really used per now, but serves as a useful reference and
+ * available information for tests runs or test cases that wants to disable
+ * caching altogether.
+ */
+type nocache struct {}
+func (c *nocache) set(key string, val cacheEntry) {}
+func (c *nocache) get(key string) (cacheEntry, bool) {
+	return cacheEntry{}, false
+}
+
+/*
+ * The downloaded fragment (as it is stored in blob). The index is a key, used
+ * to coordinate with C++ to map fragments (and by extension coordinates) to
+ * the right extracted data (and coordinates).
+ */
+type fragment struct {
+	index int
+	chunk []byte
+}
+
+/*
+ * A failed download, annotated with the fragment that could not be fetched.
+ */
+type fetchError struct {
+	fragment string
+	err      error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("%s: %v", e.fragment, e.err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.err
+}
+
+/*
+ * A request for a blob download, complete with the output channel (including
+ * error channel).
+ */
+type request struct {
+	index     int
+	store     storage.Storage
+	blob      *url.URL
+	fragments chan fragment
+	errors    chan error
+	ctx       context.Context
+}
+
+/*
+ * This is the handle returned to the controlling process. The worker pool will
+ * write the completed objects to the fragments channel, or post the error on
+ * the error channel.
+ *
+ * Downloaded fragments are consumed by pulling messages from the fragments
+ * channel. The worker pool has no concept of tasks or groups of downloads, so
+ * it is up to the consumer to determine that all requested fragments are
+ * received.
+ *
+ * The request should be aborted if any message is posted on the errors channel.
+ */
+type fetchQueue struct {
+	fragments chan fragment
+	errors    chan error
+}
+
+type fetch struct {
+	requests chan request
+	cache    fragmentcache
+	retry    retryPolicy
+}
+
+func newFetch(jobs int, retries int) *fetch {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1e7, // 100M
+		MaxCost:     10 * (1 << 30), // 1 << 30 == 1G
+		BufferItems: 64,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &fetch {
+		requests: make(chan request, jobs),
+		cache:    &ristrettocache { Cache: *cache },
+		retry:    newRetryPolicy(retries),
+	}
+}
+
+/*
+ * Make a new queue, or download session if you will. This is a part of the
+ * make-enqueue process, which is split into two phases. For ease-of-use,
+ * enqueue() will block until all the passed blobs are scheduled, and and the
+ * consumers of the downloaded fragments also need access to the sink channels.
+ * The easiest way to accomplish this is to split make and enqueue into two
+ * functions.
+ */
+func (f *fetch) mkqueue() fetchQueue {
+	return fetchQueue {
+		fragments: make(chan fragment, cap(f.requests)),
+		errors:    make(chan error,    cap(f.requests)),
+	}
+}
+
+/*
+ * The enqueue function is really just automation - it makes and schedules
+ * requests for the passed urls. This function will block until all URLs are
+ * scheduled.
+ */
+func (f *fetch) enqueue(
+	ctx   context.Context,
+	queue fetchQueue,
+	store storage.Storage,
+	urls  []*url.URL,
+) {
+	for i, url := range urls {
+		f.requests <- request {
+			index:     i,
+			store:     store,
+			blob:      url,
+			fragments: queue.fragments,
+			errors:    queue.errors,
+			ctx:       ctx,
+		}
+	}
+}
+
+func fetchblob(
+	ctx   context.Context,
+	store storage.Storage,
+	blob  *url.URL,
+	cache fragmentcache,
+) ([]byte, error) {
+	if blob == nil  {
+		log.Printf("Empty bloburl")
+		return nil, internal.NewInternalError()
+	}
+
+	/*
+	 * Fragments without an etag cannot be revalidated, so they are never
+	 * cached, and an entry without an etag is treated as a miss
+	 */
+	key := blob.Path
+	cached, hit := cache.get(key)
+	hit = hit && cached.etag != nil
+	if !hit {
+		cached = cacheEntry {}
+	}
+
+	cold, err := store.GetFragment(ctx, blob, cached.etag)
+	if err == nil {
+		/* nil means the download succeeded *and* was not etag match */
+		if hit {
+			/* This probably means expired ETag, which again means a fragment
+			* has been updated since cached. This should not happen in a
+			* healthy system and must be investigated immediately.
+			 */
+			log.Printf(
+				"ETag (= %s) expired for %v; investigate immediately",
+				*cached.etag,
+				blob,
+			)
+			return nil, internal.NewInternalError()
+		} else {
+			// This is good; not in cache, so clean fetch was expected.
+			if cold.ETag != nil {
+				entry := cacheEntry { chunk: cold.Chunk, etag: cold.ETag }
+				go cache.set(key, entry)
+			}
+			return cold.Chunk, nil
+		}
+	}
+
+	if errors.Is(err, storage.ErrNotModified) {
+		return cached.chunk, nil
+	}
+	/*
+	 * The error is passed through as-is, so that the caller can tell if it
+	 * is worth retrying, and it must be sanitized with clientError() before
+	 * it is reported.
+	 */
+	return nil, err
+}
+
+/*
+ * Retry failed blob downloads with exponential backoff and full jitter [1],
+ * i.e. the n-th retry waits a random duration in [0, base * 2^n), capped at
+ * max. The jitter spreads the retries of the many concurrent downloads, which
+ * usually fail together (e.g. when the storage account is throttling), so
+ * that they do not all hit the storage account again at the same time.
+ *
+ * [1] https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+ */
+type retryPolicy struct {
+	retries int
+	base    time.Duration
+	max     time.Duration
+}
+
+func newRetryPolicy(retries int) retryPolicy {
+	return retryPolicy {
+		retries: retries,
+		base:    100 * time.Millisecond,
+		max:     5 * time.Second,
+	}
+}
+
+func (p retryPolicy) backoff(retry int) time.Duration {
+	ceil := p.max
+	if retry < 32 && p.base << retry < p.max {
+		ceil = p.base << retry
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil)))
+}
+
+/*
+ * Statuses that indicate a transient problem with the storage account, as
+ * opposed to a problem with the request, like 403 Forbidden or 404 Not Found,
+ * which will fail the same way no matter how many times it is retried.
+ */
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	default:
+		return status >= 500
+	}
+}
+
+func retryable(err error) bool {
+	var stgErr *storage.Error
+	if errors.As(err, &stgErr) {
+		return retryableStatus(stgErr.Status)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+/*
+ * Call f until it succeeds, it fails with an error that is not retryable, the
+ * retries are exhausted, or the context is cancelled. The name is only used
+ * for logging.
+ */
+func (p retryPolicy) do(
+	ctx  context.Context,
+	name string,
+	f    func() error,
+) error {
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil {
+			if retry > 0 {
+				log.Printf("%s succeeded after %d retries", name, retry)
+			}
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return err
+		}
+
+		if !retryable(err) {
+			if retry > 0 {
+				log.Printf("%s failed after %d retries: %v", name, retry, err)
+			}
+			return err
+		}
+
+		if retry >= p.retries {
+			if retry > 0 {
+				log.Printf("%s failed, %d retries exhausted: %v", name, retry, err)
+			}
+			return err
+		}
+
+		wait := p.backoff(retry)
+		log.Printf(
+			"%s failed (retry %d/%d in %v): %v",
+			name,
+			retry + 1,
+			p.retries,
+			wait,
+			err,
+		)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+/*
+ * Map a download error to the error reported to the client. The raw errors
+ * can include the blob URL, and with it the signature, so they are logged,
+ * but never passed on.
+ */
+func clientError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var stgErr *storage.Error
+	if errors.As(err, &stgErr) {
+		status := stgErr.Status
+		switch status {
+		case http.StatusForbidden, http.StatusUnauthorized:
+			return internal.PermissionDeniedFromStatus(status)
+		case http.StatusNotFound:
+			return internal.NewNotFoundError()
+		}
+	}
+
+	switch err.(type) {
+	case *internal.InternalE:
+		return err
+	default:
+		log.Printf("Unhandled error type %T (= %v)", err, err)
+		return internal.NewInternalError()
+	}
+}
+
+/*
+ * The process stops listening on the queue on the first error, or when it is
+ * cancelled, so the workers must never block on a queue that is abandoned.
+ * Only the first error matters, so the error is dropped if the errors channel
+ * is full, and a fragment is dropped if the process is cancelled.
+ */
+func (f *fetch) run() {
+	for request := range f.requests {
+		name := ""
+		if request.blob != nil {
+			name = request.blob.Path
+		}
+
+		var b []byte
+		err := f.retry.do(request.ctx, name, func() (err error) {
+			b, err = fetchblob(request.ctx, request.store, request.blob, f.cache)
+			return
+		})
+		if err != nil {
+			err = &fetchError { fragment: name, err: clientError(err) }
+			select {
+			case request.errors <- err:
+			default:
+			}
+		} else {
+			select {
+			case request.fragments <- fragment {
+				index: request.index,
+				chunk: b,
+			}:
+			case <-request.ctx.Done():
+			}
+		}
+	}
+}
+
+func (f *fetch) startWorkers() {
+	for i := 0; i < cap(f.requests); i++ {
+		go f.run()
+	}
+}
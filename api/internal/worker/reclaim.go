@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * This module implements the at-least-once consumption of the job queue. In
+ * this mode, tasks are kept pending in the queue until they are
+ * acknowledged. Tasks are acknowledged only when the result is written, and
+ * tasks that have been pending for too long, e.g. because the worker died on
+ * a spot node that was reclaimed, are claimed by other workers and run again.
+ *
+ * A task that is slow rather than abandoned is also reclaimed, and then the
+ * part is written twice. The result service handles duplicated parts, so the
+ * only cost is the extra work. The idle time should be set comfortably above
+ * the time it takes to complete a task.
+ */
+
+/*
+ * Periodically claim and run the abandoned tasks, until the context is
+ * cancelled. This function should be called as a goroutine.
+ */
+func reclaim(
+	ctx    context.Context,
+	q      queue.Queue,
+	cfg    Config,
+	handle func(queue.Job),
+) {
+	ticker := time.NewTicker(cfg.ReclaimIdle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		jobs, err := q.Reclaim(ctx, cfg.Consumer)
+		if err != nil {
+			log.Printf("Unable to reclaim tasks: %v", err)
+		}
+		for _, job := range jobs {
+			log.Printf("reclaimed task %s", job.ID)
+			handle(job)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/storage"
+)
+
+/*
+ * The worker reads tasks from the job queue, downloads the fragments of the
+ * task, and writes the part of the result back to the queue. The worker is
+ * run as its own service by cmd/fetch, and in-process by cmd/server.
+ */
+type Config struct {
+	/*
+	 * Consumer ID of this worker, which should be unique among all the
+	 * workers in the consumer group.
+	 */
+	Consumer     string
+	/*
+	 * Number of concurrent downloads
+	 */
+	Jobs         int
+	/*
+	 * Max attempted retries per fragment, for transient errors
+	 */
+	Retries      int
+	/*
+	 * Consume tasks at-least-once, which must match the queue, and reclaim
+	 * abandoned tasks. The queue decides how long a task must be pending
+	 * before it is reclaimed, and this is how often to look for them.
+	 */
+	AtLeastOnce  bool
+	ReclaimIdle  time.Duration
+	/*
+	 * On shutdown, wait this long for the running tasks to complete
+	 */
+	DrainTimeout time.Duration
+	/*
+	 * Only serve tasks for this storage. Empty means any storage.
+	 */
+	StorageURL   string
+}
+
+/*
+ * Open the storage of a task. Tasks carry their storage endpoint, which is
+ * trusted as-is by default, but a worker that is configured with a storage
+ * URL only serves that storage. This matters for storage that is read with
+ * the worker's own credentials, like a local directory, as the endpoint would
+ * otherwise decide what files the worker reads.
+ */
+type opener func(endpoint string) (storage.Storage, error)
+
+func makeOpener(storageURL string) opener {
+	return func(endpoint string) (storage.Storage, error) {
+		if storageURL != "" && !storage.SameEndpoint(storageURL, endpoint) {
+			msg := "storage endpoint %s is not served by this worker"
+			return nil, fmt.Errorf(msg, endpoint)
+		}
+		return storage.OpenURL(endpoint)
+	}
+}
+
+func run(
+	q      queue.Queue,
+	fetch  *fetch,
+	active *running,
+	open   opener,
+	retry  bool,
+	job    queue.Job,
+	done   func(),
+) {
+	pid  := job.Pid
+	part := job.Part
+	msg  := [][]byte{ []byte(pid), []byte(part), job.Body }
+
+	/*
+	 * The process may have been cancelled after the task was scheduled, in
+	 * which case it is dropped before any fragments are downloaded.
+	 */
+	ctx := context.Background()
+	stop, err := q.Cancelled(ctx, pid)
+	if err != nil {
+		log.Printf("pid=%s, part=%s unable to check cancel: %v", pid, part, err)
+	}
+	if stop {
+		log.Printf("pid=%s, part=%s dropping cancelled process", pid, part)
+		done()
+		return
+	}
+
+	proc, err := exec(msg)
+	if err != nil {
+		log.Printf("pid=%s, part=%s dropping bad process %v", pid, part, err)
+		fail(q, pid, part, "task", err)
+		done()
+		return
+	}
+	/*
+	 * Build the container-URL early, in case it should be broken,
+	 * so that no goroutines are scheduled before any sanity
+	 * checking of input.
+	 */
+	container, err := proc.container()
+	if err != nil {
+		log.Printf("%s dropping bad process %v", proc.logpid(), err)
+		fail(q, pid, part, "task", err)
+		done()
+		return
+	}
+	store, err := open(proc.task.StorageEndpoint)
+	if err != nil {
+		log.Printf("%s dropping bad process %v", proc.logpid(), err)
+		fail(q, pid, part, "task", err)
+		done()
+		return
+	}
+
+	fragments := proc.fragments()
+	blobs := make([]*url.URL, len(fragments))
+	for i, id := range fragments {
+		blob, err := proc.blob(container, id)
+		if err != nil {
+			log.Printf("%s dropping bad process %v", proc.logpid(), err)
+			fail(q, pid, part, "task", err)
+			done()
+			return
+		}
+		blobs[i] = blob
+	}
+
+	fq := fetch.mkqueue()
+	active.add(proc)
+	go func() {
+		defer active.remove(proc)
+		err := proc.gather(q, len(fragments), fq)
+		/*
+		 * In at-least-once mode the task is not done if the result could not
+		 * be written, so that it can be reclaimed and retried. Otherwise the
+		 * task is lost, and the process is failed.
+		 */
+		var we *writeError
+		if errors.As(err, &we) {
+			if retry {
+				return
+			}
+			fail(q, pid, part, "write", err)
+		} else if err != nil {
+			fail(q, pid, part, "download", err)
+		}
+		done()
+	}()
+	fetch.enqueue(proc.ctx, fq, store, blobs)
+}
+
+/*
+ * Run the worker until the context is cancelled, and then drain the running
+ * tasks and leave the consumer group. The worker must have joined the group.
+ * Errors reading from the queue are fatal, and returned.
+ */
+func Run(shutdown context.Context, q queue.Queue, cfg Config) error {
+	ctx := context.Background()
+
+	/*
+	 * Make the function that marks a task as done. In at-least-once mode the
+	 * task is acknowledged and deleted from the job queue, otherwise it was
+	 * deleted when it was read.
+	 */
+	mkdone := func(job queue.Job) func() {
+		return func() {
+			err := q.Ack(ctx, job)
+			if err != nil {
+				log.Printf("Unable to ack %s: %v", job.ID, err)
+			}
+		}
+	}
+
+	fetch := newFetch(cfg.Jobs, cfg.Retries)
+	fetch.startWorkers()
+
+	/*
+	 * Cancelled processes are announced by the queue, and the tasks of that
+	 * process that are running on this worker are stopped.
+	 */
+	active := newRunning()
+	open := makeOpener(cfg.StorageURL)
+	listening, unlisten := context.WithCancel(ctx)
+	defer unlisten()
+	cancellations, err := q.Cancellations(listening)
+	if err != nil {
+		return fmt.Errorf("unable to listen for cancellations: %w", err)
+	}
+	go func() {
+		for pid := range cancellations {
+			n := active.cancel(pid)
+			if n > 0 {
+				log.Printf("pid=%s, cancelled %d tasks", pid, n)
+			}
+		}
+	}()
+
+	reclaimed := make(chan struct{})
+	if cfg.AtLeastOnce {
+		go func() {
+			defer close(reclaimed)
+			reclaim(shutdown, q, cfg, func(job queue.Job) {
+				done := mkdone(job)
+				/* the task was deleted, e.g. by cancel, but is still pending */
+				if job.Body == nil {
+					done()
+					return
+				}
+				run(q, fetch, active, open, cfg.AtLeastOnce, job, done)
+			})
+		}()
+	} else {
+		close(reclaimed)
+	}
+
+	/*
+	 * Only one task is read at a time, and the read blocks for a short while
+	 * only, so that shutdown is noticed.
+	 */
+	for shutdown.Err() == nil {
+		jobs, err := q.Dequeue(ctx, cfg.Consumer, time.Second)
+		if err != nil {
+			return fmt.Errorf("unable to read from queue: %w", err)
+		}
+		for _, job := range jobs {
+			run(q, fetch, active, open, cfg.AtLeastOnce, job, mkdone(job))
+		}
+	}
+
+	log.Printf("shutting down; draining running tasks")
+	<-reclaimed
+	remaining := active.drain(cfg.DrainTimeout)
+	for _, proc := range remaining {
+		log.Printf("%s still running at shutdown", proc.logpid())
+		/*
+		 * In at-least-once mode the task is still pending, and will be
+		 * reclaimed by another worker. Otherwise the task is lost, and the
+		 * process is failed so that the client does not wait forever.
+		 */
+		if !cfg.AtLeastOnce {
+			err := errors.New("worker shut down before the task completed")
+			fail(q, proc.pid, proc.part, "task", err)
+		}
+	}
+	err = q.Leave(ctx, cfg.Consumer)
+	if err != nil {
+		log.Printf("Unable to remove consumer %s: %v", cfg.Consumer, err)
+	} else {
+		log.Printf("consumer %s removed", cfg.Consumer)
+	}
+	return nil
+}
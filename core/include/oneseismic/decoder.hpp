@@ -134,6 +134,7 @@ private:
     void extract(const msgpack::v2::object&) noexcept (false);
     void slice  (const msgpack::v2::object&) noexcept (false);
     void curtain(const msgpack::v2::object&) noexcept (false);
+    void statistics(const msgpack::v2::object&) noexcept (false);
 
     /*
      * Look for the writer for some attribute ('data', 'cdpx' etc.). If no such
@@ -157,6 +158,11 @@ private:
     int nbundles = 0;
     process_header head;
     std::map< std::string, void* > writers;
+    /*
+     * The statistics are merged from the bundles as they are processed, and
+     * this is the running summary.
+     */
+    statistics_bundle summary;
 };
 
 }
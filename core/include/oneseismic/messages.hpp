@@ -2,11 +2,14 @@
 #define ONESEISMIC_MESSAGES_HPP
 
 #include <array>
+#include <cstdint>
 #include <optional>
 #include <stdexcept>
 #include <string>
 #include <vector>
 
+#include <oneseismic/sampleformat.hpp>
+
 namespace one {
 
 template < typename T >
@@ -60,6 +63,25 @@ struct manifestdoc {
     std::optional< std::vector< std::vector< double > > > utm_to_lineno;
 };
 
+/*
+ * Statistics are computed by the workers over the region given by an inner
+ * function (slice, curtain, subvolume, ...), so that only the summary and
+ * histogram is sent to the client, not the samples.
+ *
+ * The histogram has bins equally-sized bins over range [lo, hi]. Samples
+ * outside the range are counted in the first or last bin.
+ *
+ * Every worker allocates the full histogram, so the number of bins is capped
+ * at max_histogram_bins. The graphql resolver checks the same limit.
+ */
+constexpr int max_histogram_bins = 65536;
+
+struct statisticsdesc {
+    std::string             function;
+    int                     bins;
+    std::array< double, 2 > range;
+};
+
 /*
  * The *query messages are parsing utilities for the input messages built from
  * the graphql queries. They help build a corresponding *task which is fed to
@@ -75,6 +97,39 @@ struct basic_query {
     std::string                 storage_endpoint;
     std::string                 function;
     std::vector< std::string >  attributes;
+    /*
+     * The (cartesian, inclusive) range [fst, lst] of samples to include from
+     * every trace, when the query is restricted to a vertical window.
+     */
+    std::optional< std::pair< int, int > > zrange;
+    /*
+     * Compute statistics over the queried region rather than returning the
+     * samples.
+     */
+    std::optional< statisticsdesc > statistics;
+    /*
+     * Decimate the output, keeping every stride[i]-th line in dimension i,
+     * starting at the first line of the output. The stride of the sliced
+     * dimension is ignored, and so are the horizontal strides for queries
+     * that output a list of traces (curtain, horizon, etc.), since the traces
+     * are given explicitly.
+     */
+    std::array< int, 3 > stride = { 1, 1, 1 };
+    /*
+     * The format to send the samples in, see sampleformat.hpp.
+     */
+    formatdesc format;
+
+    /*
+     * The samples [fst, lst] to extract, which is either the zrange or the
+     * full trace.
+     */
+    std::pair< int, int > zwindow() const noexcept (false) {
+        if (this->zrange)
+            return *this->zrange;
+        const auto& samples = this->manifest.line_numbers.back();
+        return { 0, int(samples.size()) - 1 };
+    }
 
     const std::vector< int >& shape() const noexcept (false) {
         /*
@@ -108,7 +163,9 @@ struct basic_task {
         storage_endpoint (q.storage_endpoint),
         shape            (q.shape()),
         function         (q.function),
-        attribute        ("data")
+        attribute        ("data"),
+        stride           (q.stride),
+        format           (q.format)
     {
         this->shape_cube.reserve(q.manifest.line_numbers.size());
         for (const auto& d : q.manifest.line_numbers)
@@ -125,7 +182,8 @@ struct basic_task {
         storage_endpoint (q.storage_endpoint),
         shape            (attr.shapes.at(0)),
         function         (q.function),
-        attribute        (attr.type)
+        attribute        (attr.type),
+        stride           (q.stride)
     {
         this->shape_cube.reserve(q.manifest.line_numbers.size());
         for (const auto& d : q.manifest.line_numbers)
@@ -144,6 +202,21 @@ struct basic_task {
     std::vector< int > shape_cube;
     std::string        function;
     std::string        attribute;
+    /*
+     * Set for statistics tasks, in which case function is "statistics" and
+     * statistics->function is the function that extracts the region.
+     */
+    std::optional< statisticsdesc > statistics;
+    /*
+     * The stride the output is decimated with, see basic_query. Workers
+     * decimate before pack(), so that only the kept samples are sent.
+     */
+    std::array< int, 3 > stride = { 1, 1, 1 };
+    /*
+     * The format the samples are encoded in before pack(). Only set for data
+     * tasks, attributes are always float32.
+     */
+    formatdesc format;
 };
 
 /*
@@ -169,8 +242,13 @@ struct basic_task {
  */
 
 enum class functionid {
-    slice   = 1,
-    curtain = 2,
+    slice      = 1,
+    curtain    = 2,
+    horizon    = 3,
+    subvolume  = 4,
+    traces     = 5,
+    fence      = 6,
+    statistics = 7,
 };
 
 struct process_header : MsgPackable< process_header > {
@@ -182,11 +260,27 @@ struct process_header : MsgPackable< process_header > {
     std::vector< std::string >          labels;
     std::vector< std::string >          attributes;
     std::vector< int >                  shapes;
+    /*
+     * The [x, y] UTM positions of the output traces, flattened, for the
+     * queries that are not aligned with the grid (fence). Empty otherwise.
+     */
+    std::vector< double >               coordinates;
+    /*
+     * The format of the data samples, and the scale and offset for the
+     * integer formats.
+     */
+    formatdesc                          format;
 };
 
 struct slice_query : public basic_query, Packable< slice_query > {
     int dim;
     int idx;
+    /*
+     * The weight of the next line (idx + 1) when blending two neighbouring
+     * slices, i.e. the output is (1 - weight) * slice[idx] + weight *
+     * slice[idx + 1]. A weight of zero means no blending.
+     */
+    float weight = 0;
 };
 
 struct curtain_query : public basic_query, Packable< curtain_query > {
@@ -210,7 +304,18 @@ struct slice_task : public basic_task, Packable< slice_task > {
 
     int dim;
     int idx;
+    /*
+     * The weight of the next line, see slice_query. When the next line is in
+     * the next fragment, that fragment must be fetched too.
+     */
+    float weight = 0;
     std::vector< std::array< int, 3 > > ids;
+    /*
+     * The (cube-global, inclusive) samples to extract, when the slice is
+     * vertical and restricted to a z-window. When not set, the full slice is
+     * extracted.
+     */
+    std::optional< std::pair< int, int > > zrange;
 };
 
 struct tile {
@@ -225,6 +330,11 @@ struct tile {
 struct slice_tiles {
     std::string attr;
     std::vector< tile > tiles;
+    /*
+     * The format the values are encoded in by pack() and decoded from by
+     * unpack(). It is not a part of the message, but given by the header.
+     */
+    formatdesc format;
 
     std::string pack()   const noexcept (false);
     void unpack(const char* fst, const char* lst) noexcept (false);
@@ -251,6 +361,11 @@ struct single {
 struct curtain_task : public basic_task, Packable< curtain_task > {
     using basic_task::basic_task;
     std::vector< single > ids;
+    /*
+     * The (cube-global, inclusive) samples to extract. When not set, the full
+     * trace is extracted.
+     */
+    std::optional< std::pair< int, int > > zrange;
 };
 
 struct curtain_bundle {
@@ -298,6 +413,162 @@ struct curtain_bundle {
     std::vector< int > major;
     std::vector< int > minor;
     std::vector< float > values;
+    /* the format of values, see slice_tiles */
+    formatdesc format;
+
+    std::string pack() const noexcept (false);
+    void unpack(const char* fst, const char* lst) noexcept (false);
+};
+
+/*
+ * The horizon query is a curtain-like query, except every trace has a z
+ * (depth/time) position and a window around it. Conceptually, the user gives
+ * a surface [(x1 y1 z1) (x2 y2 z2) ...] and gets back the samples
+ * [z-window, z+window] of every trace (x, y).
+ *
+ * Unlike the curtain, the input order of the surface is preserved, and the
+ * i-th row of the output always corresponds to the i-th point in the surface.
+ */
+struct horizon_query : public basic_query, Packable< horizon_query > {
+    std::vector< int > dim0s;
+    std::vector< int > dim1s;
+    std::vector< int > dim2s;
+    int window;
+};
+
+/*
+ * The traces query is a list of (unrelated) traces, as opposed to the
+ * curtain, which is a path through the cube. The output is one full trace per
+ * distinct (x, y), in the order they were queried.
+ *
+ * The traces query is planned as a horizon covering the full trace.
+ */
+struct traces_query : public basic_query, Packable< traces_query > {
+    std::vector< int > dim0s;
+    std::vector< int > dim1s;
+};
+
+struct horizon_segments {
+    /* id is a 3-tuple (i,j,k) that gives the fragment-ID */
+    std::array< int, 3 > id;
+
+    /*
+     * A segment is the 4-tuple (n, i', j', zfst), where n is the row of the
+     * trace in the output, (i', j') is the fragment-local x/y position of the
+     * trace, and zfst is the (cube-global) first sample of the window.
+     *
+     * The window [zfst, zfst + zlength) usually spans more than one fragment,
+     * and may extend past the edges of the cube. Workers clip it to the
+     * fragment.
+     */
+    std::vector< std::array< int, 4 > > segments;
+};
+
+struct horizon_task : public basic_task, Packable< horizon_task > {
+    using basic_task::basic_task;
+    int zlength;
+    std::vector< horizon_segments > ids;
+};
+
+/*
+ * The subvolume query is a bounding box [lower, upper] in the cartesian grid.
+ * Both ends are inclusive, so that a box of line numbers [from, to] maps
+ * cleanly onto the output.
+ */
+struct subvolume_query : public basic_query, Packable< subvolume_query > {
+    std::array< int, 3 > lower;
+    std::array< int, 3 > upper;
+};
+
+struct subvolume_task : public basic_task, Packable< subvolume_task > {
+    subvolume_task() = default;
+    explicit subvolume_task(const subvolume_query& q) :
+        basic_task(q),
+        lower(q.lower),
+        upper(q.upper)
+    {}
+
+    subvolume_task(const subvolume_query& q, const attributedesc& attr) :
+        basic_task(q, attr),
+        lower(q.lower),
+        upper(q.upper)
+    {
+        /* attributes are 1-sample high, so only the top sample is read */
+        this->lower[2] = 0;
+        this->upper[2] = 0;
+    }
+
+    std::array< int, 3 > lower;
+    std::array< int, 3 > upper;
+    std::vector< std::array< int, 3 > > ids;
+};
+
+/*
+ * The fence is a curtain along an arbitrary UTM polyline, which is resampled
+ * at a fixed spacing. The sampled positions rarely fall on the grid, so every
+ * trace in the fence is a weighted sum of the (up to 4) cube traces around
+ * it, i.e. a bilinear interpolation. With nearest interpolation it is just
+ * the nearest trace, with weight 1.
+ */
+struct fence_point {
+    /* the cartesian (i, j) of the cube trace */
+    std::array< int, 2 > position;
+    float weight;
+};
+
+struct fence_query : public basic_query, Packable< fence_query > {
+    /* the sampled [x, y] UTM positions, flattened */
+    std::vector< double > coordinates;
+    /* the cube traces that make up every trace in the fence */
+    std::vector< std::vector< fence_point > > traces;
+};
+
+struct fence_trace {
+    /* the trace (row) in the output */
+    int n;
+    std::vector< fence_point > points;
+};
+
+struct fence_segments {
+    /*
+     * The fragment of the first point of every trace, and the z-block. The
+     * other points may be in the neighbouring fragments.
+     */
+    std::array< int, 3 > id;
+    std::vector< fence_trace > traces;
+};
+
+struct fence_task : public basic_task, Packable< fence_task > {
+    using basic_task::basic_task;
+    std::vector< fence_segments > ids;
+    /*
+     * The (cube-global, inclusive) samples to extract. When not set, the full
+     * trace is extracted.
+     */
+    std::optional< std::pair< int, int > > zrange;
+};
+
+/*
+ * A statistics task is a task of the inner function (slice_task,
+ * curtain_task, ...) with the statistics set. Only the basic_task part is
+ * parsed, the rest is left for the inner function.
+ */
+struct statistics_task : public basic_task, Packable< statistics_task > {};
+
+/*
+ * The statistics over the samples of a single task. The bundles are merged
+ * by the decoder, which is why sum and sum-of-squares is sent rather than
+ * mean and rms.
+ */
+struct statistics_bundle {
+    std::string attr;
+    std::int64_t count = 0;
+    float min = 0;
+    float max = 0;
+    double sum = 0;
+    double sumsq = 0;
+    std::array< double, 2 > range;
+    std::vector< std::int64_t > histogram;
 
     std::string pack() const noexcept (false);
     void unpack(const char* fst, const char* lst) noexcept (false);
@@ -18,6 +18,12 @@ public:
      *
      * Kind should be one of:
      * - slice
+     * - curtain
+     * - horizon
+     * - traces
+     * - subvolume
+     * - fence
+     * - statistics
      */
     static
     std::unique_ptr< proc > make(const std::string& kind)
@@ -37,7 +43,7 @@ public:
      *          for fragment in proc.fragments().split(';')
      *     ]
      */
-    const std::string& fragments() const;
+    virtual const std::string& fragments() const;
 
     /*
      * Add (or register) a downloaded fragment. This function is responsible
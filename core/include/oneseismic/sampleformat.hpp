@@ -0,0 +1,77 @@
+#ifndef ONESEISMIC_SAMPLEFORMAT_HPP
+#define ONESEISMIC_SAMPLEFORMAT_HPP
+
+#include <cstddef>
+#include <string>
+
+namespace one {
+
+/*
+ * The format the samples are sent to the client in. The workers always
+ * compute in float32, and encode the samples just before packing. The
+ * integer formats are scaled, so that a sample is recovered as
+ *
+ *     sample = offset + scale * x
+ *
+ * with the scale and offset recorded in the process header. The format
+ * applies to the data only, the attributes (e.g. cdpx, cdpy) are always sent
+ * as float32, as they would be useless with reduced precision.
+ *
+ * The decoder converts back to float32 when writing the output, so that
+ * clients can treat every response the same, and the format only affects the
+ * size of the payload.
+ */
+enum class sampleformat {
+    float32,
+    float16,
+    int16,
+    int8,
+};
+
+struct formatdesc {
+    sampleformat type = sampleformat::float32;
+    double scale  = 1;
+    double offset = 0;
+};
+
+sampleformat parse_sampleformat(const std::string&) noexcept (false);
+std::string to_string(sampleformat) noexcept (true);
+
+/*
+ * The size in bytes of a single sample in the format.
+ */
+std::size_t samplesize(sampleformat) noexcept (true);
+
+/*
+ * Make the format that maps the sample range [lo, hi] onto the range of the
+ * integer type, so that the full resolution is used. Values outside the range
+ * are clamped when encoded. The float formats are not scaled.
+ */
+formatdesc scaled(sampleformat, double lo, double hi) noexcept (false);
+
+/*
+ * Encode n float32 samples from src into dst, which must have room for
+ * n * samplesize(fmt.type) bytes. Samples that are not finite are encoded
+ * as the offset (zero) for the integer formats.
+ */
+void encode(
+    const float* src,
+    std::size_t n,
+    const formatdesc& fmt,
+    char* dst)
+noexcept (true);
+
+/*
+ * Decode n samples from src, the inverse of encode, into float32 samples.
+ * Neither src nor dst need to be aligned.
+ */
+void decode(
+    const char* src,
+    std::size_t n,
+    const formatdesc& fmt,
+    char* dst)
+noexcept (true);
+
+}
+
+#endif //ONESEISMIC_SAMPLEFORMAT_HPP
@@ -1,3 +1,6 @@
+#include <algorithm>
+#include <cmath>
+#include <limits>
 #include <vector>
 #include <string>
 #include <map>
@@ -20,6 +23,11 @@ struct convert< one::functionid > {
         switch (static_cast< one::functionid >(v)) {
             case one::functionid::slice:
             case one::functionid::curtain:
+            case one::functionid::horizon:
+            case one::functionid::subvolume:
+            case one::functionid::traces:
+            case one::functionid::fence:
+            case one::functionid::statistics:
                 break;
 
             default: {
@@ -33,6 +41,15 @@ struct convert< one::functionid > {
     }
 };
 
+template <>
+struct convert< one::sampleformat > {
+    const v2::object& operator () (const v2::object& o, one::sampleformat& f)
+    const noexcept (false) {
+        f = one::parse_sampleformat(o.as< std::string >());
+        return o;
+    }
+};
+
 template <>
 struct convert< one::process_header > {
     const v2::object& operator () (const v2::object& o, one::process_header& head)
@@ -40,19 +57,28 @@ struct convert< one::process_header > {
         if (o.type != type::MAP)
             throw type_error();
 
+        /*
+         * The optional keys are not always present, so start from a blank
+         * header to not carry them over from the previous message.
+         */
+        head = one::process_header {};
         const auto& kvs = o.via.map;
         std::string key;
         for (int i = 0; i < kvs.size; ++i) {
             const auto& kv = kvs.ptr[i];
             kv.key >> key;
-                 if (key == "pid")        kv.val >> head.pid;
-            else if (key == "function")   kv.val >> head.function;
-            else if (key == "nbundles")   kv.val >> head.nbundles;
-            else if (key == "ndims")      kv.val >> head.ndims;
-            else if (key == "labels")     kv.val >> head.labels;
-            else if (key == "index")      kv.val >> head.index;
-            else if (key == "shapes")     kv.val >> head.shapes;
-            else if (key == "attributes") kv.val >> head.attributes;
+                 if (key == "pid")         kv.val >> head.pid;
+            else if (key == "function")    kv.val >> head.function;
+            else if (key == "nbundles")    kv.val >> head.nbundles;
+            else if (key == "ndims")       kv.val >> head.ndims;
+            else if (key == "labels")      kv.val >> head.labels;
+            else if (key == "index")       kv.val >> head.index;
+            else if (key == "shapes")      kv.val >> head.shapes;
+            else if (key == "attributes")  kv.val >> head.attributes;
+            else if (key == "coordinates") kv.val >> head.coordinates;
+            else if (key == "format")      kv.val >> head.format.type;
+            else if (key == "scale")       kv.val >> head.format.scale;
+            else if (key == "offset")      kv.val >> head.format.offset;
             else {
                 throw one::bad_message("Unknown key '" + key + "' in header");
             }
@@ -121,6 +147,17 @@ std::uint16_t net16(const char* net) noexcept (true) {
     ;
 }
 
+/*
+ * The sample format only applies to the data, the attributes are always
+ * float32.
+ */
+formatdesc formatof(const process_header& head, const std::string& attr)
+noexcept (true) {
+    if (attr == "data")
+        return head.format;
+    return formatdesc {};
+}
+
 struct insufficient_bytes : public std::exception {};
 int parse_array_len(const char* input, std::size_t size, int& len)
 noexcept (false) {
@@ -171,6 +208,7 @@ void decoder::reset() {
     // optionally writers are not?
     this->unp.remove_nonparsed_buffer();
     this->phase = state::envelope;
+    this->summary = statistics_bundle {};
     this->nbundles = 0;
     this->writers.clear();
 }
@@ -301,13 +339,30 @@ decoder::status decoder::buffer_and_process(
 void decoder::extract(const msgpack::v2::object& obj) {
     switch (this->head.function) {
         case functionid::slice:
+        case functionid::subvolume:
+            /*
+             * The subvolume is packed as slice tiles, with one tile per
+             * x-line of every fragment.
+             */
             this->slice(obj);
             return;
 
         case functionid::curtain:
+        case functionid::horizon:
+        case functionid::traces:
+        case functionid::fence:
+            /*
+             * The horizon, traces, and fence are packed as curtain bundles,
+             * where the z-axis is the window around the horizon, or the full
+             * trace.
+             */
             this->curtain(obj);
             return;
 
+        case functionid::statistics:
+            this->statistics(obj);
+            return;
+
         default:
             break;
     }
@@ -325,6 +380,8 @@ noexcept (false) {
     if (!dst)
         return;
 
+    const auto fmt = formatof(this->head, attribute);
+    const auto elemsize = samplesize(fmt.type);
     const auto atiles = asarray(root[1]);
     const auto ntiles = atiles.size;
     const auto tiles  = atiles.ptr;
@@ -341,10 +398,11 @@ noexcept (false) {
 
         const auto* src = v.ptr;
         for (int i = 0; i < iterations; ++i) {
-            std::memcpy(
-                dst + sizeof(float) * (i * superstride + initial_skip),
-                src + sizeof(float) * (i * substride),
-                sizeof(float) * chunk_size
+            decode(
+                src + elemsize * (i * substride),
+                chunk_size,
+                fmt,
+                dst + sizeof(float) * (i * superstride + initial_skip)
             );
         }
     }
@@ -366,6 +424,7 @@ noexcept (false) {
     const auto major = slots[3].as< std::vector< int > >();
     const auto minor = slots[4].as< std::vector< int > >();
     const auto v     = asbinarray(slots[5]);
+    const auto fmt   = formatof(this->head, attribute);
 
     const auto* src = v.ptr;
     for (int n = 0; n < size; ++n) {
@@ -374,20 +433,95 @@ noexcept (false) {
         const auto zfst = minor[n*2 + 0];
         const auto zlst = minor[n*2 + 1];
 
-        const auto elemsize = sizeof(float);
+        const auto elemsize = samplesize(fmt.type);
         const auto chunksize = elemsize * (zlst - zfst);
         for (int i = ifst; i < ilst; ++i) {
             const auto chunk = i - ifst;
-            std::memcpy(
-                dst + elemsize  * (i*zlen + zfst),
+            decode(
                 src + chunksize * chunk,
-                chunksize
+                zlst - zfst,
+                fmt,
+                dst + sizeof(float) * (i*zlen + zfst)
             );
         }
         src += chunksize * (ilst - ifst);
     }
 }
 
+/*
+ * Every bundle holds the statistics of a single task, which are merged into
+ * the summary. The output is re-written for every bundle, so that it is
+ * complete when the last bundle is processed. The output is laid out as:
+ *
+ *   [count, min, max, mean, rms, lo, hi, histogram...]
+ *
+ * where [lo, hi] is the range of the histogram. When no samples are counted,
+ * min, max, mean, and rms are NaN.
+ *
+ * The output is float32 like every other result, so count and the histogram
+ * are exact only up to 2^24 (16777216). Larger counts are rounded to the
+ * nearest float, i.e. they have a relative error of at most 2^-24.
+ */
+void decoder::statistics(const msgpack::v2::object& obj)
+noexcept (false) {
+    const auto slots = astuple(obj, 9);
+
+    const auto attribute = slots[0].as< std::string >();
+    auto* dst = this->get_writer_for(attribute);
+    if (!dst)
+        return;
+
+    const auto count     = slots[1].as< std::int64_t >();
+    const auto min       = slots[2].as< float >();
+    const auto max       = slots[3].as< float >();
+    const auto histogram = slots[8].as< std::vector< std::int64_t > >();
+
+    auto& summary = this->summary;
+    if (summary.histogram.empty())
+        summary.histogram.assign(histogram.size(), 0);
+
+    if (summary.histogram.size() != histogram.size()) {
+        const auto msg = "inconsistent number of bins; expected "
+            + std::to_string(summary.histogram.size())
+            + ", was "
+            + std::to_string(histogram.size())
+        ;
+        throw bad_message(msg);
+    }
+
+    if (count > 0) {
+        if (summary.count == 0) {
+            summary.min = min;
+            summary.max = max;
+        } else {
+            summary.min = std::min(summary.min, min);
+            summary.max = std::max(summary.max, max);
+        }
+    }
+
+    summary.count    += count;
+    summary.sum      += slots[4].as< double >();
+    summary.sumsq    += slots[5].as< double >();
+    summary.range[0]  = slots[6].as< double >();
+    summary.range[1]  = slots[7].as< double >();
+    for (std::size_t i = 0; i < histogram.size(); ++i)
+        summary.histogram[i] += histogram[i];
+
+    const auto nan = std::numeric_limits< float >::quiet_NaN();
+    const auto n   = double(summary.count);
+    std::vector< float > out = {
+        float(summary.count),
+        summary.count > 0 ? summary.min : nan,
+        summary.count > 0 ? summary.max : nan,
+        summary.count > 0 ? float(summary.sum / n) : nan,
+        summary.count > 0 ? float(std::sqrt(summary.sumsq / n)) : nan,
+        float(summary.range[0]),
+        float(summary.range[1]),
+    };
+    out.insert(out.end(), summary.histogram.begin(), summary.histogram.end());
+    std::memcpy(dst, out.data(), sizeof(float) * out.size());
+}
+
 char* decoder::get_writer_for(const std::string& attr) noexcept (true) {
     auto itr = this->writers.find(attr);
     if (itr == this->writers.end())
@@ -1,6 +1,7 @@
 #include <algorithm>
 #include <cassert>
 #include <math.h>
+#include <set>
 #include <string>
 #include <tuple>
 
@@ -48,13 +49,29 @@ void MsgPackable< T >::unpack(const char* fst, const char* lst) noexcept (false)
 
 namespace {
 
-template < typename Packer, typename T >
-void packarray_bin(Packer& packer, const std::vector< T >& vec)
-noexcept (true) {
-    const auto vsize = vec.size() * sizeof(T);
-    const auto* body = reinterpret_cast< const char* >(vec.data());
-    packer.pack_bin(vsize);
-    packer.pack_bin_body(body, vsize);
+/*
+ * Pack the samples as a bin, encoded in the sample format fmt.
+ */
+template < typename Packer >
+void packsamples_bin(
+        Packer& packer,
+        const std::vector< float >& vec,
+        const formatdesc& fmt)
+noexcept (false) {
+    std::vector< char > body(vec.size() * samplesize(fmt.type));
+    encode(vec.data(), vec.size(), fmt, body.data());
+    packer.pack_bin(body.size());
+    packer.pack_bin_body(body.data(), body.size());
+}
+
+std::vector< float > unpacksamples_bin(
+        const msgpack::v2::object_bin& bin,
+        const formatdesc& fmt)
+noexcept (false) {
+    std::vector< float > values(bin.size / samplesize(fmt.type));
+    auto* dst = reinterpret_cast< char* >(values.data());
+    decode(bin.ptr, values.size(), fmt, dst);
+    return values;
 }
 
 }
@@ -83,7 +100,7 @@ std::string slice_tiles::pack() const noexcept (false) {
         packer.pack(tile.initial_skip);
         packer.pack(tile.superstride);
         packer.pack(tile.substride);
-        packarray_bin(packer, tile.v);
+        packsamples_bin(packer, tile.v, this->format);
     }
 
     return std::string(buffer.data(), buffer.size());
@@ -125,9 +142,7 @@ void slice_tiles::unpack(const char* fst, const char* lst) noexcept (false) {
 
         if (ptile[5].type != msgpack::v2::type::BIN)
             throw bad_value("tile.v should be BIN");
-        auto tv = ptile[5].via.bin;
-        t.v.resize(tv.size / sizeof(float));
-        std::memcpy(t.v.data(), tv.ptr, tv.size);
+        t.v = unpacksamples_bin(ptile[5].via.bin, this->format);
         this->tiles.push_back(std::move(t));
     }
 }
@@ -142,7 +157,7 @@ std::string curtain_bundle::pack() const noexcept (false) {
     packer.pack(this->zlength);
     packer.pack(this->major);
     packer.pack(this->minor);
-    packarray_bin(packer, this->values);
+    packsamples_bin(packer, this->values, this->format);
     return std::string(buffer.data(), buffer.size());
 }
 
@@ -164,8 +179,44 @@ noexcept (false) {
     auto tv = obj.via.array.ptr[5];
     if (tv.type != msgpack::v2::type::BIN)
         throw bad_value("curtain.values should be BIN");
-    this->values.resize(tv.via.bin.size / sizeof(float));
-    std::memcpy(this->values.data(), tv.via.bin.ptr, tv.via.bin.size);
+    this->values = unpacksamples_bin(tv.via.bin, this->format);
+}
+
+std::string statistics_bundle::pack() const noexcept (false) {
+    msgpack::sbuffer buffer;
+    msgpack::packer< decltype(buffer) > packer(buffer);
+
+    packer.pack_array(9);
+    packer.pack(this->attr);
+    packer.pack(this->count);
+    packer.pack(this->min);
+    packer.pack(this->max);
+    packer.pack(this->sum);
+    packer.pack(this->sumsq);
+    packer.pack(this->range[0]);
+    packer.pack(this->range[1]);
+    packer.pack(this->histogram);
+    return std::string(buffer.data(), buffer.size());
+}
+
+void statistics_bundle::unpack(const char* fst, const char* lst)
+noexcept (false) {
+    const auto result = msgpack::unpack(fst, std::distance(fst, lst));
+    const auto& obj = result.get();
+    ensurearray(obj);
+
+    if (obj.via.array.size != 9)
+        throw bad_message("expected array of len 9");
+
+    obj.via.array.ptr[0] >> this->attr;
+    obj.via.array.ptr[1] >> this->count;
+    obj.via.array.ptr[2] >> this->min;
+    obj.via.array.ptr[3] >> this->max;
+    obj.via.array.ptr[4] >> this->sum;
+    obj.via.array.ptr[5] >> this->sumsq;
+    obj.via.array.ptr[6] >> this->range[0];
+    obj.via.array.ptr[7] >> this->range[1];
+    obj.via.array.ptr[8] >> this->histogram;
 }
 
 
@@ -225,6 +276,60 @@ void to_json(nlohmann::json& doc, const basic_query& query) noexcept(false) {
     throw std::logic_error(msg);
 }
 
+namespace {
+
+/*
+ * Map the interval [from, to] (inclusive) of kind index or lineno to the
+ * cartesian interval [fst, lst]. For line numbers, the interval is the set of
+ * lines in [from, to], so the endpoints don't have to be actual line numbers.
+ * This makes it possible to ask for e.g. [1000, 1100] on a survey where every
+ * other line is recorded.
+ *
+ * The what is used to prefix error messages, e.g. "dimension 1".
+ */
+std::pair< int, int > cartesian_range(
+        const std::vector< int >& labels,
+        int from,
+        int to,
+        const std::string& kind,
+        const std::string& what)
+noexcept (false) {
+    if (from > to) {
+        constexpr auto msg = "{}: from (= {}) > to (= {})";
+        throw bad_value(fmt::format(msg, what, from, to));
+    }
+
+    if (kind == "index") {
+        const auto size = int(labels.size());
+        if (from < 0 or to >= size) {
+            constexpr auto msg = "{}: [{}, {}] is out of cube boundaries [0, {})";
+            throw not_found(fmt::format(msg, what, from, to, size));
+        }
+        return { from, to };
+    }
+
+    if (kind == "lineno") {
+        assert(std::is_sorted(labels.begin(), labels.end()));
+        const auto begin = labels.begin();
+        const auto end   = labels.end();
+        const auto fst = std::lower_bound(begin, end, from);
+        const auto lst = std::upper_bound(begin, end, to);
+        if (fst == lst) {
+            constexpr auto msg = "{}: no lines in [{}, {}]";
+            throw not_found(fmt::format(msg, what, from, to));
+        }
+        return {
+            int(std::distance(begin, fst)),
+            int(std::distance(begin, lst)) - 1,
+        };
+    }
+
+    constexpr auto msg = "expected kind 'index' or 'lineno', got {}";
+    throw bad_message(fmt::format(msg, kind));
+}
+
+}
+
 void from_json(const nlohmann::json& doc, basic_query& query) noexcept (false) {
     doc.at("pid")             .get_to(query.pid);
     doc.at("url-query")       .get_to(query.url_query);
@@ -238,9 +343,117 @@ void from_json(const nlohmann::json& doc, basic_query& query) noexcept (false) {
 
     const auto& opts = *optsitr;
 
+    /*
+     * Unset options are sent as null from the graphql layer, e.g. when only
+     * zrange is set, so null is treated as not-set.
+     */
     const auto attr = opts.find("attributes");
-    if (attr != opts.end())
+    if (attr != opts.end() and not attr->is_null())
         attr->get_to(query.attributes);
+
+    const auto zrange = opts.find("zrange");
+    if (zrange != opts.end() and not zrange->is_null()) {
+        const auto& samples = query.manifest.line_numbers.back();
+        query.zrange = cartesian_range(
+            samples,
+            zrange->at("from"),
+            zrange->at("to"),
+            zrange->value("kind", "lineno"),
+            "opts.zrange"
+        );
+    }
+
+    const auto stride = opts.find("stride");
+    if (stride != opts.end() and not stride->is_null()) {
+        const auto strides = stride->get< std::vector< int > >();
+        if (strides.size() != query.stride.size()) {
+            constexpr auto msg = "opts.stride: expected {} strides, got {}";
+            const auto n = query.stride.size();
+            throw bad_message(fmt::format(msg, n, strides.size()));
+        }
+
+        for (const auto s : strides) {
+            if (s < 1) {
+                constexpr auto msg = "opts.stride (= [{}]) must be positive";
+                const auto xs = fmt::format("{}", fmt::join(strides, ", "));
+                throw bad_message(fmt::format(msg, xs));
+            }
+        }
+        std::copy(strides.begin(), strides.end(), query.stride.begin());
+    }
+
+    const auto format = opts.find("format");
+    if (format != opts.end() and not format->is_null()) {
+        const auto type = parse_sampleformat(format->at("type").get< std::string >());
+        const auto range = format->find("range");
+        const auto integral = type == sampleformat::int16
+                           or type == sampleformat::int8;
+
+        if (integral and (range == format->end() or range->is_null())) {
+            constexpr auto msg = "opts.format.range must be set for {}";
+            throw bad_message(fmt::format(msg, to_string(type)));
+        }
+
+        if (integral) {
+            const auto [lo, hi] = range->get< std::array< double, 2 > >();
+            if (not (lo < hi)) {
+                constexpr auto msg = "opts.format.range (= [{}, {}]) is empty";
+                throw bad_message(fmt::format(msg, lo, hi));
+            }
+            query.format = scaled(type, lo, hi);
+        } else {
+            query.format = scaled(type, 0, 0);
+        }
+    }
+
+    const auto statistics = opts.find("statistics");
+    if (statistics != opts.end() and not statistics->is_null()) {
+        statisticsdesc desc;
+        desc.function = query.function;
+        statistics->at("bins") .get_to(desc.bins);
+        statistics->at("range").get_to(desc.range);
+
+        if (desc.bins < 1) {
+            constexpr auto msg = "opts.statistics.bins (= {}) must be positive";
+            throw bad_message(fmt::format(msg, desc.bins));
+        }
+        if (desc.bins > max_histogram_bins) {
+            constexpr auto msg = "opts.statistics.bins (= {}) must be <= {}";
+            throw bad_message(fmt::format(msg, desc.bins, max_histogram_bins));
+        }
+
+        const auto [lo, hi] = desc.range;
+        if (not (lo < hi)) {
+            constexpr auto msg = "opts.statistics.range (= [{}, {}]) is empty";
+            throw bad_message(fmt::format(msg, lo, hi));
+        }
+        query.statistics = desc;
+    }
+}
+
+void to_json(nlohmann::json& doc, const statisticsdesc& desc) noexcept (false) {
+    doc["function"] = desc.function;
+    doc["bins"]     = desc.bins;
+    doc["range"]    = desc.range;
+}
+
+void from_json(const nlohmann::json& doc, statisticsdesc& desc)
+noexcept (false) {
+    doc.at("function").get_to(desc.function);
+    doc.at("bins")    .get_to(desc.bins);
+    doc.at("range")   .get_to(desc.range);
+}
+
+void to_json(nlohmann::json& doc, const formatdesc& fmt) noexcept (false) {
+    doc["type"]   = to_string(fmt.type);
+    doc["scale"]  = fmt.scale;
+    doc["offset"] = fmt.offset;
+}
+
+void from_json(const nlohmann::json& doc, formatdesc& fmt) noexcept (false) {
+    fmt.type = parse_sampleformat(doc.at("type").get< std::string >());
+    doc.at("scale") .get_to(fmt.scale);
+    doc.at("offset").get_to(fmt.offset);
 }
 
 void to_json(nlohmann::json& doc, const basic_task& task) noexcept (false) {
@@ -254,6 +467,12 @@ void to_json(nlohmann::json& doc, const basic_task& task) noexcept (false) {
     doc["shape-cube"]       = task.shape_cube;
     doc["function"]         = task.function;
     doc["attribute"]        = task.attribute;
+    if (task.statistics)
+        doc["statistics"] = *task.statistics;
+    if (task.stride != std::array< int, 3 >{ 1, 1, 1 })
+        doc["stride"] = task.stride;
+    if (task.format.type != sampleformat::float32)
+        doc["format"] = task.format;
     assert(task.shape_cube.size() == task.shape.size());
 }
 
@@ -268,6 +487,22 @@ void from_json(const nlohmann::json& doc, basic_task& task) noexcept (false) {
     doc.at("shape-cube")      .get_to(task.shape_cube);
     doc.at("function")        .get_to(task.function);
     doc.at("attribute")       .get_to(task.attribute);
+
+    if (doc.count("statistics") != 0)
+        task.statistics = doc.at("statistics").get< statisticsdesc >();
+    if (doc.count("stride") != 0)
+        doc.at("stride").get_to(task.stride);
+    if (doc.count("format") != 0)
+        doc.at("format").get_to(task.format);
+}
+
+void to_json(nlohmann::json& doc, const statistics_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+}
+
+void from_json(const nlohmann::json& doc, statistics_task& task)
+noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
 }
 
 void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
@@ -279,6 +514,13 @@ void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
     doc["labels"]       = head.labels;
     doc["shapes"]       = head.shapes;
     doc["attributes"]   = head.attributes;
+    if (not head.coordinates.empty())
+        doc["coordinates"] = head.coordinates;
+    if (head.format.type != sampleformat::float32) {
+        doc["format"] = to_string(head.format.type);
+        doc["scale"]  = head.format.scale;
+        doc["offset"] = head.format.offset;
+    }
 }
 
 void from_json(const nlohmann::json& doc, process_header& head) noexcept (false) {
@@ -290,6 +532,13 @@ void from_json(const nlohmann::json& doc, process_header& head) noexcept (false)
     doc.at("labels")    .get_to(head.labels);
     doc.at("shapes")    .get_to(head.shapes);
     doc.at("attributes").get_to(head.attributes);
+    if (doc.count("coordinates") != 0)
+        doc.at("coordinates").get_to(head.coordinates);
+    if (doc.count("format") != 0) {
+        head.format.type = parse_sampleformat(doc.at("format").get< std::string >());
+        doc.at("scale") .get_to(head.format.scale);
+        doc.at("offset").get_to(head.format.offset);
+    }
 }
 
 void from_json(const nlohmann::json& doc, slice_query& query) noexcept (false) {
@@ -334,6 +583,20 @@ void from_json(const nlohmann::json& doc, slice_query& query) noexcept (false) {
         constexpr auto msg = "expected kind 'index' or 'lineno', got {}";
         throw bad_message(fmt::format(msg, kind));
     }
+
+    if (args.count("weight") != 0) {
+        args.at("weight").get_to(query.weight);
+        if (!(0 <= query.weight && query.weight < 1)) {
+            constexpr auto msg = "args.weight (= {}) not in [0, 1)";
+            throw bad_message(fmt::format(msg, query.weight));
+        }
+
+        const auto next = query.idx + 1;
+        if (query.weight > 0 and next >= lines[query.dim].size()) {
+            constexpr auto msg = "args.weight (= {}) > 0 for the last line";
+            throw bad_message(fmt::format(msg, query.weight));
+        }
+    }
 }
 
 namespace {
@@ -499,16 +762,19 @@ std::pair< int, int > utm_to_cartesian(
 
 }
 
-void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false) {
-    from_json(doc, static_cast< basic_query& >(query));
-
-    if (query.function != "curtain") {
-        constexpr auto msg = "expected query 'curtain', got {}";
-        throw bad_message(fmt::format(msg, query.function));
-    }
-
-    const auto& args = doc.at("args");
+namespace {
 
+/*
+ * Parse the list of [x, y] coordinates of kind index, lineno, or utm, and
+ * map them to the cartesian grid. This is shared between the queries that
+ * take a list of traces, e.g. curtain and traces.
+ */
+void parse_xy_coordinates(
+        const nlohmann::json& args,
+        const basic_query& query,
+        std::vector< int >& dim0s,
+        std::vector< int >& dim1s)
+noexcept (false) {
     auto extract_coords = [&]<typename T>(auto mapping, T) {
         std::vector<std::vector<T>> coords;
         try {
@@ -516,16 +782,16 @@ void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false)
         } catch (nlohmann::json::type_error&) {
             throw bad_value("bad coords arg: expected list-of-pairs");
         }
-        query.dim0s.reserve(coords.size());
-        query.dim1s.reserve(coords.size());
+        dim0s.reserve(coords.size());
+        dim1s.reserve(coords.size());
 
         for (const auto& pair : coords) {
             if (pair.size() != 2) {
                 throw bad_value("bad coords arg: expected list-of-pairs");
             }
             const auto dims = mapping(pair.at(0), pair.at(1));
-            query.dim0s.push_back(dims.first);
-            query.dim1s.push_back(dims.second);
+            dim0s.push_back(dims.first);
+            dim1s.push_back(dims.second);
         }
     };
 
@@ -538,8 +804,8 @@ void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false)
         );
         auto dim = -1;
         try {
-            assure_cartesian_in_bounds(line_numbers[++dim], query.dim0s);
-            assure_cartesian_in_bounds(line_numbers[++dim], query.dim1s);
+            assure_cartesian_in_bounds(line_numbers[++dim], dim0s);
+            assure_cartesian_in_bounds(line_numbers[++dim], dim1s);
         } catch (not_found& exc) {
             constexpr auto msg = "Failure while processing dimension {}: ";
             throw not_found(fmt::format(msg, dim) + exc.what());
@@ -588,14 +854,393 @@ void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false)
         throw bad_message(fmt::format(msg, kind));
     }
 
+}
+
+}
+
+void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "curtain") {
+        constexpr auto msg = "expected query 'curtain', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& args = doc.at("args");
+    parse_xy_coordinates(args, query, query.dim0s, query.dim1s);
     group_by_fragment_inplace(query);
 }
 
+void from_json(const nlohmann::json& doc, traces_query& query) noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "traces") {
+        constexpr auto msg = "expected query 'traces', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    std::vector< int > dim0s;
+    std::vector< int > dim1s;
+    parse_xy_coordinates(doc.at("args"), query, dim0s, dim1s);
+
+    /*
+     * Scattered points, in particular UTM coordinates, often map to the same
+     * trace. Only keep the first occurence of every trace, but otherwise
+     * preserve the input order.
+     */
+    std::set< std::pair< int, int > > seen;
+    for (std::size_t i = 0; i < dim0s.size(); ++i) {
+        const auto [_, inserted] = seen.emplace(dim0s[i], dim1s[i]);
+        if (not inserted)
+            continue;
+
+        query.dim0s.push_back(dim0s[i]);
+        query.dim1s.push_back(dim1s[i]);
+    }
+}
+
+namespace {
+
+/*
+ * Map a depth/time value to the index of the nearest sample. Unlike the x/y
+ * line numbers, depth/time values are continuous, and horizons are rarely
+ * picked exactly on a sample.
+ */
+int nearest_sample(const std::vector< int >& samples, float z)
+noexcept (false) {
+    assert(std::is_sorted(samples.begin(), samples.end()));
+    if (samples.empty() or z < samples.front() or samples.back() < z) {
+        constexpr auto msg = "depth/time (= {}) is not in the cube";
+        throw not_found(fmt::format(msg, z));
+    }
+
+    auto itr = std::lower_bound(samples.begin(), samples.end(), z);
+    if (itr != samples.begin() and std::abs(z - *itr) > std::abs(z - *(itr - 1)))
+        --itr;
+
+    return std::distance(samples.begin(), itr);
+}
+
+}
+
+void from_json(const nlohmann::json& doc, horizon_query& query)
+noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "horizon") {
+        constexpr auto msg = "expected query 'horizon', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& line_numbers = query.manifest.line_numbers;
+    if (line_numbers.size() != 3) {
+        constexpr auto msg =
+            "horizon requires 3-dimensional cube, but dimension was {}";
+        throw not_found(fmt::format(msg, line_numbers.size()));
+    }
+
+    const auto& args = doc.at("args");
+    query.window = args.value("window", 0);
+    if (query.window < 0) {
+        constexpr auto msg = "window (= {}) must be non-negative";
+        throw bad_value(fmt::format(msg, query.window));
+    }
+
+    std::vector< std::vector< float > > coords;
+    try {
+        args.at("coords").get_to(coords);
+    } catch (nlohmann::json::type_error&) {
+        throw bad_value("bad coords arg: expected list-of-triples");
+    }
+
+    const std::string& kind = args.at("kind");
+    if (kind == "utm" and query.manifest.utm_to_lineno == std::nullopt) {
+        const auto msg = "Manifest does not contain geographic information,"
+                         " can not perform UTM query";
+        throw not_found(msg);
+    }
+
+    const auto index = [](const std::vector< int >& labels, float x) {
+        const int i = std::round(x);
+        if (!(0 <= i && i < labels.size())) {
+            constexpr auto msg = "coordinate (= {}) of type index is out of "
+                                 "cube boundaries [0, {})";
+            throw not_found(fmt::format(msg, i, labels.size()));
+        }
+        return i;
+    };
+
+    query.dim0s.reserve(coords.size());
+    query.dim1s.reserve(coords.size());
+    query.dim2s.reserve(coords.size());
+    for (const auto& point : coords) {
+        if (point.size() != 3)
+            throw bad_value("bad coords arg: expected list-of-triples");
+
+        const auto x = point[0];
+        const auto y = point[1];
+        const auto z = point[2];
+
+        if (kind == "index") {
+            query.dim0s.push_back(index(line_numbers[0], x));
+            query.dim1s.push_back(index(line_numbers[1], y));
+            query.dim2s.push_back(index(line_numbers[2], z));
+        }
+        else if (kind == "lineno") {
+            query.dim0s.push_back(to_cartesian(line_numbers[0], int(std::round(x))));
+            query.dim1s.push_back(to_cartesian(line_numbers[1], int(std::round(y))));
+            query.dim2s.push_back(nearest_sample(line_numbers[2], z));
+        }
+        else if (kind == "utm") {
+            const auto [i, j] = detail::utm_to_cartesian(
+                line_numbers[0],
+                line_numbers[1],
+                query.manifest.utm_to_lineno.value(),
+                x,
+                y
+            );
+            query.dim0s.push_back(i);
+            query.dim1s.push_back(j);
+            query.dim2s.push_back(nearest_sample(line_numbers[2], z));
+        }
+        else {
+            constexpr auto msg =
+                "expected kind 'index' or 'lineno' or 'utm', got {}";
+            throw bad_message(fmt::format(msg, kind));
+        }
+    }
+}
+
+void from_json(const nlohmann::json& doc, subvolume_query& query)
+noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "subvolume") {
+        constexpr auto msg = "expected query 'subvolume', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& line_numbers = query.manifest.line_numbers;
+    if (line_numbers.size() != 3) {
+        constexpr auto msg =
+            "subvolume requires 3-dimensional cube, but dimension was {}";
+        throw not_found(fmt::format(msg, line_numbers.size()));
+    }
+
+    const auto& args = doc.at("args");
+    std::vector< int > from;
+    std::vector< int > to;
+    args.at("from").get_to(from);
+    args.at("to")  .get_to(to);
+    if (from.size() != 3 or to.size() != 3)
+        throw bad_value("bad from/to arg: expected [x, y, z]");
+
+    const std::string& kind = args.at("kind");
+    for (int dim = 0; dim < 3; ++dim) {
+        const auto [fst, lst] = cartesian_range(
+            line_numbers[dim],
+            from[dim],
+            to[dim],
+            kind,
+            fmt::format("dimension {}", dim)
+        );
+        query.lower[dim] = fst;
+        query.upper[dim] = lst;
+    }
+}
+
+namespace {
+
+/*
+ * Map a (fractional) line number to the fractional index, by linear
+ * interpolation between the neighbouring lines. Unlike to_cartesian, the line
+ * does not have to exist, but it must be inside the cube.
+ */
+std::optional< double > fractional_index(
+        const std::vector< int >& labels,
+        double x)
+noexcept (true) {
+    assert(std::is_sorted(labels.begin(), labels.end()));
+    if (labels.empty() or x < labels.front() or labels.back() < x)
+        return std::nullopt;
+
+    const auto itr = std::upper_bound(labels.begin(), labels.end(), x);
+    if (itr == labels.end())
+        return labels.size() - 1;
+
+    const auto i = std::distance(labels.begin(), itr) - 1;
+    return i + (x - labels[i]) / double(labels[i + 1] - labels[i]);
+}
+
+/*
+ * The distance between neighbouring traces along the inlines and crosslines
+ * in UTM units, from the inverse of the utm-to-lineno affine transform. The
+ * default fence spacing is the smaller of the two, so that no trace is
+ * skipped.
+ */
+double grid_spacing(const manifestdoc& manifest) noexcept (false) {
+    const auto& m = manifest.utm_to_lineno.value();
+    const auto det = m[0][0] * m[1][1] - m[0][1] * m[1][0];
+    if (det == 0)
+        throw bad_document("utm-to-lineno is not invertible");
+
+    const auto step = [](const std::vector< int >& labels) noexcept {
+        return labels.size() > 1 ? std::abs(labels[1] - labels[0]) : 1;
+    };
+
+    const auto& lines = manifest.line_numbers;
+    const auto d0 = std::hypot(m[1][1], m[1][0]) * step(lines[0]);
+    const auto d1 = std::hypot(m[0][1], m[0][0]) * step(lines[1]);
+    return std::min(d0, d1) / std::abs(det);
+}
+
+/*
+ * Resample the polyline at a fixed spacing, starting at the first vertex. The
+ * last vertex is always included, so that the fence ends where the polyline
+ * does.
+ */
+std::vector< std::array< double, 2 > > resample(
+        const std::vector< std::array< double, 2 > >& polyline,
+        double spacing)
+noexcept (false) {
+    /*
+     * Guard against accidentally (or maliciously) tiny spacings, which would
+     * otherwise blow up the number of traces.
+     */
+    constexpr auto max_samples = 100000;
+
+    double length = 0;
+    for (std::size_t i = 1; i < polyline.size(); ++i) {
+        const auto& a = polyline[i - 1];
+        const auto& b = polyline[i];
+        length += std::hypot(b[0] - a[0], b[1] - a[1]);
+    }
+
+    if (length / spacing > max_samples) {
+        constexpr auto msg = "spacing (= {}) gives more than {} traces";
+        throw bad_value(fmt::format(msg, spacing, max_samples));
+    }
+
+    std::vector< std::array< double, 2 > > out = { polyline.front() };
+
+    /* the distance travelled since the last sample */
+    double carry = 0;
+    for (std::size_t i = 1; i < polyline.size(); ++i) {
+        const auto& a = polyline[i - 1];
+        const auto& b = polyline[i];
+        const auto len = std::hypot(b[0] - a[0], b[1] - a[1]);
+
+        auto t = spacing - carry;
+        for (; t <= len; t += spacing) {
+            out.push_back({
+                a[0] + (b[0] - a[0]) * (t / len),
+                a[1] + (b[1] - a[1]) * (t / len),
+            });
+        }
+        carry = len - (t - spacing);
+    }
+
+    if (carry > 1e-6 * spacing)
+        out.push_back(polyline.back());
+
+    return out;
+}
+
+}
+
+void from_json(const nlohmann::json& doc, fence_query& query)
+noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "fence") {
+        constexpr auto msg = "expected query 'fence', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    if (query.manifest.utm_to_lineno == std::nullopt) {
+        const auto msg = "Manifest does not contain geographic information,"
+                         " can not perform UTM query";
+        throw not_found(msg);
+    }
+
+    const auto& args = doc.at("args");
+    std::vector< std::array< double, 2 > > polyline;
+    try {
+        args.at("polyline").get_to(polyline);
+    } catch (nlohmann::json::exception&) {
+        throw bad_value("bad polyline arg: expected list-of-pairs");
+    }
+    if (polyline.empty())
+        throw bad_value("bad polyline arg: expected at least one point");
+
+    auto spacing = grid_spacing(query.manifest);
+    if (args.count("spacing") != 0 and not args.at("spacing").is_null())
+        args.at("spacing").get_to(spacing);
+    if (!(spacing > 0)) {
+        constexpr auto msg = "spacing (= {}) must be positive";
+        throw bad_value(fmt::format(msg, spacing));
+    }
+
+    const std::string interpolation = args.value("interpolation", "nearest");
+    if (interpolation != "nearest" and interpolation != "linear") {
+        constexpr auto msg =
+            "expected interpolation 'nearest' or 'linear', got {}";
+        throw bad_message(fmt::format(msg, interpolation));
+    }
+
+    const auto& line_numbers = query.manifest.line_numbers;
+    const auto& utm_to_lino  = query.manifest.utm_to_lineno.value();
+    for (const auto& [x, y] : resample(polyline, spacing)) {
+        const auto [iline, xline] = utm_to_lineno(utm_to_lino, x, y);
+        const auto i = fractional_index(line_numbers[0], iline);
+        const auto j = fractional_index(line_numbers[1], xline);
+        if (not i or not j) {
+            const auto msg = fmt::format("Point ({}, {}) not in cube", x, y);
+            throw not_found(msg);
+        }
+
+        query.coordinates.push_back(x);
+        query.coordinates.push_back(y);
+
+        auto& points = query.traces.emplace_back();
+        if (interpolation == "nearest") {
+            const int i0 = std::round(*i);
+            const int j0 = std::round(*j);
+            points.push_back({ { i0, j0 }, 1.0f });
+            continue;
+        }
+
+        /*
+         * Bilinear interpolation between the four surrounding traces. Traces
+         * with zero weight (when the point is on a line) are dropped, so that
+         * no fragments are fetched needlessly.
+         */
+        const int i0 = std::floor(*i);
+        const int j0 = std::floor(*j);
+        const auto wi = float(*i - i0);
+        const auto wj = float(*j - j0);
+        const auto corners = {
+            fence_point { { i0,     j0     }, (1 - wi) * (1 - wj) },
+            fence_point { { i0 + 1, j0     },      wi  * (1 - wj) },
+            fence_point { { i0,     j0 + 1 }, (1 - wi) *      wj  },
+            fence_point { { i0 + 1, j0 + 1 },      wi  *      wj  },
+        };
+        for (const auto& corner : corners) {
+            if (corner.weight > 0)
+                points.push_back(corner);
+        }
+    }
+}
+
 void to_json(nlohmann::json& doc, const slice_task& task) noexcept (false) {
     to_json(doc, static_cast< const basic_task& >(task));
     doc["dim"] = task.dim;
     doc["idx"] = task.idx;
     doc["ids"] = task.ids;
+    if (task.weight != 0)
+        doc["weight"] = task.weight;
+    if (task.zrange)
+        doc["zrange"] = *task.zrange;
 }
 
 void from_json(const nlohmann::json& doc, slice_task& task) noexcept (false) {
@@ -603,6 +1248,10 @@ void from_json(const nlohmann::json& doc, slice_task& task) noexcept (false) {
     doc.at("dim").get_to(task.dim);
     doc.at("idx").get_to(task.idx);
     doc.at("ids").get_to(task.ids);
+    if (doc.count("weight") != 0)
+        doc.at("weight").get_to(task.weight);
+    if (doc.count("zrange") != 0)
+        task.zrange = doc.at("zrange").get< std::pair< int, int > >();
 
     if (task.ids.empty()) {
         /*
@@ -669,11 +1318,103 @@ void from_json(const nlohmann::json& doc, single& single) noexcept (false) {
 void to_json(nlohmann::json& doc, const curtain_task& curtain) noexcept (false) {
     to_json(doc, static_cast< const basic_task& >(curtain));
     doc["ids"] = curtain.ids;
+    if (curtain.zrange)
+        doc["zrange"] = *curtain.zrange;
 }
 
 void from_json(const nlohmann::json& doc, curtain_task& curtain) noexcept (false) {
     from_json(doc, static_cast< basic_task& >(curtain));
     doc.at("ids").get_to(curtain.ids);
+    if (doc.count("zrange") != 0)
+        curtain.zrange = doc.at("zrange").get< std::pair< int, int > >();
+}
+
+void to_json(nlohmann::json& doc, const horizon_segments& segs)
+noexcept (false) {
+    doc["id"]       = segs.id;
+    doc["segments"] = segs.segments;
+}
+
+void from_json(const nlohmann::json& doc, horizon_segments& segs)
+noexcept (false) {
+    doc.at("id")      .get_to(segs.id);
+    doc.at("segments").get_to(segs.segments);
+}
+
+void to_json(nlohmann::json& doc, const horizon_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["zlength"] = task.zlength;
+    doc["ids"]     = task.ids;
+}
+
+void from_json(const nlohmann::json& doc, horizon_task& task) noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("zlength").get_to(task.zlength);
+    doc.at("ids")    .get_to(task.ids);
+}
+
+void to_json(nlohmann::json& doc, const subvolume_task& task)
+noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["lower"] = task.lower;
+    doc["upper"] = task.upper;
+    doc["ids"]   = task.ids;
+}
+
+void from_json(const nlohmann::json& doc, subvolume_task& task)
+noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("lower").get_to(task.lower);
+    doc.at("upper").get_to(task.upper);
+    doc.at("ids")  .get_to(task.ids);
+}
+
+void to_json(nlohmann::json& doc, const fence_point& point) noexcept (false) {
+    doc["position"] = point.position;
+    doc["weight"]   = point.weight;
+}
+
+void from_json(const nlohmann::json& doc, fence_point& point)
+noexcept (false) {
+    doc.at("position").get_to(point.position);
+    doc.at("weight")  .get_to(point.weight);
+}
+
+void to_json(nlohmann::json& doc, const fence_trace& trace) noexcept (false) {
+    doc["n"]      = trace.n;
+    doc["points"] = trace.points;
+}
+
+void from_json(const nlohmann::json& doc, fence_trace& trace)
+noexcept (false) {
+    doc.at("n")     .get_to(trace.n);
+    doc.at("points").get_to(trace.points);
+}
+
+void to_json(nlohmann::json& doc, const fence_segments& segs)
+noexcept (false) {
+    doc["id"]     = segs.id;
+    doc["traces"] = segs.traces;
+}
+
+void from_json(const nlohmann::json& doc, fence_segments& segs)
+noexcept (false) {
+    doc.at("id")    .get_to(segs.id);
+    doc.at("traces").get_to(segs.traces);
+}
+
+void to_json(nlohmann::json& doc, const fence_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["ids"] = task.ids;
+    if (task.zrange)
+        doc["zrange"] = *task.zrange;
+}
+
+void from_json(const nlohmann::json& doc, fence_task& task) noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("ids").get_to(task.ids);
+    if (doc.count("zrange") != 0)
+        task.zrange = doc.at("zrange").get< std::pair< int, int > >();
 }
 
 /*
@@ -687,6 +1428,14 @@ template struct Packable< slice_query >;
 template struct Packable< slice_task >;
 template struct Packable< curtain_query >;
 template struct Packable< curtain_task >;
+template struct Packable< horizon_query >;
+template struct Packable< horizon_task >;
+template struct Packable< subvolume_query >;
+template struct Packable< subvolume_task >;
+template struct Packable< traces_query >;
+template struct Packable< fence_query >;
+template struct Packable< fence_task >;
+template struct Packable< statistics_task >;
 
 template struct MsgPackable< process_header >;
 
@@ -1,6 +1,7 @@
 #include <algorithm>
 #include <cassert>
 #include <iterator>
+#include <map>
 #include <sstream>
 #include <string>
 #include <vector>
@@ -83,6 +84,26 @@ std::array< int, 2 > coordinate(const FP< 3 > localid) noexcept (false) {
     };
 }
 
+/*
+ * The length of a dimension of length n, decimated with stride.
+ */
+int strided(int n, int stride) noexcept (true) {
+    return (n + stride - 1) / stride;
+}
+
+/*
+ * Append every stride-th element in [fst, lst) to out, starting at fst. This
+ * is the index (labels) of a decimated dimension.
+ */
+template < typename Itr >
+void append_strided(std::vector< int >& out, Itr fst, Itr lst, int stride)
+noexcept (false) {
+    for (auto n = std::distance(fst, lst); n > 0; n -= stride) {
+        out.push_back(*fst);
+        std::advance(fst, std::min< decltype(n) >(n, stride));
+    }
+}
+
 int task_count(int jobs, int task_size) {
     /*
      * Return the number of task-size'd tasks needed to process all jobs
@@ -169,6 +190,31 @@ std::vector< slice_task > build(const slice_query& query) {
         const auto idx = query.idx % gvt.cube_shape()[dim];
         task.idx = gvt.fragment_shape().index(dim, idx);
         task.ids = convert(gvt.slice(dim, idx));
+
+        /*
+         * Only blend when the next line actually exists, which it does not
+         * for the flat (z) dimension of attributes.
+         */
+        if (idx + 1 < gvt.cube_shape()[dim])
+            task.weight = query.weight;
+
+        /*
+         * Vertical slices restricted to a z-window only need the fragments
+         * that intersect the window. Attributes have no z-axis, and are
+         * always read in full.
+         */
+        if (query.zrange and query.dim != 2 and task.attribute == "data") {
+            const auto zheight = int(gvt.fragment_shape()[gvt.mkdim(2)]);
+            const auto [zfst, zlst] = *query.zrange;
+            const auto outside = [=](const auto& id) noexcept {
+                return id[2] < zfst / zheight or zlst / zheight < id[2];
+            };
+            task.ids.erase(
+                std::remove_if(task.ids.begin(), task.ids.end(), outside),
+                task.ids.end()
+            );
+            task.zrange = query.zrange;
+        }
     };
 
     return tasks;
@@ -197,22 +243,39 @@ noexcept (false) {
      * was queried (useful when source is index or coordinate) and the
      * direction of the output.
      */
+    const auto [zfst, zlst] = query.zwindow();
+    const auto& stride = query.stride;
     for (std::size_t i = 0; i < mdims.size(); ++i) {
-        if (i != query.dim) {
-            head.index.push_back(mdims[i].size());
-        } else {
+        if (i == query.dim) {
             head.index.push_back(1);
+        } else if (i == mdims.size() - 1) {
+            head.index.push_back(strided(zlst - zfst + 1, stride[i]));
+        } else {
+            head.index.push_back(strided(mdims[i].size(), stride[i]));
         }
     }
     for (std::size_t i = 0; i < mdims.size(); ++i) {
-        if (i != query.dim) {
-            head.index.insert(
-                head.index.end(),
-                mdims[i].begin(),
-                mdims[i].end()
+        if (i == query.dim) {
+            /*
+             * The index is integral, so a blended slice is labelled with the
+             * line it is nearest to.
+             */
+            const auto nearest = query.weight < 0.5 ? 0 : 1;
+            head.index.push_back(mdims[i][query.idx + nearest]);
+        } else if (i == mdims.size() - 1) {
+            append_strided(
+                head.index,
+                mdims[i].begin() + zfst,
+                mdims[i].begin() + zlst + 1,
+                stride[i]
             );
         } else {
-            head.index.push_back(mdims[i][query.idx]);
+            append_strided(
+                head.index,
+                mdims[i].begin(),
+                mdims[i].end(),
+                stride[i]
+            );
         }
     }
 
@@ -318,7 +381,21 @@ std::vector< curtain_task > build(const curtain_query& query) {
     for (auto& task : tasks) {
         ids.clear();
         const auto gvt = geometry(task);
-        const auto zheight = gvt.fragment_count(gvt.mkdim(2));
+
+        /*
+         * Only the fragments that intersect the z-window are read. For
+         * attributes, the z-window is always just the one sample.
+         */
+        auto zfragments = std::make_pair(0, 0);
+        if (task.attribute == "data") {
+            const auto zdim    = gvt.mkdim(2);
+            const auto zshape  = int(gvt.fragment_shape()[zdim]);
+            const auto zwindow = query.zwindow();
+            zfragments.first  = zwindow.first  / zshape;
+            zfragments.second = zwindow.second / zshape;
+            task.zrange = query.zrange;
+        }
+        const auto zheight = zfragments.second - zfragments.first + 1;
 
         /*
          * Guess the number of coordinates per fragment. A reasonable
@@ -349,7 +426,7 @@ std::vector< curtain_task > build(const curtain_query& query) {
                 block.offset = i;
                 itr = ids.insert(itr, zheight, block);
                 for (int z = 0; z < zheight; ++z)
-                    (itr + z)->id[2] = z;
+                    (itr + z)->id[2] = zfragments.first + z;
             }
 
             const auto lid = coordinate(gvt.to_local(top));
@@ -382,15 +459,22 @@ noexcept (false) {
     );
 
     auto& index = head.index;
+    const auto [zfst, zlst] = query.zwindow();
+    const auto zstride = query.stride.back();
 
     index.push_back(query.dim0s .size());
     index.push_back(query.dim1s .size());
-    index.push_back(mdims.back().size());
+    index.push_back(strided(zlst - zfst + 1, zstride));
 
     const auto& line_numbers = query.manifest.line_numbers;
     for (auto x : query.dim0s) index.push_back(line_numbers[0][x]);
     for (auto x : query.dim1s) index.push_back(line_numbers[1][x]);
-    index.insert(index.end(), mdims.back().begin(), mdims.back().end());
+    append_strided(
+        index,
+        mdims.back().begin() + zfst,
+        mdims.back().begin() + zlst + 1,
+        zstride
+    );
 
     /*
      * The curtain is already pretty constrained in its output shapes, since it
@@ -408,7 +492,414 @@ noexcept (false) {
     return head;
 }
 
+/*
+ * Build the tasks for queries that read a z-window [zfst, zfst + zlength) of
+ * a list of traces, i.e. the horizon and traces. The zfst function maps the
+ * i-th trace to the first sample of its window.
+ */
+template < typename Query, typename Zfst >
+std::vector< horizon_task > build_segments(
+        const Query& query,
+        int zlength,
+        Zfst zfst_of)
+noexcept (false) {
+    std::vector< horizon_task > tasks;
+
+    tasks.emplace_back(query);
+    tasks.back().zlength = zlength;
+    for (const auto& attr : query.attributes) {
+        auto [itr, found] = find_attribute(query, attr);
+        if (not found)
+            continue;
+
+        /*
+         * Attributes are 1-sample-high, so the window is always just the one
+         * sample.
+         */
+        tasks.emplace_back(query, *itr);
+        tasks.back().zlength = 1;
+    }
+
+    for (auto& task : tasks) {
+        const auto gvt = geometry(task);
+        const auto zdim = gvt.mkdim(2);
+        const auto zmax = int(gvt.cube_shape()[zdim]);
+        const auto zheight = int(gvt.fragment_shape()[zdim]);
+        const auto attribute = task.attribute != "data";
+
+        /*
+         * Sorting the fragments with an ordered map means every fragment is
+         * only fetched once, and the tasks are handed out in a predictable
+         * order. The segments themselves carry the output row, so input order
+         * is preserved regardless of how the traces are grouped.
+         */
+        std::map< std::array< int, 3 >, horizon_segments > ids;
+        for (int i = 0; i < int(query.dim0s.size()); ++i) {
+            const auto zfst = attribute ? 0 : zfst_of(i);
+            const auto zlst = std::min(zfst + task.zlength, zmax);
+
+            const auto top = top_cubepoint(query.dim0s, query.dim1s, i);
+            const auto lid = coordinate(gvt.to_local(top));
+            auto fid = gvt.frag_id(top);
+
+            for (auto k = std::max(zfst, 0) / zheight; k * zheight < zlst; ++k) {
+                fid[2] = k;
+                std::array< int, 3 > key;
+                std::copy_n(fid.begin(), key.size(), key.begin());
+                auto& block = ids[key];
+                block.id = key;
+                block.segments.push_back({ i, lid[0], lid[1], zfst });
+            }
+        }
+
+        task.ids.reserve(ids.size());
+        for (auto& kv : ids)
+            task.ids.push_back(std::move(kv.second));
+    }
+
+    return tasks;
+}
+
+std::vector< horizon_task > build(const horizon_query& query) {
+    const auto zfst = [&query](int i) noexcept {
+        return query.dim2s[i] - query.window;
+    };
+    return build_segments(query, 2 * query.window + 1, zfst);
+}
 
+process_header header(const horizon_query& query, int ntasks)
+noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+
+    process_header head;
+    head.pid        = query.pid;
+    head.function   = functionid::horizon;
+    head.nbundles   = ntasks;
+    head.ndims      = mdims.size();
+    head.labels     = query.manifest.line_labels;
+    head.attributes.push_back("data");
+    head.attributes.insert(
+        head.attributes.end(),
+        query.attributes.begin(),
+        query.attributes.end()
+    );
+
+    const auto zlength = 2 * query.window + 1;
+    const auto zstride = query.stride.back();
+
+    auto& index = head.index;
+    index.push_back(query.dim0s.size());
+    index.push_back(query.dim1s.size());
+    index.push_back(strided(zlength, zstride));
+
+    const auto& line_numbers = query.manifest.line_numbers;
+    for (auto x : query.dim0s) index.push_back(line_numbers[0][x]);
+    for (auto x : query.dim1s) index.push_back(line_numbers[1][x]);
+
+    /*
+     * The depth/time of the horizon varies from trace to trace, so the z-axis
+     * of the index is the offset from the horizon, in the units of the
+     * depth/time axis, i.e. [-window*dz, window*dz].
+     */
+    const auto& zs = mdims.back();
+    const auto dz = zs.size() > 1 ? zs[1] - zs[0] : 1;
+    for (int k = -query.window; k <= query.window; k += zstride)
+        index.push_back(k * dz);
+
+    auto& shapes = head.shapes;
+    shapes.push_back(2);
+    shapes.insert(shapes.end(), index.begin() + 1, index.begin() + 3);
+
+    for (const auto& attr : query.attributes) {
+        shapes.push_back(1);
+        shapes.push_back(head.index.front());
+    }
+
+    return head;
+}
+
+std::vector< subvolume_task > build(const subvolume_query& query) {
+    std::vector< subvolume_task > tasks;
+    tasks.reserve(query.attributes.size() + 1);
+
+    tasks.emplace_back(query);
+    for (const auto& attr : query.attributes) {
+        auto [itr, found] = find_attribute(query, attr);
+        if (not found)
+            continue;
+
+        tasks.emplace_back(query, *itr);
+    }
+
+    /*
+     * The fragments that make up the box are all the fragments between the
+     * fragment of the lower corner and the fragment of the upper corner. Every
+     * fragment is only fetched once, regardless of how much of it is in the
+     * box.
+     */
+    for (auto& task : tasks) {
+        const auto gvt = geometry(task);
+        const auto lower = gvt.frag_id(CP< 3 > {
+            std::size_t(task.lower[0]),
+            std::size_t(task.lower[1]),
+            std::size_t(task.lower[2]),
+        });
+        const auto upper = gvt.frag_id(CP< 3 > {
+            std::size_t(task.upper[0]),
+            std::size_t(task.upper[1]),
+            std::size_t(task.upper[2]),
+        });
+
+        for (int i = lower[0]; i <= int(upper[0]); ++i)
+        for (int j = lower[1]; j <= int(upper[1]); ++j)
+        for (int k = lower[2]; k <= int(upper[2]); ++k)
+            task.ids.push_back({ i, j, k });
+    }
+
+    return tasks;
+}
+
+process_header header(const subvolume_query& query, int ntasks)
+noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+
+    process_header head;
+    head.pid        = query.pid;
+    head.function   = functionid::subvolume;
+    head.nbundles   = ntasks;
+    head.ndims      = mdims.size();
+    head.labels     = query.manifest.line_labels;
+    head.attributes.push_back("data");
+    head.attributes.insert(
+        head.attributes.end(),
+        query.attributes.begin(),
+        query.attributes.end()
+    );
+
+    const auto& stride = query.stride;
+    for (std::size_t i = 0; i < mdims.size(); ++i) {
+        const auto n = query.upper[i] - query.lower[i] + 1;
+        head.index.push_back(strided(n, stride[i]));
+    }
+
+    for (std::size_t i = 0; i < mdims.size(); ++i) {
+        append_strided(
+            head.index,
+            mdims[i].begin() + query.lower[i],
+            mdims[i].begin() + query.upper[i] + 1,
+            stride[i]
+        );
+    }
+
+    /*
+     * The attributes are one-per-trace, so their shape is the x/y shape of the
+     * box, with a 1-length z dimension.
+     */
+    auto& shapes = head.shapes;
+    shapes.push_back(head.ndims);
+    shapes.insert(
+        shapes.end(),
+        head.index.begin(),
+        head.index.begin() + head.ndims
+    );
+
+    for (const auto& attr : query.attributes) {
+        shapes.push_back(head.ndims);
+        shapes.insert(
+            shapes.end(),
+            head.index.begin(),
+            head.index.begin() + head.ndims
+        );
+        shapes.back() = 1;
+    }
+
+    return head;
+}
+
+
+std::vector< horizon_task > build(const traces_query& query) {
+    const auto [fst, lst] = query.zwindow();
+    const auto zfst = [fst = fst](int) noexcept { return fst; };
+    return build_segments(query, lst - fst + 1, zfst);
+}
+
+process_header header(const traces_query& query, int ntasks)
+noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+
+    process_header head;
+    head.pid        = query.pid;
+    head.function   = functionid::traces;
+    head.nbundles   = ntasks;
+    head.ndims      = mdims.size();
+    head.labels     = query.manifest.line_labels;
+    head.attributes.push_back("data");
+    head.attributes.insert(
+        head.attributes.end(),
+        query.attributes.begin(),
+        query.attributes.end()
+    );
+
+    auto& index = head.index;
+    const auto [zfst, zlst] = query.zwindow();
+    const auto zstride = query.stride.back();
+    index.push_back(query.dim0s .size());
+    index.push_back(query.dim1s .size());
+    index.push_back(strided(zlst - zfst + 1, zstride));
+
+    for (auto x : query.dim0s) index.push_back(mdims[0][x]);
+    for (auto x : query.dim1s) index.push_back(mdims[1][x]);
+    append_strided(
+        index,
+        mdims.back().begin() + zfst,
+        mdims.back().begin() + zlst + 1,
+        zstride
+    );
+
+    auto& shapes = head.shapes;
+    shapes.push_back(2);
+    shapes.insert(shapes.end(), index.begin() + 1, index.begin() + 3);
+
+    for (const auto& attr : query.attributes) {
+        shapes.push_back(1);
+        shapes.push_back(head.index.front());
+    }
+
+    return head;
+}
+
+
+std::vector< fence_task > build(const fence_query& query) {
+    std::vector< fence_task > tasks;
+
+    tasks.emplace_back(query);
+    for (const auto& attr : query.attributes) {
+        auto [itr, found] = find_attribute(query, attr);
+        if (not found)
+            continue;
+
+        tasks.emplace_back(query, *itr);
+    }
+
+    for (auto& task : tasks) {
+        const auto gvt = geometry(task);
+        const auto& fs = gvt.fragment_shape();
+        const auto zheight = int(fs[gvt.mkdim(2)]);
+
+        /* attributes are 1-sample high, so the window is the one sample */
+        auto zwindow = std::make_pair(0, 0);
+        if (task.attribute == "data") {
+            zwindow = query.zwindow();
+            task.zrange = query.zrange;
+        }
+
+        /*
+         * Group the traces by the fragment of their first point, so that
+         * traces that are close together end up in the same task and share
+         * fragments. Every trace is always processed in full by a single task,
+         * since it is a sum over all its points.
+         */
+        std::map< std::array< int, 3 >, fence_segments > ids;
+        for (int n = 0; n < int(query.traces.size()); ++n) {
+            const auto& points = query.traces[n];
+            const auto& first  = points.front().position;
+            const auto kfst = zwindow.first  / zheight;
+            const auto klst = zwindow.second / zheight;
+            for (int k = kfst; k <= klst; ++k) {
+                const auto key = std::array< int, 3 > {
+                    int(first[0] / fs[0]),
+                    int(first[1] / fs[1]),
+                    k,
+                };
+                auto& block = ids[key];
+                block.id = key;
+                block.traces.push_back({ n, points });
+            }
+        }
+
+        task.ids.reserve(ids.size());
+        for (auto& kv : ids)
+            task.ids.push_back(std::move(kv.second));
+    }
+
+    return tasks;
+}
+
+process_header header(const fence_query& query, int ntasks)
+noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+
+    process_header head;
+    head.pid         = query.pid;
+    head.function    = functionid::fence;
+    head.nbundles    = ntasks;
+    head.ndims       = mdims.size();
+    head.labels      = query.manifest.line_labels;
+    head.coordinates = query.coordinates;
+    head.attributes.push_back("data");
+    head.attributes.insert(
+        head.attributes.end(),
+        query.attributes.begin(),
+        query.attributes.end()
+    );
+
+    const auto ntraces = int(query.traces.size());
+    const auto [zfst, zlst] = query.zwindow();
+    const auto zstride = query.stride.back();
+
+    auto& index = head.index;
+    index.push_back(ntraces);
+    index.push_back(ntraces);
+    index.push_back(strided(zlst - zfst + 1, zstride));
+
+    /*
+     * The index is integral, so the traces are labelled with the nearest
+     * inline and crossline. The actual UTM positions are in the coordinates.
+     */
+    const auto nearest = [](const auto& points) noexcept {
+        const auto heavier = [](const auto& lhs, const auto& rhs) noexcept {
+            return lhs.weight < rhs.weight;
+        };
+        return std::max_element(points.begin(), points.end(), heavier)->position;
+    };
+    for (const auto& points : query.traces)
+        index.push_back(mdims[0][nearest(points)[0]]);
+    for (const auto& points : query.traces)
+        index.push_back(mdims[1][nearest(points)[1]]);
+    append_strided(
+        index,
+        mdims.back().begin() + zfst,
+        mdims.back().begin() + zlst + 1,
+        zstride
+    );
+
+    auto& shapes = head.shapes;
+    shapes.push_back(2);
+    shapes.insert(shapes.end(), index.begin() + 1, index.begin() + 3);
+
+    for (const auto& attr : query.attributes) {
+        shapes.push_back(1);
+        shapes.push_back(head.index.front());
+    }
+
+    return head;
+}
+
+/*
+ * The statistics header is the header of the inner function, so that the
+ * index still describes the region the statistics were computed over, but
+ * the output is a single array:
+ *
+ *   [count, min, max, mean, rms, lo, hi, histogram...]
+ *
+ * where [lo, hi] is the range of the histogram.
+ */
+void statistics_header(process_header& head, const statisticsdesc& desc)
+noexcept (false) {
+    head.function   = functionid::statistics;
+    head.attributes = { "data" };
+    head.shapes     = { 1, 7 + desc.bins };
+}
 
 template< typename Outputs >
 int count_tasks(const Outputs& outputs, int task_size) noexcept (true) {
@@ -543,10 +1034,29 @@ taskset schedule(Input& in, const char* doc, int len, int task_size)
 noexcept (false) {
     in.unpack(doc, doc + len);
     in.attributes = normalized_attributes(in);
+    /*
+     * statistics are computed over the samples only, and the summary is
+     * always sent as float32
+     */
+    if (in.statistics) {
+        in.attributes.clear();
+        in.format = formatdesc {};
+    }
+
     auto fetch = build(in);
+    if (in.statistics) {
+        for (auto& task : fetch) {
+            task.function   = "statistics";
+            task.statistics = in.statistics;
+        }
+    }
+
     auto sched = partition(fetch, task_size);
     const auto ntasks = int(sched.count());
-    const auto head   = header(in, ntasks);
+    auto head = header(in, ntasks);
+    head.format = in.format;
+    if (in.statistics)
+        statistics_header(head, *in.statistics);
     sched.append(pack_with_envelope(head));
     return sched;
 }
@@ -609,6 +1119,22 @@ noexcept (false) {
         curtain_query q;
         return schedule(q, doc, len, task_size);
     }
+    if (function == "horizon") {
+        horizon_query q;
+        return schedule(q, doc, len, task_size);
+    }
+    if (function == "subvolume") {
+        subvolume_query q;
+        return schedule(q, doc, len, task_size);
+    }
+    if (function == "traces") {
+        traces_query q;
+        return schedule(q, doc, len, task_size);
+    }
+    if (function == "fence") {
+        fence_query q;
+        return schedule(q, doc, len, task_size);
+    }
     throw std::logic_error("No handler for function " + function);
 }
 
@@ -1,4 +1,7 @@
+#include <algorithm>
 #include <ciso646>
+#include <cmath>
+#include <map>
 #include <numeric>
 #include <string>
 #include <vector>
@@ -56,6 +59,18 @@ private:
     int idx;
     one::slice_layout layout;
     one::gvt< 2 > gvt;
+    one::gvt< 3 > cube;
+    /*
+     * True if the next line, when blending, is in the next fragment. These
+     * fragments are fetched after the ones in input.ids, so that the key
+     * (modulo the number of ids) is always the tile.
+     */
+    bool next_fragment;
+
+    void extract(int, const char* chunk, int idx, float weight)
+        noexcept (false);
+    void extract_zrange(int, const char* chunk, int idx, float weight)
+        noexcept (false);
 };
 
 class curtain : public proc {
@@ -69,6 +84,86 @@ private:
     one::curtain_bundle output;
     one::gvt< 3 >       gvt;
     std::vector< int >  traceindex;
+    /* the [fst, lst) samples to extract from every trace */
+    std::pair< int, int > zwindow;
+
+    std::pair< int, int > zextent(const one::single&) const noexcept (true);
+};
+
+class subvolume : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::subvolume_task input;
+    one::slice_tiles    output;
+    one::gvt< 3 >       gvt;
+    /*
+     * Every fragment is made up of many tiles (one per x-line), so the tiles
+     * are collected per add()-key, and merged on pack(). This keeps add()
+     * order-insensitive.
+     */
+    std::vector< std::vector< one::tile > > tiles;
+};
+
+class horizon : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::horizon_task   input;
+    one::curtain_bundle output;
+    one::gvt< 3 >       gvt;
+    std::vector< int >  traceindex;
+};
+
+class fence : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::fence_task     input;
+    one::curtain_bundle output;
+    one::gvt< 3 >       gvt;
+
+    /*
+     * A part is what a fragment contributes to a trace segment in the output,
+     * i.e. weight * the length samples from src (in the fragment), added to
+     * the output values at dst. The parts are collected per add()-key.
+     */
+    struct part {
+        int   dst;
+        int   src;
+        int   length;
+        float weight;
+    };
+    std::vector< std::vector< part > > parts;
+};
+
+/*
+ * The statistics proc wraps the proc of the inner function, which extracts
+ * the region as usual. On pack(), the extracted samples are reduced to a
+ * statistics_bundle, so that only the summary is sent back.
+ */
+class statistics : public proc {
+public:
+    void init(const char* msg, int len) override;
+    const std::string& fragments() const override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::statistics_task     input;
+    one::statistics_bundle   output;
+    std::unique_ptr< proc >  inner;
+
+    void tally(const float* fst, const float* lst) noexcept (true);
 };
 
 }
@@ -78,6 +173,14 @@ std::unique_ptr< proc > proc::make(const std::string& kind) noexcept (false) {
         return std::make_unique< slice >();
     if (kind == "curtain")
         return std::make_unique< curtain >();
+    if (kind == "horizon" or kind == "traces")
+        return std::make_unique< horizon >();
+    if (kind == "subvolume")
+        return std::make_unique< subvolume >();
+    if (kind == "fence")
+        return std::make_unique< fence >();
+    if (kind == "statistics")
+        return std::make_unique< statistics >();
     else
         return nullptr;
 }
@@ -118,11 +221,146 @@ const std::string& proc::fragments() const {
 
 namespace {
 
+/*
+ * Write the n floats in src to dst. When blending two lines, the weighted
+ * values are accumulated instead, so that the order the fragments are added
+ * in does not matter.
+ */
+void put(float* dst, const char* src, int n, float weight, bool blend)
+noexcept (true) {
+    if (not blend) {
+        std::memcpy(dst, src, n * sizeof(float));
+        return;
+    }
+
+    for (int i = 0; i < n; ++i) {
+        float x;
+        std::memcpy(&x, src + i * sizeof(float), sizeof(float));
+        dst[i] += weight * x;
+    }
+}
+
+int ceildiv(int x, int d) noexcept (true) {
+    return (x + d - 1) / d;
+}
+
+/*
+ * Decimate the tiles of an output of shape (C order), so that only the
+ * samples where every index is a multiple of the stride are kept, and pack
+ * them. The kept samples are moved to their position in the decimated output,
+ * which has the shape ceil(shape / stride).
+ *
+ * The rows (chunks) of a tile must only differ in the second-to-last index,
+ * which holds for both slices and subvolumes.
+ */
+std::string pack_decimated(
+        const one::slice_tiles& tiles,
+        const std::vector< int >& shape,
+        const std::vector< int >& stride)
+noexcept (false) {
+    const auto unit = [](int s) noexcept { return s == 1; };
+    if (std::all_of(stride.begin(), stride.end(), unit))
+        return tiles.pack();
+
+    const auto ndims = int(shape.size());
+    const auto row   = ndims - 2;
+    const auto col   = ndims - 1;
+
+    std::vector< int > decimated(ndims);
+    for (int i = 0; i < ndims; ++i)
+        decimated[i] = ceildiv(shape[i], stride[i]);
+
+    one::slice_tiles out;
+    out.attr   = tiles.attr;
+    out.format = tiles.format;
+    for (const auto& t : tiles.tiles) {
+        /* the output index of the first sample of the tile */
+        std::vector< int > index(ndims);
+        auto offset = t.initial_skip;
+        for (int i = ndims - 1; i >= 0; --i) {
+            index[i] = offset % shape[i];
+            offset  /= shape[i];
+        }
+
+        bool kept = true;
+        for (int i = 0; i < row; ++i)
+            kept = kept and index[i] % stride[i] == 0;
+
+        const auto r0 = ceildiv(index[row], stride[row]);
+        const auto r1 = ceildiv(index[row] + t.iterations, stride[row]);
+        const auto c0 = ceildiv(index[col], stride[col]);
+        const auto c1 = ceildiv(index[col] + t.chunk_size, stride[col]);
+        if (not kept or r0 == r1 or c0 == c1)
+            continue;
+
+        one::tile d;
+        d.iterations   = r1 - r0;
+        d.chunk_size   = c1 - c0;
+        d.superstride  = decimated[col];
+        d.substride    = d.chunk_size;
+        d.initial_skip = 0;
+        for (int i = 0; i < ndims; ++i) {
+            const auto x = i == row ? r0
+                         : i == col ? c0
+                         : index[i] / stride[i]
+                         ;
+            d.initial_skip = d.initial_skip * decimated[i] + x;
+        }
+
+        d.v.reserve(d.iterations * d.chunk_size);
+        for (int r = r0; r < r1; ++r) {
+            const auto i = r * stride[row] - index[row];
+            const auto* src = t.v.data() + i * t.substride;
+            for (int c = c0; c < c1; ++c)
+                d.v.push_back(src[c * stride[col] - index[col]]);
+        }
+        out.tiles.push_back(std::move(d));
+    }
+
+    return out.pack();
+}
+
+/*
+ * Decimate the z-axis of a curtain bundle, so that only the samples where the
+ * output z index is a multiple of the stride are kept, and pack it. The
+ * traces are never decimated, since they are given explicitly by the user.
+ */
+std::string pack_decimated(const one::curtain_bundle& bundle, int stride)
+noexcept (false) {
+    if (stride == 1)
+        return bundle.pack();
+
+    one::curtain_bundle out = bundle;
+    out.zlength = ceildiv(bundle.zlength, stride);
+    out.values.clear();
+
+    const auto* src = bundle.values.data();
+    for (int n = 0; n < bundle.size; ++n) {
+        const auto rows = bundle.major[n*2 + 1] - bundle.major[n*2 + 0];
+        const auto zfst = bundle.minor[n*2 + 0];
+        const auto zlst = bundle.minor[n*2 + 1];
+        const auto z0 = ceildiv(zfst, stride);
+        const auto z1 = ceildiv(zlst, stride);
+
+        for (int i = 0; i < rows; ++i) {
+            for (int z = z0; z < z1; ++z)
+                out.values.push_back(src[z * stride - zfst]);
+            src += zlst - zfst;
+        }
+        out.minor[n*2 + 0] = z0;
+        out.minor[n*2 + 1] = z1;
+    }
+
+    return out.pack();
+}
+
 void slice::init(const char* msg, int len) {
     this->clear();
     this->input.unpack(msg, msg + len);
+    this->output.tiles.clear();
     this->output.tiles.resize(this->input.ids.size());
-    this->output.attr = this->input.attribute;
+    this->output.attr   = this->input.attribute;
+    this->output.format = this->input.format;
 
     const auto g3 = gvt3(this->input);
     const auto& fragment_shape = g3.fragment_shape();
@@ -132,14 +370,48 @@ void slice::init(const char* msg, int len) {
     this->idx = this->input.idx;
     this->layout = fragment_shape.slice_stride(this->dim);
     this->gvt = g3.squeeze(this->dim);
+    this->cube = g3;
+    this->next_fragment = this->input.weight != 0
+        and this->idx + 1 == int(fragment_shape[this->dim]);
 
     for (const auto& id : this->input.ids) {
         const auto name = fmt::format("{}", fmt::join(id, "-"));
         this->add_fragment(name, this->input.ext);
     }
+
+    if (not this->next_fragment)
+        return;
+
+    for (auto id : this->input.ids) {
+        id[this->input.dim] += 1;
+        const auto name = fmt::format("{}", fmt::join(id, "-"));
+        this->add_fragment(name, this->input.ext);
+    }
 }
 
 void slice::add(int key, const char* chunk, int len) {
+    const auto weight = this->input.weight;
+    const auto ntiles = int(this->input.ids.size());
+    const auto tile = key % ntiles;
+
+    if (weight == 0)
+        return this->extract(tile, chunk, this->idx, 1);
+
+    if (key >= ntiles)
+        return this->extract(tile, chunk, 0, weight);
+
+    this->extract(tile, chunk, this->idx, 1 - weight);
+    if (not this->next_fragment)
+        this->extract(tile, chunk, this->idx + 1, weight);
+}
+
+/*
+ * Extract the line idx (fragment-local) from the chunk, into the tile.
+ */
+void slice::extract(int key, const char* chunk, int idx, float weight) {
+    if (this->input.zrange)
+        return this->extract_zrange(key, chunk, idx, weight);
+
     auto& t = this->output.tiles[key];
     const auto squeezed_id = id3(this->input.ids[key]).squeeze(this->dim);
     const auto tile_layout = this->gvt.injection_stride(squeezed_id);
@@ -149,18 +421,78 @@ void slice::add(int key, const char* chunk, int len) {
     t.superstride  = tile_layout.superstride;
     t.substride    = tile_layout.substride;
 
+    const auto blend = this->input.weight != 0;
     t.v.resize(this->layout.iterations * this->layout.chunk_size);
-    auto* dst = reinterpret_cast< std::uint8_t* >(t.v.data());
-    auto* src = chunk + this->layout.initial_skip * this->idx * sizeof(float);
+    auto* dst = t.v.data();
+    auto* src = chunk + this->layout.initial_skip * idx * sizeof(float);
     for (auto i = 0; i < this->layout.iterations; ++i) {
-        std::memcpy(dst, src, this->layout.chunk_size * sizeof(float));
-        dst += this->layout.substride * sizeof(float);
+        put(dst, src, this->layout.chunk_size, weight, blend);
+        dst += this->layout.substride;
         src += this->layout.superstride * sizeof(float);
     }
 }
 
+/*
+ * Extract a vertical slice restricted to the z-window [zfst, zlst]. The output
+ * is the (squeezed) 2D array (n, zlst - zfst + 1), where n is the length of
+ * the horizontal dimension that is not sliced, and every fragment is a single
+ * tile of (x or y) iterations of z-chunks.
+ */
+void slice::extract_zrange(int key, const char* chunk, int idx, float weight) {
+    const auto& fs = this->cube.fragment_shape();
+    const auto  id = id3(this->input.ids[key]);
+    const auto [zfst, zlst] = *this->input.zrange;
+
+    /* the horizontal dimension that is not sliced */
+    const auto across = this->input.dim == 0 ? 1 : 0;
+    const auto across_max = int(this->cube.cube_shape()[across]);
+
+    const auto afst = int(id[across] * fs[across]);
+    const auto alst = std::min(afst + int(fs[across]), across_max);
+    const auto fzfst = int(id[2] * fs[2]);
+    const auto z0 = std::max(fzfst, zfst);
+    const auto z1 = std::min(fzfst + int(fs[2]), zlst + 1);
+    const auto zlength = zlst - zfst + 1;
+
+    auto& t = this->output.tiles[key];
+    t.iterations   = alst - afst;
+    t.chunk_size   = std::max(z1 - z0, 0);
+    t.initial_skip = afst * zlength + (z0 - zfst);
+    t.superstride  = zlength;
+    t.substride    = t.chunk_size;
+    t.v.resize(t.iterations * t.chunk_size);
+
+    const auto blend = this->input.weight != 0;
+    auto* dst = t.v.data();
+    for (int a = 0; a < t.iterations; ++a) {
+        std::array< std::size_t, 3 > local;
+        local[this->input.dim] = idx;
+        local[across] = a;
+        local[2] = z0 - fzfst;
+        const auto fp = one::FP< 3 > { local[0], local[1], local[2] };
+        const auto off = fs.to_offset(fp);
+        put(dst, chunk + off * sizeof(float), t.chunk_size, weight, blend);
+        dst += t.chunk_size;
+    }
+}
+
 std::string slice::pack() {
-    return this->output.pack();
+    /* the output is the (squeezed) plane of the dimensions not sliced */
+    std::vector< int > shape;
+    std::vector< int > stride;
+    const auto& cs = this->cube.cube_shape();
+    for (int i = 0; i < 3; ++i) {
+        if (i == this->input.dim)
+            continue;
+
+        const auto& zrange = this->input.zrange;
+        if (i == 2 and zrange)
+            shape.push_back(zrange->second - zrange->first + 1);
+        else
+            shape.push_back(int(cs[i]));
+        stride.push_back(this->input.stride[i]);
+    }
+    return pack_decimated(this->output, shape, stride);
 }
 
 void curtain::init(const char* msg, int len) {
@@ -176,17 +508,23 @@ void curtain::init(const char* msg, int len) {
         this->add_fragment(name, this->input.ext);
     }
 
+    const auto zdim = this->gvt.mkdim(gvt.ndims - 1);
+    const auto zmax = int(this->gvt.nsamples(zdim));
+    if (this->input.zrange) {
+        this->zwindow.first  = this->input.zrange->first;
+        this->zwindow.second = this->input.zrange->second + 1;
+    } else {
+        this->zwindow = { 0, zmax };
+    }
+
     const auto zsize = [this](const auto& id) noexcept {
         /*
          * Compute the size, in floats, of a block of (sub)traces. A block is
-         * made up of all the trace segments in one (i,j,k) fragment, and maybe
-         * padded.
+         * made up of all the trace segments in one (i,j,k) fragment, clipped
+         * to the z-window.
          */
-        const auto zdim     = this->gvt.mkdim(gvt.ndims - 1);
-        const auto zheight  = this->gvt.fragment_shape()[zdim];
-        const auto fid      = id3(id.id);
-        const auto zreal    = zheight - this->gvt.padding(fid, zdim);
-        return zreal * id.coordinates.size();
+        const auto [zfst, zlst] = this->zextent(id);
+        return (zlst - zfst) * id.coordinates.size();
     };
 
     /*
@@ -223,51 +561,437 @@ void curtain::init(const char* msg, int len) {
         return x.coordinates.size();
     };
 
-    const auto zdim    = this->gvt.mkdim(gvt.ndims - 1);
-    const auto zheight = this->gvt.fragment_shape()[zdim];
-    const auto zmax    = this->gvt.nsamples(zdim);
-    this->output.attr = this->input.attribute;
+    this->output.attr   = this->input.attribute;
+    this->output.format = this->input.format;
     this->output.size = ids.size();
-    this->output.zlength = zmax;
+    this->output.zlength = this->zwindow.second - this->zwindow.first;
     this->output.major.reserve(this->output.size * 2);
     this->output.minor.reserve(this->output.size * 2);
     this->output.values.resize(this->traceindex.back());
     for (const auto& id : ids) {
-        const auto zfst = id.id[zdim] * zheight;
-        const auto zlst = std::min(zfst + zheight, zmax);
+        const auto [zfst, zlst] = this->zextent(id);
         this->output.major.push_back(id.offset);
         this->output.major.push_back(id.offset + csize(id));
-        this->output.minor.push_back(zfst);
-        this->output.minor.push_back(zlst);
+        this->output.minor.push_back(zfst - this->zwindow.first);
+        this->output.minor.push_back(zlst - this->zwindow.first);
     }
 }
 
+/*
+ * The [fst, lst) samples (cube-global) to extract from the fragment, i.e. the
+ * intersection of the fragment and the z-window. Padding is never included.
+ */
+std::pair< int, int > curtain::zextent(const one::single& id)
+const noexcept (true) {
+    const auto zdim    = this->gvt.mkdim(gvt.ndims - 1);
+    const auto zheight = int(this->gvt.fragment_shape()[zdim]);
+    const auto zmax    = int(this->gvt.nsamples(zdim));
+    const auto zfst    = id.id[zdim] * zheight;
+    const auto zlst    = std::min(zfst + zheight, zmax);
+
+    const auto fst = std::max(zfst, this->zwindow.first);
+    const auto lst = std::max(fst, std::min(zlst, this->zwindow.second));
+    return { fst, lst };
+}
+
 void curtain::add(int key, const char* chunk, int len) {
     const auto& id = this->input.ids[key];
 
-    const auto fid = id3(id.id);
     const auto zdim    = this->gvt.mkdim(gvt.ndims - 1);
-    const auto zpad    = this->gvt.padding(fid, zdim);
-    const auto zheight = this->gvt.fragment_shape()[zdim] - zpad;
+    const auto zheight = int(this->gvt.fragment_shape()[zdim]);
+    const auto [zfst, zlst] = this->zextent(id);
+    const auto zlocal  = zfst - id.id[zdim] * zheight;
+    const auto zlength = zlst - zfst;
 
     auto* dst = this->output.values.data() +  this->traceindex[key];
     for (const auto& coord : id.coordinates) {
         const auto fp = one::FP< 3 > {
             std::size_t(coord[0]),
             std::size_t(coord[1]),
-            std::size_t(0),
+            std::size_t(zlocal),
         };
         const auto off = this->gvt.fragment_shape().to_offset(fp);
         const auto src = chunk + off * sizeof(float);
-        std::memcpy(dst, src, sizeof(float) * zheight);
-        dst += zheight;
+        std::memcpy(dst, src, sizeof(float) * zlength);
+        dst += zlength;
     }
 }
 
 std::string curtain::pack() {
-    return this->output.pack();
+    return pack_decimated(this->output, this->input.stride.back());
 }
 
+/*
+ * Clip the window of a horizon segment to the fragment it is read from. The
+ * returned [fst, lst) is in cube-global samples, and may be empty.
+ */
+std::pair< int, int > clip(
+        const one::gvt< 3 >& gvt,
+        const one::horizon_segments& block,
+        const std::array< int, 4 >& segment,
+        int zlength)
+noexcept (true) {
+    const auto zdim    = gvt.mkdim(gvt.ndims - 1);
+    const auto zheight = int(gvt.fragment_shape()[zdim]);
+    const auto zmax    = int(gvt.nsamples(zdim));
+    const auto fzfst   = block.id[2] * zheight;
+    const auto fzlst   = std::min(fzfst + zheight, zmax);
+    const auto zfst    = segment[3];
+
+    const auto fst = std::max(fzfst, zfst);
+    const auto lst = std::max(fst, std::min(fzlst, zfst + zlength));
+    return { fst, lst };
+}
+
+void horizon::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_prefix(this->input);
+
+    const auto& ids = this->input.ids;
+    for (const auto& block : ids) {
+        const auto name = fmt::format("{}", fmt::join(block.id, "-"));
+        this->add_fragment(name, this->input.ext);
+    }
+
+    /*
+     * The horizon output is a curtain_bundle where every trace segment is its
+     * own [n, n+1) major, and the minor is the part of the window covered by
+     * this fragment. Like with the curtain, the position in the values array
+     * is computed up front so that add() can be called in any order.
+     */
+    const auto zlength = this->input.zlength;
+    this->output.attr    = this->input.attribute;
+    this->output.format  = this->input.format;
+    this->output.zlength = zlength;
+    this->output.size    = 0;
+    this->output.major.clear();
+    this->output.minor.clear();
+    this->traceindex.assign(1, 0);
+
+    for (const auto& block : ids) {
+        auto size = this->traceindex.back();
+        for (const auto& seg : block.segments) {
+            const auto [fst, lst] = clip(this->gvt, block, seg, zlength);
+            this->output.major.push_back(seg[0]);
+            this->output.major.push_back(seg[0] + 1);
+            this->output.minor.push_back(fst - seg[3]);
+            this->output.minor.push_back(lst - seg[3]);
+            this->output.size += 1;
+            size += lst - fst;
+        }
+        this->traceindex.push_back(size);
+    }
+
+    this->output.values.resize(this->traceindex.back());
+}
+
+void horizon::add(int key, const char* chunk, int len) {
+    const auto& block = this->input.ids[key];
+
+    const auto zdim    = this->gvt.mkdim(gvt.ndims - 1);
+    const auto zheight = int(this->gvt.fragment_shape()[zdim]);
+    const auto fzfst   = block.id[2] * zheight;
+
+    auto* dst = this->output.values.data() + this->traceindex[key];
+    for (const auto& seg : block.segments) {
+        const auto [fst, lst] = clip(this->gvt, block, seg, this->input.zlength);
+        const auto fp = one::FP< 3 > {
+            std::size_t(seg[1]),
+            std::size_t(seg[2]),
+            std::size_t(fst - fzfst),
+        };
+        const auto off = this->gvt.fragment_shape().to_offset(fp);
+        const auto src = chunk + off * sizeof(float);
+        std::memcpy(dst, src, sizeof(float) * (lst - fst));
+        dst += lst - fst;
+    }
+}
+
+std::string horizon::pack() {
+    return pack_decimated(this->output, this->input.stride.back());
+}
+
+void fence::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_prefix(this->input);
+    this->parts.clear();
+
+    const auto& fs     = this->gvt.fragment_shape();
+    const auto zdim    = this->gvt.mkdim(gvt.ndims - 1);
+    const auto zheight = int(fs[zdim]);
+    auto zwindow = std::make_pair(0, int(this->gvt.nsamples(zdim)));
+    if (this->input.zrange) {
+        zwindow.first  = this->input.zrange->first;
+        zwindow.second = this->input.zrange->second + 1;
+    }
+
+    /*
+     * The fence output is a curtain_bundle where every trace segment is its
+     * own [n, n+1) major, like the horizon. Every output trace is the
+     * weighted sum of its points, which may be spread over (up to 4)
+     * fragments, so the output is accumulated and the parts are computed up
+     * front, which makes add() order-insensitive.
+     */
+    this->output.attr    = this->input.attribute;
+    this->output.format  = this->input.format;
+    this->output.zlength = zwindow.second - zwindow.first;
+    this->output.size    = 0;
+    this->output.major.clear();
+    this->output.minor.clear();
+
+    /*
+     * Neighbouring traces often share fragments, in particular with bilinear
+     * interpolation, so every fragment is only fetched once. The keys are
+     * handed out in the order the fragments are first seen.
+     */
+    std::map< std::array< int, 3 >, int > keys;
+    int dst = 0;
+    for (const auto& block : this->input.ids) {
+        const auto fzfst = block.id[2] * zheight;
+        const auto z0 = std::max(fzfst, zwindow.first);
+        const auto z1 = std::min(fzfst + zheight, zwindow.second);
+
+        for (const auto& trace : block.traces) {
+            this->output.major.push_back(trace.n);
+            this->output.major.push_back(trace.n + 1);
+            this->output.minor.push_back(z0 - zwindow.first);
+            this->output.minor.push_back(z1 - zwindow.first);
+            this->output.size += 1;
+
+            for (const auto& point : trace.points) {
+                const auto& pos = point.position;
+                const auto id = std::array< int, 3 > {
+                    int(pos[0] / fs[0]),
+                    int(pos[1] / fs[1]),
+                    block.id[2],
+                };
+                const auto [itr, inserted] = keys.emplace(id, keys.size());
+                if (inserted) {
+                    const auto name = fmt::format("{}", fmt::join(id, "-"));
+                    this->add_fragment(name, this->input.ext);
+                    this->parts.emplace_back();
+                }
+
+                const auto fp = one::FP< 3 > {
+                    std::size_t(pos[0] % fs[0]),
+                    std::size_t(pos[1] % fs[1]),
+                    std::size_t(z0 - fzfst),
+                };
+                const auto src = int(fs.to_offset(fp));
+                this->parts[itr->second].push_back(
+                    { dst, src, z1 - z0, point.weight }
+                );
+            }
+            dst += z1 - z0;
+        }
+    }
+
+    this->output.values.assign(dst, 0);
+}
+
+void fence::add(int key, const char* chunk, int len) {
+    auto* values = this->output.values.data();
+    for (const auto& part : this->parts[key]) {
+        put(
+            values + part.dst,
+            chunk + part.src * sizeof(float),
+            part.length,
+            part.weight,
+            true
+        );
+    }
+}
+
+std::string fence::pack() {
+    return pack_decimated(this->output, this->input.stride.back());
+}
+
+}
+
+void subvolume::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_prefix(this->input);
+    this->output.attr   = this->input.attribute;
+    this->output.format = this->input.format;
+    this->output.tiles.clear();
+    this->tiles.assign(this->input.ids.size(), {});
+
+    for (const auto& id : this->input.ids) {
+        const auto name = fmt::format("{}", fmt::join(id, "-"));
+        this->add_fragment(name, this->input.ext);
+    }
+}
+
+void subvolume::add(int key, const char* chunk, int len) {
+    const auto& lower = this->input.lower;
+    const auto& upper = this->input.upper;
+    const auto& fs    = this->gvt.fragment_shape();
+    const auto  id    = id3(this->input.ids[key]);
+
+    /*
+     * The intersection [fst, lst) of the box and the fragment, in cube
+     * coordinates. The box is already clamped to the cube, so padding is
+     * never read.
+     */
+    std::array< int, 3 > origin, fst, lst, shape;
+    for (int i = 0; i < 3; ++i) {
+        origin[i] = int(id[i] * fs[i]);
+        fst[i]    = std::max(lower[i], origin[i]);
+        lst[i]    = std::min(upper[i] + 1, origin[i] + int(fs[i]));
+        shape[i]  = upper[i] - lower[i] + 1;
+    }
+
+    /*
+     * The output is a C-ordered (x, y, z) box, so every x-line of the
+     * fragment is a tile of (y) iterations of (z) chunks.
+     */
+    auto& tiles = this->tiles[key];
+    tiles.clear();
+    for (int x = fst[0]; x < lst[0]; ++x) {
+        one::tile t;
+        t.iterations   = lst[1] - fst[1];
+        t.chunk_size   = lst[2] - fst[2];
+        t.initial_skip = ((x - lower[0]) * shape[1] + (fst[1] - lower[1]))
+                       * shape[2] + (fst[2] - lower[2]);
+        t.superstride  = shape[2];
+        t.substride    = t.chunk_size;
+        t.v.resize(t.iterations * t.chunk_size);
+
+        auto* dst = t.v.data();
+        for (int y = fst[1]; y < lst[1]; ++y) {
+            const auto fp = one::FP< 3 > {
+                std::size_t(x - origin[0]),
+                std::size_t(y - origin[1]),
+                std::size_t(fst[2] - origin[2]),
+            };
+            const auto off = fs.to_offset(fp);
+            std::memcpy(
+                dst,
+                chunk + off * sizeof(float),
+                t.chunk_size * sizeof(float)
+            );
+            dst += t.chunk_size;
+        }
+        tiles.push_back(std::move(t));
+    }
+}
+
+std::string subvolume::pack() {
+    this->output.tiles.clear();
+    for (const auto& tiles : this->tiles) {
+        this->output.tiles.insert(
+            this->output.tiles.end(),
+            tiles.begin(),
+            tiles.end()
+        );
+    }
+
+    std::vector< int > shape(3);
+    for (int i = 0; i < 3; ++i)
+        shape[i] = this->input.upper[i] - this->input.lower[i] + 1;
+
+    const auto& stride = this->input.stride;
+    return pack_decimated(
+        this->output,
+        shape,
+        std::vector< int >(stride.begin(), stride.end())
+    );
+}
+
+void statistics::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    if (not this->input.statistics)
+        throw bad_message("statistics task without statistics description");
+
+    const auto& desc = *this->input.statistics;
+    if (desc.function == "statistics")
+        throw bad_message("statistics of statistics is not supported");
+
+    this->inner = proc::make(desc.function);
+    if (not this->inner) {
+        constexpr auto msg = "no function '{}' to compute statistics over";
+        throw bad_message(fmt::format(msg, desc.function));
+    }
+    this->inner->init(msg, len);
+
+    this->output = one::statistics_bundle {};
+    this->output.attr  = this->input.attribute;
+    this->output.range = desc.range;
+    this->output.histogram.assign(desc.bins, 0);
+}
+
+const std::string& statistics::fragments() const {
+    return this->inner->fragments();
+}
+
+void statistics::add(int key, const char* chunk, int len) {
+    this->inner->add(key, chunk, len);
+}
+
+void statistics::tally(const float* fst, const float* lst) noexcept (true) {
+    auto& out = this->output;
+    const auto bins  = int(out.histogram.size());
+    const auto [lo, hi] = out.range;
+    const auto scale = bins / (hi - lo);
+
+    for (auto itr = fst; itr != lst; ++itr) {
+        const auto x = *itr;
+        if (not std::isfinite(x))
+            continue;
+
+        if (out.count == 0) {
+            out.min = x;
+            out.max = x;
+        } else {
+            out.min = std::min(out.min, x);
+            out.max = std::max(out.max, x);
+        }
+
+        out.count += 1;
+        out.sum   += x;
+        out.sumsq += double(x) * x;
+
+        /* samples outside the range are put in the edge bins */
+        const auto bin = std::clamp((x - lo) * scale, 0.0, bins - 1.0);
+        out.histogram[int(bin)] += 1;
+    }
+}
+
+std::string statistics::pack() {
+    const auto packed = this->inner->pack();
+    const auto* fst = packed.data();
+    const auto* lst = packed.data() + packed.size();
+
+    /*
+     * The slice and subvolume are packed as slice tiles, where only
+     * iterations * chunk_size of the values are a part of the output. The
+     * other functions are packed as curtain bundles, where all values are.
+     */
+    const auto& function = this->input.statistics->function;
+    if (function == "slice" or function == "subvolume") {
+        one::slice_tiles tiles;
+        tiles.unpack(fst, lst);
+        for (const auto& tile : tiles.tiles) {
+            for (int i = 0; i < tile.iterations; ++i) {
+                const auto* src = tile.v.data() + i * tile.substride;
+                this->tally(src, src + tile.chunk_size);
+            }
+        }
+    } else {
+        one::curtain_bundle bundle;
+        bundle.unpack(fst, lst);
+        const auto& values = bundle.values;
+        this->tally(values.data(), values.data() + values.size());
+    }
+
+    return this->output.pack();
 }
 
 }
@@ -0,0 +1,221 @@
+#include <algorithm>
+#include <cmath>
+#include <cstdint>
+#include <cstring>
+#include <string>
+
+#include <oneseismic/messages.hpp>
+#include <oneseismic/sampleformat.hpp>
+
+/*
+ * The sample format conversion is used both by the workers (encode) and the
+ * decoder (decode), and the decoder is built without the dependencies of the
+ * core library, so this file should only depend on the standard library and
+ * the header-only exceptions (bad_value) in messages.hpp.
+ *
+ * Samples are encoded little endian, like the float32 samples.
+ */
+
+namespace one {
+
+namespace {
+
+/*
+ * IEEE 754 binary32 -> binary16 conversion, rounding to nearest even.
+ * Values too large for binary16 become infinity, too small become (signed)
+ * zero, and NaNs stay NaN.
+ */
+std::uint16_t tohalf(float f) noexcept (true) {
+    std::uint32_t x;
+    std::memcpy(&x, &f, sizeof(x));
+
+    const std::uint32_t sign = (x >> 16) & 0x8000;
+    const std::uint32_t exp  = (x >> 23) & 0xFF;
+    std::uint32_t mant       = x & 0x7FFFFF;
+
+    if (exp == 0xFF)
+        return sign | 0x7C00 | (mant ? 0x200 : 0);
+
+    const int e = int(exp) - 127 + 15;
+    if (e >= 0x1F)
+        return sign | 0x7C00;
+
+    if (e <= 0) {
+        /* subnormal in binary16, or too small to be represented at all */
+        if (e < -10)
+            return sign;
+
+        mant |= 0x800000;
+        const int shift = 14 - e;
+        std::uint32_t half = mant >> shift;
+        const std::uint32_t rem = mant & ((1u << shift) - 1);
+        const std::uint32_t mid = 1u << (shift - 1);
+        if (rem > mid or (rem == mid and (half & 1)))
+            half += 1;
+        return sign | half;
+    }
+
+    /*
+     * Rounding may carry into the exponent, which is still correct, and
+     * rounds to infinity at the top of the range.
+     */
+    std::uint32_t half = (std::uint32_t(e) << 10) | (mant >> 13);
+    const std::uint32_t rem = mant & 0x1FFF;
+    if (rem > 0x1000 or (rem == 0x1000 and (half & 1)))
+        half += 1;
+    return sign | half;
+}
+
+float fromhalf(std::uint16_t h) noexcept (true) {
+    const std::uint32_t sign = std::uint32_t(h & 0x8000) << 16;
+    const std::uint32_t exp  = (h >> 10) & 0x1F;
+    const std::uint32_t mant = h & 0x3FF;
+
+    if (exp == 0) {
+        const auto f = float(std::ldexp(double(mant), -24));
+        return sign ? -f : f;
+    }
+
+    std::uint32_t x;
+    if (exp == 0x1F)
+        x = sign | 0x7F800000 | (mant << 13);
+    else
+        x = sign | ((exp + 127 - 15) << 23) | (mant << 13);
+
+    float f;
+    std::memcpy(&f, &x, sizeof(f));
+    return f;
+}
+
+double intmax(sampleformat type) noexcept (true) {
+    switch (type) {
+        case sampleformat::int16: return 32767;
+        case sampleformat::int8:  return 127;
+        default:                  return 1;
+    }
+}
+
+template < typename T >
+void encode_int(const float* src, std::size_t n, const formatdesc& fmt, char* dst)
+noexcept (true) {
+    const auto hi = intmax(fmt.type);
+    for (std::size_t i = 0; i < n; ++i) {
+        double x = (double(src[i]) - fmt.offset) / fmt.scale;
+        if (not std::isfinite(x))
+            x = 0;
+        const auto v = T(std::clamp(std::round(x), -hi, hi));
+        std::memcpy(dst + i * sizeof(T), &v, sizeof(T));
+    }
+}
+
+template < typename T >
+void decode_int(const char* src, std::size_t n, const formatdesc& fmt, char* dst)
+noexcept (true) {
+    for (std::size_t i = 0; i < n; ++i) {
+        T v;
+        std::memcpy(&v, src + i * sizeof(T), sizeof(T));
+        const auto x = float(fmt.offset + fmt.scale * double(v));
+        std::memcpy(dst + i * sizeof(float), &x, sizeof(float));
+    }
+}
+
+}
+
+sampleformat parse_sampleformat(const std::string& name) noexcept (false) {
+    if (name == "float32") return sampleformat::float32;
+    if (name == "float16") return sampleformat::float16;
+    if (name == "int16")   return sampleformat::int16;
+    if (name == "int8")    return sampleformat::int8;
+
+    const auto msg = "expected format float32, float16, int16, or int8, got "
+                   + name;
+    throw bad_value(msg);
+}
+
+std::string to_string(sampleformat type) noexcept (true) {
+    switch (type) {
+        case sampleformat::float16: return "float16";
+        case sampleformat::int16:   return "int16";
+        case sampleformat::int8:    return "int8";
+        default:                    return "float32";
+    }
+}
+
+std::size_t samplesize(sampleformat type) noexcept (true) {
+    switch (type) {
+        case sampleformat::float16: return sizeof(std::uint16_t);
+        case sampleformat::int16:   return sizeof(std::int16_t);
+        case sampleformat::int8:    return sizeof(std::int8_t);
+        default:                    return sizeof(float);
+    }
+}
+
+formatdesc scaled(sampleformat type, double lo, double hi) noexcept (false) {
+    formatdesc fmt;
+    fmt.type = type;
+    if (type == sampleformat::float32 or type == sampleformat::float16)
+        return fmt;
+
+    if (not (lo < hi)) {
+        const auto msg = "sample range [" + std::to_string(lo)
+                       + ", " + std::to_string(hi) + "] is empty"
+                       ;
+        throw bad_value(msg);
+    }
+
+    fmt.offset = (lo + hi) / 2;
+    fmt.scale  = (hi - lo) / (2 * intmax(type));
+    return fmt;
+}
+
+void encode(const float* src, std::size_t n, const formatdesc& fmt, char* dst)
+noexcept (true) {
+    switch (fmt.type) {
+        case sampleformat::float16:
+            for (std::size_t i = 0; i < n; ++i) {
+                const auto h = tohalf(src[i]);
+                std::memcpy(dst + i * sizeof(h), &h, sizeof(h));
+            }
+            return;
+
+        case sampleformat::int16:
+            encode_int< std::int16_t >(src, n, fmt, dst);
+            return;
+
+        case sampleformat::int8:
+            encode_int< std::int8_t >(src, n, fmt, dst);
+            return;
+
+        default:
+            std::memcpy(dst, src, n * sizeof(float));
+            return;
+    }
+}
+
+void decode(const char* src, std::size_t n, const formatdesc& fmt, char* dst)
+noexcept (true) {
+    switch (fmt.type) {
+        case sampleformat::float16:
+            for (std::size_t i = 0; i < n; ++i) {
+                std::uint16_t h;
+                std::memcpy(&h, src + i * sizeof(h), sizeof(h));
+                const auto f = fromhalf(h);
+                std::memcpy(dst + i * sizeof(f), &f, sizeof(f));
+            }
+            return;
+
+        case sampleformat::int16:
+            decode_int< std::int16_t >(src, n, fmt, dst);
+            return;
+
+        case sampleformat::int8:
+            decode_int< std::int8_t >(src, n, fmt, dst);
+            return;
+
+        default:
+            std::memcpy(dst, src, n * sizeof(float));
+            return;
+    }
+}
+
+}
@@ -15,12 +15,21 @@ using namespace Catch::Matchers;
 
 namespace one {
 
+bool operator == (const one::formatdesc& lhs, const one::formatdesc& rhs) {
+    return lhs.type   == rhs.type
+        && lhs.scale  == rhs.scale
+        && lhs.offset == rhs.offset
+    ;
+}
+
 bool operator == (const one::basic_task& lhs, const one::basic_task& rhs) {
     return lhs.pid              == rhs.pid
         && lhs.guid             == rhs.guid
         && lhs.storage_endpoint == rhs.storage_endpoint
         && lhs.shape            == rhs.shape
         && lhs.function         == rhs.function
+        && lhs.stride           == rhs.stride
+        && lhs.format           == rhs.format
     ;
 }
 
@@ -28,10 +37,26 @@ bool operator == (const one::slice_task& lhs, const one::slice_task& rhs) {
     return static_cast< const one::basic_task& >(lhs) == rhs
         && lhs.dim == rhs.dim
         && lhs.idx == rhs.idx
+        && lhs.weight == rhs.weight
         && lhs.ids == rhs.ids
     ;
 }
 
+bool operator == (
+        const one::horizon_segments& lhs,
+        const one::horizon_segments& rhs) {
+    return lhs.id       == rhs.id
+        && lhs.segments == rhs.segments
+    ;
+}
+
+bool operator == (const one::horizon_task& lhs, const one::horizon_task& rhs) {
+    return static_cast< const one::basic_task& >(lhs) == rhs
+        && lhs.zlength == rhs.zlength
+        && lhs.ids     == rhs.ids
+    ;
+}
+
 bool operator == (const one::volumedesc& lhs, const one::volumedesc& rhs) {
     return lhs.prefix == rhs.prefix
         && lhs.ext    == rhs.ext
@@ -436,6 +461,624 @@ SCENARIO("Requests of different kinds return the same result for curtain") {
     }
 }
 
+SCENARIO("Requests of different kinds return the same result for horizon") {
+    const std::string query_main =
+        fmt::sprintf(query_base_template, "[[10, 11], [1, 2], [0, 4, 8]]",
+                     R"(,"utm-to-lineno": [[1, 0, 10], [0, 1, 1]])");
+    std::string query_specific = R"(
+            "function": "horizon",
+    )";
+
+    one::horizon_query query;
+    const auto verify = [&]() {
+        WHEN("Unpacking the request") {
+            const auto doc =
+                fmt::format("{{ {}, {} }}", query_main, query_specific);
+            query.unpack(doc.c_str(), doc.c_str() + doc.size());
+
+            THEN("The coordinates are unpacked correctly, in input order") {
+                CHECK(query.dim0s == std::vector{1, 0});
+                CHECK(query.dim1s == std::vector{1, 0});
+                CHECK(query.dim2s == std::vector{2, 1});
+                CHECK(query.window == 1);
+            }
+        }
+    };
+
+    GIVEN("Index coordinates") {
+        query_specific += R"(
+            "args": {
+                "kind": "index",
+                "coords": [[1, 1, 2], [0, 0, 1]],
+                "window": 1
+            }
+        )";
+        verify();
+    }
+
+    GIVEN("Lineno coordinates") {
+        query_specific += R"(
+            "args": {
+                "kind": "lineno",
+                "coords": [[11, 2, 7.1], [10, 1, 5]],
+                "window": 1
+            }
+        )";
+        verify();
+    }
+
+    GIVEN("UTM coordinates") {
+        query_specific += R"(
+            "args": {
+                "kind": "utm",
+                "coords": [[0.9, 1.1, 8], [0.1, -0.1, 2.5]],
+                "window": 1
+            }
+        )";
+        verify();
+    }
+}
+
+TEST_CASE("horizon query with bad arguments fails") {
+    const std::string query_main =
+        fmt::sprintf(query_base_template, "[[10, 11], [1, 2], [0, 4, 8]]", "");
+
+    const auto unpack = [&](const std::string& args) {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "horizon", "args": {} }})",
+            query_main,
+            args
+        );
+        one::horizon_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+    };
+
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "lineno", "coords": [[10, 1, 9]] })"),
+        Contains("depth/time (= 9) is not in the cube")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "lineno", "coords": [[10, 1]] })"),
+        Contains("bad coords arg: expected list-of-triples")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "index", "coords": [[0, 0, 3]] })"),
+        Contains("coordinate (= 3) of type index is out of cube")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "lineno", "coords": [], "window": -1 })"),
+        Contains("window (= -1) must be non-negative")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "utm", "coords": [] })"),
+        Contains("Manifest does not contain geographic information")
+    );
+}
+
+SCENARIO("Requests of different kinds return the same result for subvolume") {
+    std::string query_specific = R"(
+            "function": "subvolume",
+    )";
+
+    one::subvolume_query query;
+    const auto verify = [&]() {
+        WHEN("Unpacking the request") {
+            const auto doc =
+                fmt::format("{{ {}, {} }}", query_required, query_specific);
+            query.unpack(doc.c_str(), doc.c_str() + doc.size());
+
+            THEN("The box is unpacked correctly") {
+                CHECK(query.lower == std::array< int, 3 >{ 1, 2, 0 });
+                CHECK(query.upper == std::array< int, 3 >{ 3, 5, 1 });
+            }
+        }
+    };
+
+    GIVEN("Index box") {
+        query_specific += R"(
+            "args": {
+                "kind": "index",
+                "from": [1, 2, 0],
+                "to":   [3, 5, 1]
+            }
+        )";
+        verify();
+    }
+
+    GIVEN("Lineno box") {
+        query_specific += R"(
+            "args": {
+                "kind": "lineno",
+                "from": [2, 8, 12],
+                "to":   [4, 69, 34]
+            }
+        )";
+        verify();
+    }
+
+    GIVEN("Lineno box with endpoints between lines") {
+        query_specific += R"(
+            "args": {
+                "kind": "lineno",
+                "from": [2, 8, 0],
+                "to":   [4, 100, 500]
+            }
+        )";
+        verify();
+    }
+}
+
+TEST_CASE("subvolume query with bad arguments fails") {
+    const auto unpack = [&](const std::string& args) {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "subvolume", "args": {} }})",
+            query_required,
+            args
+        );
+        one::subvolume_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+    };
+
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "index", "from": [0, 0], "to": [1, 1] })"),
+        Contains("bad from/to arg: expected [x, y, z]")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "index", "from": [0, 0, 0], "to": [1, 6, 1] })"),
+        Contains("dimension 1: [0, 6] is out of cube boundaries [0, 6)")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "index", "from": [2, 0, 0], "to": [1, 1, 1] })"),
+        Contains("dimension 0: from (= 2) > to (= 1)")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "lineno", "from": [1, 11, 12], "to": [2, 68, 12] })"),
+        Contains("dimension 1: no lines in [11, 68]")
+    );
+    CHECK_THROWS_WITH(
+        unpack(R"({ "kind": "utm", "from": [1, 6, 12], "to": [2, 7, 12] })"),
+        Contains("expected kind 'index' or 'lineno', got utm")
+    );
+}
+
+TEST_CASE("traces query keeps input order and drops duplicates") {
+    const std::string query_main =
+        fmt::sprintf(query_base_template, "[[10, 11], [1, 2], [0, 1]]",
+                     R"(,"utm-to-lineno": [[1, 0, 10], [0, 1, 1]])");
+
+    const auto unpack = [&](const std::string& args) {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "traces", "args": {} }})",
+            query_main,
+            args
+        );
+        one::traces_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("for index coordinates") {
+        const auto query = unpack(R"({
+            "kind": "index",
+            "coords": [[1, 1], [0, 0], [1, 1], [0, 1]]
+        })");
+        CHECK(query.dim0s == std::vector{1, 0, 0});
+        CHECK(query.dim1s == std::vector{1, 0, 1});
+    }
+
+    SECTION("for UTM coordinates that snap to the same trace") {
+        const auto query = unpack(R"({
+            "kind": "utm",
+            "coords": [[0.9, 1.1], [0.1, -0.1], [1.1, 0.9]]
+        })");
+        CHECK(query.dim0s == std::vector{1, 0});
+        CHECK(query.dim1s == std::vector{1, 0});
+    }
+
+    SECTION("unless the function is wrong") {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "curtain", "args": {{}} }})",
+            query_main
+        );
+        one::traces_query query;
+        CHECK_THROWS_WITH(
+            query.unpack(doc.c_str(), doc.c_str() + doc.size()),
+            Contains("expected query 'traces', got curtain")
+        );
+    }
+}
+
+TEST_CASE("fence query resamples the polyline") {
+    const std::string query_main =
+        fmt::sprintf(query_base_template, "[[10, 11, 12], [1, 2], [0, 1]]",
+                     R"(,"utm-to-lineno": [[1, 0, 10], [0, 1, 1]])");
+
+    const auto unpack = [&](const std::string& args) {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "fence", "args": {} }})",
+            query_main,
+            args
+        );
+        one::fence_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    const auto positions = [](const auto& points) {
+        std::vector< std::array< int, 2 > > out;
+        for (const auto& point : points)
+            out.push_back(point.position);
+        return out;
+    };
+
+    SECTION("at the grid spacing by default") {
+        const auto query = unpack(R"({ "polyline": [[0, 0], [2, 0]] })");
+        CHECK(query.coordinates == std::vector< double >{ 0, 0, 1, 0, 2, 0 });
+        REQUIRE(query.traces.size() == 3);
+        for (int i = 0; i < 3; ++i) {
+            INFO("trace " << i);
+            REQUIRE(query.traces[i].size() == 1);
+            CHECK(query.traces[i][0].position == std::array< int, 2 >{ i, 0 });
+            CHECK(query.traces[i][0].weight == 1);
+        }
+    }
+
+    SECTION("and always includes the last point") {
+        const auto query = unpack(R"({
+            "polyline": [[0, 0], [1, 0], [1, 0.5]],
+            "spacing": 1
+        })");
+        CHECK(query.coordinates == std::vector< double >{ 0, 0, 1, 0, 1, 0.5 });
+    }
+
+    SECTION("with bilinear interpolation between traces") {
+        const auto query = unpack(R"({
+            "polyline": [[0, 0], [1, 1]],
+            "spacing": 0.7071067811865476,
+            "interpolation": "linear"
+        })");
+        REQUIRE(query.traces.size() == 3);
+        CHECK(positions(query.traces[0]).size() == 1);
+        CHECK(positions(query.traces[2]).size() == 1);
+
+        const auto& mid = query.traces[1];
+        const auto expected = std::vector< std::array< int, 2 > > {
+            { 0, 0 }, { 1, 0 }, { 0, 1 }, { 1, 1 },
+        };
+        CHECK(positions(mid) == expected);
+        for (const auto& point : mid)
+            CHECK(point.weight == Catch::Detail::Approx(0.25));
+    }
+
+    SECTION("but fails when the polyline leaves the cube") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "polyline": [[0, 0], [3, 0]] })"),
+            Contains("Point (3, 0) not in cube")
+        );
+    }
+
+    SECTION("but fails when the spacing is not positive") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "polyline": [[0, 0]], "spacing": 0 })"),
+            Contains("spacing (= 0) must be positive")
+        );
+    }
+
+    SECTION("but fails on unknown interpolation") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "polyline": [[0, 0]], "interpolation": "cubic" })"),
+            Contains("expected interpolation 'nearest' or 'linear', got cubic")
+        );
+    }
+}
+
+TEST_CASE("slice query weight blends with the next line") {
+    const auto unpack = [](const std::string& args) {
+        const auto doc = fmt::format(
+            R"({{ {}, "function": "slice", "args": {} }})",
+            query_required,
+            args
+        );
+        one::slice_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("which is zero when not set") {
+        const auto query = unpack(R"({ "kind": "index", "dim": 1, "val": 2 })");
+        CHECK(query.weight == 0);
+    }
+
+    SECTION("which is unpacked when set") {
+        const auto query = unpack(
+            R"({ "kind": "index", "dim": 1, "val": 2, "weight": 0.25 })"
+        );
+        CHECK(query.idx == 2);
+        CHECK(query.weight == 0.25);
+    }
+
+    SECTION("but fails when not in [0, 1)") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "kind": "index", "dim": 1, "val": 2, "weight": 1 })"),
+            Contains("args.weight (= 1) not in [0, 1)")
+        );
+    }
+
+    SECTION("but fails when there is no next line") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "kind": "index", "dim": 1, "val": 5, "weight": 0.5 })"),
+            Contains("args.weight (= 0.5) > 0 for the last line")
+        );
+    }
+}
+
+TEST_CASE("opts.zrange is unpacked to the cartesian sample range") {
+    const auto unpack = [](const std::string& zrange) {
+        const auto doc = fmt::format(
+            R"({{ {}, {}, "opts": {{ "zrange": {} }} }})",
+            query_required,
+            query_curtain_specific,
+            zrange
+        );
+        one::curtain_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("which is the full trace when not set") {
+        const auto query = unpack("null");
+        CHECK(!query.zrange);
+        CHECK(query.zwindow() == std::make_pair(0, 2));
+    }
+
+    SECTION("for line numbers, defaulting to lineno") {
+        const auto query = unpack(R"({ "from": 30, "to": 600 })");
+        CHECK(query.zrange == std::make_pair(1, 2));
+    }
+
+    SECTION("for index") {
+        const auto query = unpack(R"({ "from": 0, "to": 1, "kind": "index" })");
+        CHECK(query.zrange == std::make_pair(0, 1));
+    }
+
+    SECTION("but fails when the range is empty") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "from": 35, "to": 500 })"),
+            Contains("opts.zrange: no lines in [35, 500]")
+        );
+    }
+
+    SECTION("but fails when from > to") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "from": 2, "to": 1, "kind": "index" })"),
+            Contains("opts.zrange: from (= 2) > to (= 1)")
+        );
+    }
+}
+
+TEST_CASE("opts.stride is unpacked to the per-dimension stride") {
+    const auto unpack = [](const std::string& stride) {
+        const auto doc = fmt::format(
+            R"({{ {}, {}, "opts": {{ "stride": {} }} }})",
+            query_required,
+            query_curtain_specific,
+            stride
+        );
+        one::curtain_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("which is every line when not set") {
+        const auto query = unpack("null");
+        CHECK(query.stride == std::array< int, 3 >{ 1, 1, 1 });
+    }
+
+    SECTION("and is forwarded to the tasks") {
+        const auto query = unpack("[1, 4, 2]");
+        CHECK(query.stride == std::array< int, 3 >{ 1, 4, 2 });
+        CHECK(one::basic_task(query).stride == query.stride);
+    }
+
+    SECTION("but fails when not one stride per dimension") {
+        CHECK_THROWS_WITH(
+            unpack("[2, 2]"),
+            Contains("opts.stride: expected 3 strides, got 2")
+        );
+    }
+
+    SECTION("but fails when not positive") {
+        CHECK_THROWS_WITH(
+            unpack("[1, 0, 2]"),
+            Contains("opts.stride (= [1, 0, 2]) must be positive")
+        );
+    }
+}
+
+TEST_CASE("opts.statistics is unpacked to the statistics description") {
+    const auto unpack = [](const std::string& statistics) {
+        const auto doc = fmt::format(
+            R"({{ {}, {}, "opts": {{ "statistics": {} }} }})",
+            query_required,
+            query_curtain_specific,
+            statistics
+        );
+        one::curtain_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("which is unset when null") {
+        const auto query = unpack("null");
+        CHECK(!query.statistics);
+    }
+
+    SECTION("with the query function as the inner function") {
+        const auto query = unpack(R"({ "bins": 8, "range": [-1.5, 2] })");
+        REQUIRE(query.statistics);
+        CHECK(query.statistics->function == "curtain");
+        CHECK(query.statistics->bins == 8);
+        CHECK(query.statistics->range == std::array< double, 2 >{ -1.5, 2 });
+    }
+
+    SECTION("but fails when there are no bins") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "bins": 0, "range": [0, 1] })"),
+            Contains("opts.statistics.bins (= 0) must be positive")
+        );
+    }
+
+    SECTION("but fails when there are too many bins") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "bins": 2000000000, "range": [0, 1] })"),
+            Contains("opts.statistics.bins (= 2000000000) must be <= 65536")
+        );
+    }
+
+    SECTION("but fails when the range is empty") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "bins": 4, "range": [1, 1] })"),
+            Contains("opts.statistics.range (= [1, 1]) is empty")
+        );
+    }
+}
+
+TEST_CASE("opts.format is unpacked to the sample format") {
+    const auto unpack = [](const std::string& format) {
+        const auto doc = fmt::format(
+            R"({{ {}, {}, "opts": {{ "format": {} }} }})",
+            query_required,
+            query_curtain_specific,
+            format
+        );
+        one::curtain_query query;
+        query.unpack(doc.c_str(), doc.c_str() + doc.size());
+        return query;
+    };
+
+    SECTION("which is float32 when not set") {
+        const auto query = unpack("null");
+        CHECK(query.format.type == one::sampleformat::float32);
+        CHECK(query.format.scale == 1);
+        CHECK(query.format.offset == 0);
+    }
+
+    SECTION("with no scaling for float16") {
+        const auto query = unpack(R"({ "type": "float16" })");
+        CHECK(query.format.type == one::sampleformat::float16);
+        CHECK(query.format.scale == 1);
+        CHECK(query.format.offset == 0);
+    }
+
+    SECTION("with the range mapped onto the integers") {
+        const auto query = unpack(R"({ "type": "int8", "range": [-1, 3] })");
+        CHECK(query.format.type == one::sampleformat::int8);
+        CHECK(query.format.offset == 1);
+        CHECK(query.format.scale == Catch::Detail::Approx(2.0 / 127));
+    }
+
+    SECTION("only for the data task") {
+        const auto query = unpack(R"({ "type": "int16", "range": [0, 1] })");
+        CHECK(one::basic_task(query).format == query.format);
+
+        one::attributedesc attr;
+        attr.shapes = { { 64, 64, 1 } };
+        const auto task = one::basic_task(query, attr);
+        CHECK(task.format.type == one::sampleformat::float32);
+    }
+
+    SECTION("but fails on unknown formats") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "type": "float64" })"),
+            Contains("got float64")
+        );
+    }
+
+    SECTION("but fails when the range is not set for integers") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "type": "int8" })"),
+            Contains("opts.format.range must be set for int8")
+        );
+    }
+
+    SECTION("but fails when the range is empty") {
+        CHECK_THROWS_WITH(
+            unpack(R"({ "type": "int16", "range": [2, -2] })"),
+            Contains("opts.format.range (= [2, -2]) is empty")
+        );
+    }
+}
+
+TEST_CASE("Curtain bundles round trip through the sample formats") {
+    one::curtain_bundle bundle;
+    bundle.attr    = "data";
+    bundle.size    = 1;
+    bundle.zlength = 6;
+    bundle.major   = { 0, 1 };
+    bundle.minor   = { 0, 6 };
+    bundle.values  = { -2.0, -0.5, 0.0, 0.1, 1.75, 2.0 };
+
+    const auto roundtrip = [&bundle](const one::formatdesc& fmt) {
+        auto in = bundle;
+        in.format = fmt;
+        const auto packed = in.pack();
+
+        one::curtain_bundle out;
+        out.format = fmt;
+        out.unpack(packed.data(), packed.data() + packed.size());
+        return out.values;
+    };
+
+    SECTION("float32 is lossless") {
+        const auto fmt = one::scaled(one::sampleformat::float32, 0, 0);
+        CHECK(roundtrip(fmt) == bundle.values);
+    }
+
+    SECTION("float16 is within half-precision") {
+        const auto fmt = one::scaled(one::sampleformat::float16, 0, 0);
+        const auto values = roundtrip(fmt);
+        REQUIRE(values.size() == bundle.values.size());
+        for (std::size_t i = 0; i < values.size(); ++i) {
+            INFO("i = " << i);
+            CHECK(values[i] == Catch::Detail::Approx(bundle.values[i])
+                .margin(1e-3)
+            );
+        }
+    }
+
+    SECTION("int8 is within a step") {
+        const auto fmt = one::scaled(one::sampleformat::int8, -2, 2);
+        const auto values = roundtrip(fmt);
+        REQUIRE(values.size() == bundle.values.size());
+        for (std::size_t i = 0; i < values.size(); ++i) {
+            INFO("i = " << i);
+            CHECK(values[i] == Catch::Detail::Approx(bundle.values[i])
+                .margin(fmt.scale / 2)
+            );
+        }
+    }
+
+    SECTION("int16 clamps outside the range") {
+        const auto fmt = one::scaled(one::sampleformat::int16, -1, 1);
+        const auto values = roundtrip(fmt);
+        REQUIRE(values.size() == bundle.values.size());
+        CHECK(values.front() == Catch::Detail::Approx(-1));
+        CHECK(values.back()  == Catch::Detail::Approx(1));
+        CHECK(values[3] == Catch::Detail::Approx(0.1).margin(fmt.scale));
+    }
+
+    SECTION("packs a quarter of the bytes as int8") {
+        auto in = bundle;
+        in.values.assign(1024, 0.5);
+        in.minor = { 0, 1024 };
+        in.zlength = 1024;
+        const auto float32 = in.pack().size();
+        in.format = one::scaled(one::sampleformat::int8, -1, 1);
+        const auto int8 = in.pack().size();
+        CHECK(int8 < float32 / 3);
+    }
+}
+
 TEST_CASE("packing a query is not supported") {
     const auto msg = "Packing is not implemented for query";
     one::slice_query slice_query;
@@ -443,6 +1086,18 @@ TEST_CASE("packing a query is not supported") {
 
     one::curtain_query curtain_query;
     CHECK_THROWS_WITH(curtain_query.pack(), Contains(msg));
+
+    one::horizon_query horizon_query;
+    CHECK_THROWS_WITH(horizon_query.pack(), Contains(msg));
+
+    one::subvolume_query subvolume_query;
+    CHECK_THROWS_WITH(subvolume_query.pack(), Contains(msg));
+
+    one::traces_query traces_query;
+    CHECK_THROWS_WITH(traces_query.pack(), Contains(msg));
+
+    one::fence_query fence_query;
+    CHECK_THROWS_WITH(fence_query.pack(), Contains(msg));
 }
 
 
@@ -456,6 +1111,9 @@ TEST_CASE("slice-task can round trip packing") {
     task.function = "slice";
     task.dim = 1;
     task.idx = 2;
+    task.weight = 0.5;
+    task.stride = { 1, 2, 4 };
+    task.format = one::scaled(one::sampleformat::int8, -2, 2);
     task.ids = {
         { 0, 1, 2 },
         { 3, 4, 5 },
@@ -469,6 +1127,28 @@ TEST_CASE("slice-task can round trip packing") {
     CHECK(task == unpacked);
 }
 
+TEST_CASE("horizon-task can round trip packing") {
+    one::horizon_task task;
+    task.pid = "pid";
+    task.guid = "guid";
+    task.storage_endpoint = "https://storage.com";
+    task.shape = { 64, 64, 64 };
+    task.shape_cube = { 512, 512, 512 };
+    task.function = "horizon";
+    task.zlength = 5;
+    task.ids = {
+        { { 0, 1, 2 }, { { 0, 1, 2, 126 }, { 2, 0, 0, 130 } } },
+        { { 0, 1, 3 }, { { 0, 1, 2, 126 } } },
+    };
+
+    const auto packed = task.pack();
+    INFO(packed);
+    one::horizon_task unpacked;
+    unpacked.unpack(packed.data(), packed.data() + packed.size());
+
+    CHECK(task == unpacked);
+}
+
 SCENARIO("Converting from UTM coordinates to cartesian grid") {
     const std::vector< int > inlines{1, 2, 3, 5, 6};
     const std::vector< int > crosslines{11, 12, 13, 14, 16, 17};
@@ -1,3 +1,6 @@
+#include <algorithm>
+#include <cmath>
+
 #include <catch/catch.hpp>
 
 #include <oneseismic/geometry.hpp>
@@ -305,8 +308,595 @@ TEST_CASE("Curtains extracted from chunks matches hand-extracted curtain") {
     CHECK_THAT(output.values, Equals(expected.values));
 }
 
+one::horizon_task default_horizon_task() {
+    one::horizon_task input;
+    input.pid    = "some-pid";
+    input.token  = "some-token";
+    input.guid   = "some-guid";
+    input.prefix = "src";
+    input.ext    = "f32";
+
+    input.storage_endpoint = "some-endpoint";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.zlength    = 3;
+
+    return input;
+}
+
+TEST_CASE("Horizons extracted from chunks matches hand-extracted windows") {
+    /*
+     * Two traces, both with a 3-sample window. The first trace (row 0) sits
+     * at (2,1) in fragment (0,0,_) with the window [1, 4), which crosses the
+     * fragment boundary at z = 3. The second trace (row 1) sits at (0,0) in
+     * fragment (0,1,_) with the window [3, 6), which is clipped by the bottom
+     * of the cube at z = 5.
+     */
+    auto input = default_horizon_task();
+    input.ids = {
+        { { 0, 0, 0 }, { { 0, 2, 1, 1 } } },
+        { { 0, 0, 1 }, { { 0, 2, 1, 1 } } },
+        { { 0, 1, 1 }, { { 1, 0, 0, 3 } } },
+    };
+
+    const auto msg = input.pack();
+    auto horizon = one::proc::make("horizon");
+    horizon->init(msg.data(), msg.size());
+    CHECK(horizon->fragments() ==
+        "src/3-3-3/0-0-0.f32;"
+        "src/3-3-3/0-0-1.f32;"
+        "src/3-3-3/0-1-1.f32"
+    );
+
+    std::vector< float > blobs[3];
+    for (int i = 0; i < 3; ++i) {
+        blobs[i] = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+    }
+
+    /* add() is not sensitive to order */
+    for (int i : { 2, 0, 1 }) {
+        horizon->add(i,
+            reinterpret_cast< const char* >(blobs[i].data()),
+            int(blobs[i].size() * sizeof(float))
+        );
+    }
+
+    std::vector< float > expected;
+    const auto append = [&](const auto& blob, int x, int y, int z, int n) {
+        const auto fst = blob.begin() + x * 3 * 3 + y * 3 + z;
+        expected.insert(expected.end(), fst, fst + n);
+    };
+    append(blobs[0], 2, 1, 1, 2);
+    append(blobs[1], 2, 1, 0, 1);
+    append(blobs[2], 0, 0, 0, 2);
+
+    auto output = unpack< one::curtain_bundle >(horizon->pack());
+    CHECK(output.size == 3);
+    CHECK(output.zlength == 3);
+    CHECK_THAT(output.major,  Equals(std::vector< int >{ 0, 1, 0, 1, 1, 2 }));
+    CHECK_THAT(output.minor,  Equals(std::vector< int >{ 0, 2, 2, 3, 0, 2 }));
+    CHECK_THAT(output.values, Equals(expected));
+}
+
+TEST_CASE("Subvolumes extracted from chunks matches hand-extracted box") {
+    one::subvolume_task input;
+    input.pid    = "some-pid";
+    input.prefix = "src";
+    input.ext    = "f32";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower = { 1, 2, 1 };
+    input.upper = { 3, 3, 4 };
+    input.ids = {
+        { 0, 0, 0 }, { 0, 0, 1 }, { 0, 1, 0 }, { 0, 1, 1 },
+        { 1, 0, 0 }, { 1, 0, 1 }, { 1, 1, 0 }, { 1, 1, 1 },
+    };
+
+    const auto msg = input.pack();
+    auto subvolume = one::proc::make("subvolume");
+    subvolume->init(msg.data(), msg.size());
+
+    /*
+     * Build the full (padded) 6x6x6 cube from the fragments, then cut out the
+     * box by hand.
+     */
+    float cube[6][6][6];
+    for (int key = int(input.ids.size()) - 1; key >= 0; --key) {
+        const auto blob = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+        subvolume->add(key,
+            reinterpret_cast< const char* >(blob.data()),
+            int(blob.size() * sizeof(float))
+        );
+
+        const auto& id = input.ids[key];
+        for (int i = 0; i < 3; ++i)
+        for (int j = 0; j < 3; ++j)
+        for (int k = 0; k < 3; ++k) {
+            const auto x = id[0] * 3 + i;
+            const auto y = id[1] * 3 + j;
+            const auto z = id[2] * 3 + k;
+            cube[x][y][z] = blob[i * 9 + j * 3 + k];
+        }
+    }
+
+    std::vector< float > expected;
+    for (int x = 1; x <= 3; ++x)
+    for (int y = 2; y <= 3; ++y)
+    for (int z = 1; z <= 4; ++z)
+        expected.push_back(cube[x][y][z]);
+
+    /* Assemble the output the same way the decoder does */
+    const auto output = unpack< one::slice_tiles >(subvolume->pack());
+    std::vector< float > extracted(expected.size());
+    for (const auto& tile : output.tiles) {
+        for (int i = 0; i < tile.iterations; ++i) {
+            std::copy_n(
+                tile.v.begin() + i * tile.substride,
+                tile.chunk_size,
+                extracted.begin() + i * tile.superstride + tile.initial_skip
+            );
+        }
+    }
+
+    CHECK_THAT(extracted, Equals(expected));
+}
+
+TEST_CASE("Curtains restricted to a z-window only extract the window") {
+    auto input = default_curtain_task();
+    input.ids = {
+        one::single { {0, 0, 0}, 0, { {2, 1}, {2, 2} } },
+        one::single { {0, 0, 1}, 0, { {2, 1}, {2, 2} } },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.zrange     = std::make_pair(2, 3);
+
+    const auto msg = input.pack();
+    auto curtain = one::proc::make("curtain");
+    curtain->init(msg.data(), msg.size());
+
+    std::vector< float > expected;
+    for (int i = 0; i < int(input.ids.size()); ++i) {
+        const auto blob = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+        curtain->add(i,
+            reinterpret_cast< const char* >(blob.data()),
+            int(blob.size() * sizeof(float))
+        );
+
+        /* z = 2 is the last sample of k = 0, z = 3 the first of k = 1 */
+        const auto z = i == 0 ? 2 : 0;
+        for (const auto& coord : input.ids[i].coordinates)
+            expected.push_back(blob[coord[0] * 3 * 3 + coord[1] * 3 + z]);
+    }
+
+    auto output = unpack< one::curtain_bundle >(curtain->pack());
+    CHECK(output.zlength == 2);
+    CHECK_THAT(output.major,  Equals(std::vector< int >{ 0, 2, 0, 2 }));
+    CHECK_THAT(output.minor,  Equals(std::vector< int >{ 0, 1, 1, 2 }));
+    CHECK_THAT(output.values, Equals(expected));
+}
+
+TEST_CASE("Slices restricted to a z-window only extract the window") {
+    auto input = default_slice_task();
+    input.dim = 0;
+    input.idx = 1;
+    input.ids = {
+        { 0, 0, 1 },
+        { 0, 1, 1 },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.zrange     = std::make_pair(3, 4);
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+
+    /*
+     * The output is (5, 2), the crosslines by the two samples in the window.
+     * Every fragment holds the first 2 samples of the window, but only
+     * crosslines [0, 3) and [3, 5) respectively.
+     */
+    std::vector< float > expected(5 * 2);
+    for (int i = 0; i < int(input.ids.size()); ++i) {
+        const auto blob = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+        slice->add(i,
+            reinterpret_cast< const char* >(blob.data()),
+            int(blob.size() * sizeof(float))
+        );
+
+        for (int y = 0; y < 3 and i * 3 + y < 5; ++y) {
+            for (int z = 0; z < 2; ++z) {
+                const auto out = (i * 3 + y) * 2 + z;
+                expected[out] = blob[1 * 3 * 3 + y * 3 + z];
+            }
+        }
+    }
+
+    const auto output = unpack< one::slice_tiles >(slice->pack());
+    std::vector< float > extracted(expected.size());
+    for (const auto& tile : output.tiles) {
+        for (int i = 0; i < tile.iterations; ++i) {
+            std::copy_n(
+                tile.v.begin() + i * tile.substride,
+                tile.chunk_size,
+                extracted.begin() + i * tile.superstride + tile.initial_skip
+            );
+        }
+    }
+
+    CHECK_THAT(extracted, Equals(expected));
+}
+
+TEST_CASE("Blended slices across fragments mix the neighbouring lines") {
+    auto input = default_slice_task();
+    input.dim    = 0;
+    input.idx    = 2;
+    input.weight = 0.25;
+    input.ids = {
+        { 0, 0, 0 },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 6, 3, 3 };
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+
+    /* the next line (x = 3) is the first line of the next fragment */
+    const auto fragments =
+        "src/3-3-3/0-0-0.f32" ";"
+        "src/3-3-3/1-0-0.f32"
+    ;
+    CHECK(slice->fragments() == fragments);
+
+    const auto blobs = GENERATE(
+        take(1,
+            chunk(2, chunk(3 * 3 * 3, random(-10000.0f, 10000.0f)))
+        )
+    );
+
+    std::vector< float > expected;
+    for (int i = 0; i < 3 * 3; ++i) {
+        const auto lo = blobs[0][2 * 3 * 3 + i];
+        const auto hi = blobs[1][0 * 3 * 3 + i];
+        expected.push_back(0.75f * lo + 0.25f * hi);
+    }
+
+    /* the next fragment is added first, to check that order does not matter */
+    for (const auto key : { 1, 0 }) {
+        slice->add(key,
+            reinterpret_cast< const char* >(blobs[key].data()),
+            int(blobs[key].size() * sizeof(float))
+        );
+    }
+
+    const auto output = unpack< one::slice_tiles >(slice->pack());
+    REQUIRE(output.tiles.size() == 1);
+    CHECK_THAT(output.tiles[0].v, Catch::Matchers::Approx(expected));
+}
+
+TEST_CASE("Fences are the weighted sum of the neighbouring traces") {
+    one::fence_task input;
+    input.pid        = "some-pid";
+    input.prefix     = "src";
+    input.ext        = "f32";
+    input.attribute  = "data";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 6, 3, 3 };
+    input.ids = {
+        one::fence_segments { { 0, 0, 0 }, {
+            one::fence_trace { 0, {
+                one::fence_point { { 2, 1 }, 0.75 },
+                one::fence_point { { 3, 1 }, 0.25 },
+            }},
+            one::fence_trace { 1, {
+                one::fence_point { { 1, 2 }, 1.0 },
+            }},
+        }},
+    };
+
+    const auto msg = input.pack();
+    auto fence = one::proc::make("fence");
+    fence->init(msg.data(), msg.size());
+
+    /* every fragment is only fetched once */
+    const auto fragments =
+        "src/3-3-3/0-0-0.f32" ";"
+        "src/3-3-3/1-0-0.f32"
+    ;
+    CHECK(fence->fragments() == fragments);
+
+    const auto blobs = GENERATE(
+        take(1,
+            chunk(2, chunk(3 * 3 * 3, random(-10000.0f, 10000.0f)))
+        )
+    );
+
+    std::vector< float > expected;
+    for (int z = 0; z < 3; ++z) {
+        const auto lo = blobs[0][2 * 3 * 3 + 1 * 3 + z];
+        const auto hi = blobs[1][0 * 3 * 3 + 1 * 3 + z];
+        expected.push_back(0.75f * lo + 0.25f * hi);
+    }
+    for (int z = 0; z < 3; ++z)
+        expected.push_back(blobs[0][1 * 3 * 3 + 2 * 3 + z]);
+
+    for (const auto key : { 1, 0 }) {
+        fence->add(key,
+            reinterpret_cast< const char* >(blobs[key].data()),
+            int(blobs[key].size() * sizeof(float))
+        );
+    }
+
+    auto output = unpack< one::curtain_bundle >(fence->pack());
+    CHECK(output.size    == 2);
+    CHECK(output.zlength == 3);
+    CHECK_THAT(output.major,  Equals(std::vector< int >{ 0, 1, 1, 2 }));
+    CHECK_THAT(output.minor,  Equals(std::vector< int >{ 0, 3, 0, 3 }));
+    CHECK_THAT(output.values, Catch::Matchers::Approx(expected));
+}
+
+/*
+ * Assemble the output the same way the decoder does.
+ */
+std::vector< float > assemble(const one::slice_tiles& tiles, int size) {
+    std::vector< float > out(size);
+    for (const auto& tile : tiles.tiles) {
+        for (int i = 0; i < tile.iterations; ++i) {
+            std::copy_n(
+                tile.v.begin() + i * tile.substride,
+                tile.chunk_size,
+                out.begin() + i * tile.superstride + tile.initial_skip
+            );
+        }
+    }
+    return out;
+}
+
+std::vector< float > assemble(const one::curtain_bundle& bundle, int rows) {
+    std::vector< float > out(rows * bundle.zlength);
+    auto src = bundle.values.begin();
+    for (int n = 0; n < bundle.size; ++n) {
+        const auto zfst = bundle.minor[n*2 + 0];
+        const auto zlst = bundle.minor[n*2 + 1];
+        for (int i = bundle.major[n*2 + 0]; i < bundle.major[n*2 + 1]; ++i) {
+            std::copy_n(src, zlst - zfst, out.begin() + i*bundle.zlength + zfst);
+            src += zlst - zfst;
+        }
+    }
+    return out;
+}
+
+TEST_CASE("Decimated slices keep every stride-th line") {
+    auto input = default_slice_task();
+    input.dim = 1;
+    input.idx = 1;
+    input.ids = {
+        { 0, 0, 0 },
+        { 0, 0, 1 },
+        { 1, 0, 0 },
+        { 1, 0, 1 },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.stride     = { 2, 4, 3 };
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+
+    float cube[6][6];
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto blob = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+        slice->add(key,
+            reinterpret_cast< const char* >(blob.data()),
+            int(blob.size() * sizeof(float))
+        );
+
+        const auto& id = input.ids[key];
+        for (int i = 0; i < 3; ++i)
+        for (int k = 0; k < 3; ++k)
+            cube[id[0] * 3 + i][id[2] * 3 + k] = blob[i * 9 + 1 * 3 + k];
+    }
+
+    /* the stride of the sliced dimension is ignored */
+    std::vector< float > expected;
+    for (int x = 0; x < 5; x += 2)
+    for (int z = 0; z < 5; z += 3)
+        expected.push_back(cube[x][z]);
+
+    const auto output = unpack< one::slice_tiles >(slice->pack());
+    CHECK_THAT(assemble(output, 3 * 2), Equals(expected));
+}
+
+TEST_CASE("Decimated subvolumes keep every stride-th line") {
+    one::subvolume_task input;
+    input.pid    = "some-pid";
+    input.prefix = "src";
+    input.ext    = "f32";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower  = { 1, 2, 1 };
+    input.upper  = { 3, 3, 4 };
+    input.stride = { 2, 1, 3 };
+    input.ids = {
+        { 0, 0, 0 }, { 0, 0, 1 }, { 0, 1, 0 }, { 0, 1, 1 },
+        { 1, 0, 0 }, { 1, 0, 1 }, { 1, 1, 0 }, { 1, 1, 1 },
+    };
+
+    const auto msg = input.pack();
+    auto subvolume = one::proc::make("subvolume");
+    subvolume->init(msg.data(), msg.size());
+
+    float cube[6][6][6];
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto blob = GENERATE(
+            take(1,
+                chunk(3 * 3 * 3, random(-10000.0f, 10000.0f))
+            )
+        );
+        subvolume->add(key,
+            reinterpret_cast< const char* >(blob.data()),
+            int(blob.size() * sizeof(float))
+        );
+
+        const auto& id = input.ids[key];
+        for (int i = 0; i < 3; ++i)
+        for (int j = 0; j < 3; ++j)
+        for (int k = 0; k < 3; ++k)
+            cube[id[0]*3 + i][id[1]*3 + j][id[2]*3 + k] = blob[i*9 + j*3 + k];
+    }
+
+    std::vector< float > expected;
+    for (int x = 1; x <= 3; x += 2)
+    for (int y = 2; y <= 3; y += 1)
+    for (int z = 1; z <= 4; z += 3)
+        expected.push_back(cube[x][y][z]);
+
+    const auto output = unpack< one::slice_tiles >(subvolume->pack());
+    CHECK_THAT(assemble(output, 2 * 2 * 2), Equals(expected));
+}
+
+TEST_CASE("Decimated curtains keep every stride-th sample") {
+    auto input = default_curtain_task();
+    input.ids = {
+        one::single { {0, 0, 0}, 0, { {2, 1}, {2, 2} } },
+        one::single { {0, 0, 1}, 0, { {2, 1}, {2, 2} } },
+        one::single { {0, 1, 0}, 2, { {0, 0} } },
+        one::single { {0, 1, 1}, 2, { {0, 0} } },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+
+    const auto blobs = GENERATE(
+        take(1,
+            chunk(4, chunk(3 * 3 * 3, random(-10000.0f, 10000.0f)))
+        )
+    );
+
+    const auto extract = [&](const std::array< int, 3 >& stride) {
+        input.stride = stride;
+        const auto msg = input.pack();
+        auto curtain = one::proc::make("curtain");
+        curtain->init(msg.data(), msg.size());
+        for (int key = 0; key < int(blobs.size()); ++key) {
+            curtain->add(key,
+                reinterpret_cast< const char* >(blobs[key].data()),
+                int(blobs[key].size() * sizeof(float))
+            );
+        }
+        return unpack< one::curtain_bundle >(curtain->pack());
+    };
+
+    const auto full = assemble(extract({ 1, 1, 1 }), 3);
+
+    /* the traces are never decimated */
+    const auto output = extract({ 2, 2, 2 });
+    CHECK(output.zlength == 3);
+
+    std::vector< float > expected;
+    for (int n = 0; n < 3; ++n)
+    for (int z = 0; z < 5; z += 2)
+        expected.push_back(full[n * 5 + z]);
+    CHECK_THAT(assemble(output, 3), Equals(expected));
+}
+
+TEST_CASE("Statistics summarise the samples of the extracted region") {
+    auto input = default_slice_task();
+    input.dim = 1;
+    input.idx = 1;
+    input.ids = {
+        { 0, 0, 0 },
+        { 0, 0, 1 },
+    };
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 3, 3, 5 };
+    input.attribute  = "data";
+    input.function   = "statistics";
+    input.statistics = one::statisticsdesc { "slice", 4, { -1.0, 1.0 } };
+
+    const auto msg = input.pack();
+    auto stats = one::proc::make("statistics");
+    stats->init(msg.data(), msg.size());
+
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+    CHECK(stats->fragments() == slice->fragments());
+
+    const auto blobs = GENERATE(
+        take(1,
+            chunk(2, chunk(3 * 3 * 3, random(-2.0f, 2.0f)))
+        )
+    );
+    for (int i = 0; i < int(blobs.size()); ++i) {
+        const auto* chunk = reinterpret_cast< const char* >(blobs[i].data());
+        const auto len = int(blobs[i].size() * sizeof(float));
+        stats->add(i, chunk, len);
+        slice->add(i, chunk, len);
+    }
+
+    /*
+     * The second fragment is only partially in the cube (z = 5), so the tiles
+     * hold padding that must not be counted.
+     */
+    std::vector< float > samples;
+    for (const auto& tile : unpack< one::slice_tiles >(slice->pack()).tiles) {
+        for (int i = 0; i < tile.iterations; ++i) {
+            const auto* src = tile.v.data() + i * tile.substride;
+            samples.insert(samples.end(), src, src + tile.chunk_size);
+        }
+    }
+    REQUIRE(samples.size() == 3 * 5);
+
+    double sum = 0;
+    double sumsq = 0;
+    std::vector< std::int64_t > histogram(4, 0);
+    for (const auto x : samples) {
+        sum   += x;
+        sumsq += double(x) * x;
+        const auto bin = int(std::floor((x + 1.0) * 2));
+        histogram[std::clamp(bin, 0, 3)] += 1;
+    }
+
+    auto output = unpack< one::statistics_bundle >(stats->pack());
+    CHECK(output.attr  == "data");
+    CHECK(output.count == 15);
+    CHECK(output.min   == *std::min_element(samples.begin(), samples.end()));
+    CHECK(output.max   == *std::max_element(samples.begin(), samples.end()));
+    CHECK(output.sum   == Catch::Detail::Approx(sum));
+    CHECK(output.sumsq == Catch::Detail::Approx(sumsq));
+    CHECK(output.range == std::array< double, 2 >{ -1.0, 1.0 });
+    CHECK_THAT(output.histogram, Equals(histogram));
+}
+
 TEST_CASE("All process kinds can be constructed") {
     CHECK( one::proc::make("slice"));
     CHECK( one::proc::make("curtain"));
+    CHECK( one::proc::make("horizon"));
+    CHECK( one::proc::make("subvolume"));
+    CHECK( one::proc::make("traces"));
+    CHECK( one::proc::make("fence"));
+    CHECK( one::proc::make("statistics"));
     CHECK(!one::proc::make("unknown"));
 }
@@ -32,17 +32,34 @@ one::process_header header_get(const one::decoder& self) {
     return *self.header();
 }
 
+std::string header_format(const one::process_header& self) {
+    return one::to_string(self.format.type);
+}
+
+double header_scale(const one::process_header& self) {
+    return self.format.scale;
+}
+
+double header_offset(const one::process_header& self) {
+    return self.format.offset;
+}
+
 EMSCRIPTEN_BINDINGS(decoder) {
     register_vector< int >("VectorInt");
+    register_vector< double >("VectorDouble");
     register_vector< std::string >("VectorString");
 
     class_< one::process_header >("process_header")
-        .property("attrs",    &one::process_header::attributes)
-        .property("ndims",    &one::process_header::ndims)
-        .property("index",    &one::process_header::index)
-        .property("function", &one::process_header::function)
-        .property("shapes",   &one::process_header::shapes)
-        .property("labels",   &one::process_header::labels)
+        .property("attrs",       &one::process_header::attributes)
+        .property("ndims",       &one::process_header::ndims)
+        .property("index",       &one::process_header::index)
+        .property("function",    &one::process_header::function)
+        .property("shapes",      &one::process_header::shapes)
+        .property("labels",      &one::process_header::labels)
+        .property("coordinates", &one::process_header::coordinates)
+        .property("format",      header_format)
+        .property("scale",       header_scale)
+        .property("offset",      header_offset)
     ;
 
     class_< one::decoder >("decoder")
@@ -63,7 +80,12 @@ EMSCRIPTEN_BINDINGS(decoder) {
     ;
 
     enum_<one::functionid>("functionid")
-        .value("slice",   one::functionid::slice)
-        .value("curtain", one::functionid::curtain)
+        .value("slice",      one::functionid::slice)
+        .value("curtain",    one::functionid::curtain)
+        .value("horizon",    one::functionid::horizon)
+        .value("subvolume",  one::functionid::subvolume)
+        .value("traces",     one::functionid::traces)
+        .value("fence",      one::functionid::fence)
+        .value("statistics", one::functionid::statistics)
     ;
 }
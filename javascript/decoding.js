@@ -41,6 +41,9 @@ function native_process_header(primitive) {
     head.labels   = emvector_to_array(primitive.labels)
     head.ndims    = primitive.ndims
     head.function = primitive.function
+    head.format   = primitive.format
+    head.scale    = primitive.scale
+    head.offset   = primitive.offset
     return head
 }
 
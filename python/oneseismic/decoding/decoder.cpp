@@ -42,17 +42,37 @@ void register_writer(
 
 PYBIND11_MODULE(decoder, m) {
     py::class_<one::process_header>(m, "header")
-        .def_readonly("attrs",      &one::process_header::attributes)
-        .def_readonly("ndims",      &one::process_header::ndims)
-        .def_readonly("index",      &one::process_header::index)
-        .def_readonly("function",   &one::process_header::function)
-        .def_readonly("shapes",     &one::process_header::shapes)
-        .def_readonly("labels",     &one::process_header::labels)
+        .def_readonly("attrs",       &one::process_header::attributes)
+        .def_readonly("ndims",       &one::process_header::ndims)
+        .def_readonly("index",       &one::process_header::index)
+        .def_readonly("function",    &one::process_header::function)
+        .def_readonly("shapes",      &one::process_header::shapes)
+        .def_readonly("labels",      &one::process_header::labels)
+        .def_readonly("coordinates", &one::process_header::coordinates)
+        .def_readonly("format",      &one::process_header::format)
+    ;
+
+    py::class_<one::formatdesc>(m, "formatdesc")
+        .def_readonly("type",   &one::formatdesc::type)
+        .def_readonly("scale",  &one::formatdesc::scale)
+        .def_readonly("offset", &one::formatdesc::offset)
+    ;
+
+    py::enum_<one::sampleformat>(m, "sampleformat")
+        .value("float32", one::sampleformat::float32)
+        .value("float16", one::sampleformat::float16)
+        .value("int16",   one::sampleformat::int16)
+        .value("int8",    one::sampleformat::int8)
     ;
 
     py::enum_<one::functionid>(m, "functionid")
-        .value("slice",     one::functionid::slice)
-        .value("curtain",   one::functionid::curtain)
+        .value("slice",      one::functionid::slice)
+        .value("curtain",    one::functionid::curtain)
+        .value("horizon",    one::functionid::horizon)
+        .value("subvolume",  one::functionid::subvolume)
+        .value("traces",     one::functionid::traces)
+        .value("fence",      one::functionid::fence)
+        .value("statistics", one::functionid::statistics)
         .export_values()
     ;
 
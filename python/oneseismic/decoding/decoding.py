@@ -27,12 +27,16 @@ class process_header:
     with regular reference mechanics.
     """
     def __init__(self, h):
-        self.attrs    = h.attrs
-        self.ndims    = h.ndims
-        self.index    = h.index
-        self.function = h.function
-        self.shapes   = h.shapes
-        self.labels   = h.labels
+        self.attrs       = h.attrs
+        self.ndims       = h.ndims
+        self.index       = h.index
+        self.function    = h.function
+        self.shapes      = h.shapes
+        self.labels      = h.labels
+        self.coordinates = h.coordinates
+        self.format      = h.format.type.name
+        self.scale       = h.format.scale
+        self.offset      = h.format.offset
 
 def decode_stream(stream, dec = None):
     """Decode a stream
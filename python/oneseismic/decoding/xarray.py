@@ -1,5 +1,6 @@
 """
 """
+import numpy as np
 import xarray as xa
 
 from . import decoder
@@ -52,16 +53,76 @@ def xarray(decoded):
             array = array.squeeze()
             coords[attr] = (dims[:array.ndim], array.squeeze())
 
-    elif function == decoder.functionid.curtain:
+    elif function in (decoder.functionid.curtain, decoder.functionid.traces):
         dims = ['x, y', 'x, y', labels[-1]]
         for name, indices, dim in zip(labels, index, dims):
             coords[name] = (dim, indices)
 
-        aname = 'curtain'
+        aname = 'curtain' if function == decoder.functionid.curtain else 'traces'
         dims.pop(0)
         for attr, array in d.items():
             coords[attr] = (dims[0], array.squeeze())
 
+    elif function == decoder.functionid.fence:
+        # The fence traces are interpolated between the grid traces, so the
+        # line numbers are only the nearest lines. The actual positions are
+        # the sampled UTM coordinates.
+        dims = ['x, y', 'x, y', labels[-1]]
+        for name, indices, dim in zip(labels, index, dims):
+            coords[name] = (dim, indices)
+        coords['utm x'] = (dims[0], head.coordinates[0::2])
+        coords['utm y'] = (dims[0], head.coordinates[1::2])
+
+        aname = 'fence'
+        dims.pop(0)
+        for attr, array in d.items():
+            coords[attr] = (dims[0], array.squeeze())
+
+    elif function == decoder.functionid.subvolume:
+        dims = list(labels)
+        for name, indices in zip(labels, index):
+            coords[name] = (name, indices)
+
+        aname = 'subvolume'
+        # Attributes are one-per-trace, and only span the x/y plane
+        for attr, array in d.items():
+            coords[attr] = (dims[:2], array[:, :, 0])
+
+    elif function == decoder.functionid.horizon:
+        # The z-axis of the horizon is the offset from the horizon itself,
+        # since the depth/time of the horizon varies from trace to trace
+        dims = ['x, y', 'x, y', 'offset']
+        for name, indices, dim in zip(labels[:2], index, dims):
+            coords[name] = (dim, indices)
+        coords['offset'] = ('offset', index[-1])
+
+        aname = 'horizon'
+        dims.pop(0)
+        for attr, array in d.items():
+            coords[attr] = (dims[0], array.squeeze())
+
+    elif function == decoder.functionid.statistics:
+        # The statistics are [count, min, max, mean, rms, lo, hi, histogram],
+        # and the histogram is the array, labelled with the bin centres
+        # The counts are float32, and only exact up to 2**24
+        count, vmin, vmax, mean, rms, lo, hi = data[:7]
+        histogram = data[7:]
+        width = (hi - lo) / len(histogram)
+        centres = lo + width * (np.arange(len(histogram)) + 0.5)
+
+        dims = ['value']
+        coords['value'] = ('value', centres)
+        attrs = {
+            'count': int(count),
+            'min': vmin,
+            'max': vmax,
+            'mean': mean,
+            'rms': rms,
+            'range': (lo, hi),
+        }
+        aname = 'statistics'
+        data = histogram
+
     else:
         raise RuntimeError(f'bad message; unknown function {function}')
 
@@ -135,6 +135,11 @@ def blobfs_from_args(url, method, connstr, creds):
 def localfs_from_args(path):
     if path is None:
         path = Path()
+
+    # file:///data/oneseismic is the same storage url the server uses for
+    # local directories, so accept it too
+    if isinstance(path, str) and path.startswith('file://'):
+        path = urlparse(path).path
     path = Path(path)
 
     # localfs('file.sgy') => '.'
@@ -122,6 +122,27 @@ class process:
         # read from the promise, or even be read from / in true REST fashion.
         return urljoin(baseurl, f'{self.path}/stream')
 
+    def cancel(self, baseurl = None):
+        """URL to cancel the process
+
+        Parameters
+        ----------
+        baseurl : str or None
+            Base url to the oneseismic server. If this is None, this returns
+            the relative path
+
+        Returns
+        -------
+        cancel_url : str
+            URL to DELETE to cancel the process
+
+        Examples
+        --------
+        >>> cancel = proc.cancel('https://oneseismic.equinor.com')
+        >>> requests.delete(cancel, headers = proc.headers())
+        """
+        return urljoin(baseurl, self.path)
+
 def procs_from_promises(response):
     """Make process instances from GraphQL response
 
@@ -12,3 +12,6 @@ def test_localfs_file_arg_gets_dir(tmp_path):
     assert fs.root == tmp_path
     with fs.open('some-file', 'rb'):
         pass
+
+def test_localfs_root_from_file_url():
+    assert localfs_from_args('file:///usr').root == Path('/usr')
@@ -52,6 +52,18 @@ class simple_result:
             self.cached_decoded = decoding.decode_stream(r.iter_content(None))
             return self.cached_decoded
 
+    def cancel(self):
+        """Cancel the process
+
+        Stop the workers from computing the result, which is useful when the
+        result is no longer needed.
+        """
+        r = requests.delete(
+            self.process.cancel(self.url),
+            headers = self.process.headers(),
+        )
+        r.raise_for_status()
+
     def numpy(self):
         return decoding.numpy(self.decoded())
 
@@ -111,6 +123,13 @@ def check_curtain(curtain):
             raise ValueError(msg)
     return curtain
 
+def check_horizon(surface):
+    for i, point in enumerate(surface):
+        if len(point) != 3:
+            msg = f'expected triple [x, y, z], got {point!r} at index {i}'
+            raise ValueError(msg)
+    return surface
+
 class simple_client:
     """Simple and limited queries
 
@@ -234,6 +253,55 @@ class simple_client:
 
         return prepared_query(self.client, query, variables)
 
+    def sliceByValue(
+        self,
+        guid,
+        dim,
+        value,
+        interpolation = 'nearest',
+        attributes = None,
+    ):
+        """
+        Slice by a value along the dimension, e.g. 2350 ms, rather than by a
+        line number. With interpolation = 'linear' the two neighbouring lines
+        are blended, otherwise the nearest line is used.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> proc = sc.sliceByValue(guid, dim = 2, value = 2350)()
+        >>> proc.numpy()
+        """
+        query = gql.gql('''
+            query sliceByValue(
+                $id: ID!,
+                $dim: Int!,
+                $value: Float!,
+                $interpolation: Interpolation,
+                $opts: Opts
+            ) {
+                cube(id: $id) {
+                    sliceByValue(
+                        dim: $dim,
+                        value: $value,
+                        interpolation: $interpolation,
+                        opts: $opts
+                    )
+                }
+            }
+        ''')
+        variables = {
+            'id':            guid,
+            'dim':           dim,
+            'value':         value,
+            'interpolation': interpolation,
+        }
+
+        if attributes is not None:
+            variables['opts'] = { 'attributes': attributes }
+
+        return prepared_query(self.client, query, variables)
+
     def curtainByIndex(self, guid, curtain, attributes = None):
         """
         Examples
@@ -348,3 +416,292 @@ class simple_client:
             variables['opts'] = {'attributes': attributes}
 
         return prepared_query(self.client, query, variables)
+
+    def fence(
+        self,
+        guid,
+        polyline,
+        spacing = None,
+        interpolation = 'nearest',
+        attributes = None,
+    ):
+        """Get a fence along a UTM polyline
+
+        The polyline is resampled at a fixed spacing, and the traces are
+        interpolated (nearest or bilinear) between the traces of the cube. The
+        sampled UTM positions are available in the xarray coordinates.
+
+        Parameters
+        ----------
+            guid : string
+            polyline : list
+                List of UTM coordinates [[x, y], ...]
+            spacing : float
+                Distance between the traces, in UTM units. Defaults to the
+                grid spacing.
+            interpolation : {'nearest', 'linear'}
+            attributes : list of string
+
+        Returns
+        -------
+            A handle to the result of the fence query.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> polyline = [[472000.32, 6501690.2], [472209.32, 6501795.2]]
+        >>> proc = sc.fence(guid, polyline, spacing = 12.5)
+        >>> proc.xarray()
+        """
+        query = gql.gql('''
+            query fence(
+                $id: ID!,
+                $polyline: [[Float!]!]!,
+                $spacing: Float,
+                $interpolation: Interpolation,
+                $opts: Opts
+            ) {
+                cube(id: $id) {
+                    fence(
+                        polyline: $polyline,
+                        spacing: $spacing,
+                        interpolation: $interpolation,
+                        opts: $opts
+                    )
+                }
+            }
+        ''')
+
+        variables = {
+            'id':            guid,
+            'polyline':      check_curtain(polyline),
+            'spacing':       spacing,
+            'interpolation': interpolation,
+        }
+
+        if attributes is not None:
+            variables['opts'] = {'attributes': attributes}
+
+        return prepared_query(self.client, query, variables)
+
+    def statistics(self, guid, region, bins = 64, range = None):
+        """Get summary statistics and a histogram of a region
+
+        The statistics are computed server-side, so the samples of the region
+        are never downloaded. The region is exactly one of a slice, curtain
+        or subvolume, described as for the corresponding queries.
+
+        The histogram has bins equally-sized bins over range, which defaults
+        to [sampleValueMin, sampleValueMax] of the cube. Samples outside the
+        range are counted in the first or last bin.
+
+        Parameters
+        ----------
+            guid : string
+            region : dict
+                One of {'slice': {'dim': int, 'val': int}},
+                {'curtain': {'coords': [[x, y], ...]}}, or
+                {'subvolume': {'from': [x, y, z], 'to': [x, y, z]}}, with an
+                optional kind {'lineno', 'index'} ('utm' for curtains).
+            bins : int
+            range : list of float
+                The [low, high] range of the histogram.
+
+        Returns
+        -------
+            A handle to the result of the statistics query. The xarray is the
+            histogram, labelled with the bin centres, and count, min, max,
+            mean and rms are in its attrs. The count and histogram are
+            float32, and only exact up to 2**24 samples.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> region = {'slice': {'dim': 0, 'val': 9961}}
+        >>> stats = sc.statistics(guid, region)().xarray()
+        >>> stats.attrs['rms']
+        1.1254
+        """
+        if len(region) != 1:
+            raise ValueError('expected exactly one of slice, curtain, subvolume')
+
+        query = gql.gql('''
+            query statistics(
+                $id: ID!,
+                $region: Region!,
+                $bins: Int,
+                $range: [Float!]
+            ) {
+                cube(id: $id) {
+                    statistics(region: $region, bins: $bins, range: $range)
+                }
+            }
+        ''')
+
+        variables = {
+            'id': guid,
+            'region': region,
+            'bins': bins,
+            'range': range,
+        }
+
+        return prepared_query(self.client, query, variables)
+
+    def traces(self, guid, coords, kind = 'lineno', attributes = None):
+        """Get full traces at scattered points
+
+        Unlike the curtain, the traces are returned in the same order as the
+        input, and points that map to the same trace are only returned once.
+
+        Parameters
+        ----------
+            guid : string
+            coords : list
+                List of coordinates [[x, y], ...]
+            kind : {'lineno', 'index', 'utm'}
+            attributes : list of string
+                List of attribbutes to include in the result.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> proc = sc.traces(guid, [[472000.32, 6501690.2]], kind = 'utm')
+        >>> proc().numpy()
+        [0.7283162   0.00633962  0.02923059 ...  1.3414259   0.39454985]
+        """
+        query = gql.gql('''
+            query traces(
+                $id: ID!,
+                $coords: [[Float!]!]!,
+                $kind: CoordinateKind,
+                $opts: Opts
+            ) {
+                cube(id: $id) {
+                    traces(coords: $coords, kind: $kind, opts: $opts)
+                }
+            }
+        ''')
+
+        variables = {
+            'id': guid,
+            'coords': check_curtain(coords),
+            'kind': kind,
+        }
+
+        if attributes is not None:
+            variables['opts'] = {'attributes': attributes}
+
+        return prepared_query(self.client, query, variables)
+
+    def horizon(self, guid, surface, kind = 'lineno', window = 0, attributes = None):
+        """Get the samples along a horizon
+
+        The horizon is a list of points [x, y, z], and the result is the
+        samples [z - window, z + window] for every trace (x, y), in the same
+        order as the input.
+
+        Parameters
+        ----------
+            guid : string
+            surface : list
+                List of points [[x, y, z], ...]
+            kind : {'lineno', 'index', 'utm'}
+                How to interpret x and y. The z is the depth/time, or the
+                sample index for kind 'index'.
+            window : int
+                Number of samples to include above and below the horizon
+            attributes : list of string
+                List of attribbutes to include in the result.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> proc = sc.horizon(guid, [[1, 1, 204.2], [1, 2, 208.5]], window = 1)
+        >>> proc().numpy()
+        [[ 0.7283162   0.00633962  0.02923059]
+         [ 2.471489    0.5148768  -0.28820574]]
+        """
+        query = gql.gql('''
+            query horizon(
+                $id: ID!,
+                $surface: [[Float!]!]!,
+                $kind: CoordinateKind,
+                $window: Int,
+                $opts: Opts
+            ) {
+                cube(id: $id) {
+                    horizon(
+                        surface: $surface,
+                        kind: $kind,
+                        window: $window,
+                        opts: $opts
+                    )
+                }
+            }
+        ''')
+
+        variables = {
+            'id': guid,
+            'surface': check_horizon(surface),
+            'kind': kind,
+            'window': window,
+        }
+
+        if attributes is not None:
+            variables['opts'] = {'attributes': attributes}
+
+        return prepared_query(self.client, query, variables)
+
+    def subvolume(self, guid, lower, upper, kind = 'lineno', attributes = None):
+        """Get a sub-volume (bounding box) of the cube
+
+        The box is [lower, upper], inclusive in all directions. For kind
+        'lineno', the endpoints do not have to be actual line numbers, and the
+        box includes every line in the interval.
+
+        Parameters
+        ----------
+            guid : string
+            lower : list of int
+                The [x, y, z] corner of the box
+            upper : list of int
+                The [x, y, z] corner of the box, opposite of lower
+            kind : {'lineno', 'index'}
+            attributes : list of string
+                List of attribbutes to include in the result.
+
+        Examples
+        --------
+        >>> sc = simple_client(url)
+        >>> proc = sc.subvolume(guid, [1, 1, 0], [3, 4, 1000])
+        >>> proc().numpy().shape
+        (3, 4, 251)
+        """
+        if len(lower) != 3 or len(upper) != 3:
+            raise ValueError('expected lower and upper as [x, y, z]')
+
+        query = gql.gql('''
+            query subvolume(
+                $id: ID!,
+                $from: [Int!]!,
+                $to: [Int!]!,
+                $kind: CoordinateKind,
+                $opts: Opts
+            ) {
+                cube(id: $id) {
+                    subvolume(from: $from, to: $to, kind: $kind, opts: $opts)
+                }
+            }
+        ''')
+
+        variables = {
+            'id': guid,
+            'from': lower,
+            'to': upper,
+            'kind': kind,
+        }
+
+        if attributes is not None:
+            variables['opts'] = {'attributes': attributes}
+
+        return prepared_query(self.client, query, variables)
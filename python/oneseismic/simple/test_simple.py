@@ -37,3 +37,14 @@ def test_curtain_fails_if_not_all_pairs():
         _ = sc.curtainByIndex('<id>', [[1, 2, 3]])
     with pytest.raises(ValueError):
         _ = sc.curtainByLineno('<id>', [[1, 2, 3]])
+
+def test_horizon_fails_if_not_all_triples():
+    sc = noschema_simple_client('<url>')
+
+    _ = sc.horizon('<id>', [(1, 2, 3)])
+    _ = sc.horizon('<id>', [[1, 2, 3.5]])
+
+    with pytest.raises(ValueError):
+        _ = sc.horizon('<id>', [[1, 2]])
+    with pytest.raises(ValueError):
+        _ = sc.horizon('<id>', [[1, 2, 3, 4]])